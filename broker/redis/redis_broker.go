@@ -0,0 +1,111 @@
+package redis
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/mofancloud/xmicro/broker"
+	rcache "github.com/mofancloud/xmicro/cache/redis"
+)
+
+const (
+	fieldPayload     = "payload"
+	fieldContentType = "contentType"
+)
+
+// redisStreamBroker publish messages to redis streams, one stream per topic.
+// every service subscribes with its own consumer group, so each group
+// receives all messages and the consumers of one group share them.
+type redisStreamBroker struct {
+	cache    *rcache.Cache
+	group    string
+	consumer string
+	maxLen   int64
+
+	mux       sync.Mutex
+	consumers []*rcache.StreamConsumer
+}
+
+// NewRedisBroker create a broker on redis streams.
+// group is usually the service name and consumer the instance id.
+func NewRedisBroker(cache *rcache.Cache, group string, consumer string) *redisStreamBroker {
+	return &redisStreamBroker{
+		cache:    cache,
+		group:    group,
+		consumer: consumer,
+	}
+}
+
+// MaxLen cap each topic stream to about maxLen messages, 0 means not capped.
+func (self *redisStreamBroker) MaxLen(maxLen int64) *redisStreamBroker {
+	self.maxLen = maxLen
+	return self
+}
+
+func (self *redisStreamBroker) Publish(p broker.Message) error {
+	payload, err := encodePayload(p.Payload())
+	if err != nil {
+		return err
+	}
+	contentType := p.ContentType()
+	if contentType == "" {
+		contentType = broker.ContentTypeJson
+	}
+
+	_, err = self.cache.XADD(p.Topic(), "*", self.maxLen, map[string]interface{}{
+		fieldPayload:     payload,
+		fieldContentType: contentType,
+	})
+	return err
+}
+
+// Subscribe h must be a broker.Handler or a func(broker.Message) error,
+// the message payload is the raw []byte published.
+func (self *redisStreamBroker) Subscribe(topic string, h interface{}) error {
+	var handler broker.Handler
+	switch fn := h.(type) {
+	case broker.Handler:
+		handler = fn
+	case func(broker.Message) error:
+		handler = fn
+	default:
+		return fmt.Errorf("unsupported handler type %T", h)
+	}
+
+	sc := rcache.NewStreamConsumer(self.cache, topic, self.group, self.consumer, func(msg rcache.StreamMessage) error {
+		pub := broker.NewDefaultPublication(topic, []byte(msg.Fields[fieldPayload]), msg.Fields[fieldContentType])
+		return handler(pub)
+	})
+	if err := sc.Start(); err != nil {
+		return err
+	}
+
+	self.mux.Lock()
+	self.consumers = append(self.consumers, sc)
+	self.mux.Unlock()
+	return nil
+}
+
+// Close stop all subscriptions.
+func (self *redisStreamBroker) Close() {
+	self.mux.Lock()
+	consumers := self.consumers
+	self.consumers = nil
+	self.mux.Unlock()
+
+	for _, sc := range consumers {
+		sc.Stop()
+	}
+}
+
+func encodePayload(payload interface{}) (interface{}, error) {
+	switch v := payload.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return v, nil
+	default:
+		return json.Marshal(v)
+	}
+}
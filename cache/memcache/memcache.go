@@ -3,33 +3,105 @@ package memcache
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/bradfitz/gomemcache/memcache"
 	"github.com/mofancloud/xmicro/cache"
 )
 
+var (
+	// DefaultKey the namespace of memcache for cache adapter.
+	DefaultKey = "memcache"
+	// DefaultVersionRefresh is how long the namespace version is cached locally,
+	// a ClearAll of another process is seen after at most this time.
+	DefaultVersionRefresh = time.Second
+)
+
+// flagJSON marks the values encoded as json by Put.
+const flagJSON uint32 = 1
+
 // Cache Memcache adapter.
+// all keys are stored under "key:version:", ClearAll bumps the version
+// so only this namespace is dropped, the old items expire by themselves.
 type Cache struct {
 	conn     *memcache.Client
 	conninfo []string
+	hash     string
+	key      string
+
+	versionMux     sync.Mutex
+	version        int64
+	versionTime    time.Time
+	versionRefresh time.Duration
 }
 
 // NewMemCache create new memcache adapter.
 func NewMemCache() cache.Cache {
-	return &Cache{}
+	return &Cache{key: DefaultKey, versionRefresh: DefaultVersionRefresh}
+}
+
+func (rc *Cache) versionKey() string {
+	return rc.key + ":__version"
+}
+
+// namespace get the current namespace version, reloaded from memcache when outdated.
+func (rc *Cache) namespace() (int64, error) {
+	rc.versionMux.Lock()
+	defer rc.versionMux.Unlock()
+
+	if rc.version > 0 && time.Since(rc.versionTime) < rc.versionRefresh {
+		return rc.version, nil
+	}
+
+	item, err := rc.conn.Get(rc.versionKey())
+	if err == memcache.ErrCacheMiss {
+		// 版本号被淘汰时用当前时间重建, 保证不会回到旧的版本
+		v := strconv.FormatInt(time.Now().UnixNano(), 10)
+		err = rc.conn.Add(&memcache.Item{Key: rc.versionKey(), Value: []byte(v)})
+		if err == nil || err == memcache.ErrNotStored {
+			item, err = rc.conn.Get(rc.versionKey())
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	version, err := strconv.ParseInt(string(item.Value), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad namespace version %q", item.Value)
+	}
+
+	rc.version = version
+	rc.versionTime = time.Now()
+	return version, nil
+}
+
+// associate the key with the namespace and its version.
+func (rc *Cache) associate(key string) (string, error) {
+	version, err := rc.namespace()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:%d:%s", rc.key, version, key), nil
 }
 
 // Get get value from memcache.
+// string, []byte and integers are returned as []byte, other values are decoded from json.
 func (rc *Cache) Get(key string) interface{} {
 	if rc.conn == nil {
 		if err := rc.connectInit(); err != nil {
 			return err
 		}
 	}
-	if item, err := rc.conn.Get(key); err == nil {
-		return item.Value
+	k, err := rc.associate(key)
+	if err != nil {
+		return nil
+	}
+	if item, err := rc.conn.Get(k); err == nil {
+		return decodeValue(item)
 	}
 	return nil
 }
@@ -46,12 +118,24 @@ func (rc *Cache) GetMulti(keys []string) []interface{} {
 			return rv
 		}
 	}
-	mv, err := rc.conn.GetMulti(keys)
+	version, err := rc.namespace()
 	if err == nil {
-		for _, v := range mv {
-			rv = append(rv, v.Value)
+		nsKeys := make([]string, size)
+		for i, key := range keys {
+			nsKeys[i] = fmt.Sprintf("%s:%d:%s", rc.key, version, key)
+		}
+		var mv map[string]*memcache.Item
+		mv, err = rc.conn.GetMulti(nsKeys)
+		if err == nil {
+			for _, k := range nsKeys {
+				if item, ok := mv[k]; ok {
+					rv = append(rv, decodeValue(item))
+				} else {
+					rv = append(rv, nil)
+				}
+			}
+			return rv
 		}
-		return rv
 	}
 	for i := 0; i < size; i++ {
 		rv = append(rv, err)
@@ -60,23 +144,78 @@ func (rc *Cache) GetMulti(keys []string) []interface{} {
 }
 
 // Put put value to memcache.
+// integers are stored as decimal so they can be Incr, other values
+// than string and []byte are encoded as json.
 func (rc *Cache) Put(key string, val interface{}, timeout time.Duration) error {
 	if rc.conn == nil {
 		if err := rc.connectInit(); err != nil {
 			return err
 		}
 	}
-	item := memcache.Item{Key: key, Expiration: int32(timeout / time.Second)}
-	if v, ok := val.([]byte); ok {
-		item.Value = v
-	} else if str, ok := val.(string); ok {
-		item.Value = []byte(str)
-	} else {
-		return errors.New("val only support string and []byte")
+	k, err := rc.associate(key)
+	if err != nil {
+		return err
+	}
+	item := memcache.Item{Key: k, Expiration: int32(timeout / time.Second)}
+	if err = encodeValue(&item, val); err != nil {
+		return err
 	}
 	return rc.conn.Set(&item)
 }
 
+// Gets get the item with its cas id, for CompareAndSwap.
+// the returned item key is the key without namespace.
+func (rc *Cache) Gets(key string) (*memcache.Item, error) {
+	if rc.conn == nil {
+		if err := rc.connectInit(); err != nil {
+			return nil, err
+		}
+	}
+	k, err := rc.associate(key)
+	if err != nil {
+		return nil, err
+	}
+	item, err := rc.conn.Get(k)
+	if err != nil {
+		return nil, err
+	}
+	item.Key = key
+	return item, nil
+}
+
+// CompareAndSwap write the item only if it was not modified since it was got by Gets.
+// returns memcache.ErrCASConflict if it was modified, memcache.ErrNotStored if it was deleted.
+func (rc *Cache) CompareAndSwap(item *memcache.Item) error {
+	if rc.conn == nil {
+		if err := rc.connectInit(); err != nil {
+			return err
+		}
+	}
+	key := item.Key
+	k, err := rc.associate(key)
+	if err != nil {
+		return err
+	}
+	// the cas id is kept inside item, so the key is swapped in place
+	item.Key = k
+	defer func() { item.Key = key }()
+	return rc.conn.CompareAndSwap(item)
+}
+
+// Touch update the expire time of the item without fetching it.
+func (rc *Cache) Touch(key string, timeout time.Duration) error {
+	if rc.conn == nil {
+		if err := rc.connectInit(); err != nil {
+			return err
+		}
+	}
+	k, err := rc.associate(key)
+	if err != nil {
+		return err
+	}
+	return rc.conn.Touch(k, int32(timeout/time.Second))
+}
+
 // Delete delete value in memcache.
 func (rc *Cache) Delete(key string) error {
 	if rc.conn == nil {
@@ -84,7 +223,11 @@ func (rc *Cache) Delete(key string) error {
 			return err
 		}
 	}
-	return rc.conn.Delete(key)
+	k, err := rc.associate(key)
+	if err != nil {
+		return err
+	}
+	return rc.conn.Delete(k)
 }
 
 // Incr increase counter.
@@ -94,7 +237,11 @@ func (rc *Cache) Incr(key string) error {
 			return err
 		}
 	}
-	_, err := rc.conn.Increment(key, 1)
+	k, err := rc.associate(key)
+	if err != nil {
+		return err
+	}
+	_, err = rc.conn.Increment(k, 1)
 	return err
 }
 
@@ -105,7 +252,11 @@ func (rc *Cache) Decr(key string) error {
 			return err
 		}
 	}
-	_, err := rc.conn.Decrement(key, 1)
+	k, err := rc.associate(key)
+	if err != nil {
+		return err
+	}
+	_, err = rc.conn.Decrement(k, 1)
 	return err
 }
 
@@ -116,22 +267,42 @@ func (rc *Cache) IsExist(key string) bool {
 			return false
 		}
 	}
-	_, err := rc.conn.Get(key)
+	k, err := rc.associate(key)
+	if err != nil {
+		return false
+	}
+	_, err = rc.conn.Get(k)
 	return !(err != nil)
 }
 
-// ClearAll clear all cached in memcache.
+// ClearAll clear all cached in the namespace by bumping its version,
+// the servers are not flushed so other namespaces are kept.
 func (rc *Cache) ClearAll() error {
 	if rc.conn == nil {
 		if err := rc.connectInit(); err != nil {
 			return err
 		}
 	}
-	return rc.conn.FlushAll()
+	rc.versionMux.Lock()
+	defer rc.versionMux.Unlock()
+
+	version, err := rc.conn.Increment(rc.versionKey(), 1)
+	if err == memcache.ErrCacheMiss {
+		v := time.Now().UnixNano()
+		err = rc.conn.Set(&memcache.Item{Key: rc.versionKey(), Value: []byte(strconv.FormatInt(v, 10))})
+		version = uint64(v)
+	}
+	if err != nil {
+		return err
+	}
+	rc.version = int64(version)
+	rc.versionTime = time.Now()
+	return nil
 }
 
 // StartAndGC start memcache adapter.
-// config string is like {"conn":"connection info"}.
+// config string is like {"key":"namespace","conn":"host1:port;host2:port=2","hash":"consistent"}.
+// hash is "consistent" (default) or "modulo", a server can be weighted by "=weight" with consistent hash.
 // if connecting error, return.
 func (rc *Cache) StartAndGC(config string) error {
 	var cf map[string]string
@@ -139,7 +310,22 @@ func (rc *Cache) StartAndGC(config string) error {
 	if _, ok := cf["conn"]; !ok {
 		return errors.New("config has no conn key")
 	}
+	if _, ok := cf["key"]; !ok {
+		cf["key"] = DefaultKey
+	}
+	if _, ok := cf["hash"]; !ok {
+		cf["hash"] = "consistent"
+	}
+	if v, ok := cf["versionRefresh"]; ok {
+		seconds, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("bad versionRefresh %s", v)
+		}
+		rc.versionRefresh = time.Duration(seconds) * time.Second
+	}
 	rc.conninfo = strings.Split(cf["conn"], ";")
+	rc.key = cf["key"]
+	rc.hash = cf["hash"]
 	if rc.conn == nil {
 		if err := rc.connectInit(); err != nil {
 			return err
@@ -150,10 +336,55 @@ func (rc *Cache) StartAndGC(config string) error {
 
 // connect to memcache and keep the connection.
 func (rc *Cache) connectInit() error {
-	rc.conn = memcache.New(rc.conninfo...)
+	switch rc.hash {
+	case "modulo":
+		ss := new(memcache.ServerList)
+		if err := ss.SetServers(rc.conninfo...); err != nil {
+			return err
+		}
+		rc.conn = memcache.NewFromSelector(ss)
+	case "consistent", "":
+		ss := NewConsistentHash(DefaultReplicas)
+		if err := ss.SetServers(rc.conninfo...); err != nil {
+			return err
+		}
+		rc.conn = memcache.NewFromSelector(ss)
+	default:
+		return fmt.Errorf("unknown memcache hash %s", rc.hash)
+	}
+	return nil
+}
+
+func encodeValue(item *memcache.Item, val interface{}) error {
+	switch v := val.(type) {
+	case []byte:
+		item.Value = v
+	case string:
+		item.Value = []byte(v)
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		item.Value = []byte(fmt.Sprint(v))
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		item.Value = b
+		item.Flags |= flagJSON
+	}
 	return nil
 }
 
+func decodeValue(item *memcache.Item) interface{} {
+	if item.Flags&flagJSON == 0 {
+		return item.Value
+	}
+	var v interface{}
+	if err := json.Unmarshal(item.Value, &v); err != nil {
+		return item.Value
+	}
+	return v
+}
+
 func init() {
 	cache.Register("memcache", NewMemCache)
 }
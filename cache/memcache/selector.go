@@ -0,0 +1,110 @@
+package memcache
+
+import (
+	"fmt"
+	"hash/crc32"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// DefaultReplicas is the number of virtual nodes of each server on the hash ring.
+var DefaultReplicas = 160
+
+// ConsistentHash is a memcache.ServerSelector distributing keys on a consistent hash ring,
+// adding or removing a server only moves the keys of its neighbours.
+type ConsistentHash struct {
+	mu       sync.RWMutex
+	replicas int
+	hashes   []uint32
+	nodes    map[uint32]net.Addr
+	addrs    []net.Addr
+}
+
+// NewConsistentHash create a hash ring with replicas virtual nodes per server.
+func NewConsistentHash(replicas int) *ConsistentHash {
+	if replicas <= 0 {
+		replicas = DefaultReplicas
+	}
+	return &ConsistentHash{replicas: replicas}
+}
+
+// SetServers replace the servers of the ring. a server is "host:port" or a unix socket path,
+// and can be weighted as "host:port=weight".
+func (ch *ConsistentHash) SetServers(servers ...string) error {
+	nodes := make(map[uint32]net.Addr)
+	hashes := []uint32{}
+	addrs := make([]net.Addr, 0, len(servers))
+
+	for _, server := range servers {
+		weight := 1
+		if i := strings.LastIndex(server, "="); i > -1 {
+			w, err := strconv.Atoi(server[i+1:])
+			if err != nil || w < 1 {
+				return fmt.Errorf("bad weight of memcache server %s", server)
+			}
+			server, weight = server[:i], w
+		}
+
+		addr, err := resolveAddr(server)
+		if err != nil {
+			return err
+		}
+		addrs = append(addrs, addr)
+
+		for i := 0; i < ch.replicas*weight; i++ {
+			h := crc32.ChecksumIEEE([]byte(server + "#" + strconv.Itoa(i)))
+			if _, ok := nodes[h]; ok {
+				continue
+			}
+			nodes[h] = addr
+			hashes = append(hashes, h)
+		}
+	}
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i] < hashes[j] })
+
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.nodes = nodes
+	ch.hashes = hashes
+	ch.addrs = addrs
+	return nil
+}
+
+// PickServer pick the first virtual node clockwise of the key hash.
+func (ch *ConsistentHash) PickServer(key string) (net.Addr, error) {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	if len(ch.hashes) == 0 {
+		return nil, memcache.ErrNoServers
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(ch.hashes), func(i int) bool { return ch.hashes[i] >= h })
+	if i == len(ch.hashes) {
+		i = 0
+	}
+	return ch.nodes[ch.hashes[i]], nil
+}
+
+// Each iterate over every server of the ring.
+func (ch *ConsistentHash) Each(f func(net.Addr) error) error {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	for _, a := range ch.addrs {
+		if err := f(a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func resolveAddr(server string) (net.Addr, error) {
+	if strings.Contains(server, "/") {
+		return net.ResolveUnixAddr("unix", server)
+	}
+	return net.ResolveTCPAddr("tcp", server)
+}
@@ -0,0 +1,59 @@
+package memcache
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestConsistentHash(t *testing.T) {
+	ch := NewConsistentHash(0)
+	if _, err := ch.PickServer("a"); err == nil {
+		t.Error("empty ring should fail")
+	}
+
+	if err := ch.SetServers("127.0.0.1:11211", "127.0.0.1:11212", "127.0.0.1:11213"); err != nil {
+		t.Fatal("set servers err", err)
+	}
+
+	counts := map[string]int{}
+	picked := map[string]string{}
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		addr, err := ch.PickServer(key)
+		if err != nil {
+			t.Fatal("pick err", err)
+		}
+		counts[addr.String()]++
+		picked[key] = addr.String()
+	}
+	for addr, n := range counts {
+		if n < 500 {
+			t.Errorf("server %s gets too few keys: %d", addr, n)
+		}
+	}
+
+	// 去掉一台后, 其它服务器上的 key 不应移动
+	if err := ch.SetServers("127.0.0.1:11211", "127.0.0.1:11212"); err != nil {
+		t.Fatal("set servers err", err)
+	}
+	for key, old := range picked {
+		if old == "127.0.0.1:11213" {
+			continue
+		}
+		addr, _ := ch.PickServer(key)
+		if addr.String() != old {
+			t.Errorf("key %s moved from %s to %s", key, old, addr)
+		}
+	}
+
+	n := 0
+	ch.Each(func(a net.Addr) error { n++; return nil })
+	if n != 2 {
+		t.Error("each err", n)
+	}
+
+	if err := ch.SetServers("127.0.0.1:11211=0"); err == nil {
+		t.Error("bad weight should fail")
+	}
+}
@@ -0,0 +1,332 @@
+package redis
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var (
+	// SubscribeHealthInterval is how often the subscribe connection is pinged,
+	// the connection is re-established when no reply arrives in two intervals.
+	SubscribeHealthInterval = 30 * time.Second
+	// SubscribeMaxBackoff is the max wait between two reconnect attempts.
+	SubscribeMaxBackoff = 30 * time.Second
+)
+
+// PubSubMessage is a message received on a subscribed channel.
+// Channel and Pattern are without the adapter key prefix.
+type PubSubMessage struct {
+	Channel string
+	Pattern string
+	Data    []byte
+}
+
+// MessageHandler handle a message of a subscribed channel.
+// handlers run one at a time on a dispatch goroutine separate from the receive loop,
+// a slow handler delays the later messages. a handler may call Unsubscribe or
+// CloseSubscriber; CloseSubscriber does not wait for the handler calling it.
+type MessageHandler func(msg PubSubMessage)
+
+// subscribeQueueSize is how many received messages wait for their handlers.
+const subscribeQueueSize = 64
+
+// Subscribe listen on channel, the channel is associated with the adapter key like Publich.
+// all subscriptions share one dedicated connection, which is re-established
+// and re-subscribed when lost.
+func (rc *Cache) Subscribe(channel string, handler MessageHandler) error {
+	if handler == nil {
+		return errors.New("missing message handler")
+	}
+	return rc.getSubscriber().add(false, rc.associate(channel), handler)
+}
+
+// PSubscribe listen on the channels matching pattern.
+func (rc *Cache) PSubscribe(pattern string, handler MessageHandler) error {
+	if handler == nil {
+		return errors.New("missing message handler")
+	}
+	return rc.getSubscriber().add(true, rc.associate(pattern), handler)
+}
+
+// Unsubscribe stop listening on channel.
+func (rc *Cache) Unsubscribe(channel string) error {
+	return rc.getSubscriber().remove(false, rc.associate(channel))
+}
+
+// PUnsubscribe stop listening on pattern.
+func (rc *Cache) PUnsubscribe(pattern string) error {
+	return rc.getSubscriber().remove(true, rc.associate(pattern))
+}
+
+// CloseSubscriber unsubscribe all channels and close the subscribe connection.
+// no handler is called after it returns, except one already running.
+func (rc *Cache) CloseSubscriber() {
+	rc.subMux.Lock()
+	s := rc.subscriber
+	rc.subscriber = nil
+	rc.subMux.Unlock()
+
+	if s != nil {
+		s.close()
+	}
+}
+
+func (rc *Cache) getSubscriber() *subscriber {
+	rc.subMux.Lock()
+	defer rc.subMux.Unlock()
+	if rc.subscriber == nil {
+		rc.subscriber = newSubscriber(rc)
+		go rc.subscriber.run()
+		go rc.subscriber.dispatch()
+	}
+	return rc.subscriber
+}
+
+type subscriber struct {
+	rc *Cache
+
+	mux      sync.Mutex // guards the maps and the writes to conn
+	channels map[string]MessageHandler
+	patterns map[string]MessageHandler
+	conn     *redis.PubSubConn // nil while disconnected
+
+	queue chan delivery // received messages waiting for dispatch
+	stop  chan struct{}
+	done  chan struct{} // closed when the receive loop exits
+}
+
+// delivery is a received message with its handler.
+type delivery struct {
+	handler MessageHandler
+	msg     PubSubMessage
+}
+
+func newSubscriber(rc *Cache) *subscriber {
+	return &subscriber{
+		rc:       rc,
+		channels: make(map[string]MessageHandler),
+		patterns: make(map[string]MessageHandler),
+		queue:    make(chan delivery, subscribeQueueSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+func (s *subscriber) add(pattern bool, name string, handler MessageHandler) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if pattern {
+		s.patterns[name] = handler
+	} else {
+		s.channels[name] = handler
+	}
+	// 未连接时, 重连后会统一订阅
+	if s.conn == nil {
+		return nil
+	}
+	if pattern {
+		return s.conn.PSubscribe(name)
+	}
+	return s.conn.Subscribe(name)
+}
+
+func (s *subscriber) remove(pattern bool, name string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if pattern {
+		delete(s.patterns, name)
+	} else {
+		delete(s.channels, name)
+	}
+	if s.conn == nil {
+		return nil
+	}
+	if pattern {
+		return s.conn.PUnsubscribe(name)
+	}
+	return s.conn.Unsubscribe(name)
+}
+
+func (s *subscriber) handler(pattern bool, name string) MessageHandler {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if pattern {
+		return s.patterns[name]
+	}
+	return s.channels[name]
+}
+
+func (s *subscriber) stopped() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// run keep the subscribe connection alive until closed.
+func (s *subscriber) run() {
+	defer close(s.done)
+
+	backoff := time.Second
+	for !s.stopped() {
+		c, err := s.rc.dial()
+		if err != nil {
+			log.Printf("redis subscribe connect err: %v, retry in %v", err, backoff)
+			select {
+			case <-s.stop:
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > SubscribeMaxBackoff {
+				backoff = SubscribeMaxBackoff
+			}
+			continue
+		}
+		backoff = time.Second
+
+		psc := &redis.PubSubConn{Conn: c}
+		if err = s.connected(psc); err == nil {
+			err = s.receive(psc)
+		}
+
+		s.mux.Lock()
+		s.conn = nil
+		s.mux.Unlock()
+		psc.Close()
+
+		if err != nil && !s.stopped() {
+			log.Printf("redis subscribe connection lost: %v, reconnecting", err)
+		}
+	}
+}
+
+// connected subscribe all registered channels on the new connection.
+func (s *subscriber) connected(psc *redis.PubSubConn) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.stopped() {
+		return errors.New("subscriber closed")
+	}
+	for name := range s.channels {
+		if err := psc.Subscribe(name); err != nil {
+			return err
+		}
+	}
+	for name := range s.patterns {
+		if err := psc.PSubscribe(name); err != nil {
+			return err
+		}
+	}
+	s.conn = psc
+	return nil
+}
+
+func (s *subscriber) receive(psc *redis.PubSubConn) error {
+	// 定时 ping, 收不到回复说明连接已断开
+	pingDone := make(chan struct{})
+	defer close(pingDone)
+	go func() {
+		ticker := time.NewTicker(SubscribeHealthInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-pingDone:
+				return
+			case <-ticker.C:
+				s.mux.Lock()
+				err := psc.Ping("")
+				s.mux.Unlock()
+				if err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		switch v := psc.ReceiveWithTimeout(2 * SubscribeHealthInterval).(type) {
+		case redis.Message, redis.PMessage:
+			if d, ok := s.delivery(v); ok {
+				// 关闭后不再排队, 避免阻塞接收
+				select {
+				case s.queue <- d:
+				case <-s.stop:
+				}
+			}
+		case redis.Subscription:
+			// 关闭时退订完所有频道后退出
+			if v.Count == 0 && s.stopped() {
+				return nil
+			}
+		case error:
+			return v
+		}
+	}
+}
+
+// delivery find the handler of a received message and strip the key prefix
+// from Channel and Pattern. ok is false when nothing handles the message.
+func (s *subscriber) delivery(v interface{}) (d delivery, ok bool) {
+	prefix := s.rc.key + ":"
+	switch v := v.(type) {
+	case redis.Message:
+		d.handler = s.handler(false, v.Channel)
+		d.msg = PubSubMessage{Channel: strings.TrimPrefix(v.Channel, prefix), Data: v.Data}
+	case redis.PMessage:
+		d.handler = s.handler(true, v.Pattern)
+		d.msg = PubSubMessage{
+			Channel: strings.TrimPrefix(v.Channel, prefix),
+			Pattern: strings.TrimPrefix(v.Pattern, prefix),
+			Data:    v.Data,
+		}
+	}
+	return d, d.handler != nil
+}
+
+// dispatch call the handlers in the order the messages were received, until closed.
+func (s *subscriber) dispatch() {
+	for {
+		select {
+		case <-s.stop:
+			return
+		case d := <-s.queue:
+			if s.stopped() {
+				return
+			}
+			d.handler(d.msg)
+		}
+	}
+}
+
+// close unsubscribe everything, and force the connection closed
+// if the server does not confirm in time. it waits for the receive loop only,
+// so a handler can call it without deadlock.
+func (s *subscriber) close() {
+	s.mux.Lock()
+	close(s.stop)
+	psc := s.conn
+	if psc != nil {
+		psc.Unsubscribe()
+		psc.PUnsubscribe()
+	}
+	s.mux.Unlock()
+
+	select {
+	case <-s.done:
+	case <-time.After(5 * time.Second):
+		if psc != nil {
+			psc.Close()
+		}
+		<-s.done
+	}
+}
@@ -0,0 +1,71 @@
+package redis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestSubscriberDelivery(t *testing.T) {
+	s := newSubscriber(&Cache{key: "app"})
+	received := make(chan PubSubMessage, 2)
+	handler := func(msg PubSubMessage) {
+		received <- msg
+	}
+	s.channels["app:news"] = handler
+	s.patterns["app:news.*"] = handler
+
+	d, ok := s.delivery(redis.Message{Channel: "app:news", Data: []byte("a")})
+	if !ok || d.msg.Channel != "news" || d.msg.Pattern != "" || string(d.msg.Data) != "a" {
+		t.Fatalf("message: %+v %v", d.msg, ok)
+	}
+	d, ok = s.delivery(redis.PMessage{Pattern: "app:news.*", Channel: "app:news.sport", Data: []byte("b")})
+	if !ok || d.msg.Channel != "news.sport" || d.msg.Pattern != "news.*" {
+		t.Fatalf("pattern message: %+v %v", d.msg, ok)
+	}
+	if _, ok = s.delivery(redis.Message{Channel: "app:other"}); ok {
+		t.Fatal("message without handler")
+	}
+
+	// 按接收顺序分发
+	go s.dispatch()
+	first, _ := s.delivery(redis.Message{Channel: "app:news", Data: []byte("1")})
+	second, _ := s.delivery(redis.Message{Channel: "app:news", Data: []byte("2")})
+	s.queue <- first
+	s.queue <- second
+	for _, expected := range []string{"1", "2"} {
+		select {
+		case msg := <-received:
+			if string(msg.Data) != expected {
+				t.Fatalf("got %s, expected %s", msg.Data, expected)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("message not dispatched")
+		}
+	}
+	close(s.stop)
+}
+
+func TestSubscriberCloseFromHandler(t *testing.T) {
+	s := newSubscriber(&Cache{key: "app"})
+	// 代替 run, 关闭后退出接收
+	go func() {
+		<-s.stop
+		close(s.done)
+	}()
+	closed := make(chan struct{})
+	s.channels["app:news"] = func(msg PubSubMessage) {
+		s.close()
+		close(closed)
+	}
+	go s.dispatch()
+
+	d, _ := s.delivery(redis.Message{Channel: "app:news"})
+	s.queue <- d
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("close from handler deadlocked")
+	}
+}
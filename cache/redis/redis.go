@@ -10,6 +10,7 @@ import (
 	"strings"
 
 	"regexp"
+	"sync"
 
 	"github.com/mofancloud/xmicro/cache"
 
@@ -34,10 +35,20 @@ type Cache struct {
 	key      string
 	password string
 	maxIdle  int
+
+	scriptMux sync.RWMutex
+	scripts   map[string]*Script // registered lua scripts
+
+	subMux     sync.Mutex
+	subscriber *subscriber // dedicated pub/sub connection
 }
 
 func NewRedisCache() cache.Cache {
-	return &Cache{key: DefaultKey}
+	rc := &Cache{key: DefaultKey, scripts: make(map[string]*Script)}
+	for _, s := range builtinScripts {
+		rc.scripts[s.Name] = s
+	}
+	return rc
 }
 
 // actually do the redis cmds, args[0] must be the key name.
@@ -390,33 +401,35 @@ func (rc *Cache) StartAndGC(config string) error {
 	return c.Err()
 }
 
-// connect to redis.
-func (rc *Cache) connectInit() {
-	dialFunc := func() (c redis.Conn, err error) {
-		c, err = redis.Dial("tcp", rc.conninfo)
-		if err != nil {
-			return nil, err
-		}
-
-		if rc.password != "" {
-			if _, err := c.Do("AUTH", rc.password); err != nil {
-				c.Close()
-				return nil, err
-			}
-		}
+// dial a new connection to redis.
+func (rc *Cache) dial() (c redis.Conn, err error) {
+	c, err = redis.Dial("tcp", rc.conninfo)
+	if err != nil {
+		return nil, err
+	}
 
-		_, selecterr := c.Do("SELECT", rc.dbNum)
-		if selecterr != nil {
+	if rc.password != "" {
+		if _, err := c.Do("AUTH", rc.password); err != nil {
 			c.Close()
-			return nil, selecterr
+			return nil, err
 		}
-		return
 	}
+
+	_, selecterr := c.Do("SELECT", rc.dbNum)
+	if selecterr != nil {
+		c.Close()
+		return nil, selecterr
+	}
+	return
+}
+
+// connect to redis.
+func (rc *Cache) connectInit() {
 	// initialize a new pool
 	rc.p = &redis.Pool{
 		MaxIdle:     rc.maxIdle,
 		IdleTimeout: 180 * time.Second,
-		Dial:        dialFunc,
+		Dial:        rc.dial,
 	}
 }
 
@@ -0,0 +1,182 @@
+package redis
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Script is a lua script registered in the redis adapter.
+// the KEYS of the script are associated with the adapter key, so
+// the script only touches the keys of its own collection.
+type Script struct {
+	Name     string
+	KeyCount int
+	Src      string
+	Hash     string
+}
+
+func newScript(name string, keyCount int, src string) *Script {
+	h := sha1.Sum([]byte(src))
+	return &Script{
+		Name:     name,
+		KeyCount: keyCount,
+		Src:      src,
+		Hash:     hex.EncodeToString(h[:]),
+	}
+}
+
+const (
+	// ScriptCompareAndSet set KEYS[1] to ARGV[2] only if its value is ARGV[1], ARGV[3] is the expire seconds.
+	ScriptCompareAndSet = "compareAndSet"
+	// ScriptCappedIncr increase KEYS[1] by ARGV[1] only if the result is not over ARGV[2].
+	ScriptCappedIncr = "cappedIncr"
+	// ScriptLeakyBucket take ARGV[3] tokens from the bucket KEYS[1] of capacity ARGV[1] leaking ARGV[2] tokens per second.
+	ScriptLeakyBucket = "leakyBucket"
+)
+
+var builtinScripts = []*Script{
+	newScript(ScriptCompareAndSet, 1, `
+local v = redis.call('GET', KEYS[1])
+if v == ARGV[1] or (v == false and ARGV[1] == '') then
+	if tonumber(ARGV[3]) > 0 then
+		redis.call('SET', KEYS[1], ARGV[2], 'EX', ARGV[3])
+	else
+		redis.call('SET', KEYS[1], ARGV[2])
+	end
+	return 1
+end
+return 0
+`),
+	newScript(ScriptCappedIncr, 1, `
+local v = tonumber(redis.call('GET', KEYS[1]) or '0') + tonumber(ARGV[1])
+if v > tonumber(ARGV[2]) then
+	return -1
+end
+return redis.call('INCRBY', KEYS[1], ARGV[1])
+`),
+	newScript(ScriptLeakyBucket, 1, `
+local capacity = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local amount = tonumber(ARGV[3])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) + tonumber(t[2]) / 1000000
+local b = redis.call('HMGET', KEYS[1], 'level', 'ts')
+local level = tonumber(b[1]) or 0
+local ts = tonumber(b[2]) or now
+level = math.max(0, level - (now - ts) * rate)
+if level + amount > capacity then
+	return 0
+end
+redis.call('HMSET', KEYS[1], 'level', level + amount, 'ts', now)
+redis.call('EXPIRE', KEYS[1], math.ceil(capacity / rate) + 1)
+return 1
+`),
+}
+
+// RegisterScript add a lua script to the adapter registry, it replaces the script of the same name.
+func (rc *Cache) RegisterScript(name string, keyCount int, src string) *Script {
+	s := newScript(name, keyCount, src)
+
+	rc.scriptMux.Lock()
+	defer rc.scriptMux.Unlock()
+	if rc.scripts == nil {
+		rc.scripts = make(map[string]*Script)
+	}
+	rc.scripts[name] = s
+	return s
+}
+
+// GetScript get the registered script by name.
+func (rc *Cache) GetScript(name string) (*Script, bool) {
+	rc.scriptMux.RLock()
+	defer rc.scriptMux.RUnlock()
+	s, ok := rc.scripts[name]
+	return s, ok
+}
+
+// LoadScripts load all registered scripts into the script cache of redis.
+func (rc *Cache) LoadScripts() error {
+	rc.scriptMux.RLock()
+	scripts := make([]*Script, 0, len(rc.scripts))
+	for _, s := range rc.scripts {
+		scripts = append(scripts, s)
+	}
+	rc.scriptMux.RUnlock()
+
+	c := rc.p.Get()
+	defer c.Close()
+	for _, s := range scripts {
+		if _, err := c.Do("SCRIPT", "LOAD", s.Src); err != nil {
+			return fmt.Errorf("load script %s err: %v", s.Name, err)
+		}
+	}
+	return nil
+}
+
+// EvalScript run the registered script by EVALSHA, the script is loaded
+// when redis answers NOSCRIPT. keys are associated with the adapter key.
+func (rc *Cache) EvalScript(name string, keys []string, args ...interface{}) (reply interface{}, err error) {
+	s, ok := rc.GetScript(name)
+	if !ok {
+		return nil, fmt.Errorf("script %s not registered", name)
+	}
+	if len(keys) != s.KeyCount {
+		return nil, fmt.Errorf("script %s needs %d keys, got %d", name, s.KeyCount, len(keys))
+	}
+
+	params := make([]interface{}, 0, len(keys)+len(args)+2)
+	params = append(params, s.Hash, s.KeyCount)
+	for _, k := range keys {
+		params = append(params, rc.associate(k))
+	}
+	params = append(params, args...)
+
+	c := rc.p.Get()
+	defer c.Close()
+
+	reply, err = c.Do("EVALSHA", params...)
+	if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		if _, err = c.Do("SCRIPT", "LOAD", s.Src); err != nil {
+			return nil, err
+		}
+		reply, err = c.Do("EVALSHA", params...)
+	}
+	return
+}
+
+// CompareAndSet set key to newVal only if its current value is oldVal,
+// empty oldVal means the key must not exist. expired <= 0 means never expired.
+func (rc *Cache) CompareAndSet(key string, oldVal string, newVal string, expired int) (bool, error) {
+	return redis.Bool(rc.EvalScript(ScriptCompareAndSet, []string{key}, oldVal, newVal, expired))
+}
+
+// IncrCapped increase the counter by increment unless it would be over max.
+// returns the new value, or an error when the cap is reached.
+func (rc *Cache) IncrCapped(key string, increment int64, max int64) (int64, error) {
+	v, err := redis.Int64(rc.EvalScript(ScriptCappedIncr, []string{key}, increment, max))
+	if err != nil {
+		return 0, err
+	}
+	if v < 0 {
+		return 0, errors.New("counter reaches the cap")
+	}
+	return v, nil
+}
+
+// LeakyBucket try to put amount into the bucket of capacity leaking rate per second,
+// returns false when the bucket would overflow. capacity and rate must be positive.
+func (rc *Cache) LeakyBucket(key string, capacity int64, rate float64, amount int64) (bool, error) {
+	if capacity <= 0 {
+		return false, errors.New("leaky bucket capacity must be positive")
+	}
+	// !(rate > 0) 同时排除 NaN
+	if !(rate > 0) {
+		return false, errors.New("leaky bucket rate must be positive")
+	}
+	return redis.Bool(rc.EvalScript(ScriptLeakyBucket, []string{key}, capacity, rate, amount))
+}
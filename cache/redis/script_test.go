@@ -0,0 +1,41 @@
+package redis
+
+import (
+	"math"
+	"testing"
+)
+
+func TestScriptRegistry(t *testing.T) {
+	rc := NewRedisCache().(*Cache)
+
+	for _, name := range []string{ScriptCompareAndSet, ScriptCappedIncr, ScriptLeakyBucket} {
+		if _, ok := rc.GetScript(name); !ok {
+			t.Errorf("builtin script %s not registered", name)
+		}
+	}
+
+	s := rc.RegisterScript("get", 1, "return redis.call('GET', KEYS[1])")
+	if s.Hash != "d3c21d0c2b9ca22f82737626a27bcaf5d288f99f" {
+		t.Error("script hash err", s.Hash)
+	}
+
+	if _, err := rc.EvalScript("get", []string{"a", "b"}); err == nil {
+		t.Error("key count should be checked")
+	}
+	if _, err := rc.EvalScript("missing", nil); err == nil {
+		t.Error("missing script should fail")
+	}
+}
+
+func TestLeakyBucketArgs(t *testing.T) {
+	rc := NewRedisCache().(*Cache)
+	// 未连接, 参数不对时在执行脚本前返回错误
+	for _, rate := range []float64{0, -1, math.NaN()} {
+		if _, err := rc.LeakyBucket("bucket", 10, rate, 1); err == nil {
+			t.Errorf("rate %v should fail", rate)
+		}
+	}
+	if _, err := rc.LeakyBucket("bucket", 0, 1, 1); err == nil {
+		t.Error("capacity 0 should fail")
+	}
+}
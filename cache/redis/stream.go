@@ -0,0 +1,394 @@
+package redis
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// StreamMessage is one entry of a redis stream.
+type StreamMessage struct {
+	ID     string
+	Fields map[string]string
+}
+
+// StreamPending is one entry of the pending entries list of a consumer group.
+type StreamPending struct {
+	ID         string
+	Consumer   string
+	Idle       time.Duration
+	Deliveries int64
+}
+
+// doRaw runs the redis cmd without associating args[0],
+// callers must associate the stream keys themselves.
+func (rc *Cache) doRaw(commandName string, args ...interface{}) (reply interface{}, err error) {
+	c := rc.p.Get()
+	defer c.Close()
+
+	return c.Do(commandName, args...)
+}
+
+// XADD append an entry to the stream, maxLen > 0 caps the stream length approximately.
+// id is usually "*" to let redis generate it.
+func (rc *Cache) XADD(key string, id string, maxLen int64, fields map[string]interface{}) (string, error) {
+	if len(fields) == 0 {
+		return "", errors.New("missing stream fields")
+	}
+	params := []interface{}{key}
+	if maxLen > 0 {
+		params = append(params, "MAXLEN", "~", maxLen)
+	}
+	if id == "" {
+		id = "*"
+	}
+	params = append(params, id)
+	for k, v := range fields {
+		params = append(params, k, v)
+	}
+	return redis.String(rc.do("XADD", params...))
+}
+
+// XGROUPCREATE create the consumer group, the stream is created when missing.
+// it is not an error if the group already exists.
+func (rc *Cache) XGROUPCREATE(key string, group string, startID string) error {
+	if startID == "" {
+		startID = "$"
+	}
+	_, err := rc.doRaw("XGROUP", "CREATE", rc.associate(key), group, startID, "MKSTREAM")
+	if err != nil && strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil
+	}
+	return err
+}
+
+// XREADGROUP read entries of the stream as consumer of group.
+// id ">" reads new entries, any other id reads the consumer's own pending entries.
+// block <= 0 means not blocking.
+func (rc *Cache) XREADGROUP(key string, group string, consumer string, id string, count int64, block time.Duration) ([]StreamMessage, error) {
+	params := []interface{}{"GROUP", group, consumer}
+	if count > 0 {
+		params = append(params, "COUNT", count)
+	}
+	if block > 0 {
+		params = append(params, "BLOCK", int64(block/time.Millisecond))
+	}
+	params = append(params, "STREAMS", rc.associate(key), id)
+
+	reply, err := rc.doRaw("XREADGROUP", params...)
+	if err == redis.ErrNil || (err == nil && reply == nil) {
+		return nil, nil
+	}
+	streams, err := redis.Values(reply, err)
+	if err != nil {
+		return nil, err
+	}
+	var messages []StreamMessage
+	for _, s := range streams {
+		// [stream name, [entries...]]
+		pair, err := redis.Values(s, nil)
+		if err != nil || len(pair) != 2 {
+			return nil, fmt.Errorf("unexpected XREADGROUP reply: %v", s)
+		}
+		entries, err := parseStreamEntries(pair[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, entries...)
+	}
+	return messages, nil
+}
+
+// XACK acknowledge the entries of group, returns the number of acknowledged entries.
+func (rc *Cache) XACK(key string, group string, ids ...string) (int64, error) {
+	params := []interface{}{key, group}
+	for _, id := range ids {
+		params = append(params, id)
+	}
+	return redis.Int64(rc.do("XACK", params...))
+}
+
+// XPENDING list the pending entries of group between start and end.
+// consumer is optional, empty means all consumers of the group.
+func (rc *Cache) XPENDING(key string, group string, start string, end string, count int64, consumer string) ([]StreamPending, error) {
+	params := []interface{}{key, group, start, end, count}
+	if consumer != "" {
+		params = append(params, consumer)
+	}
+	items, err := redis.Values(rc.do("XPENDING", params...))
+	if err != nil {
+		return nil, err
+	}
+	pendings := make([]StreamPending, 0, len(items))
+	for _, item := range items {
+		// [id, consumer, idle ms, deliveries]
+		fields, err := redis.Values(item, nil)
+		if err != nil || len(fields) != 4 {
+			return nil, fmt.Errorf("unexpected XPENDING reply: %v", item)
+		}
+		id, _ := redis.String(fields[0], nil)
+		owner, _ := redis.String(fields[1], nil)
+		idle, _ := redis.Int64(fields[2], nil)
+		deliveries, _ := redis.Int64(fields[3], nil)
+		pendings = append(pendings, StreamPending{
+			ID:         id,
+			Consumer:   owner,
+			Idle:       time.Duration(idle) * time.Millisecond,
+			Deliveries: deliveries,
+		})
+	}
+	return pendings, nil
+}
+
+// XCLAIM change the ownership of pending entries idle for at least minIdle to consumer.
+func (rc *Cache) XCLAIM(key string, group string, consumer string, minIdle time.Duration, ids ...string) ([]StreamMessage, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	params := []interface{}{key, group, consumer, int64(minIdle / time.Millisecond)}
+	for _, id := range ids {
+		params = append(params, id)
+	}
+	return parseStreamEntries(rc.do("XCLAIM", params...))
+}
+
+// XTRIM trim the stream to about maxLen entries, returns the number of deleted entries.
+func (rc *Cache) XTRIM(key string, maxLen int64) (int64, error) {
+	return redis.Int64(rc.do("XTRIM", key, "MAXLEN", "~", maxLen))
+}
+
+// parse [[id, [field, value, ...]], ...]
+func parseStreamEntries(reply interface{}, err error) ([]StreamMessage, error) {
+	items, e := redis.Values(reply, err)
+	if e != nil {
+		return nil, e
+	}
+	messages := make([]StreamMessage, 0, len(items))
+	for _, item := range items {
+		entry, e := redis.Values(item, nil)
+		if e != nil || len(entry) != 2 {
+			return nil, fmt.Errorf("unexpected stream entry: %v", item)
+		}
+		id, e := redis.String(entry[0], nil)
+		if e != nil {
+			return nil, e
+		}
+		// entries deleted while pending are returned with nil fields
+		fields, e := redis.StringMap(entry[1], nil)
+		if e != nil && entry[1] != nil {
+			return nil, e
+		}
+		messages = append(messages, StreamMessage{ID: id, Fields: fields})
+	}
+	return messages, nil
+}
+
+// StreamHandler handle one stream message, the message is acknowledged when it returns nil.
+type StreamHandler func(msg StreamMessage) error
+
+// StreamConsumer read a stream as one consumer of a group.
+// on start it first re-delivers its own pending entries, and then
+// periodically claims the entries left idle by dead consumers.
+type StreamConsumer struct {
+	Cache    *Cache
+	Stream   string
+	Group    string
+	Consumer string
+	Handler  StreamHandler
+
+	// Count is the max entries read at once.
+	Count int64
+	// Block is the max time a read blocks waiting new entries.
+	Block time.Duration
+	// MinIdle is how long an entry stays pending before it can be claimed.
+	MinIdle time.Duration
+	// MaxDeliveries > 0 acknowledges and drops entries delivered more times,
+	// 0 retries a failing entry forever. NewStreamConsumer sets 10.
+	MaxDeliveries int64
+
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewStreamConsumer create a stream consumer with default settings.
+func NewStreamConsumer(rc *Cache, stream, group, consumer string, handler StreamHandler) *StreamConsumer {
+	return &StreamConsumer{
+		Cache:    rc,
+		Stream:   stream,
+		Group:    group,
+		Consumer: consumer,
+		Handler:  handler,
+		Count:    10,
+		Block:    2 * time.Second,
+		MinIdle:  time.Minute,
+
+		MaxDeliveries: 10,
+	}
+}
+
+// Start create the group if needed and run the consume loop in background.
+func (sc *StreamConsumer) Start() error {
+	if sc.Handler == nil {
+		return errors.New("stream consumer has no handler")
+	}
+	if err := sc.Cache.XGROUPCREATE(sc.Stream, sc.Group, "0"); err != nil {
+		return err
+	}
+	sc.stop = make(chan struct{})
+	sc.done = make(chan struct{})
+	go sc.loop()
+	return nil
+}
+
+// Stop stop the consume loop and wait for the in-flight messages.
+func (sc *StreamConsumer) Stop() {
+	if sc.stop == nil {
+		return
+	}
+	sc.stopOnce.Do(func() {
+		close(sc.stop)
+	})
+	<-sc.done
+}
+
+func (sc *StreamConsumer) stopped() bool {
+	select {
+	case <-sc.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (sc *StreamConsumer) loop() {
+	defer close(sc.done)
+
+	// 先处理自己未确认的消息
+	sc.recoverOwn()
+
+	lastClaim := time.Now()
+	for !sc.stopped() {
+		if time.Since(lastClaim) >= sc.MinIdle {
+			sc.claimIdle()
+			lastClaim = time.Now()
+		}
+
+		messages, err := sc.Cache.XREADGROUP(sc.Stream, sc.Group, sc.Consumer, ">", sc.Count, sc.Block)
+		if err != nil {
+			log.Printf("redis stream %s read err: %v", sc.Stream, err)
+			select {
+			case <-sc.stop:
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		sc.handle(messages)
+	}
+}
+
+// recoverOwn re-deliver the entries this consumer read but never acknowledged.
+func (sc *StreamConsumer) recoverOwn() {
+	id := "0"
+	for !sc.stopped() {
+		messages, err := sc.Cache.XREADGROUP(sc.Stream, sc.Group, sc.Consumer, id, sc.Count, 0)
+		if err != nil {
+			log.Printf("redis stream %s recover err: %v", sc.Stream, err)
+			return
+		}
+		if len(messages) == 0 {
+			return
+		}
+		sc.handle(messages)
+		id = messages[len(messages)-1].ID
+	}
+}
+
+// claimIdle take over the entries other consumers left pending too long.
+// the whole pending list is paged through Count entries at a time.
+func (sc *StreamConsumer) claimIdle() {
+	start := "-"
+	for !sc.stopped() {
+		pendings, err := sc.Cache.XPENDING(sc.Stream, sc.Group, start, "+", sc.Count, "")
+		if err != nil {
+			log.Printf("redis stream %s pending err: %v", sc.Stream, err)
+			return
+		}
+		if len(pendings) == 0 {
+			return
+		}
+
+		ids := []string{}
+		for _, p := range pendings {
+			if p.Idle < sc.MinIdle {
+				continue
+			}
+			if sc.MaxDeliveries > 0 && p.Deliveries >= sc.MaxDeliveries {
+				log.Printf("redis stream %s drop message %s after %d deliveries", sc.Stream, p.ID, p.Deliveries)
+				sc.Cache.XACK(sc.Stream, sc.Group, p.ID)
+				continue
+			}
+			ids = append(ids, p.ID)
+		}
+
+		messages, err := sc.Cache.XCLAIM(sc.Stream, sc.Group, sc.Consumer, sc.MinIdle, ids...)
+		if err != nil {
+			log.Printf("redis stream %s claim err: %v", sc.Stream, err)
+			return
+		}
+		sc.handle(messages)
+
+		if int64(len(pendings)) < sc.Count {
+			return
+		}
+		if start, err = nextStreamID(pendings[len(pendings)-1].ID); err != nil {
+			log.Printf("redis stream %s pending err: %v", sc.Stream, err)
+			return
+		}
+	}
+}
+
+// nextStreamID the smallest id after id, used as an inclusive range start.
+// the exclusive "(id" range needs redis 6.2.
+func nextStreamID(id string) (string, error) {
+	i := strings.IndexByte(id, '-')
+	if i < 0 {
+		return "", fmt.Errorf("invalid stream id %s", id)
+	}
+	ms, err := strconv.ParseUint(id[:i], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid stream id %s", id)
+	}
+	seq, err := strconv.ParseUint(id[i+1:], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid stream id %s", id)
+	}
+	if seq == math.MaxUint64 {
+		return strconv.FormatUint(ms+1, 10) + "-0", nil
+	}
+	return id[:i] + "-" + strconv.FormatUint(seq+1, 10), nil
+}
+
+func (sc *StreamConsumer) handle(messages []StreamMessage) {
+	for _, msg := range messages {
+		// 已被删除的消息直接确认
+		if msg.Fields == nil {
+			sc.Cache.XACK(sc.Stream, sc.Group, msg.ID)
+			continue
+		}
+		if err := sc.Handler(msg); err != nil {
+			log.Printf("redis stream %s handle message %s err: %v", sc.Stream, msg.ID, err)
+			continue
+		}
+		if _, err := sc.Cache.XACK(sc.Stream, sc.Group, msg.ID); err != nil {
+			log.Printf("redis stream %s ack message %s err: %v", sc.Stream, msg.ID, err)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package redis
+
+import (
+	"testing"
+)
+
+func TestParseStreamEntries(t *testing.T) {
+	reply := []interface{}{
+		[]interface{}{[]byte("1-0"), []interface{}{[]byte("payload"), []byte("a"), []byte("contentType"), []byte("text/plain")}},
+		[]interface{}{[]byte("2-0"), nil},
+	}
+
+	messages, err := parseStreamEntries(reply, nil)
+	if err != nil {
+		t.Fatal("parse err", err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("parse len err: %d", len(messages))
+	}
+	if messages[0].ID != "1-0" || messages[0].Fields["payload"] != "a" || messages[0].Fields["contentType"] != "text/plain" {
+		t.Error("parse entry err", messages[0])
+	}
+	if messages[1].ID != "2-0" || messages[1].Fields != nil {
+		t.Error("parse deleted entry err", messages[1])
+	}
+
+	if _, err = parseStreamEntries([]interface{}{[]interface{}{[]byte("1-0")}}, nil); err == nil {
+		t.Error("malformed entry should fail")
+	}
+}
+
+func TestNextStreamID(t *testing.T) {
+	tests := map[string]string{
+		"1-0":                    "1-1",
+		"1526985054069-9":        "1526985054069-10",
+		"7-18446744073709551615": "8-0",
+	}
+	for id, expected := range tests {
+		if next, err := nextStreamID(id); err != nil || next != expected {
+			t.Errorf("next of %s: %s %v", id, next, err)
+		}
+	}
+	if _, err := nextStreamID("1"); err == nil {
+		t.Error("invalid id should fail")
+	}
+}
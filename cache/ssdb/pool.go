@@ -0,0 +1,131 @@
+package ssdb
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ssdb/gossdb/ssdb"
+)
+
+var (
+	// ErrPoolExhausted is returned when maxActive connections are all in use.
+	ErrPoolExhausted = errors.New("ssdb: connection pool exhausted")
+	// ErrPoolClosed is returned when getting a connection of a closed pool.
+	ErrPoolClosed = errors.New("ssdb: connection pool closed")
+
+	// IdleTestInterval is how long a connection stays idle before it is pinged on borrow.
+	IdleTestInterval = time.Minute
+)
+
+type pooledConn struct {
+	c *ssdb.Client
+	t time.Time // time put back to the pool
+}
+
+// connPool keeps the idle ssdb connections, broken connections are dropped
+// and replaced by new ones on the next get.
+type connPool struct {
+	dial        func() (*ssdb.Client, error)
+	maxIdle     int
+	maxActive   int // 0 means no limit
+	idleTimeout time.Duration
+
+	mu     sync.Mutex
+	idle   []*pooledConn
+	active int
+	closed bool
+}
+
+func (p *connPool) get() (*ssdb.Client, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrPoolClosed
+		}
+		p.pruneLocked()
+
+		n := len(p.idle)
+		if n == 0 {
+			if p.maxActive > 0 && p.active >= p.maxActive {
+				p.mu.Unlock()
+				return nil, ErrPoolExhausted
+			}
+			p.active++
+			p.mu.Unlock()
+
+			c, err := p.dial()
+			if err != nil {
+				p.release()
+				return nil, err
+			}
+			return c, nil
+		}
+
+		pc := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+
+		if time.Since(pc.t) < IdleTestInterval || ping(pc.c) == nil {
+			return pc.c, nil
+		}
+		// 连接已失效, 丢弃后重新获取
+		pc.c.Close()
+		p.release()
+	}
+}
+
+// put give back the connection, broken connections are closed.
+func (p *connPool) put(c *ssdb.Client, broken bool) {
+	p.mu.Lock()
+	if !broken && !p.closed && len(p.idle) < p.maxIdle {
+		p.idle = append(p.idle, &pooledConn{c: c, t: time.Now()})
+		p.mu.Unlock()
+		return
+	}
+	p.active--
+	p.mu.Unlock()
+	c.Close()
+}
+
+func (p *connPool) release() {
+	p.mu.Lock()
+	p.active--
+	p.mu.Unlock()
+}
+
+// close the idle connections older than idleTimeout, the oldest are at the head.
+func (p *connPool) pruneLocked() {
+	if p.idleTimeout <= 0 {
+		return
+	}
+	i := 0
+	for ; i < len(p.idle) && time.Since(p.idle[i].t) > p.idleTimeout; i++ {
+		p.idle[i].c.Close()
+		p.active--
+	}
+	p.idle = p.idle[i:]
+}
+
+func (p *connPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, pc := range p.idle {
+		pc.c.Close()
+		p.active--
+	}
+	p.idle = nil
+}
+
+func ping(c *ssdb.Client) error {
+	resp, err := c.Do("ping")
+	if err != nil {
+		return err
+	}
+	if len(resp) == 0 || resp[0] != "ok" {
+		return errors.New("bad ping response")
+	}
+	return nil
+}
@@ -3,8 +3,10 @@ package ssdb
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ssdb/gossdb/ssdb"
@@ -12,25 +14,109 @@ import (
 	"github.com/mofancloud/xmicro/cache"
 )
 
+// ErrNotFound is returned by the typed helpers when the key does not exist.
+var ErrNotFound = errors.New("ssdb: not found")
+
 // Cache SSDB adapter
 type Cache struct {
-	conn     *ssdb.Client
-	conninfo []string
+	mux         sync.Mutex
+	pool        *connPool
+	closed      bool // Close 之后为 true, 重新 StartAndGC 前返回 ErrPoolClosed
+	conninfo    []string
+	maxIdle     int
+	maxActive   int
+	idleTimeout time.Duration
 }
 
 //NewSsdbCache create new ssdb adapter.
 func NewSsdbCache() cache.Cache {
-	return &Cache{}
+	return &Cache{maxIdle: 3, idleTimeout: 180 * time.Second}
 }
 
-// Get get value from memcache.
-func (rc *Cache) Get(key string) interface{} {
-	if rc.conn == nil {
-		if err := rc.connectInit(); err != nil {
-			return nil
+// readCmds 只读的命令, 连接断开时可以在新连接上重试.
+// 写命令失败时可能已在服务端执行, 重试会导致 incr, qpush 等重复执行, 所以不重试
+var readCmds = map[string]bool{
+	"get": true, "exists": true, "ttl": true, "multi_get": true, "scan": true,
+	"hget": true, "hgetall": true, "hsize": true,
+	"zget": true, "zsize": true, "zcount": true, "zrange": true, "zrrange": true,
+	"qsize": true, "qslice": true,
+}
+
+// do run the ssdb cmd on a pooled connection, read cmds are retried once
+// on a new connection if the connection is broken.
+func (rc *Cache) do(args ...interface{}) ([]string, error) {
+	if err := rc.connectInit(); err != nil {
+		return nil, err
+	}
+	rc.mux.Lock()
+	p := rc.pool
+	rc.mux.Unlock()
+	if p == nil {
+		return nil, ErrPoolClosed
+	}
+
+	attempts := 1
+	if cmd, ok := args[0].(string); ok && readCmds[cmd] {
+		attempts = 2
+	}
+	var resp []string
+	var err error
+	for i := 0; i < attempts; i++ {
+		var c *ssdb.Client
+		c, err = p.get()
+		if err != nil {
+			return nil, err
 		}
+		resp, err = c.Do(args...)
+		p.put(c, err != nil)
+		if err == nil {
+			return resp, nil
+		}
+	}
+	return nil, err
+}
+
+// check the status of the response, and return the data part.
+func (rc *Cache) doCheck(args ...interface{}) ([]string, error) {
+	resp, err := rc.do(args...)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) == 0 {
+		return nil, errors.New("bad response")
 	}
-	value, err := rc.conn.Get(key)
+	switch resp[0] {
+	case "ok":
+		return resp[1:], nil
+	case "not_found":
+		return nil, ErrNotFound
+	default:
+		return nil, fmt.Errorf("ssdb: %s", strings.Join(resp, " "))
+	}
+}
+
+func (rc *Cache) doString(args ...interface{}) (string, error) {
+	data, err := rc.doCheck(args...)
+	if err != nil {
+		return "", err
+	}
+	if len(data) == 0 {
+		return "", errors.New("bad response")
+	}
+	return data[0], nil
+}
+
+func (rc *Cache) doInt64(args ...interface{}) (int64, error) {
+	v, err := rc.doString(args...)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(v, 10, 64)
+}
+
+// Get get value from memcache.
+func (rc *Cache) Get(key string) interface{} {
+	value, err := rc.doString("get", key)
 	if err == nil {
 		return value
 	}
@@ -41,19 +127,19 @@ func (rc *Cache) Get(key string) interface{} {
 func (rc *Cache) GetMulti(keys []string) []interface{} {
 	size := len(keys)
 	var values []interface{}
-	if rc.conn == nil {
-		if err := rc.connectInit(); err != nil {
-			for i := 0; i < size; i++ {
-				values = append(values, err)
-			}
-			return values
-		}
-	}
-	res, err := rc.conn.Do("multi_get", keys)
-	resSize := len(res)
+	res, err := rc.doCheck("multi_get", keys)
 	if err == nil {
-		for i := 1; i < resSize; i += 2 {
-			values = append(values, res[i+1])
+		// 只返回存在的 key, 按请求的顺序排列
+		found := make(map[string]string, len(res)/2)
+		for i := 0; i+1 < len(res); i += 2 {
+			found[res[i]] = res[i+1]
+		}
+		for _, key := range keys {
+			if v, ok := found[key]; ok {
+				values = append(values, v)
+			} else {
+				values = append(values, nil)
+			}
 		}
 		return values
 	}
@@ -65,22 +151,12 @@ func (rc *Cache) GetMulti(keys []string) []interface{} {
 
 // DelMulti get value from memcache.
 func (rc *Cache) DelMulti(keys []string) error {
-	if rc.conn == nil {
-		if err := rc.connectInit(); err != nil {
-			return err
-		}
-	}
-	_, err := rc.conn.Do("multi_del", keys)
+	_, err := rc.do("multi_del", keys)
 	return err
 }
 
 // Put put value to memcache. only support string.
 func (rc *Cache) Put(key string, value interface{}, timeout time.Duration) error {
-	if rc.conn == nil {
-		if err := rc.connectInit(); err != nil {
-			return err
-		}
-	}
 	v, ok := value.(string)
 	if !ok {
 		return errors.New("value must string")
@@ -89,9 +165,9 @@ func (rc *Cache) Put(key string, value interface{}, timeout time.Duration) error
 	var err error
 	ttl := int(timeout / time.Second)
 	if ttl < 0 {
-		resp, err = rc.conn.Do("set", key, v)
+		resp, err = rc.do("set", key, v)
 	} else {
-		resp, err = rc.conn.Do("setx", key, v, ttl)
+		resp, err = rc.do("setx", key, v, ttl)
 	}
 	if err != nil {
 		return err
@@ -104,62 +180,53 @@ func (rc *Cache) Put(key string, value interface{}, timeout time.Duration) error
 
 // Delete delete value in memcache.
 func (rc *Cache) Delete(key string) error {
-	if rc.conn == nil {
-		if err := rc.connectInit(); err != nil {
-			return err
-		}
-	}
-	_, err := rc.conn.Del(key)
+	_, err := rc.do("del", key)
 	return err
 }
 
 // Incr increase counter.
 func (rc *Cache) Incr(key string) error {
-	if rc.conn == nil {
-		if err := rc.connectInit(); err != nil {
-			return err
-		}
-	}
-	_, err := rc.conn.Do("incr", key, 1)
+	_, err := rc.do("incr", key, 1)
 	return err
 }
 
 // Decr decrease counter.
 func (rc *Cache) Decr(key string) error {
-	if rc.conn == nil {
-		if err := rc.connectInit(); err != nil {
-			return err
-		}
-	}
-	_, err := rc.conn.Do("incr", key, -1)
+	_, err := rc.do("incr", key, -1)
 	return err
 }
 
 // IsExist check value exists in memcache.
+// ssdb removes the expired keys in background, so a key whose ttl
+// has elapsed is reported as not existing even if not removed yet.
 func (rc *Cache) IsExist(key string) bool {
-	if rc.conn == nil {
-		if err := rc.connectInit(); err != nil {
-			return false
-		}
-	}
-	resp, err := rc.conn.Do("exists", key)
+	resp, err := rc.do("exists", key)
 	if err != nil {
 		return false
 	}
-	if len(resp) == 2 && resp[1] == "1" {
-		return true
+	if len(resp) != 2 || resp[1] != "1" {
+		return false
+	}
+	ttl, err := rc.TTL(key)
+	if err != nil {
+		return false
 	}
-	return false
+	return ttl == -1 || ttl > 0
+}
+
+// TTL get the remaining seconds of key, -1 means the key never expires.
+func (rc *Cache) TTL(key string) (int64, error) {
+	return rc.doInt64("ttl", key)
+}
 
+// Expire set the ttl of an existing key.
+func (rc *Cache) Expire(key string, timeout time.Duration) error {
+	_, err := rc.doCheck("expire", key, int(timeout/time.Second))
+	return err
 }
 
 // ClearAll clear all cached in memcache.
 func (rc *Cache) ClearAll() error {
-	if rc.conn == nil {
-		if err := rc.connectInit(); err != nil {
-			return err
-		}
-	}
 	keyStart, keyEnd, limit := "", "", 50
 	resp, err := rc.Scan(keyStart, keyEnd, limit)
 	for err == nil {
@@ -171,7 +238,7 @@ func (rc *Cache) ClearAll() error {
 		for i := 1; i < size; i += 2 {
 			keys = append(keys, resp[i])
 		}
-		_, e := rc.conn.Do("multi_del", keys)
+		_, e := rc.do("multi_del", keys)
 		if e != nil {
 			return e
 		}
@@ -183,20 +250,185 @@ func (rc *Cache) ClearAll() error {
 
 // Scan key all cached in ssdb.
 func (rc *Cache) Scan(keyStart string, keyEnd string, limit int) ([]string, error) {
-	if rc.conn == nil {
-		if err := rc.connectInit(); err != nil {
-			return nil, err
-		}
-	}
-	resp, err := rc.conn.Do("scan", keyStart, keyEnd, limit)
+	resp, err := rc.do("scan", keyStart, keyEnd, limit)
 	if err != nil {
 		return nil, err
 	}
 	return resp, nil
 }
 
+// HSET set field of hash key.
+func (rc *Cache) HSET(key string, field string, value interface{}) error {
+	_, err := rc.doCheck("hset", key, field, value)
+	return err
+}
+
+// HGET get field of hash key, ErrNotFound if missing.
+func (rc *Cache) HGET(key string, field string) (string, error) {
+	return rc.doString("hget", key, field)
+}
+
+// HDEL delete fields of hash key.
+func (rc *Cache) HDEL(key string, fields []string) error {
+	_, err := rc.doCheck("multi_hdel", key, fields)
+	return err
+}
+
+// HGETALL get all fields of hash key.
+func (rc *Cache) HGETALL(key string) (map[string]string, error) {
+	data, err := rc.doCheck("hgetall", key)
+	if err != nil {
+		return nil, err
+	}
+	return pairs(data), nil
+}
+
+// HMSET set several fields of hash key.
+func (rc *Cache) HMSET(key string, fields map[string]interface{}) error {
+	params := []interface{}{"multi_hset", key}
+	for k, v := range fields {
+		params = append(params, k, v)
+	}
+	_, err := rc.doCheck(params...)
+	return err
+}
+
+// HINCRBY increase field of hash key, returns the new value.
+func (rc *Cache) HINCRBY(key string, field string, increment int64) (int64, error) {
+	return rc.doInt64("hincr", key, field, increment)
+}
+
+// HLEN get the field count of hash key.
+func (rc *Cache) HLEN(key string) (int64, error) {
+	return rc.doInt64("hsize", key)
+}
+
+// ZADD set the score of member in sorted set key, ssdb scores are int64.
+func (rc *Cache) ZADD(key string, score int64, member string) error {
+	_, err := rc.doCheck("zset", key, member, score)
+	return err
+}
+
+// ZSCORE get the score of member, ErrNotFound if missing.
+func (rc *Cache) ZSCORE(key string, member string) (int64, error) {
+	return rc.doInt64("zget", key, member)
+}
+
+// ZREM remove members of sorted set key.
+func (rc *Cache) ZREM(key string, members ...string) error {
+	_, err := rc.doCheck("multi_zdel", key, members)
+	return err
+}
+
+// ZINCRBY increase the score of member, returns the new score.
+func (rc *Cache) ZINCRBY(key string, increment int64, member string) (int64, error) {
+	return rc.doInt64("zincr", key, member, increment)
+}
+
+// ZCARD get the member count of sorted set key.
+func (rc *Cache) ZCARD(key string) (int64, error) {
+	return rc.doInt64("zsize", key)
+}
+
+// ZCOUNT count the members with score between minScore and maxScore.
+func (rc *Cache) ZCOUNT(key string, minScore, maxScore int64) (int64, error) {
+	return rc.doInt64("zcount", key, minScore, maxScore)
+}
+
+// ZRANGE get the members ranked from startRank to endRank with their scores, in order.
+func (rc *Cache) ZRANGE(key string, startRank, endRank int64) ([]string, []int64, error) {
+	return rc.zrange("zrange", key, startRank, endRank)
+}
+
+// ZREVRANGE like ZRANGE in reverse order.
+func (rc *Cache) ZREVRANGE(key string, startRank, endRank int64) ([]string, []int64, error) {
+	return rc.zrange("zrrange", key, startRank, endRank)
+}
+
+func (rc *Cache) zrange(cmd string, key string, startRank, endRank int64) ([]string, []int64, error) {
+	if endRank < startRank {
+		return nil, nil, nil
+	}
+	data, err := rc.doCheck(cmd, key, startRank, endRank-startRank+1)
+	if err != nil {
+		return nil, nil, err
+	}
+	members := make([]string, 0, len(data)/2)
+	scores := make([]int64, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		score, err := strconv.ParseInt(data[i+1], 10, 64)
+		if err != nil {
+			return nil, nil, err
+		}
+		members = append(members, data[i])
+		scores = append(scores, score)
+	}
+	return members, scores, nil
+}
+
+// RPush push values to the back of queue key, returns the queue size.
+func (rc *Cache) RPush(key string, vals ...interface{}) (int64, error) {
+	return rc.doInt64(append([]interface{}{"qpush_back", key}, vals...)...)
+}
+
+// LPush push values to the front of queue key, returns the queue size.
+func (rc *Cache) LPush(key string, vals ...interface{}) (int64, error) {
+	return rc.doInt64(append([]interface{}{"qpush_front", key}, vals...)...)
+}
+
+// LPop pop the front of queue key, ErrNotFound if empty.
+func (rc *Cache) LPop(key string) (string, error) {
+	return rc.doString("qpop_front", key)
+}
+
+// RPop pop the back of queue key, ErrNotFound if empty.
+func (rc *Cache) RPop(key string) (string, error) {
+	return rc.doString("qpop_back", key)
+}
+
+// LRange get the items of queue key from start to stop.
+func (rc *Cache) LRange(key string, start int64, stop int64) ([]string, error) {
+	return rc.doCheck("qslice", key, start, stop)
+}
+
+// LTRIM keep only the items of queue key from start to stop.
+func (rc *Cache) LTRIM(key string, start int64, stop int64) error {
+	size, err := rc.QSize(key)
+	if err != nil {
+		return err
+	}
+	if start < 0 {
+		start += size
+	}
+	if stop < 0 {
+		stop += size
+	}
+	if start > 0 {
+		if _, err = rc.doCheck("qtrim_front", key, start); err != nil {
+			return err
+		}
+	}
+	if back := size - 1 - stop; back > 0 {
+		_, err = rc.doCheck("qtrim_back", key, back)
+	}
+	return err
+}
+
+// QSize get the size of queue key.
+func (rc *Cache) QSize(key string) (int64, error) {
+	return rc.doInt64("qsize", key)
+}
+
+func pairs(data []string) map[string]string {
+	m := make(map[string]string, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		m[data[i]] = data[i+1]
+	}
+	return m
+}
+
 // StartAndGC start memcache adapter.
-// config string is like {"conn":"connection info"}.
+// config string is like {"conn":"connection info","maxIdle":"3","maxActive":"0","idleTimeout":"180"}.
 // if connecting error, return.
 func (rc *Cache) StartAndGC(config string) error {
 	var cf map[string]string
@@ -205,25 +437,75 @@ func (rc *Cache) StartAndGC(config string) error {
 		return errors.New("config has no conn key")
 	}
 	rc.conninfo = strings.Split(cf["conn"], ";")
-	if rc.conn == nil {
-		if err := rc.connectInit(); err != nil {
-			return err
-		}
+	if v, ok := cf["maxIdle"]; ok {
+		rc.maxIdle, _ = strconv.Atoi(v)
+	}
+	if v, ok := cf["maxActive"]; ok {
+		rc.maxActive, _ = strconv.Atoi(v)
 	}
+	if v, ok := cf["idleTimeout"]; ok {
+		seconds, _ := strconv.Atoi(v)
+		rc.idleTimeout = time.Duration(seconds) * time.Second
+	}
+	rc.mux.Lock()
+	rc.closed = false
+	rc.mux.Unlock()
+	if err := rc.connectInit(); err != nil {
+		return err
+	}
+
+	// 检查连接是否可用
+	c, err := rc.pool.get()
+	if err != nil {
+		return err
+	}
+	rc.pool.put(c, false)
 	return nil
 }
 
-// connect to memcache and keep the connection.
+// Close close the idle connections of the pool, later cmds return ErrPoolClosed.
+func (rc *Cache) Close() {
+	rc.mux.Lock()
+	defer rc.mux.Unlock()
+	rc.closed = true
+	if rc.pool != nil {
+		rc.pool.close()
+		rc.pool = nil
+	}
+}
+
+// initialize the connection pool.
 func (rc *Cache) connectInit() error {
+	rc.mux.Lock()
+	defer rc.mux.Unlock()
+	if rc.closed {
+		return ErrPoolClosed
+	}
+	if rc.pool != nil {
+		return nil
+	}
+	if len(rc.conninfo) == 0 {
+		return errors.New("ssdb adapter not started")
+	}
+
 	conninfoArray := strings.Split(rc.conninfo[0], ":")
+	if len(conninfoArray) != 2 {
+		return fmt.Errorf("bad ssdb conn %s", rc.conninfo[0])
+	}
 	host := conninfoArray[0]
 	port, e := strconv.Atoi(conninfoArray[1])
 	if e != nil {
 		return e
 	}
-	var err error
-	rc.conn, err = ssdb.Connect(host, port)
-	return err
+	rc.pool = &connPool{
+		dial: func() (*ssdb.Client, error) {
+			return ssdb.Connect(host, port)
+		},
+		maxIdle:     rc.maxIdle,
+		maxActive:   rc.maxActive,
+		idleTimeout: rc.idleTimeout,
+	}
+	return nil
 }
 
 func init() {
@@ -102,3 +102,80 @@ func TestSsdbcacheCache(t *testing.T) {
 		t.Error("check err")
 	}
 }
+
+func TestSsdbcacheHelpers(t *testing.T) {
+	bm, err := cache.NewCache("ssdb", `{"conn": "127.0.0.1:8888", "maxIdle": "2"}`)
+	if err != nil {
+		t.Fatal("init err")
+	}
+	rc := bm.(*Cache)
+
+	// test hash
+	if err = rc.HSET("h", "a", 1); err != nil {
+		t.Error("hset err", err)
+	}
+	if v, err := rc.HINCRBY("h", "a", 2); err != nil || v != 3 {
+		t.Error("hincr err", v, err)
+	}
+	if v, err := rc.HGET("h", "a"); err != nil || v != "3" {
+		t.Error("hget err", v, err)
+	}
+	if _, err := rc.HGET("h", "missing"); err != ErrNotFound {
+		t.Error("hget missing err", err)
+	}
+	if m, err := rc.HGETALL("h"); err != nil || m["a"] != "3" {
+		t.Error("hgetall err", m, err)
+	}
+	rc.HDEL("h", []string{"a"})
+
+	// test zset
+	rc.ZADD("z", 2, "b")
+	rc.ZADD("z", 1, "a")
+	if members, scores, err := rc.ZRANGE("z", 0, 1); err != nil || len(members) != 2 || members[0] != "a" || scores[1] != 2 {
+		t.Error("zrange err", members, scores, err)
+	}
+	if v, err := rc.ZINCRBY("z", 5, "a"); err != nil || v != 6 {
+		t.Error("zincr err", v, err)
+	}
+	rc.ZREM("z", "a", "b")
+	if n, err := rc.ZCARD("z"); err != nil || n != 0 {
+		t.Error("zcard err", n, err)
+	}
+
+	// test queue
+	if n, err := rc.RPush("q", "1", "2", "3"); err != nil || n != 3 {
+		t.Error("qpush err", n, err)
+	}
+	if v, err := rc.LPop("q"); err != nil || v != "1" {
+		t.Error("qpop err", v, err)
+	}
+	if items, err := rc.LRange("q", 0, -1); err != nil || len(items) != 2 {
+		t.Error("qslice err", items, err)
+	}
+	rc.LTRIM("q", 1, -1)
+	if n, err := rc.QSize("q"); err != nil || n != 1 {
+		t.Error("qsize err", n, err)
+	}
+	rc.RPop("q")
+
+	// test ttl
+	if err = rc.Put("ttl", "v", 10*time.Second); err != nil {
+		t.Error("set Error", err)
+	}
+	if ttl, err := rc.TTL("ttl"); err != nil || ttl <= 0 {
+		t.Error("ttl err", ttl, err)
+	}
+	rc.Delete("ttl")
+	rc.Close()
+}
+
+func TestSsdbCacheClosed(t *testing.T) {
+	rc := &Cache{conninfo: []string{"127.0.0.1:8888"}}
+	rc.Close()
+	if _, err := rc.do("get", "ssdb"); err != ErrPoolClosed {
+		t.Fatalf("expect pool closed, got %v", err)
+	}
+	if rc.pool != nil {
+		t.Fatal("pool recreated after close")
+	}
+}
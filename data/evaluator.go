@@ -0,0 +1,407 @@
+package data
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Evaluator 在内存中按 Filter 匹配文档, 用于测试或内存存储.
+// 文档为 map[string]interface{} 或结构体, 结构体字段按 TagName 的标签取名, 没有标签时用字段名.
+// 数组字段与 Mongo 一致: 任一元素满足即满足. GEO_WITHIN 和 TEXT 返回 ErrUnsupportedFilter
+type Evaluator struct {
+	TagName string
+}
+
+// Constructor
+func NewEvaluator(tagName string) *Evaluator {
+	return &Evaluator{TagName: tagName}
+}
+
+// Match doc 是否满足 f, f 为 nil 时满足
+func (e *Evaluator) Match(f Filter, doc interface{}) (bool, error) {
+	if f == nil {
+		return true, nil
+	}
+	switch t := f.(type) {
+	case *Logical:
+		return e.matchLogical(t, doc)
+	case *Condition:
+		return e.matchCondition(t, doc)
+	case *TextSearch:
+		return false, fmt.Errorf("%w: %s", ErrUnsupportedFilter, FilterType_TEXT)
+	}
+	return false, fmt.Errorf("%w: %T", ErrUnsupportedFilter, f)
+}
+
+func (e *Evaluator) matchLogical(l *Logical, doc interface{}) (bool, error) {
+	for _, sub := range l.Filters {
+		ok, err := e.Match(sub, doc)
+		if err != nil {
+			return false, err
+		}
+		switch l.Op {
+		case FilterType_AND:
+			if !ok {
+				return false, nil
+			}
+		case FilterType_OR:
+			if ok {
+				return true, nil
+			}
+		case FilterType_NOR:
+			if ok {
+				return false, nil
+			}
+		default:
+			return false, fmt.Errorf("%w: %s", ErrUnsupportedFilter, l.Op)
+		}
+	}
+	// 空的 OR 不满足, 空的 AND/NOR 满足
+	return l.Op != FilterType_OR, nil
+}
+
+func (e *Evaluator) matchCondition(c *Condition, doc interface{}) (bool, error) {
+	var v interface{} = doc
+	found := true
+	if c.Field != "" {
+		v, found = e.Lookup(doc, c.Field)
+	}
+
+	switch c.Op {
+	case FilterType_EXISTS:
+		exists, _ := c.Value.(bool)
+		return found == exists, nil
+	case FilterType_SIZE:
+		n, _ := toFloat(c.Value)
+		rv := reflect.ValueOf(v)
+		return found && isArray(rv) && float64(rv.Len()) == n, nil
+	case FilterType_ELEM_MATCH:
+		sub, ok := c.Value.(Filter)
+		rv := reflect.ValueOf(v)
+		if !ok || !found || !isArray(rv) {
+			return false, nil
+		}
+		for i := 0; i < rv.Len(); i++ {
+			if ok, err := e.Match(sub, rv.Index(i).Interface()); ok || err != nil {
+				return ok, err
+			}
+		}
+		return false, nil
+	case FilterType_NE, FilterType_NOT_IN, FilterType_NOT_LIKE:
+		// 取反: 没有任何值 (或元素) 满足对应的正向运算
+		positive := &Condition{Field: c.Field, Op: negate(c.Op), Value: c.Value}
+		ok, err := e.matchCondition(positive, doc)
+		return !ok, err
+	case FilterType_GEO_WITHIN:
+		return false, fmt.Errorf("%w: %s", ErrUnsupportedFilter, c.Op)
+	}
+
+	test, err := e.valueTest(c)
+	if err != nil {
+		return false, err
+	}
+	if !found {
+		// 不存在的字段只与 nil 相等
+		return (c.Op == FilterType_EQ && c.Value == nil) || (c.Op == FilterType_IN && containsNil(c.Value)), nil
+	}
+	if test(v) {
+		return true, nil
+	}
+	if rv := reflect.ValueOf(v); isArray(rv) {
+		for i := 0; i < rv.Len(); i++ {
+			if test(rv.Index(i).Interface()) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func negate(op FilterType) FilterType {
+	switch op {
+	case FilterType_NE:
+		return FilterType_EQ
+	case FilterType_NOT_IN:
+		return FilterType_IN
+	}
+	return FilterType_LIKE
+}
+
+// valueTest 单个值上的判断, 数组字段的每个元素都会用它判断
+func (e *Evaluator) valueTest(c *Condition) (func(v interface{}) bool, error) {
+	switch c.Op {
+	case FilterType_EQ:
+		return func(v interface{}) bool { return EqualValues(v, c.Value) }, nil
+	case FilterType_GT, FilterType_GTE, FilterType_LT, FilterType_LTE:
+		return func(v interface{}) bool {
+			n, ok := CompareValues(v, c.Value)
+			if !ok {
+				return false
+			}
+			switch c.Op {
+			case FilterType_GT:
+				return n > 0
+			case FilterType_GTE:
+				return n >= 0
+			case FilterType_LT:
+				return n < 0
+			}
+			return n <= 0
+		}, nil
+	case FilterType_IN:
+		rv := reflect.ValueOf(c.Value)
+		if !isArray(rv) {
+			return nil, invalidFilter(c.Field, c.Op, "expect an array, got %T", c.Value)
+		}
+		return func(v interface{}) bool {
+			for i := 0; i < rv.Len(); i++ {
+				if EqualValues(v, rv.Index(i).Interface()) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case FilterType_LIKE, FilterType_ILIKE, FilterType_MATCH:
+		re, err := compileRegex(c)
+		if err != nil {
+			return nil, err
+		}
+		return func(v interface{}) bool {
+			s, ok := v.(string)
+			return ok && re.MatchString(s)
+		}, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedFilter, c.Op)
+}
+
+func compileRegex(c *Condition) (*regexp.Regexp, error) {
+	pattern, options := "", ""
+	switch v := c.Value.(type) {
+	case string:
+		pattern = v
+	case map[string]interface{}:
+		pattern, _ = v["pattern"].(string)
+		options, _ = v["options"].(string)
+	default:
+		return nil, invalidFilter(c.Field, c.Op, "expect a pattern, got %T", c.Value)
+	}
+	if c.Op == FilterType_ILIKE {
+		options = "i"
+	}
+	flags := ""
+	for _, o := range options {
+		switch o {
+		case 'i', 'm', 's':
+			flags += string(o)
+		default:
+			return nil, fmt.Errorf("%w: regex option `%c`", ErrUnsupportedFilter, o)
+		}
+	}
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, invalidFilter(c.Field, c.Op, "%v", err)
+	}
+	return re, nil
+}
+
+// Lookup 取 a.b.c 形式的字段值, 经过数组时取每个元素的字段组成数组
+func (e *Evaluator) Lookup(doc interface{}, path string) (interface{}, bool) {
+	v := doc
+	for _, k := range strings.Split(path, ".") {
+		rv := reflect.ValueOf(v)
+		for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+			if rv.IsNil() {
+				return nil, false
+			}
+			rv = rv.Elem()
+		}
+		if isArray(rv) {
+			values := []interface{}{}
+			for i := 0; i < rv.Len(); i++ {
+				if ev, ok := e.Lookup(rv.Index(i).Interface(), k); ok {
+					values = append(values, ev)
+				}
+			}
+			if len(values) == 0 {
+				return nil, false
+			}
+			v = values
+			continue
+		}
+		fv, ok := e.field(rv, k)
+		if !ok {
+			return nil, false
+		}
+		v = fv
+	}
+	return v, true
+}
+
+func (e *Evaluator) field(rv reflect.Value, name string) (interface{}, bool) {
+	switch rv.Kind() {
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return nil, false
+		}
+		fv := rv.MapIndex(reflect.ValueOf(name).Convert(rv.Type().Key()))
+		if !fv.IsValid() {
+			return nil, false
+		}
+		return fv.Interface(), true
+	case reflect.Struct:
+		t := rv.Type()
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			if sf.PkgPath != "" {
+				continue
+			}
+			tag := sf.Name
+			if e.TagName != "" {
+				if tv := strings.Split(sf.Tag.Get(e.TagName), ",")[0]; tv == "-" {
+					continue
+				} else if tv != "" {
+					tag = tv
+				}
+			}
+			if tag == name {
+				fv := rv.Field(i)
+				// 与 omitempty 的 nil 指针一样视为不存在
+				if fv.Kind() == reflect.Ptr && fv.IsNil() {
+					return nil, false
+				}
+				return fv.Interface(), true
+			}
+		}
+	}
+	return nil, false
+}
+
+func isArray(rv reflect.Value) bool {
+	if !rv.IsValid() {
+		return false
+	}
+	// []byte 视为标量
+	return (rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array) && rv.Type().Elem().Kind() != reflect.Uint8
+}
+
+func containsNil(list interface{}) bool {
+	rv := reflect.ValueOf(list)
+	if !isArray(rv) {
+		return false
+	}
+	for i := 0; i < rv.Len(); i++ {
+		if rv.Index(i).Interface() == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	return 0, false
+}
+
+func deref(v interface{}) interface{} {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil
+		}
+		rv = rv.Elem()
+	}
+	if !rv.IsValid() {
+		return nil
+	}
+	return rv.Interface()
+}
+
+// CompareValues 比较同类的两个值: 数字, 字符串 (含 string 为底层类型的, 如 ObjectId), 时间, bool.
+// 类型不可比较时第二个返回值为 false
+func CompareValues(a, b interface{}) (int, bool) {
+	a, b = deref(a), deref(b)
+	if fa, ok := toFloat(a); ok {
+		fb, ok := toFloat(b)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case fa < fb:
+			return -1, true
+		case fa > fb:
+			return 1, true
+		}
+		return 0, true
+	}
+	if ta, ok := a.(time.Time); ok {
+		tb, ok := b.(time.Time)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case ta.Before(tb):
+			return -1, true
+		case ta.After(tb):
+			return 1, true
+		}
+		return 0, true
+	}
+	ra, rb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if !ra.IsValid() || !rb.IsValid() || ra.Kind() != rb.Kind() {
+		return 0, false
+	}
+	switch ra.Kind() {
+	case reflect.String:
+		return strings.Compare(ra.String(), rb.String()), true
+	case reflect.Bool:
+		switch {
+		case ra.Bool() == rb.Bool():
+			return 0, true
+		case !ra.Bool():
+			return -1, true
+		}
+		return 1, true
+	}
+	return 0, false
+}
+
+// EqualValues 数字按值比较, 其余可比较的按 CompareValues, 不能比较的按 reflect.DeepEqual
+func EqualValues(a, b interface{}) bool {
+	a, b = deref(a), deref(b)
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	if n, ok := CompareValues(a, b); ok {
+		return n == 0
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// Select 返回 list 中满足 f 的元素
+func Select[T any](e *Evaluator, f Filter, list []T) ([]T, error) {
+	out := []T{}
+	for _, item := range list {
+		ok, err := e.Match(f, item)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			out = append(out, item)
+		}
+	}
+	return out, nil
+}
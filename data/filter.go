@@ -0,0 +1,410 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+)
+
+// ErrInvalidFilter filters 的格式或取值不正确
+var ErrInvalidFilter = errors.New("invalid filter")
+
+// ErrUnsupportedFilter Translator 或 Evaluator 不支持的条件
+var ErrUnsupportedFilter = errors.New("unsupported filter")
+
+// Filter 过滤条件的语法树, 由 ParseFilter 从 PageQuery.Filters 解析, 或用 Field/And/Or 构造
+type Filter interface {
+	isFilter()
+}
+
+// Condition 字段上的一个运算, 如 age GTE 18.
+// ELEM_MATCH 的 Value 为 Filter, 其中 Field 为空的 Condition 作用于数组元素本身
+type Condition struct {
+	Field string
+	Op    FilterType
+	Value interface{}
+}
+
+// Logical AND/OR/NOR
+type Logical struct {
+	Op      FilterType
+	Filters []Filter
+}
+
+// TextSearch 全文检索
+type TextSearch struct {
+	Search             string
+	Language           string
+	CaseSensitive      bool
+	DiacriticSensitive bool
+}
+
+func (*Condition) isFilter()  {}
+func (*Logical) isFilter()    {}
+func (*TextSearch) isFilter() {}
+
+// Translator 将 Filter 转为某个存储的查询条件
+type Translator interface {
+	Translate(f Filter) (interface{}, error)
+}
+
+// FilterError 某个字段的条件不正确, errors.Is(err, ErrInvalidFilter) 为 true
+type FilterError struct {
+	Field    string     `json:"field"`
+	Operator FilterType `json:"operator"`
+	Message  string     `json:"message"`
+}
+
+func (e *FilterError) Error() string {
+	if e.Operator == "" {
+		return fmt.Sprintf("filter `%s`: %s", e.Field, e.Message)
+	}
+	return fmt.Sprintf("filter `%s` %s: %s", e.Field, e.Operator, e.Message)
+}
+
+func (e *FilterError) Unwrap() error {
+	return ErrInvalidFilter
+}
+
+func invalidFilter(field string, op FilterType, format string, args ...interface{}) error {
+	return &FilterError{Field: field, Operator: op, Message: fmt.Sprintf(format, args...)}
+}
+
+// IsFieldOperator op 为字段上的运算, 而不是 AND/OR/NOR/TEXT
+func IsFieldOperator(op FilterType) bool {
+	switch op {
+	case FilterType_EQ, FilterType_NE, FilterType_GT, FilterType_GTE, FilterType_LT, FilterType_LTE,
+		FilterType_IN, FilterType_NOT_IN, FilterType_LIKE, FilterType_ILIKE, FilterType_NOT_LIKE, FilterType_MATCH,
+		FilterType_EXISTS, FilterType_SIZE, FilterType_ELEM_MATCH, FilterType_GEO_WITHIN:
+		return true
+	}
+	return false
+}
+
+// ParseFilter 解析 PageQuery.Filters 的 JSON 格式, 结果总是一个 AND, 字段和运算符按名字排序
+func ParseFilter(filters map[string]interface{}) (*Logical, error) {
+	and := &Logical{Op: FilterType_AND, Filters: []Filter{}}
+
+	for _, k := range sortedKeys(filters) {
+		v := filters[k]
+		switch op := FilterType(k); op {
+		case FilterType_AND, FilterType_OR, FilterType_NOR:
+			subs, err := parseSubFilters(op, v)
+			if err != nil {
+				return nil, err
+			}
+			and.Filters = append(and.Filters, &Logical{Op: op, Filters: subs})
+		case FilterType_TEXT:
+			text, err := parseText(v)
+			if err != nil {
+				return nil, err
+			}
+			and.Filters = append(and.Filters, text)
+		default:
+			ops, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, invalidFilter(k, "", "expect an object of operators, got %T", v)
+			}
+			conds, err := parseConditions(k, ops)
+			if err != nil {
+				return nil, err
+			}
+			and.Filters = append(and.Filters, conds...)
+		}
+	}
+	return and, nil
+}
+
+func parseSubFilters(op FilterType, v interface{}) ([]Filter, error) {
+	var items []map[string]interface{}
+	switch vs := v.(type) {
+	case []map[string]interface{}:
+		items = vs
+	case []interface{}:
+		for _, item := range vs {
+			m, ok := item.(map[string]interface{})
+			if !ok {
+				return nil, invalidFilter(string(op), "", "expect an array of filters, got element %T", item)
+			}
+			items = append(items, m)
+		}
+	default:
+		return nil, invalidFilter(string(op), "", "expect an array of filters, got %T", v)
+	}
+	if len(items) == 0 {
+		return nil, invalidFilter(string(op), "", "empty array")
+	}
+
+	subs := []Filter{}
+	for _, item := range items {
+		sub, err := ParseFilter(item)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	return subs, nil
+}
+
+func parseConditions(field string, ops map[string]interface{}) ([]Filter, error) {
+	conds := []Filter{}
+	for _, k := range sortedKeys(ops) {
+		op, v := FilterType(k), ops[k]
+		switch op {
+		case FilterType_IN, FilterType_NOT_IN:
+			if kind := reflect.ValueOf(v).Kind(); v == nil || (kind != reflect.Slice && kind != reflect.Array) {
+				return nil, invalidFilter(field, op, "expect an array, got %T", v)
+			}
+		case FilterType_LIKE, FilterType_ILIKE, FilterType_NOT_LIKE:
+			if _, ok := v.(string); !ok {
+				return nil, invalidFilter(field, op, "expect a string, got %T", v)
+			}
+		case FilterType_MATCH:
+			if m, ok := v.(map[string]interface{}); ok {
+				if _, ok = m["pattern"].(string); !ok {
+					return nil, invalidFilter(field, op, "expect a pattern")
+				}
+			} else if _, ok := v.(string); !ok {
+				return nil, invalidFilter(field, op, "expect a pattern or {pattern, options}, got %T", v)
+			}
+		case FilterType_EXISTS:
+			if _, ok := v.(bool); !ok {
+				return nil, invalidFilter(field, op, "expect a bool, got %T", v)
+			}
+		case FilterType_SIZE:
+			if n, ok := toFloat(v); !ok || n != math.Trunc(n) {
+				return nil, invalidFilter(field, op, "expect an integer, got %v", v)
+			}
+		case FilterType_ELEM_MATCH:
+			elem, err := parseElemMatch(field, v)
+			if err != nil {
+				return nil, err
+			}
+			v = elem
+		case FilterType_GEO_WITHIN:
+			if _, ok := v.(map[string]interface{}); !ok {
+				return nil, invalidFilter(field, op, "expect a GeoJSON geometry or shape, got %T", v)
+			}
+		default:
+			if !IsFieldOperator(op) {
+				return nil, invalidFilter(field, op, "unknown operator")
+			}
+		}
+		conds = append(conds, &Condition{Field: field, Op: op, Value: v})
+	}
+	return conds, nil
+}
+
+// ELEM_MATCH 的值为运算符 (标量数组) 或元素字段的条件 (对象数组)
+func parseElemMatch(field string, v interface{}) (Filter, error) {
+	sub, ok := v.(map[string]interface{})
+	if !ok || len(sub) == 0 {
+		return nil, invalidFilter(field, FilterType_ELEM_MATCH, "expect a non-empty object, got %T", v)
+	}
+	for k := range sub {
+		if !IsFieldOperator(FilterType(k)) {
+			return ParseFilter(sub)
+		}
+	}
+	conds, err := parseConditions("", sub)
+	if err != nil {
+		return nil, err
+	}
+	return &Logical{Op: FilterType_AND, Filters: conds}, nil
+}
+
+func parseText(v interface{}) (*TextSearch, error) {
+	field := string(FilterType_TEXT)
+	switch m := v.(type) {
+	case string:
+		return &TextSearch{Search: m}, nil
+	case map[string]interface{}:
+		text := &TextSearch{}
+		for k, val := range m {
+			var ok bool
+			switch k {
+			case "search":
+				text.Search, ok = val.(string)
+			case "language":
+				text.Language, ok = val.(string)
+			case "caseSensitive":
+				text.CaseSensitive, ok = val.(bool)
+			case "diacriticSensitive":
+				text.DiacriticSensitive, ok = val.(bool)
+			default:
+				return nil, invalidFilter(field, "", "unknown option `%s`", k)
+			}
+			if !ok {
+				return nil, invalidFilter(field, "", "`%s` has wrong type %T", k, val)
+			}
+		}
+		if text.Search == "" {
+			return nil, invalidFilter(field, "", "empty search")
+		}
+		return text, nil
+	}
+	return nil, invalidFilter(field, "", "expect words or {search, language}, got %T", v)
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// FilterMap 将 Filter 转回 PageQuery.Filters 的 JSON 格式, 同一字段的运算合并到一起
+func FilterMap(f Filter) map[string]interface{} {
+	if f == nil {
+		return map[string]interface{}{}
+	}
+	switch t := f.(type) {
+	case *Condition:
+		return map[string]interface{}{t.Field: map[string]interface{}{string(t.Op): conditionValue(t)}}
+	case *TextSearch:
+		text := map[string]interface{}{"search": t.Search}
+		if t.Language != "" {
+			text["language"] = t.Language
+		}
+		if t.CaseSensitive {
+			text["caseSensitive"] = true
+		}
+		if t.DiacriticSensitive {
+			text["diacriticSensitive"] = true
+		}
+		return map[string]interface{}{string(FilterType_TEXT): text}
+	case *Logical:
+		subs := make([]interface{}, len(t.Filters))
+		for i, sub := range t.Filters {
+			subs[i] = FilterMap(sub)
+		}
+		if t.Op != FilterType_AND {
+			return map[string]interface{}{string(t.Op): subs}
+		}
+		if merged, ok := mergeFilterMaps(subs); ok {
+			return merged
+		}
+		return map[string]interface{}{string(FilterType_AND): subs}
+	}
+	return map[string]interface{}{}
+}
+
+func conditionValue(c *Condition) interface{} {
+	if sub, ok := c.Value.(Filter); ok && c.Op == FilterType_ELEM_MATCH {
+		m := FilterMap(sub)
+		// 作用于元素本身的运算符, 去掉空字段名
+		if ops, ok := m[""].(map[string]interface{}); ok && len(m) == 1 {
+			return ops
+		}
+		return m
+	}
+	return c.Value
+}
+
+// AND 的子条件没有冲突时合并为一个对象
+func mergeFilterMaps(subs []interface{}) (map[string]interface{}, bool) {
+	merged := map[string]interface{}{}
+	for _, sub := range subs {
+		for k, v := range sub.(map[string]interface{}) {
+			exist, ok := merged[k]
+			if !ok {
+				merged[k] = v
+				continue
+			}
+			existOps, ok1 := exist.(map[string]interface{})
+			ops, ok2 := v.(map[string]interface{})
+			if !ok1 || !ok2 || !IsFieldOperator(firstKey(ops)) {
+				return nil, false
+			}
+			union := map[string]interface{}{}
+			for op, val := range existOps {
+				union[op] = val
+			}
+			for op, val := range ops {
+				if _, dup := union[op]; dup {
+					return nil, false
+				}
+				union[op] = val
+			}
+			merged[k] = union
+		}
+	}
+	return merged, true
+}
+
+func firstKey(m map[string]interface{}) FilterType {
+	for k := range m {
+		return FilterType(k)
+	}
+	return ""
+}
+
+// FieldFilter 构造字段上的条件
+//
+//	data.And(data.Field("age").Gte(18), data.Field("nick").Like("^a"))
+type FieldFilter struct {
+	name string
+}
+
+func Field(name string) FieldFilter {
+	return FieldFilter{name: name}
+}
+
+func (f FieldFilter) Op(op FilterType, v interface{}) *Condition {
+	return &Condition{Field: f.name, Op: op, Value: v}
+}
+
+func (f FieldFilter) Eq(v interface{}) *Condition  { return f.Op(FilterType_EQ, v) }
+func (f FieldFilter) Ne(v interface{}) *Condition  { return f.Op(FilterType_NE, v) }
+func (f FieldFilter) Gt(v interface{}) *Condition  { return f.Op(FilterType_GT, v) }
+func (f FieldFilter) Gte(v interface{}) *Condition { return f.Op(FilterType_GTE, v) }
+func (f FieldFilter) Lt(v interface{}) *Condition  { return f.Op(FilterType_LT, v) }
+func (f FieldFilter) Lte(v interface{}) *Condition { return f.Op(FilterType_LTE, v) }
+
+func (f FieldFilter) In(vs ...interface{}) *Condition    { return f.Op(FilterType_IN, vs) }
+func (f FieldFilter) NotIn(vs ...interface{}) *Condition { return f.Op(FilterType_NOT_IN, vs) }
+
+func (f FieldFilter) Like(pattern string) *Condition    { return f.Op(FilterType_LIKE, pattern) }
+func (f FieldFilter) ILike(pattern string) *Condition   { return f.Op(FilterType_ILIKE, pattern) }
+func (f FieldFilter) NotLike(pattern string) *Condition { return f.Op(FilterType_NOT_LIKE, pattern) }
+
+// Match options 为 i, m, s 等正则选项
+func (f FieldFilter) Match(pattern string, options string) *Condition {
+	if options == "" {
+		return f.Op(FilterType_MATCH, pattern)
+	}
+	return f.Op(FilterType_MATCH, map[string]interface{}{"pattern": pattern, "options": options})
+}
+
+func (f FieldFilter) Exists(exists bool) *Condition { return f.Op(FilterType_EXISTS, exists) }
+func (f FieldFilter) Size(n int) *Condition         { return f.Op(FilterType_SIZE, n) }
+
+// ElemMatch sub 中 Field 为空的条件作用于数组元素本身, 如 data.Field("").Gte(80)
+func (f FieldFilter) ElemMatch(sub ...Filter) *Condition {
+	return f.Op(FilterType_ELEM_MATCH, And(sub...))
+}
+
+// GeoWithin geometry 为 GeoJSON 或 {"box"/"polygon"/"centerSphere": ...}
+func (f FieldFilter) GeoWithin(geometry map[string]interface{}) *Condition {
+	return f.Op(FilterType_GEO_WITHIN, geometry)
+}
+
+func And(filters ...Filter) *Logical {
+	return &Logical{Op: FilterType_AND, Filters: filters}
+}
+
+func Or(filters ...Filter) *Logical {
+	return &Logical{Op: FilterType_OR, Filters: filters}
+}
+
+func Nor(filters ...Filter) *Logical {
+	return &Logical{Op: FilterType_NOR, Filters: filters}
+}
+
+func Text(search string) *TextSearch {
+	return &TextSearch{Search: search}
+}
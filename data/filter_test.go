@@ -0,0 +1,167 @@
+package data
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type evalDoc struct {
+	Id      string                   `bson:"_id"`
+	Nick    string                   `bson:"nick"`
+	Age     int                      `bson:"age"`
+	Tags    []string                 `bson:"tags"`
+	Scores  []int                    `bson:"scores"`
+	Orders  []map[string]interface{} `bson:"orders"`
+	Ctime   time.Time                `bson:"ctime"`
+	Deleted *time.Time               `bson:"deletedAt,omitempty"`
+}
+
+func TestParseFilter(t *testing.T) {
+	tests := []string{
+		`{}`,
+		`{"age": {"GT": 1, "LT": 9}, "nick": {"EQ": "a"}}`,
+		`{"nick": {"ILIKE": "a", "NOT_LIKE": "b"}, "tags": {"IN": ["x"], "SIZE": 2}}`,
+		`{"nick": {"MATCH": {"pattern": "^a", "options": "i"}}, "deletedAt": {"EXISTS": false}}`,
+		`{"scores": {"ELEM_MATCH": {"GTE": 80}}, "orders": {"ELEM_MATCH": {"amount": {"GT": 1}}}}`,
+		`{"OR": [{"nick": {"EQ": "a"}}, {"age": {"LT": 3}}], "NOR": [{"age": {"EQ": 5}}]}`,
+		`{"TEXT": {"search": "coffee", "language": "en"}}`,
+		`{"loc": {"GEO_WITHIN": {"box": [[0, 0], [1, 1]]}}}`,
+	}
+	for _, s := range tests {
+		var filters map[string]interface{}
+		if err := json.Unmarshal([]byte(s), &filters); err != nil {
+			t.Fatal(err)
+		}
+		f, err := ParseFilter(filters)
+		if err != nil {
+			t.Errorf("%s: %v", s, err)
+			continue
+		}
+		// 转回 JSON 格式后不变
+		if m := FilterMap(f); !reflect.DeepEqual(m, filters) {
+			t.Errorf("%s: got %v", s, m)
+		}
+	}
+
+	invalid := []string{
+		`{"nick": "a"}`,
+		`{"nick": {"EQUALS": "a"}}`,
+		`{"tags": {"IN": "x"}}`,
+		`{"nick": {"LIKE": 1}}`,
+		`{"nick": {"EXISTS": "yes"}}`,
+		`{"tags": {"SIZE": 1.5}}`,
+		`{"scores": {"ELEM_MATCH": {}}}`,
+		`{"OR": []}`,
+		`{"AND": [1]}`,
+		`{"TEXT": {"search": "a", "fuzzy": true}}`,
+	}
+	for _, s := range invalid {
+		var filters map[string]interface{}
+		if err := json.Unmarshal([]byte(s), &filters); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ParseFilter(filters); !errors.Is(err, ErrInvalidFilter) {
+			t.Errorf("%s: expect invalid filter, got %v", s, err)
+		}
+	}
+}
+
+func TestBuilderFilterMap(t *testing.T) {
+	f := And(
+		Field("age").Gte(18),
+		Field("age").Lt(60),
+		Or(Field("nick").ILike("^a"), Field("tags").In("x", "y")),
+		Field("scores").ElemMatch(Field("").Gt(90)),
+	)
+	expected := map[string]interface{}{
+		"age": map[string]interface{}{"GTE": 18, "LT": 60},
+		"OR": []interface{}{
+			map[string]interface{}{"nick": map[string]interface{}{"ILIKE": "^a"}},
+			map[string]interface{}{"tags": map[string]interface{}{"IN": []interface{}{"x", "y"}}},
+		},
+		"scores": map[string]interface{}{"ELEM_MATCH": map[string]interface{}{"GT": 90}},
+	}
+	if m := FilterMap(f); !reflect.DeepEqual(m, expected) {
+		t.Fatalf("%#v\nexpected:\n%#v", m, expected)
+	}
+
+	// 相同的运算不能合并
+	m := FilterMap(And(Field("age").Gt(1), Field("age").Gt(2)))
+	if _, ok := m["AND"]; !ok {
+		t.Fatalf("expect AND, got %v", m)
+	}
+}
+
+func TestEvaluator(t *testing.T) {
+	now := time.Now()
+	docs := []*evalDoc{
+		{Id: "1", Nick: "alice", Age: 20, Tags: []string{"a", "b"}, Scores: []int{70, 95}, Ctime: now,
+			Orders: []map[string]interface{}{{"amount": 10, "state": "paid"}}},
+		{Id: "2", Nick: "Bob", Age: 35, Tags: []string{"b"}, Scores: []int{60}, Ctime: now.Add(-time.Hour), Deleted: &now},
+		{Id: "3", Nick: "carol", Age: 50, Ctime: now.Add(time.Hour),
+			Orders: []map[string]interface{}{{"amount": 5, "state": "paid"}, {"amount": 30, "state": "new"}}},
+	}
+
+	tests := []struct {
+		name     string
+		filter   Filter
+		expected []string
+	}{
+		{"all", nil, []string{"1", "2", "3"}},
+		{"EQ", Field("nick").Eq("Bob"), []string{"2"}},
+		{"NE", Field("age").Ne(35), []string{"1", "3"}},
+		{"range", And(Field("age").Gt(20), Field("age").Lte(50.0)), []string{"2", "3"}},
+		{"time", Field("ctime").Gte(now), []string{"1", "3"}},
+		{"IN", Field("age").In(20, int64(50)), []string{"1", "3"}},
+		{"NOT_IN", Field("age").NotIn(20), []string{"2", "3"}},
+		{"array EQ", Field("tags").Eq("b"), []string{"1", "2"}},
+		{"array NE", Field("tags").Ne("a"), []string{"2", "3"}},
+		{"LIKE", Field("nick").Like("^[a-c]"), []string{"1", "3"}},
+		{"ILIKE", Field("nick").ILike("^b"), []string{"2"}},
+		{"NOT_LIKE", Field("nick").NotLike("o"), []string{"1"}},
+		{"MATCH", Field("nick").Match("^A", "i"), []string{"1"}},
+		{"EXISTS", Field("deletedAt").Exists(false), []string{"1", "3"}},
+		{"missing EQ nil", Field("deletedAt").Eq(nil), []string{"1", "3"}},
+		{"SIZE", Field("tags").Size(2), []string{"1"}},
+		{"ELEM_MATCH scalar", Field("scores").ElemMatch(Field("").Gt(90)), []string{"1"}},
+		{"ELEM_MATCH object", Field("orders").ElemMatch(Field("amount").Gt(8), Field("state").Eq("new")), []string{"3"}},
+		{"nested path", Field("orders.state").Eq("paid"), []string{"1", "3"}},
+		{"OR", Or(Field("age").Lt(25), Field("age").Gt(45)), []string{"1", "3"}},
+		{"NOR", Nor(Field("age").Lt(25), Field("age").Gt(45)), []string{"2"}},
+	}
+
+	e := NewEvaluator("bson")
+	for _, test := range tests {
+		list, err := Select(e, test.filter, docs)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		ids := []string{}
+		for _, doc := range list {
+			ids = append(ids, doc.Id)
+		}
+		if !reflect.DeepEqual(ids, test.expected) {
+			t.Errorf("%s: got %v, expected %v", test.name, ids, test.expected)
+		}
+	}
+
+	// JSON 解析的条件在 map 文档上执行
+	var filters map[string]interface{}
+	json.Unmarshal([]byte(`{"age": {"GTE": 30}, "OR": [{"nick": {"ILIKE": "^b"}}]}`), &filters)
+	f, err := ParseFilter(filters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err := e.Match(f, map[string]interface{}{"nick": "bob", "age": int64(30)})
+	if err != nil || !ok {
+		t.Fatalf("expect match, got %v %v", ok, err)
+	}
+
+	if _, err = e.Match(Text("coffee"), docs[0]); !errors.Is(err, ErrUnsupportedFilter) {
+		t.Fatalf("expect unsupported, got %v", err)
+	}
+}
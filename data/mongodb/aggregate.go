@@ -0,0 +1,234 @@
+package mongodb
+
+import (
+	"context"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/mofancloud/xmicro/data"
+)
+
+// Aggregation 聚合管道构造器, m 决定在哪个库和集合上执行, 以及 filters 的字段类型
+//
+//	agg := NewAggregation(&Order{TenantId: "t1"}).
+//		MatchFilters(pageQuery.Filters).
+//		Group("$status", bson.M{"count": bson.M{"$sum": 1}}).
+//		SortBy("-count")
+type Aggregation struct {
+	m            Model
+	stages       []bson.M
+	allowDiskUse bool
+	err          error // 构造时的第一个错误, 执行时返回
+}
+
+// Constructor
+func NewAggregation(m Model) *Aggregation {
+	return &Aggregation{m: m, stages: []bson.M{}}
+}
+
+// Pipeline 生成的管道
+func (self *Aggregation) Pipeline() []bson.M {
+	return self.stages
+}
+
+// Err 构造管道时的错误, 如 filters 不正确
+func (self *Aggregation) Err() error {
+	return self.err
+}
+
+func (self *Aggregation) Stage(stage bson.M) *Aggregation {
+	self.stages = append(self.stages, stage)
+	return self
+}
+
+func (self *Aggregation) Match(criteria bson.M) *Aggregation {
+	return self.Stage(bson.M{"$match": criteria})
+}
+
+// MatchFilters 按 data.PageQuery.Filters 构造 $match, 没有条件时不加
+func (self *Aggregation) MatchFilters(filters map[string]interface{}) *Aggregation {
+	criteria, err := BuildCriteria(self.m, filters)
+	if err != nil {
+		if self.err == nil {
+			self.err = err
+		}
+		return self
+	}
+	if len(criteria) == 0 {
+		return self
+	}
+	return self.Match(criteria)
+}
+
+// Group id 为分组键, 如 "$status" 或 bson.M{"y": "$year"}, accumulators 为其余字段
+func (self *Aggregation) Group(id interface{}, accumulators bson.M) *Aggregation {
+	group := bson.M{"_id": id}
+	for k, v := range accumulators {
+		group[k] = v
+	}
+	return self.Stage(bson.M{"$group": group})
+}
+
+func (self *Aggregation) Lookup(from, localField, foreignField, as string) *Aggregation {
+	return self.Stage(bson.M{"$lookup": bson.M{
+		"from":         from,
+		"localField":   localField,
+		"foreignField": foreignField,
+		"as":           as,
+	}})
+}
+
+func (self *Aggregation) Project(fields bson.M) *Aggregation {
+	return self.Stage(bson.M{"$project": fields})
+}
+
+// Unwind path 不带 $ 前缀时自动补上
+func (self *Aggregation) Unwind(path string, preserveNullAndEmptyArrays bool) *Aggregation {
+	if !strings.HasPrefix(path, "$") {
+		path = "$" + path
+	}
+	if !preserveNullAndEmptyArrays {
+		return self.Stage(bson.M{"$unwind": path})
+	}
+	return self.Stage(bson.M{"$unwind": bson.M{
+		"path":                       path,
+		"preserveNullAndEmptyArrays": true,
+	}})
+}
+
+// Facet 每个子管道在同一批输入上执行, 子管道的 Model 被忽略
+func (self *Aggregation) Facet(facets map[string]*Aggregation) *Aggregation {
+	facet := bson.M{}
+	for name, sub := range facets {
+		if sub.err != nil && self.err == nil {
+			self.err = sub.err
+		}
+		facet[name] = sub.Pipeline()
+	}
+	return self.Stage(bson.M{"$facet": facet})
+}
+
+// Sort 按 data.SortSpec 排序, 与 ParsePageQuery 的规则一致
+func (self *Aggregation) Sort(specs ...*data.SortSpec) *Aggregation {
+	sorts := []string{}
+	for _, s := range specs {
+		if s.Type == data.SortType_DSC {
+			sorts = append(sorts, "-"+s.Property)
+		} else {
+			sorts = append(sorts, s.Property)
+		}
+	}
+	return self.SortBy(sorts...)
+}
+
+// SortBy 字段前加 - 为降序, 同 mgo 的 Query.Sort
+func (self *Aggregation) SortBy(fields ...string) *Aggregation {
+	if len(fields) == 0 {
+		return self
+	}
+	sort := bson.D{}
+	for _, f := range fields {
+		if strings.HasPrefix(f, "-") {
+			sort = append(sort, bson.DocElem{Name: f[1:], Value: -1})
+		} else {
+			sort = append(sort, bson.DocElem{Name: strings.TrimPrefix(f, "+"), Value: 1})
+		}
+	}
+	return self.Stage(bson.M{"$sort": sort})
+}
+
+func (self *Aggregation) Skip(n int64) *Aggregation {
+	return self.Stage(bson.M{"$skip": n})
+}
+
+func (self *Aggregation) Limit(n int64) *Aggregation {
+	return self.Stage(bson.M{"$limit": n})
+}
+
+// AllowDiskUse 允许大的 $group/$sort 使用临时文件
+func (self *Aggregation) AllowDiskUse() *Aggregation {
+	self.allowDiskUse = true
+	return self
+}
+
+// All 执行管道, result 为 slice 的指针
+func (self *Aggregation) All(ctx context.Context, repo MongoRepository, result interface{}) error {
+	if self.err != nil {
+		return self.err
+	}
+	if dr, ok := repo.(DriverRepository); ok {
+		return dr.ExecuteDriverContext(ctx, self.m, func(ctx context.Context, c *mongo.Collection) error {
+			opts := options.Aggregate()
+			if self.allowDiskUse {
+				opts.SetAllowDiskUse(true)
+			}
+			cursor, err := c.Aggregate(ctx, self.stages, opts)
+			if err != nil {
+				return err
+			}
+			return cursor.All(ctx, result)
+		})
+	}
+	out, commit := shadow(result)
+	err := repo.ExecuteContext(ctx, self.m, func(c *mgo.Collection) error {
+		pipe := c.Pipe(self.stages)
+		if self.allowDiskUse {
+			pipe = pipe.AllowDiskUse()
+		}
+		return pipe.All(out)
+	})
+	if err == nil {
+		commit()
+	}
+	return err
+}
+
+// One 取第一条结果, 没有结果时返回 mgo.ErrNotFound
+func (self *Aggregation) One(ctx context.Context, repo MongoRepository, result interface{}) error {
+	if self.err != nil {
+		return self.err
+	}
+	if dr, ok := repo.(DriverRepository); ok {
+		return dr.ExecuteDriverContext(ctx, self.m, func(ctx context.Context, c *mongo.Collection) error {
+			opts := options.Aggregate()
+			if self.allowDiskUse {
+				opts.SetAllowDiskUse(true)
+			}
+			cursor, err := c.Aggregate(ctx, self.stages, opts)
+			if err != nil {
+				return err
+			}
+			defer cursor.Close(ctx)
+			if !cursor.Next(ctx) {
+				if err = cursor.Err(); err != nil {
+					return err
+				}
+				return mgo.ErrNotFound
+			}
+			return cursor.Decode(result)
+		})
+	}
+	out, commit := shadow(result)
+	err := repo.ExecuteContext(ctx, self.m, func(c *mgo.Collection) error {
+		pipe := c.Pipe(self.stages)
+		if self.allowDiskUse {
+			pipe = pipe.AllowDiskUse()
+		}
+		return pipe.One(out)
+	})
+	if err == nil {
+		commit()
+	}
+	return err
+}
+
+// Aggregate 执行管道并返回类型为 R 的结果
+func Aggregate[R any](ctx context.Context, repo MongoRepository, agg *Aggregation) ([]R, error) {
+	list := []R{}
+	err := agg.All(ctx, repo, &list)
+	return list, err
+}
@@ -0,0 +1,53 @@
+package mongodb
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/mofancloud/xmicro/data"
+)
+
+func TestAggregationPipeline(t *testing.T) {
+	agg := NewAggregation(&User{TenantId: "t1"}).
+		MatchFilters(map[string]interface{}{"age": map[string]interface{}{"GTE": 18}}).
+		Lookup("orders", "_id", "userId", "orders").
+		Unwind("orders", false).
+		Group("$type", bson.M{"count": bson.M{"$sum": 1}, "amount": bson.M{"$sum": "$orders.amount"}}).
+		Project(bson.M{"count": 1, "amount": 1}).
+		Sort(&data.SortSpec{Property: "amount", Type: data.SortType_DSC}, &data.SortSpec{Property: "_id"}).
+		Facet(map[string]*Aggregation{
+			"top":   NewAggregation(nil).Limit(3),
+			"total": NewAggregation(nil).Stage(bson.M{"$count": "n"}),
+		}).
+		AllowDiskUse()
+
+	expected := []bson.M{
+		{"$match": bson.M{"age": bson.M{"$gte": 18}}},
+		{"$lookup": bson.M{"from": "orders", "localField": "_id", "foreignField": "userId", "as": "orders"}},
+		{"$unwind": "$orders"},
+		{"$group": bson.M{"_id": "$type", "count": bson.M{"$sum": 1}, "amount": bson.M{"$sum": "$orders.amount"}}},
+		{"$project": bson.M{"count": 1, "amount": 1}},
+		{"$sort": bson.D{{Name: "amount", Value: -1}, {Name: "_id", Value: 1}}},
+		{"$facet": bson.M{
+			"top":   []bson.M{{"$limit": int64(3)}},
+			"total": []bson.M{{"$count": "n"}},
+		}},
+	}
+
+	if !reflect.DeepEqual(agg.Pipeline(), expected) {
+		t.Errorf("pipeline:\n%v\nexpected:\n%v", agg.Pipeline(), expected)
+	}
+	if !agg.allowDiskUse {
+		t.Errorf("allowDiskUse not set")
+	}
+
+	agg = NewAggregation(&User{}).MatchFilters(nil).Unwind("$tags", true)
+	expected = []bson.M{
+		{"$unwind": bson.M{"path": "$tags", "preserveNullAndEmptyArrays": true}},
+	}
+	if !reflect.DeepEqual(agg.Pipeline(), expected) {
+		t.Errorf("pipeline: %v", agg.Pipeline())
+	}
+}
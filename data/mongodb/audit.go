@@ -0,0 +1,150 @@
+package mongodb
+
+import (
+	"context"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/mofancloud/xmicro/data"
+)
+
+const (
+	FieldCreatedAt = "createdAt"
+	FieldUpdatedAt = "updatedAt"
+	FieldDeletedAt = "deletedAt"
+)
+
+// Timestamped Insert 时设置 createdAt 和 updatedAt, Update/UpdateSelective/Upsert 时设置 updatedAt,
+// Upsert 只在插入时写入 createdAt. bson 字段名需为 createdAt, updatedAt
+type Timestamped interface {
+	Model
+	GetCreatedAt() time.Time
+	SetCreatedAt(t time.Time)
+	SetUpdatedAt(t time.Time)
+}
+
+// SoftDeletable Delete 时只设置 deletedAt, All/Count/FindOne/Page 默认排除已删除的文档,
+// bson 字段名需为 deletedAt, 如 DeletedAt *time.Time `bson:"deletedAt,omitempty"`
+type SoftDeletable interface {
+	Model
+	SetDeletedAt(t time.Time)
+}
+
+type includeDeletedKey struct{}
+
+// IncludeDeleted 在 ctx 上标记查询包含软删除的文档
+func IncludeDeleted(ctx context.Context) context.Context {
+	return context.WithValue(ctx, includeDeletedKey{}, true)
+}
+
+func excludeDeleted(ctx context.Context, m Model) bool {
+	if _, ok := m.(SoftDeletable); !ok {
+		return false
+	}
+	include, _ := ctx.Value(includeDeletedKey{}).(bool)
+	return !include
+}
+
+// notDeleted 在条件上排除软删除的文档. 条件中已有 deletedAt 时与排除条件一起放入 $and,
+// 客户端的 deletedAt 条件不能替换掉排除条件, 需要包含已删除的文档时使用 IncludeDeleted
+func notDeleted(ctx context.Context, m Model, criteria bson.M) bson.M {
+	if !excludeDeleted(ctx, m) {
+		return criteria
+	}
+	if _, ok := criteria[FieldDeletedAt]; ok {
+		return bson.M{"$and": []bson.M{{FieldDeletedAt: nil}, criteria}}
+	}
+	out := bson.M{FieldDeletedAt: nil}
+	for k, v := range criteria {
+		out[k] = v
+	}
+	return out
+}
+
+// notDeletedFilters 同 notDeleted, 用于 data.PageQuery 格式的 Filters, 用 AND 组合
+func notDeletedFilters(ctx context.Context, m Model, filters map[string]interface{}) map[string]interface{} {
+	if !excludeDeleted(ctx, m) {
+		return filters
+	}
+	exclusion := map[string]interface{}{
+		FieldDeletedAt: map[string]interface{}{string(data.FilterType_EQ): nil},
+	}
+	if _, ok := filters[FieldDeletedAt]; ok {
+		return map[string]interface{}{
+			string(data.FilterType_AND): []map[string]interface{}{exclusion, filters},
+		}
+	}
+	out := exclusion
+	for k, v := range filters {
+		out[k] = v
+	}
+	return out
+}
+
+func stampInsert(m Model) {
+	if tm, ok := m.(Timestamped); ok {
+		now := time.Now()
+		if tm.GetCreatedAt().IsZero() {
+			tm.SetCreatedAt(now)
+		}
+		tm.SetUpdatedAt(now)
+	}
+}
+
+func stampUpdate(m Model) {
+	if tm, ok := m.(Timestamped); ok {
+		tm.SetUpdatedAt(time.Now())
+	}
+}
+
+// upsertUpdate Upsert 的更新内容, set 为 nil 时 $set 整个 Model.
+// Timestamped 的 createdAt 改用 $setOnInsert, 更新已有文档时不覆盖创建时间
+func upsertUpdate(m Model, set bson.M) (bson.M, error) {
+	tm, ok := m.(Timestamped)
+	if !ok {
+		if set != nil {
+			return bson.M{"$set": set}, nil
+		}
+		// 转为文档, 执行时不再读取 m
+		doc, err := toDocument(m)
+		if err != nil {
+			return nil, err
+		}
+		return bson.M{"$set": doc}, nil
+	}
+
+	doc := bson.M{}
+	if set == nil {
+		var err error
+		if doc, err = toDocument(m); err != nil {
+			return nil, err
+		}
+	} else {
+		// 调用方指定了 createdAt 时按其设置
+		if _, ok := set[FieldCreatedAt]; ok {
+			return bson.M{"$set": set}, nil
+		}
+		for k, v := range set {
+			doc[k] = v
+		}
+	}
+	delete(doc, FieldCreatedAt)
+	return bson.M{"$set": doc, "$setOnInsert": bson.M{FieldCreatedAt: tm.GetCreatedAt()}}, nil
+}
+
+// stampSet 在 $set 的内容上加上 updatedAt, 不修改 set
+func stampSet(m Model, set bson.M) bson.M {
+	tm, ok := m.(Timestamped)
+	if !ok {
+		return set
+	}
+	now := time.Now()
+	tm.SetUpdatedAt(now)
+
+	out := bson.M{FieldUpdatedAt: now}
+	for k, v := range set {
+		out[k] = v
+	}
+	return out
+}
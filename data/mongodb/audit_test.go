@@ -0,0 +1,98 @@
+package mongodb
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+type Post struct {
+	Id        bson.ObjectId `bson:"_id"`
+	Title     string        `bson:"title"`
+	CreatedAt time.Time     `bson:"createdAt"`
+	UpdatedAt time.Time     `bson:"updatedAt"`
+	DeletedAt *time.Time    `bson:"deletedAt,omitempty"`
+}
+
+func (self *Post) Database() string {
+	return "cms"
+}
+
+func (self *Post) Collection() string {
+	return "posts"
+}
+
+func (self *Post) Unique() bson.M {
+	return bson.M{"_id": self.Id}
+}
+
+func (self *Post) GetCreatedAt() time.Time {
+	return self.CreatedAt
+}
+
+func (self *Post) SetCreatedAt(t time.Time) {
+	self.CreatedAt = t
+}
+
+func (self *Post) SetUpdatedAt(t time.Time) {
+	self.UpdatedAt = t
+}
+
+func (self *Post) SetDeletedAt(t time.Time) {
+	self.DeletedAt = &t
+}
+
+func TestSoftDeleteCriteria(t *testing.T) {
+	ctx := context.Background()
+	p := &Post{Id: bson.NewObjectId()}
+
+	if c := notDeleted(ctx, p, p.Unique()); !reflect.DeepEqual(c, bson.M{"_id": p.Id, "deletedAt": nil}) {
+		t.Errorf("criteria: %v", c)
+	}
+	if c := notDeleted(IncludeDeleted(ctx), p, p.Unique()); !reflect.DeepEqual(c, p.Unique()) {
+		t.Errorf("criteria including deleted: %v", c)
+	}
+	if c := notDeleted(ctx, &User{}, nil); c != nil {
+		t.Errorf("criteria of plain model: %v", c)
+	}
+
+	filters := notDeletedFilters(ctx, p, map[string]interface{}{"title": map[string]interface{}{"EQ": "a"}})
+	criteria, _ := BuildCriteria(p, filters)
+	expected := bson.M{"title": bson.M{"$eq": "a"}, "deletedAt": bson.M{"$eq": nil}}
+	if !reflect.DeepEqual(criteria, expected) {
+		t.Errorf("filters: %v", criteria)
+	}
+
+	// 客户端的 deletedAt 条件不能替换掉排除条件
+	deleted := bson.M{"deletedAt": bson.M{"$ne": nil}}
+	if c := notDeleted(ctx, p, deleted); !reflect.DeepEqual(c, bson.M{"$and": []bson.M{{"deletedAt": nil}, deleted}}) {
+		t.Errorf("criteria with deletedAt: %v", c)
+	}
+	filters = notDeletedFilters(ctx, p, map[string]interface{}{"deletedAt": map[string]interface{}{"NE": nil}})
+	criteria, _ = BuildCriteria(p, filters)
+	expected = bson.M{"deletedAt": bson.M{"$eq": nil, "$ne": nil}}
+	if !reflect.DeepEqual(criteria, expected) {
+		t.Errorf("filters with deletedAt: %v", criteria)
+	}
+}
+
+func TestTimestamps(t *testing.T) {
+	p := &Post{}
+	stampInsert(p)
+	if p.CreatedAt.IsZero() || !p.UpdatedAt.Equal(p.CreatedAt) {
+		t.Errorf("insert stamps: %v", p)
+	}
+
+	created := p.CreatedAt
+	set := stampSet(p, bson.M{"title": "b"})
+	if set["title"] != "b" || set["updatedAt"] != p.UpdatedAt || !p.CreatedAt.Equal(created) {
+		t.Errorf("set stamps: %v, %v", set, p)
+	}
+
+	if set = stampSet(&User{}, bson.M{"nick": "c"}); len(set) != 1 {
+		t.Errorf("set of plain model: %v", set)
+	}
+}
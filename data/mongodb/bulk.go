@@ -0,0 +1,475 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// DefaultBulkBatchSize 每批最多的操作数, 同 mgo 单次 bulk 的上限
+var DefaultBulkBatchSize = 1000
+
+type BulkOpType string
+
+const (
+	BulkOpInsert BulkOpType = "insert"
+	BulkOpUpdate BulkOpType = "update"
+	BulkOpUpsert BulkOpType = "upsert"
+	BulkOpDelete BulkOpType = "delete"
+)
+
+// BulkOp 批量写中的一个操作, 都按 Model.Unique() 匹配, delete 为物理删除.
+// Versioned 的 update/upsert 同 Update/Upsert 匹配当前版本, 成功后版本加 1, 版本冲突时该操作返回 ErrConcurrentModification
+type BulkOp struct {
+	Type   BulkOpType
+	Model  Model
+	Update map[string]interface{} // 为空时 $set 整个 Model, 否则 $set Update, 同 UpdateSelective
+
+	// 以下由 runBulk 的 prepare 设置
+	selector  bson.M
+	doc       bson.M // update/upsert 的更新内容
+	versioned bool
+}
+
+func InsertOp(m Model) BulkOp {
+	return BulkOp{Type: BulkOpInsert, Model: m}
+}
+
+func UpdateOp(m Model) BulkOp {
+	return BulkOp{Type: BulkOpUpdate, Model: m}
+}
+
+func UpdateSelectiveOp(m Model, updateData map[string]interface{}) BulkOp {
+	return BulkOp{Type: BulkOpUpdate, Model: m, Update: updateData}
+}
+
+func UpsertOp(m Model) BulkOp {
+	return BulkOp{Type: BulkOpUpsert, Model: m}
+}
+
+func DeleteOp(m Model) BulkOp {
+	return BulkOp{Type: BulkOpDelete, Model: m}
+}
+
+// prepare 设置时间戳并计算匹配条件和更新内容, 带版本的 update/upsert 匹配当前版本, 之后 Model 的版本加 1
+func (op BulkOp) prepare() (BulkOp, error) {
+	switch op.Type {
+	case BulkOpInsert:
+		stampInsert(op.Model)
+		return op, nil
+	case BulkOpUpsert:
+		stampInsert(op.Model)
+	case BulkOpUpdate:
+		stampUpdate(op.Model)
+	}
+	op.selector = op.Model.Unique()
+	if op.Type == BulkOpDelete {
+		return op, nil
+	}
+
+	set := bson.M(op.Update)
+	vm, versioned := op.Model.(Versioned)
+	if versioned {
+		op.versioned = true
+		op.selector = versionSelector(vm)
+		if op.Update != nil {
+			set = versionedSet(vm, op.Update)
+		}
+		vm.SetVersion(vm.GetVersion() + 1)
+	}
+	if op.Update != nil {
+		set = stampSet(op.Model, set)
+	}
+
+	if op.Type != BulkOpUpsert {
+		if set != nil {
+			op.doc = bson.M{"$set": set}
+		} else {
+			op.doc = bson.M{"$set": op.Model}
+		}
+		return op, nil
+	}
+	var err error
+	if op.doc, err = upsertUpdate(op.Model, set); err != nil && versioned {
+		vm.SetVersion(vm.GetVersion() - 1)
+	}
+	return op, err
+}
+
+func (op BulkOp) update() bson.M {
+	return op.doc
+}
+
+// checkVersion 带版本的 update 没有匹配到文档时为版本冲突
+func (op BulkOp) checkVersion(matched int) error {
+	if op.versioned && op.Type == BulkOpUpdate && matched == 0 {
+		return ErrConcurrentModification
+	}
+	return nil
+}
+
+// versionConflict 带版本的 upsert 不匹配时按 selector 插入, 与已有文档的唯一键冲突
+func (op BulkOp) versionConflict(err error, dup bool) error {
+	if op.versioned && op.Type == BulkOpUpsert && dup {
+		return ErrConcurrentModification
+	}
+	return err
+}
+
+// bulkSegments 把一批操作分成依次执行的段, 带版本的 update 单独成段, 以便按匹配数判断版本冲突.
+// byType 为 true 时同一段内的操作类型相同
+func bulkSegments(batch []BulkOp, byType bool) [][2]int {
+	alone := func(op BulkOp) bool {
+		return op.versioned && op.Type == BulkOpUpdate
+	}
+	segments := [][2]int{}
+	for start := 0; start < len(batch); {
+		end := start + 1
+		for !alone(batch[start]) && end < len(batch) && !alone(batch[end]) &&
+			(!byType || batch[end].Type == batch[start].Type) {
+			end++
+		}
+		segments = append(segments, [2]int{start, end})
+		start = end
+	}
+	return segments
+}
+
+type BulkOptions struct {
+	Ordered   bool // 有序时遇到错误即停止, 后面的操作不执行
+	BatchSize int  // 默认 DefaultBulkBatchSize
+}
+
+// BulkOpResult 单个操作的结果
+type BulkOpResult struct {
+	Index      int
+	Type       BulkOpType
+	UpsertedId interface{} // upsert 插入时的 _id, mgo 不返回
+	Err        error
+	Skipped    bool // 有序模式下前面的操作失败, 未执行
+}
+
+type BulkResult struct {
+	Inserted int
+	Matched  int
+	Modified int
+	Upserted int // mgo 不区分, upsert 插入的计入 Matched
+	Deleted  int
+	// mgo 的 update/upsert/delete 分段有操作失败时不返回计数, 这时为 true, Matched/Modified/Deleted 不包含这些分段
+	CountsUnknown bool
+	Results       []BulkOpResult
+}
+
+type BulkErrorCase struct {
+	Index int
+	Err   error
+}
+
+// BulkError 部分操作失败, 其余操作的结果仍在 BulkResult 中.
+// WriteConcernErr 不为空时操作已执行, 但没有满足写关注, 如未复制到足够的节点
+type BulkError struct {
+	Cases           []BulkErrorCase
+	WriteConcernErr error
+}
+
+func (e *BulkError) Error() string {
+	msgs := make([]string, 0, len(e.Cases)+1)
+	for _, c := range e.Cases {
+		msgs = append(msgs, fmt.Sprintf("#%d: %v", c.Index, c.Err))
+	}
+	if e.WriteConcernErr != nil {
+		msgs = append(msgs, fmt.Sprintf("write concern: %v", e.WriteConcernErr))
+	}
+	return fmt.Sprintf("bulk write failed: %s", strings.Join(msgs, "; "))
+}
+
+// Indexes 失败的操作在 ops 中的下标
+func (e *BulkError) Indexes() []int {
+	idxs := make([]int, 0, len(e.Cases))
+	for _, c := range e.Cases {
+		idxs = append(idxs, c.Index)
+	}
+	return idxs
+}
+
+// ErrBulkCollectionMismatch 一次 BulkWrite 的 Model 需在同一个集合
+var ErrBulkCollectionMismatch = errors.New("bulk operations must target the same collection")
+
+// 一批操作的结果, 下标为批内下标
+type bulkBatchResult struct {
+	inserted, matched, modified, upserted, deleted int
+	countsUnknown                                  bool
+	upsertedIds                                    map[int]interface{}
+	errs                                           map[int]error
+	writeConcernErr                                error
+}
+
+type bulkBatchFunc func(batch []BulkOp, ordered bool) (*bulkBatchResult, error)
+
+// runBulk 分批执行并汇总结果, run 返回 error 且没有结果时整体中止
+func runBulk(ops []BulkOp, opts *BulkOptions, run bulkBatchFunc) (*BulkResult, error) {
+	if opts == nil {
+		opts = &BulkOptions{}
+	}
+	size := opts.BatchSize
+	if size <= 0 {
+		size = DefaultBulkBatchSize
+	}
+
+	result := &BulkResult{Results: make([]BulkOpResult, len(ops))}
+	for i, op := range ops {
+		if op.Model.Database() != ops[0].Model.Database() || op.Model.Collection() != ops[0].Model.Collection() {
+			return nil, ErrBulkCollectionMismatch
+		}
+		result.Results[i] = BulkOpResult{Index: i, Type: op.Type}
+	}
+	// 不修改调用方的 ops
+	prepared := make([]BulkOp, 0, len(ops))
+	// 失败和未执行的操作恢复版本
+	defer func() {
+		for i, op := range prepared {
+			if r := result.Results[i]; op.versioned && (r.Err != nil || r.Skipped) {
+				vm := op.Model.(Versioned)
+				vm.SetVersion(vm.GetVersion() - 1)
+			}
+		}
+	}()
+	for i, op := range ops {
+		p, err := op.prepare()
+		if err != nil {
+			for j := range result.Results {
+				result.Results[j].Skipped = true
+			}
+			return result, fmt.Errorf("bulk operation #%d: %w", i, err)
+		}
+		prepared = append(prepared, p)
+	}
+	ops = prepared
+
+	bulkErr := &BulkError{}
+	for start := 0; start < len(ops); start += size {
+		end := start + size
+		if end > len(ops) {
+			end = len(ops)
+		}
+
+		br, err := run(ops[start:end], opts.Ordered)
+		if br == nil {
+			for i := start; i < len(ops); i++ {
+				result.Results[i].Skipped = true
+			}
+			return result, err
+		}
+
+		result.Inserted += br.inserted
+		result.Matched += br.matched
+		result.Modified += br.modified
+		result.Upserted += br.upserted
+		result.Deleted += br.deleted
+		result.CountsUnknown = result.CountsUnknown || br.countsUnknown
+		if br.writeConcernErr != nil && bulkErr.WriteConcernErr == nil {
+			bulkErr.WriteConcernErr = br.writeConcernErr
+		}
+		for i, id := range br.upsertedIds {
+			result.Results[start+i].UpsertedId = id
+		}
+
+		failed := -1
+		for i := 0; i < end-start; i++ {
+			if e, ok := br.errs[i]; ok {
+				result.Results[start+i].Err = e
+				bulkErr.Cases = append(bulkErr.Cases, BulkErrorCase{Index: start + i, Err: e})
+				if failed < 0 {
+					failed = start + i
+				}
+			}
+		}
+		if opts.Ordered && failed >= 0 {
+			for i := failed + 1; i < len(ops); i++ {
+				result.Results[i].Skipped = true
+			}
+			break
+		}
+	}
+
+	if len(bulkErr.Cases) > 0 || bulkErr.WriteConcernErr != nil {
+		return result, bulkErr
+	}
+	return result, nil
+}
+
+// mgoBulkBatch mgo 的 Bulk 失败时不返回计数, 所以按连续的同类操作分段执行,
+// 失败的 update/upsert/delete 分段计数未知, 设置 countsUnknown 而不是按 0 计
+func mgoBulkBatch(c *mgo.Collection) bulkBatchFunc {
+	return func(batch []BulkOp, ordered bool) (*bulkBatchResult, error) {
+		br := &bulkBatchResult{errs: map[int]error{}}
+
+		for _, seg := range bulkSegments(batch, true) {
+			start, end := seg[0], seg[1]
+			bulk := c.Bulk()
+			if !ordered {
+				bulk.Unordered()
+			}
+			for _, op := range batch[start:end] {
+				switch op.Type {
+				case BulkOpInsert:
+					bulk.Insert(op.Model)
+				case BulkOpUpdate:
+					bulk.Update(op.selector, op.update())
+				case BulkOpUpsert:
+					bulk.Upsert(op.selector, op.update())
+				case BulkOpDelete:
+					bulk.Remove(op.selector)
+				default:
+					return nil, fmt.Errorf("unknown bulk operation `%s`", op.Type)
+				}
+			}
+
+			r, err := bulk.Run()
+			if err != nil {
+				berr, ok := err.(*mgo.BulkError)
+				if !ok {
+					if start == 0 {
+						return nil, err
+					}
+					// 前面的分段已执行, 本段及之后按失败处理
+					for i := start; i < len(batch); i++ {
+						br.errs[i] = err
+					}
+					return br, nil
+				}
+				for _, ec := range berr.Cases() {
+					idx := ec.Index
+					if idx < 0 {
+						idx = 0
+					}
+					br.errs[start+idx] = batch[start+idx].versionConflict(ec.Err, mgo.IsDup(ec.Err))
+				}
+			}
+
+			switch {
+			case batch[start].Type == BulkOpInsert:
+				br.inserted += insertedCount(br.errs, start, end, ordered)
+			case r == nil:
+				// mgo 的 Bulk 失败时不返回计数
+				br.countsUnknown = true
+			case batch[start].Type == BulkOpDelete:
+				br.deleted += r.Matched
+			default:
+				br.matched += r.Matched
+				br.modified += r.Modified
+				if e := batch[start].checkVersion(r.Matched); e != nil {
+					br.errs[start] = e
+				}
+			}
+
+			if ordered && countErrs(br.errs, start, end) > 0 {
+				break
+			}
+		}
+		return br, nil
+	}
+}
+
+// insertedCount [start, end) 的插入分段中成功的数量, 有序时第一个失败之后的操作未执行
+func insertedCount(errs map[int]error, start, end int, ordered bool) int {
+	if !ordered {
+		return end - start - countErrs(errs, start, end)
+	}
+	for i := start; i < end; i++ {
+		if _, ok := errs[i]; ok {
+			return i - start
+		}
+	}
+	return end - start
+}
+
+func countErrs(errs map[int]error, start, end int) int {
+	n := 0
+	for i := range errs {
+		if i >= start && i < end {
+			n++
+		}
+	}
+	return n
+}
+
+// driverBulkBatch 按 bulkSegments 分段执行 BulkWrite, 通常整批为一段
+func driverBulkBatch(ctx context.Context, c *mongo.Collection) bulkBatchFunc {
+	return func(batch []BulkOp, ordered bool) (*bulkBatchResult, error) {
+		br := &bulkBatchResult{errs: map[int]error{}, upsertedIds: map[int]interface{}{}}
+		for _, seg := range bulkSegments(batch, false) {
+			start, end := seg[0], seg[1]
+			models := make([]mongo.WriteModel, 0, end-start)
+			for _, op := range batch[start:end] {
+				switch op.Type {
+				case BulkOpInsert:
+					models = append(models, mongo.NewInsertOneModel().SetDocument(op.Model))
+				case BulkOpUpdate:
+					models = append(models, mongo.NewUpdateOneModel().SetFilter(op.selector).SetUpdate(op.update()))
+				case BulkOpUpsert:
+					models = append(models, mongo.NewUpdateOneModel().SetFilter(op.selector).SetUpdate(op.update()).SetUpsert(true))
+				case BulkOpDelete:
+					models = append(models, mongo.NewDeleteOneModel().SetFilter(op.selector))
+				default:
+					return nil, fmt.Errorf("unknown bulk operation `%s`", op.Type)
+				}
+			}
+
+			r, err := c.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(ordered))
+			if r != nil {
+				br.inserted += int(r.InsertedCount)
+				br.matched += int(r.MatchedCount)
+				br.modified += int(r.ModifiedCount)
+				br.upserted += int(r.UpsertedCount)
+				br.deleted += int(r.DeletedCount)
+				for i, id := range r.UpsertedIDs {
+					br.upsertedIds[start+int(i)] = id
+				}
+			}
+			if err != nil {
+				bwe, ok := err.(mongo.BulkWriteException)
+				if !ok {
+					if start == 0 {
+						return nil, err
+					}
+					// 前面的分段已执行, 本段及之后按失败处理
+					for i := start; i < len(batch); i++ {
+						br.errs[i] = err
+					}
+					return br, nil
+				}
+				// 计数在 r 中, 只有写关注错误时操作都已执行
+				if r == nil {
+					br.countsUnknown = true
+				}
+				if bwe.WriteConcernError != nil && br.writeConcernErr == nil {
+					br.writeConcernErr = bwe.WriteConcernError
+				}
+				for _, we := range bwe.WriteErrors {
+					br.errs[start+we.Index] = batch[start+we.Index].versionConflict(we, mongo.IsDuplicateKeyError(we))
+				}
+				if len(bwe.WriteErrors) == 0 && r != nil {
+					if e := batch[start].checkVersion(int(r.MatchedCount)); e != nil {
+						br.errs[start] = e
+					}
+				}
+			} else if r != nil {
+				if e := batch[start].checkVersion(int(r.MatchedCount)); e != nil {
+					br.errs[start] = e
+				}
+			}
+
+			if ordered && countErrs(br.errs, start, end) > 0 {
+				break
+			}
+		}
+		return br, nil
+	}
+}
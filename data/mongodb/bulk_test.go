@@ -0,0 +1,88 @@
+package mongodb
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestRunBulk(t *testing.T) {
+	ops := []BulkOp{}
+	for i := 0; i < 5; i++ {
+		ops = append(ops, InsertOp(&User{Id: bson.NewObjectId(), TenantId: "t1"}))
+	}
+	ops = append(ops, DeleteOp(&User{Id: bson.NewObjectId(), TenantId: "t1"}))
+
+	dup := errors.New("duplicate key")
+	batches := []int{}
+	run := func(batch []BulkOp, ordered bool) (*bulkBatchResult, error) {
+		batches = append(batches, len(batch))
+		br := &bulkBatchResult{errs: map[int]error{}}
+		for i, op := range batch {
+			// 第二批的第一个操作失败
+			if len(batches) == 2 && i == 0 {
+				br.errs[i] = dup
+				if ordered {
+					break
+				}
+				continue
+			}
+			if op.Type == BulkOpInsert {
+				br.inserted++
+			} else {
+				br.deleted++
+			}
+		}
+		return br, nil
+	}
+
+	result, err := runBulk(ops, &BulkOptions{BatchSize: 2}, run)
+	berr, ok := err.(*BulkError)
+	if !ok || !reflect.DeepEqual(berr.Indexes(), []int{2}) {
+		t.Fatalf("unordered err: %v", err)
+	}
+	if !reflect.DeepEqual(batches, []int{2, 2, 2}) || result.Inserted != 4 || result.Deleted != 1 {
+		t.Errorf("unordered result: %v, %+v", batches, result)
+	}
+	if result.Results[2].Err != dup || result.Results[3].Skipped {
+		t.Errorf("unordered op results: %+v", result.Results)
+	}
+
+	batches = batches[:0]
+	result, err = runBulk(ops, &BulkOptions{BatchSize: 2, Ordered: true}, run)
+	if berr, ok = err.(*BulkError); !ok || !reflect.DeepEqual(berr.Indexes(), []int{2}) {
+		t.Fatalf("ordered err: %v", err)
+	}
+	if !reflect.DeepEqual(batches, []int{2, 2}) || result.Inserted != 2 {
+		t.Errorf("ordered result: %v, %+v", batches, result)
+	}
+	for i := 3; i < len(ops); i++ {
+		if !result.Results[i].Skipped {
+			t.Errorf("op %d not skipped", i)
+		}
+	}
+
+	// 只有写关注错误时操作都已执行, 计数保留
+	wcErr := errors.New("waiting for replication timed out")
+	result, err = runBulk(ops[:2], nil, func(batch []BulkOp, ordered bool) (*bulkBatchResult, error) {
+		return &bulkBatchResult{inserted: len(batch), countsUnknown: true, writeConcernErr: wcErr}, nil
+	})
+	if berr, ok = err.(*BulkError); !ok || berr.WriteConcernErr != wcErr || len(berr.Cases) != 0 {
+		t.Fatalf("write concern err: %v", err)
+	}
+	if result.Inserted != 2 || !result.CountsUnknown || result.Results[0].Skipped || result.Results[1].Err != nil {
+		t.Errorf("write concern result: %+v", result)
+	}
+
+	errs := map[int]error{3: dup}
+	if insertedCount(errs, 2, 6, false) != 3 || insertedCount(errs, 2, 6, true) != 1 {
+		t.Errorf("inserted count: %d, %d", insertedCount(errs, 2, 6, false), insertedCount(errs, 2, 6, true))
+	}
+
+	ops = append(ops, InsertOp(&User{TenantId: "t2"}))
+	if _, err = runBulk(ops, nil, run); err != ErrBulkCollectionMismatch {
+		t.Errorf("mismatch err: %v", err)
+	}
+}
@@ -0,0 +1,273 @@
+package mongodb
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	dbson "go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/mofancloud/xmicro/broker"
+	"github.com/mofancloud/xmicro/cache"
+)
+
+// ErrChangeStreamNotSupported mgo 不支持 change stream, 需使用官方驱动的数据源
+var ErrChangeStreamNotSupported = errors.New("change streams need the mongo driver")
+
+// ChangeEvent 集合的一次变更
+type ChangeEvent struct {
+	ResumeToken   dbson.Raw `bson:"_id"`
+	OperationType string    `bson:"operationType"` // insert, update, replace, delete ...
+	Ns            struct {
+		Database   string `bson:"db"`
+		Collection string `bson:"coll"`
+	} `bson:"ns"`
+	DocumentKey       dbson.Raw           `bson:"documentKey"`
+	FullDocument      dbson.Raw           `bson:"fullDocument,omitempty"` // delete 时没有, update 时需 WatchOptions.FullDocument
+	UpdateDescription *UpdateDescription  `bson:"updateDescription,omitempty"`
+	ClusterTime       primitive.Timestamp `bson:"clusterTime"`
+}
+
+type UpdateDescription struct {
+	UpdatedFields dbson.Raw `bson:"updatedFields"`
+	RemovedFields []string  `bson:"removedFields"`
+}
+
+// Decode 将 FullDocument 解码到 v, 如 *User
+func (e *ChangeEvent) Decode(v interface{}) error {
+	if len(e.FullDocument) == 0 {
+		return fmt.Errorf("change event `%s` has no full document", e.OperationType)
+	}
+	return dbson.UnmarshalWithRegistry(mgoCompatRegistry, e.FullDocument, v)
+}
+
+// MarshalJSON 文档部分为 relaxed extended JSON
+func (e *ChangeEvent) MarshalJSON() ([]byte, error) {
+	out := struct {
+		OperationType string          `json:"operationType"`
+		Database      string          `json:"database"`
+		Collection    string          `json:"collection"`
+		DocumentKey   json.RawMessage `json:"documentKey,omitempty"`
+		FullDocument  json.RawMessage `json:"fullDocument,omitempty"`
+		UpdatedFields json.RawMessage `json:"updatedFields,omitempty"`
+		RemovedFields []string        `json:"removedFields,omitempty"`
+		ClusterTime   int64           `json:"clusterTime"`
+	}{
+		OperationType: e.OperationType,
+		Database:      e.Ns.Database,
+		Collection:    e.Ns.Collection,
+		ClusterTime:   int64(e.ClusterTime.T),
+	}
+
+	var err error
+	if out.DocumentKey, err = extJSON(e.DocumentKey); err != nil {
+		return nil, err
+	}
+	if out.FullDocument, err = extJSON(e.FullDocument); err != nil {
+		return nil, err
+	}
+	if e.UpdateDescription != nil {
+		if out.UpdatedFields, err = extJSON(e.UpdateDescription.UpdatedFields); err != nil {
+			return nil, err
+		}
+		out.RemovedFields = e.UpdateDescription.RemovedFields
+	}
+	return json.Marshal(out)
+}
+
+func extJSON(raw dbson.Raw) (json.RawMessage, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	return dbson.MarshalExtJSON(raw, false, false)
+}
+
+// ChangeHandler 处理变更, 返回 error 时停止 Watch, 该变更的 resume token 不保存, 重启后再次投递
+type ChangeHandler func(e *ChangeEvent) error
+
+// ResumeTokenStore 保存 change stream 的 resume token, 重启后从中断处继续
+type ResumeTokenStore interface {
+	Load(key string) ([]byte, error) // 不存在时返回 nil, nil
+	Save(key string, token []byte) error
+}
+
+type WatchOptions struct {
+	Key          string           // resume token 的 key, 默认为 database.collection
+	Store        ResumeTokenStore // 为空时不保存, 从当前时刻开始
+	Pipeline     []bson.M         // 过滤变更, 如 $match operationType
+	FullDocument bool             // update 时也返回完整文档
+	BatchSize    int32
+	MaxAwaitTime time.Duration
+}
+
+// WatchCollection 在集合上执行 change stream, 直到 ctx 取消或出错
+func WatchCollection(ctx context.Context, c *mongo.Collection, handler ChangeHandler, opts *WatchOptions) error {
+	if opts == nil {
+		opts = &WatchOptions{}
+	}
+	key := opts.Key
+	if key == "" {
+		key = fmt.Sprintf("%s.%s", c.Database().Name(), c.Name())
+	}
+
+	csOpts := options.ChangeStream()
+	if opts.FullDocument {
+		csOpts.SetFullDocument(options.UpdateLookup)
+	}
+	if opts.BatchSize > 0 {
+		csOpts.SetBatchSize(opts.BatchSize)
+	}
+	if opts.MaxAwaitTime > 0 {
+		csOpts.SetMaxAwaitTime(opts.MaxAwaitTime)
+	}
+	if opts.Store != nil {
+		token, err := opts.Store.Load(key)
+		if err != nil {
+			return err
+		}
+		if len(token) > 0 {
+			csOpts.SetResumeAfter(dbson.Raw(token))
+		}
+	}
+
+	pipeline := opts.Pipeline
+	if pipeline == nil {
+		pipeline = []bson.M{}
+	}
+	cs, err := c.Watch(ctx, pipeline, csOpts)
+	if err != nil {
+		return err
+	}
+	defer cs.Close(context.Background())
+
+	for cs.Next(ctx) {
+		e := &ChangeEvent{}
+		if err = dbson.UnmarshalWithRegistry(mgoCompatRegistry, cs.Current, e); err != nil {
+			return err
+		}
+		if err = handler(e); err != nil {
+			return err
+		}
+		if opts.Store != nil {
+			if err = opts.Store.Save(key, cs.ResumeToken()); err != nil {
+				return err
+			}
+		}
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return cs.Err()
+}
+
+// DefaultResumeTokenTTL cache 中 resume token 的过期时间, 需长于 oplog 的保留时间
+var DefaultResumeTokenTTL = time.Hour * 24 * 30
+
+type cacheTokenStore struct {
+	cache  cache.Cache
+	prefix string
+	ttl    time.Duration
+}
+
+// NewCacheTokenStore 将 resume token 保存在任意 cache.Cache 中, 以 base64 字符串存储
+func NewCacheTokenStore(c cache.Cache, prefix string) *cacheTokenStore {
+	return &cacheTokenStore{cache: c, prefix: prefix, ttl: DefaultResumeTokenTTL}
+}
+
+func (self *cacheTokenStore) TTL(ttl time.Duration) *cacheTokenStore {
+	self.ttl = ttl
+	return self
+}
+
+func (self *cacheTokenStore) Load(key string) ([]byte, error) {
+	s, err := cache.GetString(self.cache.Get(self.prefix+key), nil)
+	if err != nil || s == "" {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(s)
+}
+
+func (self *cacheTokenStore) Save(key string, token []byte) error {
+	return self.cache.Put(self.prefix+key, base64.StdEncoding.EncodeToString(token), self.ttl)
+}
+
+// resume token 在 Mongo 中的文档
+type resumeTokenDoc struct {
+	Key   string    `bson:"_id"`
+	Token []byte    `bson:"token"`
+	Utime time.Time `bson:"utime"`
+
+	database   string
+	collection string
+}
+
+func (self *resumeTokenDoc) Database() string {
+	return self.database
+}
+
+func (self *resumeTokenDoc) Collection() string {
+	return self.collection
+}
+
+func (self *resumeTokenDoc) Unique() bson.M {
+	return bson.M{"_id": self.Key}
+}
+
+type mongoTokenStore struct {
+	repo       MongoRepository
+	database   string
+	collection string
+}
+
+// NewMongoTokenStore 将 resume token 保存在 database.collection 中, 每个 key 一个文档
+func NewMongoTokenStore(repo MongoRepository, database, collection string) *mongoTokenStore {
+	return &mongoTokenStore{repo: repo, database: database, collection: collection}
+}
+
+func (self *mongoTokenStore) Load(key string) ([]byte, error) {
+	doc := &resumeTokenDoc{Key: key, database: self.database, collection: self.collection}
+	err := self.repo.FindOne(doc)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return doc.Token, nil
+}
+
+func (self *mongoTokenStore) Save(key string, token []byte) error {
+	doc := &resumeTokenDoc{
+		Key:        key,
+		Token:      token,
+		Utime:      time.Now(),
+		database:   self.database,
+		collection: self.collection,
+	}
+	_, err := self.repo.Upsert(doc)
+	return err
+}
+
+// ChangePublisher 将变更以 JSON 发布到 broker, topic 为空时使用 database.collection
+func ChangePublisher(b broker.Broker, topic string) ChangeHandler {
+	return func(e *ChangeEvent) error {
+		t := topic
+		if t == "" {
+			t = fmt.Sprintf("%s.%s", e.Ns.Database, e.Ns.Collection)
+		}
+		payload, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		return b.Publish(broker.NewDefaultPublication(t, payload, broker.ContentTypeJson))
+	}
+}
@@ -0,0 +1,83 @@
+package mongodb
+
+import (
+	"encoding/json"
+	"testing"
+
+	dbson "go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/mofancloud/xmicro/broker"
+	"github.com/mofancloud/xmicro/cache"
+)
+
+type recordBroker struct {
+	published []broker.Message
+}
+
+func (self *recordBroker) Publish(p broker.Message) error {
+	self.published = append(self.published, p)
+	return nil
+}
+
+func (self *recordBroker) Subscribe(topic string, h interface{}) error {
+	return nil
+}
+
+func TestChangePublisher(t *testing.T) {
+	id := primitive.NewObjectID()
+	raw, err := dbson.Marshal(dbson.M{
+		"_id":           dbson.M{"_data": "8263"},
+		"operationType": "insert",
+		"ns":            dbson.M{"db": "t1_user_db", "coll": "t1_users"},
+		"documentKey":   dbson.M{"_id": id},
+		"fullDocument":  dbson.M{"_id": id, "nick": "Marry", "age": 23},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := &ChangeEvent{}
+	if err = dbson.UnmarshalWithRegistry(mgoCompatRegistry, raw, e); err != nil {
+		t.Fatalf("decode event err: %v", err)
+	}
+
+	user := &User{}
+	if err = e.Decode(user); err != nil || user.Nick != "Marry" || user.Id.Hex() != id.Hex() || user.Age != 23 {
+		t.Errorf("decode full document: %v, %v", err, user)
+	}
+
+	b := &recordBroker{}
+	if err = ChangePublisher(b, "")(e); err != nil {
+		t.Fatalf("publish err: %v", err)
+	}
+	if len(b.published) != 1 || b.published[0].Topic() != "t1_user_db.t1_users" {
+		t.Fatalf("published: %v", b.published)
+	}
+
+	var out map[string]interface{}
+	if err = json.Unmarshal(b.published[0].Payload().([]byte), &out); err != nil {
+		t.Fatalf("payload err: %v", err)
+	}
+	doc, _ := out["fullDocument"].(map[string]interface{})
+	if out["operationType"] != "insert" || doc["nick"] != "Marry" {
+		t.Errorf("payload: %v", out)
+	}
+}
+
+func TestCacheTokenStore(t *testing.T) {
+	store := NewCacheTokenStore(cache.NewMemoryCache(), "resume:")
+
+	token, err := store.Load("db.coll")
+	if err != nil || token != nil {
+		t.Errorf("load empty: %v, %v", err, token)
+	}
+
+	if err = store.Save("db.coll", []byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	token, err = store.Load("db.coll")
+	if err != nil || string(token) != string([]byte{1, 2, 3}) {
+		t.Errorf("load: %v, %v", err, token)
+	}
+}
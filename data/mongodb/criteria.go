@@ -0,0 +1,226 @@
+package mongodb
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/mofancloud/xmicro/data"
+	xreflect "github.com/mofancloud/xmicro/reflect"
+	"github.com/mofancloud/xmicro/utils"
+)
+
+// ErrInvalidFilter filters 的格式或取值不正确, 同 data.ErrInvalidFilter
+var ErrInvalidFilter = data.ErrInvalidFilter
+
+// FilterError 某个字段的条件不正确, 同 data.FilterError
+type FilterError = data.FilterError
+
+func filterError(field string, op data.FilterType, format string, args ...interface{}) error {
+	return &FilterError{Field: field, Operator: op, Message: fmt.Sprintf(format, args...)}
+}
+
+// 字段上的比较运算
+var compareOperators = map[data.FilterType]string{
+	data.FilterType_EQ:  "$eq",
+	data.FilterType_NE:  "$ne",
+	data.FilterType_GT:  "$gt",
+	data.FilterType_GTE: "$gte",
+	data.FilterType_LT:  "$lt",
+	data.FilterType_LTE: "$lte",
+}
+
+// fieldCriteria 字段上的运算, 由 Translator 调用, 不支持 ELEM_MATCH
+func fieldCriteria(s *xreflect.StructInfo, field string, ops map[string]interface{}) (bson.M, error) {
+	subCriteria := bson.M{}
+	set := func(op data.FilterType, key string, value interface{}) error {
+		if _, ok := subCriteria[key]; ok {
+			return filterError(field, op, "conflicts with another operator on `%s`", key)
+		}
+		subCriteria[key] = value
+		return nil
+	}
+
+	for vKey, vValue := range ops {
+		op := data.FilterType(vKey)
+
+		var err error
+		switch op {
+		case data.FilterType_EQ, data.FilterType_NE, data.FilterType_GT,
+			data.FilterType_GTE, data.FilterType_LT, data.FilterType_LTE:
+			err = set(op, compareOperators[op], convertValue(s, field, vValue))
+		case data.FilterType_IN, data.FilterType_NOT_IN:
+			var values []interface{}
+			if values, err = toSlice(field, op, vValue); err == nil {
+				for i := range values {
+					values[i] = convertValue(s, field, values[i])
+				}
+				key := "$in"
+				if op == data.FilterType_NOT_IN {
+					key = "$nin"
+				}
+				err = set(op, key, values)
+			}
+		case data.FilterType_LIKE:
+			var pattern string
+			if pattern, err = toString(field, op, vValue); err == nil {
+				err = set(op, "$regex", pattern)
+			}
+		case data.FilterType_ILIKE:
+			var pattern string
+			if pattern, err = toString(field, op, vValue); err == nil {
+				if err = set(op, "$regex", pattern); err == nil {
+					err = set(op, "$options", "i")
+				}
+			}
+		case data.FilterType_NOT_LIKE:
+			var pattern string
+			if pattern, err = toString(field, op, vValue); err == nil {
+				err = set(op, "$not", bson.RegEx{Pattern: pattern})
+			}
+		case data.FilterType_MATCH:
+			err = matchCriteria(field, vValue, set)
+		case data.FilterType_EXISTS:
+			exists, ok := vValue.(bool)
+			if !ok {
+				err = filterError(field, op, "expect a bool, got %T", vValue)
+			} else {
+				err = set(op, "$exists", exists)
+			}
+		case data.FilterType_SIZE:
+			var size int
+			if size, err = toInt(field, op, vValue); err == nil {
+				err = set(op, "$size", size)
+			}
+		case data.FilterType_GEO_WITHIN:
+			var geo bson.M
+			if geo, err = geoWithinCriteria(field, vValue); err == nil {
+				err = set(op, "$geoWithin", geo)
+			}
+		default:
+			err = filterError(field, op, "unknown operator")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return subCriteria, nil
+}
+
+// 时间类型的字段, 传入的数字按秒级时间戳转为 time
+func convertValue(s *xreflect.StructInfo, field string, v interface{}) interface{} {
+	if s == nil {
+		return v
+	}
+	fieldInfo, ok := s.FieldsMap[field]
+	if !ok || fieldInfo.FieldType != xreflect.TimeType {
+		return v
+	}
+	switch n := v.(type) {
+	case int64:
+		return utils.Unix(n, 0)
+	case int:
+		return utils.Unix(int64(n), 0)
+	case float64:
+		return utils.Unix(int64(n), 0)
+	case int32:
+		return utils.Unix(int64(n), 0)
+	}
+	return v
+}
+
+func toSlice(field string, op data.FilterType, v interface{}) ([]interface{}, error) {
+	rv := reflect.ValueOf(v)
+	if v == nil || (rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array) {
+		return nil, filterError(field, op, "expect an array, got %T", v)
+	}
+	values := make([]interface{}, rv.Len())
+	for i := range values {
+		values[i] = rv.Index(i).Interface()
+	}
+	return values, nil
+}
+
+func toString(field string, op data.FilterType, v interface{}) (string, error) {
+	str, ok := v.(string)
+	if !ok {
+		return "", filterError(field, op, "expect a string, got %T", v)
+	}
+	return str, nil
+}
+
+func toInt(field string, op data.FilterType, v interface{}) (int, error) {
+	switch n := v.(type) {
+	case int:
+		return n, nil
+	case int32:
+		return int(n), nil
+	case int64:
+		return int(n), nil
+	case float64:
+		if n == math.Trunc(n) {
+			return int(n), nil
+		}
+	}
+	return 0, filterError(field, op, "expect an integer, got %v", v)
+}
+
+// MATCH 的值为正则, 或 {"pattern": "^a", "options": "i"}
+func matchCriteria(field string, v interface{}, set func(data.FilterType, string, interface{}) error) error {
+	op := data.FilterType_MATCH
+	switch m := v.(type) {
+	case string:
+		return set(op, "$regex", m)
+	case map[string]interface{}:
+		pattern, err := toString(field, op, m["pattern"])
+		if err != nil {
+			return err
+		}
+		if err = set(op, "$regex", pattern); err != nil {
+			return err
+		}
+		if options, ok := m["options"]; ok {
+			str, err := toString(field, op, options)
+			if err != nil {
+				return err
+			}
+			return set(op, "$options", str)
+		}
+		return nil
+	}
+	return filterError(field, op, "expect a pattern or {pattern, options}, got %T", v)
+}
+
+// GEO_WITHIN 的值为 GeoJSON 的 Polygon/MultiPolygon, 或 {"box"|"polygon"|"centerSphere": 坐标}
+func geoWithinCriteria(field string, v interface{}) (bson.M, error) {
+	op := data.FilterType_GEO_WITHIN
+	m, ok := v.(map[string]interface{})
+	if !ok || len(m) == 0 {
+		return nil, filterError(field, op, "expect a GeoJSON geometry or shape, got %T", v)
+	}
+	if t, ok := m["type"]; ok {
+		if t != "Polygon" && t != "MultiPolygon" {
+			return nil, filterError(field, op, "unsupported geometry type %v", t)
+		}
+		if _, ok := m["coordinates"]; !ok {
+			return nil, filterError(field, op, "geometry without coordinates")
+		}
+		return bson.M{"$geometry": m}, nil
+	}
+	if len(m) != 1 {
+		return nil, filterError(field, op, "expect exactly one shape")
+	}
+	for shape, coords := range m {
+		if _, err := toSlice(field, op, coords); err != nil {
+			return nil, err
+		}
+		switch shape {
+		case "box", "polygon", "centerSphere", "center":
+			return bson.M{"$" + shape: coords}, nil
+		}
+		return nil, filterError(field, op, "unknown shape `%s`", shape)
+	}
+	return nil, nil
+}
@@ -0,0 +1,113 @@
+package mongodb
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestBuildCriteria(t *testing.T) {
+	ctime := time.Unix(1500000000, 0)
+
+	tests := []struct {
+		name     string
+		filters  string
+		expected bson.M
+	}{
+		{"EQ", `{"nick": {"EQ": "a"}}`, bson.M{"nick": bson.M{"$eq": "a"}}},
+		{"NE", `{"nick": {"NE": "a"}}`, bson.M{"nick": bson.M{"$ne": "a"}}},
+		{"GT", `{"age": {"GT": 1}}`, bson.M{"age": bson.M{"$gt": float64(1)}}},
+		{"GTE", `{"age": {"GTE": 1}}`, bson.M{"age": bson.M{"$gte": float64(1)}}},
+		{"LT", `{"age": {"LT": 1}}`, bson.M{"age": bson.M{"$lt": float64(1)}}},
+		{"LTE", `{"age": {"LTE": 1}}`, bson.M{"age": bson.M{"$lte": float64(1)}}},
+		{"range", `{"age": {"GT": 1, "LT": 9}}`, bson.M{"age": bson.M{"$gt": float64(1), "$lt": float64(9)}}},
+		{"time", `{"ctime": {"GTE": 1500000000}}`, bson.M{"ctime": bson.M{"$gte": ctime}}},
+		{"IN", `{"type": {"IN": [1, 2]}}`, bson.M{"type": bson.M{"$in": []interface{}{float64(1), float64(2)}}}},
+		{"NOT_IN", `{"type": {"NOT_IN": [1]}}`, bson.M{"type": bson.M{"$nin": []interface{}{float64(1)}}}},
+		{"LIKE", `{"nick": {"LIKE": "^a"}}`, bson.M{"nick": bson.M{"$regex": "^a"}}},
+		{"ILIKE", `{"nick": {"ILIKE": "a"}}`, bson.M{"nick": bson.M{"$regex": "a", "$options": "i"}}},
+		{"NOT_LIKE", `{"nick": {"NOT_LIKE": "a"}}`, bson.M{"nick": bson.M{"$not": bson.RegEx{Pattern: "a"}}}},
+		{"MATCH", `{"nick": {"MATCH": "^a$"}}`, bson.M{"nick": bson.M{"$regex": "^a$"}}},
+		{"MATCH options", `{"nick": {"MATCH": {"pattern": "^a", "options": "im"}}}`, bson.M{"nick": bson.M{"$regex": "^a", "$options": "im"}}},
+		{"EXISTS", `{"nick": {"EXISTS": false}}`, bson.M{"nick": bson.M{"$exists": false}}},
+		{"SIZE", `{"tags": {"SIZE": 2}}`, bson.M{"tags": bson.M{"$size": 2}}},
+		{"ELEM_MATCH scalar", `{"scores": {"ELEM_MATCH": {"GTE": 80, "LT": 90}}}`,
+			bson.M{"scores": bson.M{"$elemMatch": bson.M{"$gte": float64(80), "$lt": float64(90)}}}},
+		{"ELEM_MATCH object", `{"orders": {"ELEM_MATCH": {"amount": {"GT": 10}}}}`,
+			bson.M{"orders": bson.M{"$elemMatch": bson.M{"amount": bson.M{"$gt": float64(10)}}}}},
+		{"GEO_WITHIN geometry", `{"loc": {"GEO_WITHIN": {"type": "Polygon", "coordinates": [[[0, 0], [0, 1], [1, 1], [0, 0]]]}}}`,
+			bson.M{"loc": bson.M{"$geoWithin": bson.M{"$geometry": map[string]interface{}{
+				"type":        "Polygon",
+				"coordinates": []interface{}{[]interface{}{[]interface{}{float64(0), float64(0)}, []interface{}{float64(0), float64(1)}, []interface{}{float64(1), float64(1)}, []interface{}{float64(0), float64(0)}}},
+			}}}}},
+		{"GEO_WITHIN centerSphere", `{"loc": {"GEO_WITHIN": {"centerSphere": [[0, 0], 0.1]}}}`,
+			bson.M{"loc": bson.M{"$geoWithin": bson.M{"$centerSphere": []interface{}{[]interface{}{float64(0), float64(0)}, 0.1}}}}},
+		{"TEXT", `{"TEXT": "coffee"}`, bson.M{"$text": bson.M{"$search": "coffee"}}},
+		{"TEXT options", `{"TEXT": {"search": "coffee", "language": "en", "caseSensitive": true}}`,
+			bson.M{"$text": bson.M{"$search": "coffee", "$language": "en", "$caseSensitive": true}}},
+		{"AND", `{"AND": [{"age": {"GT": 1}}, {"age": {"LT": 9}}]}`,
+			bson.M{"age": bson.M{"$gt": float64(1), "$lt": float64(9)}}},
+		// 同一字段的 LIKE 和 ILIKE 不能合并, 按运算符排序放入 $and
+		{"LIKE and ILIKE", `{"nick": {"LIKE": "a", "ILIKE": "b"}}`,
+			bson.M{"$and": []bson.M{{"nick": bson.M{"$regex": "b", "$options": "i"}}, {"nick": bson.M{"$regex": "a"}}}}},
+		{"OR", `{"OR": [{"nick": {"EQ": "a"}}, {"type": {"EQ": 1}}]}`,
+			bson.M{"$or": []bson.M{{"nick": bson.M{"$eq": "a"}}, {"type": bson.M{"$eq": float64(1)}}}}},
+		{"NOR", `{"NOR": [{"nick": {"EQ": "a"}}]}`,
+			bson.M{"$nor": []bson.M{{"nick": bson.M{"$eq": "a"}}}}},
+		{"empty", `{}`, bson.M{}},
+	}
+
+	for _, test := range tests {
+		var filters map[string]interface{}
+		if err := json.Unmarshal([]byte(test.filters), &filters); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		criteria, err := BuildCriteria(&User{}, filters)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(criteria, test.expected) {
+			t.Errorf("%s:\n%#v\nexpected:\n%#v", test.name, criteria, test.expected)
+		}
+	}
+}
+
+func TestBuildCriteriaErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		filters string
+	}{
+		{"not an object", `{"nick": "a"}`},
+		{"unknown operator", `{"nick": {"EQUALS": "a"}}`},
+		{"IN not array", `{"type": {"IN": 1}}`},
+		{"LIKE not string", `{"nick": {"LIKE": 1}}`},
+		{"MATCH without pattern", `{"nick": {"MATCH": {"options": "i"}}}`},
+		{"EXISTS not bool", `{"nick": {"EXISTS": "yes"}}`},
+		{"SIZE not integer", `{"tags": {"SIZE": 1.5}}`},
+		{"ELEM_MATCH empty", `{"tags": {"ELEM_MATCH": {}}}`},
+		{"GEO_WITHIN point", `{"loc": {"GEO_WITHIN": {"type": "Point", "coordinates": [0, 0]}}}`},
+		{"GEO_WITHIN unknown shape", `{"loc": {"GEO_WITHIN": {"circle": [0, 0]}}}`},
+		{"TEXT unknown option", `{"TEXT": {"search": "a", "fuzzy": true}}`},
+		{"AND not array", `{"AND": {"nick": {"EQ": "a"}}}`},
+		{"OR element", `{"OR": ["a"]}`},
+		{"NOR empty", `{"NOR": []}`},
+		{"nested", `{"AND": [{"nick": {"EQ": "a"}}, {"age": {"BETWEEN": [1, 2]}}]}`},
+	}
+
+	for _, test := range tests {
+		var filters map[string]interface{}
+		if err := json.Unmarshal([]byte(test.filters), &filters); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		_, err := BuildCriteria(&User{}, filters)
+		var ferr *FilterError
+		if !errors.Is(err, ErrInvalidFilter) || !errors.As(err, &ferr) {
+			t.Errorf("%s: expect a FilterError, got %v", test.name, err)
+		}
+	}
+}
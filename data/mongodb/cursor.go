@@ -0,0 +1,290 @@
+package mongodb
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/mofancloud/xmicro/data"
+)
+
+// ErrInvalidCursor cursor 无法解析, 或与本次查询的排序字段不一致
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+const (
+	cursorNext = "n"
+	cursorPrev = "p"
+)
+
+// cursor 的内容, bson 编码后 base64 给客户端, 保留 ObjectId 和时间等类型
+type cursorToken struct {
+	Dir    string        `bson:"d"`
+	Keys   []string      `bson:"k"`
+	Values []interface{} `bson:"v"`
+}
+
+func encodeCursor(token *cursorToken) (string, error) {
+	raw, err := bson.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+func decodeCursor(s string) (*cursorToken, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	token := &cursorToken{}
+	if err = bson.Unmarshal(raw, token); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	if token.Dir != cursorNext && token.Dir != cursorPrev || len(token.Keys) != len(token.Values) {
+		return nil, ErrInvalidCursor
+	}
+	return token, nil
+}
+
+// cursorPlan 一次游标分页的查询条件和排序
+type cursorPlan struct {
+	filters  bson.M // 仅 Filters, 用于统计总数
+	criteria bson.M // Filters 加上 cursor 的位置
+	sorts    []string
+	keys     []string
+	desc     []bool
+	dir      string
+	resumed  bool // 是否带了 cursor
+	pageSize int32
+	total    data.TotalMode
+}
+
+// limit 多取一条, 用来判断是否还有下一页
+func (p *cursorPlan) limit() int {
+	return int(p.pageSize) + 1
+}
+
+func parseCursorQuery(m Model, cursorQuery *data.CursorQuery) (*cursorPlan, error) {
+	if err := ValidateQuery(m, cursorQuery.Filters, cursorQuery.Sort); err != nil {
+		return nil, err
+	}
+	filters, err := buildModelCriteria(m, cursorQuery.Filters)
+	if err != nil {
+		return nil, err
+	}
+	plan := &cursorPlan{
+		filters:  filters,
+		dir:      cursorNext,
+		pageSize: cursorQuery.PageSize,
+		total:    cursorQuery.Total,
+	}
+	if plan.pageSize < 1 {
+		plan.pageSize = 20
+	} else if plan.pageSize > 1000 {
+		plan.pageSize = 1000
+	}
+
+	// 排序字段必须能唯一确定顺序, 最后补上 _id
+	hasId := false
+	for _, s := range cursorQuery.Sort {
+		plan.keys = append(plan.keys, s.Property)
+		plan.desc = append(plan.desc, s.Type == data.SortType_DSC)
+		if s.Property == "_id" {
+			hasId = true
+		}
+	}
+	if !hasId {
+		plan.keys = append(plan.keys, "_id")
+		plan.desc = append(plan.desc, false)
+	}
+
+	plan.criteria = plan.filters
+	if len(cursorQuery.Cursor) > 0 {
+		token, err := decodeCursor(cursorQuery.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		if strings.Join(token.Keys, ",") != strings.Join(plan.keys, ",") {
+			return nil, ErrInvalidCursor
+		}
+		plan.dir = token.Dir
+		plan.resumed = true
+
+		keyset := plan.keysetCriteria(token.Values)
+		if len(plan.filters) == 0 {
+			plan.criteria = keyset
+		} else {
+			plan.criteria = bson.M{"$and": []bson.M{plan.filters, keyset}}
+		}
+	}
+
+	// 向前翻页时反向排序, 取回后再倒序
+	for i, k := range plan.keys {
+		if plan.desc[i] != (plan.dir == cursorPrev) {
+			plan.sorts = append(plan.sorts, fmt.Sprintf("-%s", k))
+		} else {
+			plan.sorts = append(plan.sorts, k)
+		}
+	}
+
+	return plan, nil
+}
+
+// projection 排序字段需要返回, 用来生成 cursor
+func (p *cursorPlan) projection(m Model, cursorQuery *data.CursorQuery) (bson.M, error) {
+	fields, err := BuildProjection(m, cursorQuery.Fields, cursorQuery.Exclude)
+	if err != nil || fields == nil {
+		return fields, err
+	}
+	for _, k := range p.keys {
+		if len(cursorQuery.Fields) > 0 {
+			fields[k] = 1
+		} else {
+			delete(fields, k)
+		}
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	return fields, nil
+}
+
+// (k1 > v1) or (k1 = v1 and k2 > v2) or ...
+func (p *cursorPlan) keysetCriteria(values []interface{}) bson.M {
+	ors := []bson.M{}
+	for i, k := range p.keys {
+		clause := bson.M{}
+		for j := 0; j < i; j++ {
+			clause[p.keys[j]] = values[j]
+		}
+		op := "$gt"
+		if p.desc[i] != (p.dir == cursorPrev) {
+			op = "$lt"
+		}
+		clause[k] = bson.M{op: values[i]}
+		ors = append(ors, clause)
+	}
+	return bson.M{"$or": ors}
+}
+
+// finish 去掉多取的一条, 恢复顺序, 生成 next/prev
+func (p *cursorPlan) finish(list interface{}) (*data.CursorInfo, error) {
+	rv := reflect.ValueOf(list)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Slice {
+		return nil, fmt.Errorf("list must be a pointer to slice, got %T", list)
+	}
+	rv = rv.Elem()
+
+	more := rv.Len() > int(p.pageSize)
+	if more {
+		rv.Set(rv.Slice(0, int(p.pageSize)))
+	}
+	n := rv.Len()
+	if p.dir == cursorPrev {
+		swap := reflect.Swapper(rv.Interface())
+		for i, j := 0, n-1; i < j; i, j = i+1, j-1 {
+			swap(i, j)
+		}
+	}
+
+	info := &data.CursorInfo{PageSize: p.pageSize}
+	if p.dir == cursorNext {
+		info.HasNext = more
+		info.HasPrev = p.resumed
+	} else {
+		// 往前没有数据时没有可以作为下一页起点的文档, 客户端从第一页重新开始
+		info.HasNext = n > 0
+		info.HasPrev = more
+	}
+	if n == 0 {
+		return info, nil
+	}
+
+	var err error
+	if info.HasNext {
+		if info.Next, err = p.cursorOf(cursorNext, rv.Index(n-1).Interface()); err != nil {
+			return nil, err
+		}
+	}
+	if info.HasPrev {
+		if info.Prev, err = p.cursorOf(cursorPrev, rv.Index(0).Interface()); err != nil {
+			return nil, err
+		}
+	}
+	return info, nil
+}
+
+func (p *cursorPlan) cursorOf(dir string, elem interface{}) (string, error) {
+	raw, err := bson.Marshal(elem)
+	if err != nil {
+		return "", err
+	}
+	doc := bson.M{}
+	if err = bson.Unmarshal(raw, doc); err != nil {
+		return "", err
+	}
+
+	values := make([]interface{}, len(p.keys))
+	for i, k := range p.keys {
+		values[i] = lookupPath(doc, k)
+	}
+	return encodeCursor(&cursorToken{Dir: dir, Keys: p.keys, Values: values})
+}
+
+// 取 a.b.c 形式的字段值, 不存在时为 nil
+func lookupPath(doc bson.M, path string) interface{} {
+	var v interface{} = doc
+	for _, k := range strings.Split(path, ".") {
+		m, ok := v.(bson.M)
+		if !ok {
+			return nil
+		}
+		v = m[k]
+	}
+	return v
+}
+
+// PageCursor 游标分页, list 为 slice 的指针
+func PageCursor(c *mgo.Collection, cursorQuery *data.CursorQuery, m Model, list interface{}) (*data.CursorInfo, error) {
+	plan, err := parseCursorQuery(m, cursorQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	fields, err := plan.projection(m, cursorQuery)
+	if err != nil {
+		return nil, err
+	}
+	q := c.Find(plan.criteria).Sort(plan.sorts...).Limit(plan.limit())
+	if fields != nil {
+		q = q.Select(fields)
+	}
+	if err = q.All(list); err != nil {
+		return nil, err
+	}
+	info, err := plan.finish(list)
+	if err != nil {
+		return nil, err
+	}
+
+	var total int
+	switch plan.total {
+	case data.TotalMode_EXACT:
+		total, err = c.Find(plan.filters).Count()
+	case data.TotalMode_ESTIMATED:
+		total, err = c.Count()
+	default:
+		return info, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	t := int64(total)
+	info.Total = &t
+	return info, nil
+}
@@ -0,0 +1,88 @@
+package mongodb
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/mofancloud/xmicro/data"
+)
+
+func TestCursorPlan(t *testing.T) {
+	query := &data.CursorQuery{
+		Filters:  map[string]interface{}{"type": map[string]interface{}{"EQ": 1}},
+		PageSize: 2,
+		Sort:     []*data.SortSpec{{Property: "age", Type: data.SortType_DSC}},
+	}
+
+	plan, err := parseCursorQuery(&User{}, query)
+	if err != nil {
+		t.Fatalf("parse err: %v", err)
+	}
+	if !reflect.DeepEqual(plan.sorts, []string{"-age", "_id"}) {
+		t.Errorf("sorts: %v", plan.sorts)
+	}
+
+	ids := []bson.ObjectId{bson.NewObjectId(), bson.NewObjectId(), bson.NewObjectId()}
+	list := []User{{Id: ids[0], Age: 30}, {Id: ids[1], Age: 20}, {Id: ids[2], Age: 10}}
+	info, err := plan.finish(&list)
+	if err != nil {
+		t.Fatalf("finish err: %v", err)
+	}
+	if len(list) != 2 || !info.HasNext || info.HasPrev || info.Next == "" || info.Prev != "" {
+		t.Fatalf("first page: %d, %+v", len(list), info)
+	}
+
+	// 下一页: type = 1 and (age < 20 or (age = 20 and _id > ids[1]))
+	query.Cursor = info.Next
+	plan, err = parseCursorQuery(&User{}, query)
+	if err != nil {
+		t.Fatalf("parse next err: %v", err)
+	}
+	expected := bson.M{"$and": []bson.M{
+		{"type": bson.M{"$eq": 1}},
+		{"$or": []bson.M{
+			{"age": bson.M{"$lt": 20}},
+			{"age": 20, "_id": bson.M{"$gt": ids[1]}},
+		}},
+	}}
+	if !reflect.DeepEqual(plan.criteria, expected) {
+		t.Errorf("criteria: %v", plan.criteria)
+	}
+
+	// 第二页只有一条, 上一页从这条开始往回
+	list = []User{{Id: ids[2], Age: 10}}
+	info, err = plan.finish(&list)
+	if err != nil || info.HasNext || !info.HasPrev || info.Prev == "" {
+		t.Fatalf("second page: %v, %+v", err, info)
+	}
+
+	query.Cursor = info.Prev
+	plan, err = parseCursorQuery(&User{}, query)
+	if err != nil {
+		t.Fatalf("parse prev err: %v", err)
+	}
+	if !reflect.DeepEqual(plan.sorts, []string{"age", "-_id"}) {
+		t.Errorf("prev sorts: %v", plan.sorts)
+	}
+
+	// 反向取回的结果恢复为原顺序
+	list = []User{{Id: ids[1], Age: 20}, {Id: ids[0], Age: 30}}
+	info, err = plan.finish(&list)
+	if err != nil || list[0].Age != 30 || !info.HasNext || info.HasPrev {
+		t.Errorf("prev page: %v, %v, %+v", err, list, info)
+	}
+
+	// 往前没有数据
+	list = []User{}
+	info, err = plan.finish(&list)
+	if err != nil || info.HasNext || info.HasPrev || info.Next != "" {
+		t.Errorf("empty prev page: %v, %+v", err, info)
+	}
+
+	query.Sort = nil
+	if _, err = parseCursorQuery(&User{}, query); err != ErrInvalidCursor {
+		t.Errorf("mismatched sort err: %v", err)
+	}
+}
@@ -0,0 +1,201 @@
+package mongodb
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	dbson "go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/mgocompat"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	tObjectId = reflect.TypeOf(bson.ObjectId(""))
+	tRegEx    = reflect.TypeOf(bson.RegEx{})
+	tD        = reflect.TypeOf(bson.D{})
+)
+
+// mgoCompatRegistry 让官方驱动能编解码 mgo 的 bson 类型,
+// 使已有的 Model (bson.ObjectId, bson.M 等) 无需修改即可迁移
+var mgoCompatRegistry = newMgoCompatRegistry()
+
+func newMgoCompatRegistry() *bsoncodec.Registry {
+	rb := mgocompat.NewRegistryBuilder()
+	rb.RegisterTypeEncoder(tObjectId, bsoncodec.ValueEncoderFunc(encodeObjectId))
+	rb.RegisterTypeDecoder(tObjectId, bsoncodec.ValueDecoderFunc(decodeObjectId))
+	rb.RegisterTypeEncoder(tRegEx, bsoncodec.ValueEncoderFunc(encodeRegEx))
+	rb.RegisterTypeEncoder(tD, bsoncodec.ValueEncoderFunc(encodeD))
+	return rb.Build()
+}
+
+func encodeObjectId(ec bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+	id := bson.ObjectId(val.String())
+	if len(id) == 0 {
+		return vw.WriteNull()
+	}
+	if !id.Valid() {
+		return fmt.Errorf("invalid ObjectId %q", string(id))
+	}
+	var oid primitive.ObjectID
+	copy(oid[:], id)
+	return vw.WriteObjectID(oid)
+}
+
+func decodeObjectId(dc bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+	switch vr.Type() {
+	case bsontype.ObjectID:
+		oid, err := vr.ReadObjectID()
+		if err != nil {
+			return err
+		}
+		val.SetString(string(oid[:]))
+		return nil
+	case bsontype.Null:
+		val.SetString("")
+		return vr.ReadNull()
+	default:
+		return fmt.Errorf("cannot decode %v into ObjectId", vr.Type())
+	}
+}
+
+func encodeRegEx(ec bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+	re := val.Interface().(bson.RegEx)
+	return vw.WriteRegex(re.Pattern, re.Options)
+}
+
+func encodeD(ec bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+	dw, err := vw.WriteDocument()
+	if err != nil {
+		return err
+	}
+	for _, e := range val.Interface().(bson.D) {
+		evw, err := dw.WriteDocumentElement(e.Name)
+		if err != nil {
+			return err
+		}
+		if e.Value == nil {
+			if err = evw.WriteNull(); err != nil {
+				return err
+			}
+			continue
+		}
+		ev := reflect.ValueOf(e.Value)
+		enc, err := ec.LookupEncoder(ev.Type())
+		if err != nil {
+			return err
+		}
+		if err = enc.EncodeValue(ec, evw, ev); err != nil {
+			return err
+		}
+	}
+	return dw.WriteDocumentEnd()
+}
+
+// 将 ParsePageQuery 生成的排序 ("-field" 为降序) 转为官方驱动的排序文档
+func driverSort(sorts []string) dbson.D {
+	d := dbson.D{}
+	for _, s := range sorts {
+		if strings.HasPrefix(s, "-") {
+			d = append(d, dbson.E{Key: s[1:], Value: -1})
+		} else {
+			d = append(d, dbson.E{Key: strings.TrimPrefix(s, "+"), Value: 1})
+		}
+	}
+	return d
+}
+
+// 将 mgo.Index 转为官方驱动的 IndexModel
+func driverIndex(i mgo.Index) (mongo.IndexModel, error) {
+	keys := dbson.D{}
+	for _, k := range i.Key {
+		field, value, err := parseIndexKey(k)
+		if err != nil {
+			return mongo.IndexModel{}, err
+		}
+		keys = append(keys, dbson.E{Key: field, Value: value})
+	}
+
+	opts := options.Index()
+	if i.Unique {
+		opts.SetUnique(true)
+	}
+	if i.Sparse {
+		opts.SetSparse(true)
+	}
+	if i.ExpireAfter > 0 {
+		seconds := int32(i.ExpireAfter.Seconds())
+		if seconds < 1 {
+			seconds = 1
+		}
+		opts.SetExpireAfterSeconds(seconds)
+	}
+	if len(i.Name) > 0 {
+		opts.SetName(i.Name)
+	}
+	if len(i.DefaultLanguage) > 0 {
+		opts.SetDefaultLanguage(i.DefaultLanguage)
+	}
+	if len(i.LanguageOverride) > 0 {
+		opts.SetLanguageOverride(i.LanguageOverride)
+	}
+	if len(i.Weights) > 0 {
+		weights := dbson.M{}
+		for k, w := range i.Weights {
+			weights[k] = w
+		}
+		opts.SetWeights(weights)
+	}
+	if i.Bits > 0 {
+		opts.SetBits(int32(i.Bits))
+	}
+	if i.Minf != 0 || i.Min != 0 {
+		opts.SetMin(i.Minf + float64(i.Min))
+	}
+	if i.Maxf != 0 || i.Max != 0 {
+		opts.SetMax(i.Maxf + float64(i.Max))
+	}
+	if i.Collation != nil {
+		opts.SetCollation(&options.Collation{
+			Locale:          i.Collation.Locale,
+			CaseLevel:       i.Collation.CaseLevel,
+			CaseFirst:       i.Collation.CaseFirst,
+			Strength:        i.Collation.Strength,
+			NumericOrdering: i.Collation.NumericOrdering,
+			Alternate:       i.Collation.Alternate,
+			Backwards:       i.Collation.Backwards,
+		})
+	}
+
+	return mongo.IndexModel{Keys: keys, Options: opts}, nil
+}
+
+// 解析 mgo 的索引 key 写法: "field", "-field", "$text:field", "$2dsphere:field" ...
+func parseIndexKey(k string) (string, interface{}, error) {
+	if strings.HasPrefix(k, "$") {
+		i := strings.Index(k, ":")
+		if i < 0 {
+			return "", nil, fmt.Errorf("invalid index key %q", k)
+		}
+		return k[i+1:], k[1:i], nil
+	}
+	if strings.HasPrefix(k, "-") {
+		return k[1:], -1, nil
+	}
+	return strings.TrimPrefix(k, "+"), 1, nil
+}
+
+// 统一官方驱动与 mgo 的 not found 错误
+func driverError(err error) error {
+	if err == mongo.ErrNoDocuments {
+		return mgo.ErrNotFound
+	}
+	return err
+}
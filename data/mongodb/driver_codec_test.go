@@ -0,0 +1,85 @@
+package mongodb
+
+import (
+	"testing"
+	"time"
+
+	dbson "go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestMgoCompatRegistry(t *testing.T) {
+	user := User{
+		Id:       bson.NewObjectId(),
+		Nick:     "Marry张",
+		Age:      23,
+		Ctime:    time.Now().Truncate(time.Millisecond),
+		TenantId: "t1",
+	}
+
+	raw, err := dbson.MarshalWithRegistry(mgoCompatRegistry, &user)
+	if err != nil {
+		t.Fatalf("marshal err: %v", err)
+	}
+
+	var doc dbson.M
+	if err = dbson.Unmarshal(raw, &doc); err != nil {
+		t.Fatalf("unmarshal err: %v", err)
+	}
+	if oid, ok := doc["_id"].(primitive.ObjectID); !ok || oid.Hex() != user.Id.Hex() {
+		t.Errorf("_id should be an ObjectID, got %T %v", doc["_id"], doc["_id"])
+	}
+
+	var decoded User
+	if err = dbson.UnmarshalWithRegistry(mgoCompatRegistry, raw, &decoded); err != nil {
+		t.Fatalf("unmarshal err: %v", err)
+	}
+	if decoded.Id != user.Id || decoded.Nick != user.Nick || !decoded.Ctime.Equal(user.Ctime) {
+		t.Errorf("decoded user not matched: %v", decoded)
+	}
+
+	// 查询条件中的 mgo 类型
+	filter := bson.M{
+		"_id":  bson.M{"$in": []bson.ObjectId{user.Id}},
+		"nick": bson.RegEx{Pattern: "^M", Options: "i"},
+		"$and": []bson.M{{"age": 23}},
+		"sort": bson.D{{Name: "age", Value: -1}},
+	}
+	raw, err = dbson.MarshalWithRegistry(mgoCompatRegistry, filter)
+	if err != nil {
+		t.Fatalf("marshal filter err: %v", err)
+	}
+	doc = dbson.M{}
+	dbson.Unmarshal(raw, &doc)
+	if re, ok := doc["nick"].(primitive.Regex); !ok || re.Pattern != "^M" || re.Options != "i" {
+		t.Errorf("regex not matched: %v", doc["nick"])
+	}
+	if sort, ok := doc["sort"].(dbson.M); !ok || sort["age"] != int32(-1) {
+		t.Errorf("bson.D not matched: %v", doc["sort"])
+	}
+}
+
+func TestDriverIndex(t *testing.T) {
+	model, err := driverIndex(mgo.Index{Key: []string{"nick", "-ctime", "$text:desc"}, Unique: true, ExpireAfter: time.Hour})
+	if err != nil {
+		t.Fatalf("convert index err: %v", err)
+	}
+	keys := model.Keys.(dbson.D)
+	if len(keys) != 3 || keys[0].Value != 1 || keys[1].Key != "ctime" || keys[1].Value != -1 || keys[2].Key != "desc" || keys[2].Value != "text" {
+		t.Errorf("index keys not matched: %v", keys)
+	}
+	if !*model.Options.Unique || *model.Options.ExpireAfterSeconds != 3600 {
+		t.Errorf("index options not matched: %v", model.Options)
+	}
+
+	if _, err = driverIndex(mgo.Index{Key: []string{"$text"}}); err == nil {
+		t.Error("invalid index key should fail")
+	}
+
+	sort := driverSort([]string{"age", "-ctime"})
+	if len(sort) != 2 || sort[0].Value != 1 || sort[1].Key != "ctime" || sort[1].Value != -1 {
+		t.Errorf("sort not matched: %v", sort)
+	}
+}
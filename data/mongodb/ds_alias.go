@@ -1,8 +1,11 @@
 package mongodb
 
 import (
+	"context"
 	"fmt"
 	"sync"
+
+	"github.com/mofancloud/xmicro/toolbox"
 )
 
 type alias struct {
@@ -30,6 +33,13 @@ func (ac *_dsCache) add(name string, al *alias) (added bool) {
 	return
 }
 
+// remove database alias.
+func (ac *_dsCache) remove(name string) {
+	ac.mux.Lock()
+	defer ac.mux.Unlock()
+	delete(ac.cache, name)
+}
+
 // get database alias if cached.
 func (ac *_dsCache) get(name string) (al *alias, ok bool) {
 	ac.mux.RLock()
@@ -44,21 +54,35 @@ func (ac *_dsCache) getDefault() (al *alias) {
 	return
 }
 
-func RegisterDataSource(aliasName string, config *Config) error {
-	ds := NewDataSource(config)
-	err := ds.Connect()
-	if err != nil {
-		return err
+// all cached aliases.
+func (ac *_dsCache) all() []*alias {
+	ac.mux.RLock()
+	defer ac.mux.RUnlock()
+	list := make([]*alias, 0, len(ac.cache))
+	for _, al := range ac.cache {
+		list = append(list, al)
 	}
+	return list
+}
 
-	al := new(alias)
-	al.Name = aliasName
+// RegisterDataSource 注册数据源并添加名为 mongodb.<aliasName> 的健康检查.
+// config.Lazy 为 true 时不立即连接, 否则连接失败 (含重试) 时返回 error, 别名可以再次注册
+func RegisterDataSource(aliasName string, config *Config) error {
+	ds := NewDataSource(config)
+	al := &alias{Name: aliasName, DataSource: ds}
+	// 先占用别名, 避免重复注册时已建立的连接泄漏
 	if !dataSourceCache.add(aliasName, al) {
 		return fmt.Errorf("DataBase alias name `%s` already registered, cannot reuse", aliasName)
 	}
 
-	al.DataSource = ds
+	if !config.Lazy {
+		if err := ds.Connect(context.Background()); err != nil {
+			dataSourceCache.remove(aliasName)
+			return err
+		}
+	}
 
+	toolbox.AddHealthCheck("mongodb."+aliasName, &dataSourceCheck{ds: ds, config: config})
 	return nil
 }
 
@@ -75,3 +99,35 @@ func GetDataSource(aliasNames ...string) (DataSource, error) {
 	}
 	return nil, fmt.Errorf("DataSource of alias name `%s` not found", name)
 }
+
+// CloseDataSources 关闭所有数据源, 用于停止服务时, 如 micro.AfterStop(mongodb.CloseDataSources)
+func CloseDataSources() error {
+	var first error
+	for _, al := range dataSourceCache.all() {
+		if err := al.DataSource.Close(); err != nil && first == nil {
+			first = fmt.Errorf("close DataSource `%s`: %w", al.Name, err)
+		}
+	}
+	return first
+}
+
+// DataSourceStats 各别名的连接池统计
+func DataSourceStats() map[string]PoolStats {
+	stats := map[string]PoolStats{}
+	for _, al := range dataSourceCache.all() {
+		stats[al.Name] = al.DataSource.Stats()
+	}
+	return stats
+}
+
+// dataSourceCheck toolbox.HealthChecker, 在 SyncTimeout 内 Ping 数据源
+type dataSourceCheck struct {
+	ds     DataSource
+	config *Config
+}
+
+func (self *dataSourceCheck) Check() error {
+	ctx, cancel := context.WithTimeout(context.Background(), self.config.syncTimeout())
+	defer cancel()
+	return self.ds.Ping(ctx)
+}
@@ -0,0 +1,158 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/mofancloud/xmicro/toolbox"
+)
+
+func TestConnectWithRetry(t *testing.T) {
+	failed := errors.New("failed")
+	calls := 0
+	err := connectWithRetry(context.Background(), &Config{ConnectRetries: 2, RetryInterval: 1}, func() error {
+		calls++
+		return failed
+	})
+	if err != failed || calls != 3 {
+		t.Fatalf("calls %d, %v", calls, err)
+	}
+
+	calls = 0
+	err = connectWithRetry(context.Background(), &Config{ConnectRetries: 2, RetryInterval: 1}, func() error {
+		calls++
+		if calls < 2 {
+			return failed
+		}
+		return nil
+	})
+	if err != nil || calls != 2 {
+		t.Fatalf("calls %d, %v", calls, err)
+	}
+}
+
+func TestConnector(t *testing.T) {
+	c := &connector[int]{}
+	config := &Config{ConnectRetries: 1000, RetryInterval: 1}
+	dialing := make(chan struct{}, 1)
+	release := make(chan struct{})
+	dials := 0
+	dial := func(ctx context.Context) (*int, error) {
+		dials++
+		dialing <- struct{}{}
+		<-release
+		n := 1
+		return &n, nil
+	}
+
+	results := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			results <- c.connect(context.Background(), config, dial, func(*int) {})
+		}()
+	}
+	<-dialing
+	// 拨号时不持有锁, 调用方的 ctx 超时后返回
+	if c.get() != nil {
+		t.Fatal("connected before dial returns")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := c.connect(ctx, config, dial, func(*int) {}); err != context.DeadlineExceeded {
+		t.Fatalf("expect deadline, got %v", err)
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if dials != 1 || c.get() == nil {
+		t.Fatalf("dials %d", dials)
+	}
+
+	// close 停止进行中的重试
+	c = &connector[int]{}
+	failed := errors.New("failed")
+	go func() {
+		results <- c.connect(context.Background(), &Config{ConnectRetries: 1000, RetryInterval: 10}, func(ctx context.Context) (*int, error) {
+			return nil, failed
+		}, func(*int) {})
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if conn := c.close(); conn != nil {
+		t.Fatal("unexpected connection")
+	}
+	select {
+	case err := <-results:
+		if err != ErrDataSourceClosed {
+			t.Fatalf("expect closed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("connect not stopped by close")
+	}
+}
+
+func TestDriverConnectConnected(t *testing.T) {
+	ds := NewDriverDataSource(&Config{TLS: true, TLSCAFile: "/nonexistent/ca.pem"})
+	// 已连接时不再读取 CA 文件
+	ds.conn.conn = &mongo.Client{}
+	if err := ds.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ds.conn.conn = nil
+	if err := ds.Connect(context.Background()); err == nil {
+		t.Fatal("expect CA file error")
+	}
+}
+
+func TestDataSourceLifecycle(t *testing.T) {
+	for _, driver := range []string{DriverMgo, DriverMongo} {
+		aliasName := "lifecycle_" + driver
+		config := &Config{Driver: driver, Addrs: "127.0.0.1:1", ConnectTimeout: 100, SyncTimeout: 100, RetryInterval: 1}
+
+		// 连接失败时释放别名
+		if err := RegisterDataSource(aliasName, config); err == nil {
+			t.Fatalf("%s: expect connect error", driver)
+		}
+		if _, err := GetDataSource(aliasName); err == nil {
+			t.Fatalf("%s: alias kept after connect error", driver)
+		}
+
+		config.Lazy = true
+		if err := RegisterDataSource(aliasName, config); err != nil {
+			t.Fatal(err)
+		}
+		if err := RegisterDataSource(aliasName, config); err == nil {
+			t.Fatalf("%s: expect duplicate alias", driver)
+		}
+		defer dataSourceCache.remove(aliasName)
+
+		ds, _ := GetDataSource(aliasName)
+		if stats := ds.Stats(); stats.Driver != driver || stats.Connected {
+			t.Fatalf("%s: %+v", driver, stats)
+		}
+		if _, ok := DataSourceStats()[aliasName]; !ok {
+			t.Fatalf("%s: missing stats", driver)
+		}
+
+		check, ok := toolbox.AdminCheckList["mongodb."+aliasName]
+		if !ok {
+			t.Fatalf("%s: health check not registered", driver)
+		}
+		if err := check.Check(); err == nil {
+			t.Fatalf("%s: expect health check error", driver)
+		}
+
+		if err := ds.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := ds.Connect(context.Background()); err != ErrDataSourceClosed {
+			t.Fatalf("%s: expect closed, got %v", driver, err)
+		}
+	}
+}
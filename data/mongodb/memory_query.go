@@ -0,0 +1,293 @@
+package mongodb
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/mofancloud/xmicro/data"
+)
+
+// 查询条件中的运算符与 data.FilterType 的对应, 与 BuildCriteria 相反
+var criteriaOperators = map[string]data.FilterType{
+	"$eq":     data.FilterType_EQ,
+	"$ne":     data.FilterType_NE,
+	"$gt":     data.FilterType_GT,
+	"$gte":    data.FilterType_GTE,
+	"$lt":     data.FilterType_LT,
+	"$lte":    data.FilterType_LTE,
+	"$in":     data.FilterType_IN,
+	"$nin":    data.FilterType_NOT_IN,
+	"$exists": data.FilterType_EXISTS,
+	"$size":   data.FilterType_SIZE,
+}
+
+var memEvaluator = data.NewEvaluator("bson")
+
+// memMatcher 将 BuildCriteria 等生成的查询条件转为 data.Filter, 在内存中用 data.Evaluator 执行
+func memMatcher(criteria bson.M) (func(doc bson.M) (bool, error), error) {
+	f, err := criteriaFilter(criteria)
+	if err != nil {
+		return nil, err
+	}
+	return func(doc bson.M) (bool, error) {
+		return memEvaluator.Match(f, doc)
+	}, nil
+}
+
+func asDocument(v interface{}) (map[string]interface{}, bool) {
+	switch m := v.(type) {
+	case bson.M:
+		return m, true
+	case map[string]interface{}:
+		return m, true
+	}
+	return nil, false
+}
+
+func asDocuments(v interface{}) ([]map[string]interface{}, bool) {
+	switch items := v.(type) {
+	case []bson.M:
+		docs := make([]map[string]interface{}, len(items))
+		for i, item := range items {
+			docs[i] = item
+		}
+		return docs, true
+	case []map[string]interface{}:
+		return items, true
+	case []interface{}:
+		docs := make([]map[string]interface{}, len(items))
+		for i, item := range items {
+			doc, ok := asDocument(item)
+			if !ok {
+				return nil, false
+			}
+			docs[i] = doc
+		}
+		return docs, true
+	}
+	return nil, false
+}
+
+func isOperatorDocument(m map[string]interface{}) bool {
+	if len(m) == 0 {
+		return false
+	}
+	for k := range m {
+		if !strings.HasPrefix(k, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+func criteriaFilter(criteria map[string]interface{}) (data.Filter, error) {
+	and := data.And()
+	keys := make([]string, 0, len(criteria))
+	for k := range criteria {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		v := criteria[k]
+		switch k {
+		case "$and", "$or", "$nor":
+			docs, ok := asDocuments(v)
+			if !ok {
+				return nil, filterError(k, "", "expect an array of documents, got %T", v)
+			}
+			subs := []data.Filter{}
+			for _, doc := range docs {
+				sub, err := criteriaFilter(doc)
+				if err != nil {
+					return nil, err
+				}
+				subs = append(subs, sub)
+			}
+			op := map[string]data.FilterType{"$and": data.FilterType_AND, "$or": data.FilterType_OR, "$nor": data.FilterType_NOR}[k]
+			and.Filters = append(and.Filters, &data.Logical{Op: op, Filters: subs})
+			continue
+		}
+		if strings.HasPrefix(k, "$") {
+			return nil, fmt.Errorf("%w: %s", data.ErrUnsupportedFilter, k)
+		}
+
+		if re, ok := v.(bson.RegEx); ok {
+			and.Filters = append(and.Filters, regexCondition(k, re.Pattern, re.Options))
+			continue
+		}
+		ops, ok := asDocument(v)
+		if !ok || !isOperatorDocument(ops) {
+			and.Filters = append(and.Filters, data.Field(k).Eq(v))
+			continue
+		}
+		conds, err := operatorConditions(k, ops)
+		if err != nil {
+			return nil, err
+		}
+		and.Filters = append(and.Filters, conds...)
+	}
+	return and, nil
+}
+
+func regexCondition(field string, pattern string, options string) *data.Condition {
+	if options == "" {
+		return data.Field(field).Op(data.FilterType_MATCH, pattern)
+	}
+	return data.Field(field).Op(data.FilterType_MATCH, map[string]interface{}{"pattern": pattern, "options": options})
+}
+
+func operatorConditions(field string, ops map[string]interface{}) ([]data.Filter, error) {
+	conds := []data.Filter{}
+	if pattern, ok := ops["$regex"]; ok {
+		p, _ := pattern.(string)
+		options, _ := ops["$options"].(string)
+		conds = append(conds, regexCondition(field, p, options))
+	}
+
+	for op, v := range ops {
+		switch op {
+		case "$regex", "$options":
+		case "$not":
+			var inner []data.Filter
+			if re, ok := v.(bson.RegEx); ok {
+				inner = []data.Filter{regexCondition(field, re.Pattern, re.Options)}
+			} else if sub, ok := asDocument(v); ok {
+				var err error
+				if inner, err = operatorConditions(field, sub); err != nil {
+					return nil, err
+				}
+			} else {
+				return nil, filterError(field, "", "$not expect a regex or operators, got %T", v)
+			}
+			conds = append(conds, data.Nor(data.And(inner...)))
+		case "$elemMatch":
+			sub, ok := asDocument(v)
+			if !ok {
+				return nil, filterError(field, "", "$elemMatch expect a document, got %T", v)
+			}
+			var elem data.Filter
+			if isOperatorDocument(sub) {
+				elemConds, err := operatorConditions("", sub)
+				if err != nil {
+					return nil, err
+				}
+				elem = data.And(elemConds...)
+			} else {
+				var err error
+				if elem, err = criteriaFilter(sub); err != nil {
+					return nil, err
+				}
+			}
+			conds = append(conds, data.Field(field).Op(data.FilterType_ELEM_MATCH, elem))
+		default:
+			t, ok := criteriaOperators[op]
+			if !ok {
+				return nil, fmt.Errorf("%w: %s", data.ErrUnsupportedFilter, op)
+			}
+			conds = append(conds, data.Field(field).Op(t, v))
+		}
+	}
+	return conds, nil
+}
+
+// Mongo 不同类型之间的排序: null < 数字 < 字符串 < 对象 < 数组 < ObjectId < bool < 时间
+func sortRank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 0
+	case bson.ObjectId:
+		return 5
+	case string:
+		return 2
+	case bool:
+		return 6
+	case time.Time:
+		return 7
+	}
+	if _, ok := asDocument(v); ok {
+		return 3
+	}
+	switch reflect.ValueOf(v).Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return 1
+	case reflect.Slice, reflect.Array:
+		return 4
+	}
+	return 8
+}
+
+func compareForSort(a, b interface{}) int {
+	ra, rb := sortRank(a), sortRank(b)
+	if ra != rb {
+		return ra - rb
+	}
+	n, _ := data.CompareValues(a, b)
+	return n
+}
+
+// sortDocs 按 ParsePageQuery 格式的排序 ("-field" 为降序) 稳定排序, 不存在的字段按 null
+func sortDocs(docs []bson.M, sorts []string) {
+	if len(sorts) == 0 {
+		return
+	}
+	sort.SliceStable(docs, func(i, j int) bool {
+		for _, s := range sorts {
+			field, desc := strings.TrimPrefix(s, "+"), false
+			if strings.HasPrefix(s, "-") {
+				field, desc = s[1:], true
+			}
+			a, _ := memEvaluator.Lookup(docs[i], field)
+			b, _ := memEvaluator.Lookup(docs[j], field)
+			if n := compareForSort(a, b); n != 0 {
+				return (n < 0) != desc
+			}
+		}
+		return false
+	})
+}
+
+// projectDoc 按 BuildProjection 的结果取字段, a.b 形式的字段按第一级处理
+func projectDoc(doc bson.M, fields bson.M) bson.M {
+	if len(fields) == 0 {
+		return doc
+	}
+	include := false
+	for k, v := range fields {
+		if k != "_id" && v == 1 {
+			include = true
+		}
+	}
+
+	out := bson.M{}
+	if include {
+		if fields["_id"] != 0 {
+			if id, ok := doc["_id"]; ok {
+				out["_id"] = id
+			}
+		}
+		for k, v := range fields {
+			top := strings.Split(k, ".")[0]
+			if val, ok := doc[top]; ok && v == 1 {
+				out[top] = val
+			}
+		}
+		return out
+	}
+	for k, v := range doc {
+		out[k] = v
+	}
+	for k := range fields {
+		if !strings.Contains(k, ".") {
+			delete(out, k)
+		}
+	}
+	return out
+}
@@ -0,0 +1,856 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/mofancloud/xmicro/data"
+)
+
+// ErrMemoryNotSupported 内存仓库没有 *mgo.Collection, 不支持 Execute 和聚合
+var ErrMemoryNotSupported = errors.New("not supported by the memory repository")
+
+// MemoryRepository 内存中的 MongoRepository, 用于单元测试.
+// 文档按 bson 编码后保存, 查询条件与 BuildCriteria/ParsePageQuery 的语义一致, 不支持 TEXT 和 GEO_WITHIN.
+// Unique() 的字段和 Indexed.Indexes() 中的唯一索引都按唯一约束检查, 集合同样按 ctx 和 Model 的租户路由.
+// WithTransaction 失败时恢复到开始时的快照, 与其他 goroutine 的写入之间没有隔离
+type MemoryRepository struct {
+	mux         sync.RWMutex
+	collections map[string]*memCollection
+}
+
+type memCollection struct {
+	name    string
+	docs    []bson.M // 按插入顺序, 文档更新时整体替换, 不在原处修改
+	indexes []mgo.Index
+}
+
+// Constructor
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{collections: map[string]*memCollection{}}
+}
+
+// memCollectionName 按 routeModel 的结果区分集合, 与 mgo 和官方驱动的仓库一样按租户路由
+func memCollectionName(aliasName, database, collection string) string {
+	if aliasName != "" {
+		return aliasName + "/" + database + "." + collection
+	}
+	return database + "." + collection
+}
+
+// collection 需持有写锁, 集合不存在时创建
+func (self *MemoryRepository) collection(ctx context.Context, m Model) (*memCollection, error) {
+	aliasName, database, collection, err := routeModel(ctx, "", m)
+	if err != nil {
+		return nil, err
+	}
+	name := memCollectionName(aliasName, database, collection)
+	c, ok := self.collections[name]
+	if !ok {
+		c = &memCollection{name: name, docs: []bson.M{}}
+		self.collections[name] = c
+	}
+	return c, nil
+}
+
+// existing 需持有读锁, 集合不存在时返回空集合
+func (self *MemoryRepository) existing(ctx context.Context, m Model) (*memCollection, error) {
+	aliasName, database, collection, err := routeModel(ctx, "", m)
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := self.collections[memCollectionName(aliasName, database, collection)]; ok {
+		return c, nil
+	}
+	return &memCollection{}, nil
+}
+
+func toDocument(v interface{}) (bson.M, error) {
+	raw, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	doc := bson.M{}
+	if err = bson.Unmarshal(raw, doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func fromDocument(doc bson.M, out interface{}) error {
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(raw, out)
+}
+
+// decodeDocs result 为 slice 的指针
+func decodeDocs(docs []bson.M, result interface{}) error {
+	rv := reflect.ValueOf(result)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("result must be a pointer to slice, got %T", result)
+	}
+	slice := rv.Elem()
+	elemType := slice.Type().Elem()
+	list := reflect.MakeSlice(slice.Type(), 0, len(docs))
+	for _, doc := range docs {
+		var elem reflect.Value
+		if elemType.Kind() == reflect.Ptr {
+			elem = reflect.New(elemType.Elem())
+			if err := fromDocument(doc, elem.Interface()); err != nil {
+				return err
+			}
+		} else {
+			ptr := reflect.New(elemType)
+			if err := fromDocument(doc, ptr.Interface()); err != nil {
+				return err
+			}
+			elem = ptr.Elem()
+		}
+		list = reflect.Append(list, elem)
+	}
+	slice.Set(list)
+	return nil
+}
+
+func copyDoc(doc bson.M) bson.M {
+	out := make(bson.M, len(doc))
+	for k, v := range doc {
+		out[k] = v
+	}
+	return out
+}
+
+// setPath 设置 a.b 形式的字段, 中间的文档复制后修改
+func setPath(doc bson.M, path string, v interface{}) {
+	parts := strings.SplitN(path, ".", 2)
+	if len(parts) == 1 {
+		doc[path] = v
+		return
+	}
+	sub := bson.M{}
+	if exist, ok := asDocument(doc[parts[0]]); ok {
+		for k, ev := range exist {
+			sub[k] = ev
+		}
+	}
+	setPath(sub, parts[1], v)
+	doc[parts[0]] = sub
+}
+
+// applySet 返回 $set 之后的新文档
+func applySet(doc bson.M, set bson.M) bson.M {
+	out := copyDoc(doc)
+	for k, v := range set {
+		setPath(out, k, v)
+	}
+	return out
+}
+
+type memUniqueKey struct {
+	fields []string
+	sparse bool
+	name   string
+}
+
+// uniqueKeys 唯一约束, 包括 Unique() 的字段和唯一索引
+func (c *memCollection) uniqueKeys(m Model) []memUniqueKey {
+	keys := []memUniqueKey{}
+	unique := []string{}
+	for k := range m.Unique() {
+		unique = append(unique, k)
+	}
+	sort.Strings(unique)
+	if len(unique) > 0 {
+		keys = append(keys, memUniqueKey{fields: unique, name: strings.Join(unique, "_")})
+	}
+
+	indexes := c.indexes
+	if im, ok := m.(Indexed); ok {
+		indexes = append(append([]mgo.Index{}, indexes...), im.Indexes()...)
+	}
+	for _, index := range indexes {
+		if !index.Unique {
+			continue
+		}
+		key := memUniqueKey{sparse: index.Sparse, name: index.Name}
+		for _, k := range index.Key {
+			if strings.HasPrefix(k, "$") {
+				key.fields = nil
+				break
+			}
+			key.fields = append(key.fields, strings.TrimLeft(k, "+-"))
+		}
+		if key.name == "" {
+			key.name = strings.Join(key.fields, "_")
+		}
+		if len(key.fields) > 0 {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// checkUnique doc 放在下标 skip 处 (-1 为新增) 时是否违反唯一约束,
+// 缺少的字段按 null 比较, sparse 索引不检查缺少字段的文档
+func (c *memCollection) checkUnique(m Model, doc bson.M, skip int) error {
+	for _, key := range c.uniqueKeys(m) {
+		values := make([]interface{}, len(key.fields))
+		missing := false
+		for i, f := range key.fields {
+			var ok bool
+			if values[i], ok = memEvaluator.Lookup(doc, f); !ok {
+				missing = true
+			}
+		}
+		if missing && key.sparse {
+			continue
+		}
+		for i, other := range c.docs {
+			if i == skip {
+				continue
+			}
+			same := true
+			for j, f := range key.fields {
+				ov, _ := memEvaluator.Lookup(other, f)
+				if !data.EqualValues(ov, values[j]) {
+					same = false
+					break
+				}
+			}
+			if same {
+				return &mgo.LastError{
+					Code: 11000,
+					Err:  fmt.Sprintf("E11000 duplicate key error collection: %s index: %s", c.name, key.name),
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// match 满足条件的文档下标, limit 为 0 时不限制
+func (c *memCollection) match(criteria bson.M, limit int) ([]int, error) {
+	matcher, err := memMatcher(criteria)
+	if err != nil {
+		return nil, err
+	}
+	idxs := []int{}
+	for i, doc := range c.docs {
+		ok, err := matcher(doc)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			idxs = append(idxs, i)
+			if limit > 0 && len(idxs) >= limit {
+				break
+			}
+		}
+	}
+	return idxs, nil
+}
+
+func (c *memCollection) insert(m Model, doc bson.M) error {
+	if _, ok := doc["_id"]; !ok {
+		doc["_id"] = bson.NewObjectId()
+	}
+	if err := c.checkUnique(m, doc, -1); err != nil {
+		return err
+	}
+	c.docs = append(c.docs, doc)
+	return nil
+}
+
+func (c *memCollection) replace(m Model, i int, doc bson.M) error {
+	if err := c.checkUnique(m, doc, i); err != nil {
+		return err
+	}
+	c.docs[i] = doc
+	return nil
+}
+
+func (c *memCollection) remove(idxs []int) {
+	removed := map[int]bool{}
+	for _, i := range idxs {
+		removed[i] = true
+	}
+	docs := make([]bson.M, 0, len(c.docs)-len(idxs))
+	for i, doc := range c.docs {
+		if !removed[i] {
+			docs = append(docs, doc)
+		}
+	}
+	c.docs = docs
+}
+
+// findDocs 过滤, 排序, 分页, 取字段, 返回的文档可以直接使用
+func (self *MemoryRepository) findDocs(ctx context.Context, m Model, criteria bson.M, sorts []string, skip int, limit int, fields bson.M) ([]bson.M, error) {
+	self.mux.RLock()
+	c, err := self.existing(ctx, m)
+	var idxs []int
+	if err == nil {
+		idxs, err = c.match(criteria, 0)
+	}
+	docs := make([]bson.M, len(idxs))
+	for i, idx := range idxs {
+		docs[i] = c.docs[idx]
+	}
+	self.mux.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	sortDocs(docs, sorts)
+	if skip > 0 {
+		if skip >= len(docs) {
+			docs = docs[:0]
+		} else {
+			docs = docs[skip:]
+		}
+	}
+	if limit > 0 && limit < len(docs) {
+		docs = docs[:limit]
+	}
+	for i := range docs {
+		docs[i] = projectDoc(docs[i], fields)
+	}
+	return docs, nil
+}
+
+func (self *MemoryRepository) findOne(ctx context.Context, m Model, criteria bson.M, fields bson.M, out interface{}) error {
+	docs, err := self.findDocs(ctx, m, criteria, nil, 0, 1, fields)
+	if err != nil {
+		return err
+	}
+	if len(docs) == 0 {
+		return mgo.ErrNotFound
+	}
+	return fromDocument(docs[0], out)
+}
+
+func (self *MemoryRepository) count(ctx context.Context, m Model, criteria bson.M, limit int) (int64, error) {
+	self.mux.RLock()
+	defer self.mux.RUnlock()
+	c, err := self.existing(ctx, m)
+	if err != nil {
+		return 0, err
+	}
+	idxs, err := c.match(criteria, limit)
+	return int64(len(idxs)), err
+}
+
+// updateAll 对满足条件的文档 $set, limit 为 0 时不限制, 返回匹配的数量
+func (self *MemoryRepository) updateAll(ctx context.Context, m Model, criteria bson.M, set bson.M, limit int) (int64, error) {
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	c, err := self.collection(ctx, m)
+	if err != nil {
+		return 0, err
+	}
+	idxs, err := c.match(criteria, limit)
+	if err != nil {
+		return 0, err
+	}
+	for _, i := range idxs {
+		if err = c.replace(m, i, applySet(c.docs[i], set)); err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(idxs)), nil
+}
+
+// removeAll 删除满足条件的文档, limit 为 0 时不限制
+func (self *MemoryRepository) removeAll(ctx context.Context, m Model, criteria bson.M, limit int) (int64, error) {
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	c, err := self.collection(ctx, m)
+	if err != nil {
+		return 0, err
+	}
+	idxs, err := c.match(criteria, limit)
+	if err != nil {
+		return 0, err
+	}
+	c.remove(idxs)
+	return int64(len(idxs)), nil
+}
+
+// upsertDocs upsertUpdate 中 $set 和 $setOnInsert 按 bson 编码后的内容
+func upsertDocs(update bson.M) (set bson.M, setOnInsert bson.M, err error) {
+	if set, err = toDocument(update["$set"]); err != nil {
+		return nil, nil, err
+	}
+	if onInsert, ok := update["$setOnInsert"]; ok {
+		if setOnInsert, err = toDocument(onInsert); err != nil {
+			return nil, nil, err
+		}
+	}
+	return set, setOnInsert, nil
+}
+
+// upsert 同 mgo 的 Upsert, 插入时文档为 selector 中的等值字段加上 set 和 setOnInsert, 返回是否更新了已有文档和插入的 _id
+func (self *MemoryRepository) upsert(ctx context.Context, m Model, selector bson.M, set bson.M, setOnInsert bson.M) (updated bool, id interface{}, err error) {
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	c, err := self.collection(ctx, m)
+	if err != nil {
+		return false, nil, err
+	}
+	idxs, err := c.match(selector, 1)
+	if err != nil {
+		return false, nil, err
+	}
+	if len(idxs) > 0 {
+		return true, nil, c.replace(m, idxs[0], applySet(c.docs[idxs[0]], set))
+	}
+
+	doc := bson.M{}
+	for k, v := range selector {
+		if ops, ok := asDocument(v); strings.HasPrefix(k, "$") || ok && isOperatorDocument(ops) {
+			continue
+		}
+		setPath(doc, k, v)
+	}
+	doc = applySet(applySet(doc, set), setOnInsert)
+	if err = c.insert(m, doc); err != nil {
+		return false, nil, err
+	}
+	return false, doc["_id"], nil
+}
+
+func (self *MemoryRepository) All(m Model, result interface{}) error {
+	return self.AllContext(context.Background(), m, result)
+}
+
+func (self *MemoryRepository) AllContext(ctx context.Context, m Model, result interface{}) error {
+	fields, err := contextProjection(ctx, m)
+	if err != nil {
+		return err
+	}
+	docs, err := self.findDocs(ctx, m, notDeleted(ctx, m, bson.M{}), nil, 0, 0, fields)
+	if err != nil {
+		return err
+	}
+	return decodeDocs(docs, result)
+}
+
+func (self *MemoryRepository) Count(m Model) (count int64, err error) {
+	return self.CountContext(context.Background(), m)
+}
+
+func (self *MemoryRepository) CountContext(ctx context.Context, m Model) (count int64, err error) {
+	return self.count(ctx, m, notDeleted(ctx, m, bson.M{}), 0)
+}
+
+func (self *MemoryRepository) Update(m Model) (updated int, err error) {
+	return self.UpdateContext(context.Background(), m)
+}
+
+func (self *MemoryRepository) UpdateContext(ctx context.Context, m Model) (updated int, err error) {
+	stampUpdate(m)
+	selector := m.Unique()
+	vm, versioned := m.(Versioned)
+	if versioned {
+		selector = versionSelector(vm)
+		vm.SetVersion(vm.GetVersion() + 1)
+	}
+
+	err = self.updateModel(ctx, m, selector, versioned)
+	if err != nil {
+		if versioned {
+			vm.SetVersion(vm.GetVersion() - 1)
+		}
+		return 0, err
+	}
+	// 同 mgo 的 ReturnNew, 读回更新后的文档
+	return 1, self.findOne(ctx, m, m.Unique(), nil, m)
+}
+
+func (self *MemoryRepository) updateModel(ctx context.Context, m Model, selector bson.M, versioned bool) error {
+	set, err := toDocument(m)
+	if err != nil {
+		return err
+	}
+	n, err := self.updateAll(ctx, m, selector, set, 1)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return self.notMatched(ctx, m, versioned)
+	}
+	return nil
+}
+
+// notMatched 按 selector 没有匹配时, 带版本的按唯一键判断是否为并发修改
+func (self *MemoryRepository) notMatched(ctx context.Context, m Model, versioned bool) error {
+	if !versioned {
+		return mgo.ErrNotFound
+	}
+	n, err := self.count(ctx, m, m.Unique(), 1)
+	if err != nil {
+		return err
+	}
+	return versionConflict(n > 0)
+}
+
+func (self *MemoryRepository) UpdateSelective(m Model, updateData map[string]interface{}) error {
+	return self.UpdateSelectiveContext(context.Background(), m, updateData)
+}
+
+func (self *MemoryRepository) UpdateSelectiveContext(ctx context.Context, m Model, updateData map[string]interface{}) error {
+	selector, set := m.Unique(), bson.M(updateData)
+	vm, versioned := m.(Versioned)
+	if versioned {
+		selector, set = versionSelector(vm), versionedSet(vm, updateData)
+	}
+	set = stampSet(m, set)
+
+	// 与数据库一致, 值按 bson 编码后保存
+	doc, err := toDocument(set)
+	if err != nil {
+		return err
+	}
+	n, err := self.updateAll(ctx, m, selector, doc, 1)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return self.notMatched(ctx, m, versioned)
+	}
+	if versioned {
+		vm.SetVersion(vm.GetVersion() + 1)
+	}
+	return nil
+}
+
+func (self *MemoryRepository) Insert(m Model) error {
+	return self.InsertContext(context.Background(), m)
+}
+
+func (self *MemoryRepository) InsertContext(ctx context.Context, m Model) error {
+	stampInsert(m)
+	doc, err := toDocument(m)
+	if err != nil {
+		return err
+	}
+	return self.insert(ctx, m, doc)
+}
+
+func (self *MemoryRepository) insert(ctx context.Context, m Model, doc bson.M) error {
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	c, err := self.collection(ctx, m)
+	if err != nil {
+		return err
+	}
+	return c.insert(m, doc)
+}
+
+func (self *MemoryRepository) Upsert(m Model) (upserted int, err error) {
+	return self.UpsertContext(context.Background(), m)
+}
+
+// UpsertContext upserted 同 mgo, 更新了已有文档时为 1, 插入时为 0
+func (self *MemoryRepository) UpsertContext(ctx context.Context, m Model) (upserted int, err error) {
+	stampInsert(m)
+	selector := m.Unique()
+	vm, versioned := m.(Versioned)
+	if versioned {
+		selector = versionSelector(vm)
+		vm.SetVersion(vm.GetVersion() + 1)
+	}
+
+	update, err := upsertUpdate(m, nil)
+	var set, setOnInsert bson.M
+	if err == nil {
+		set, setOnInsert, err = upsertDocs(update)
+	}
+	if err == nil {
+		var updated bool
+		updated, _, err = self.upsert(ctx, m, selector, set, setOnInsert)
+		if updated {
+			upserted = 1
+		}
+		if versioned && mgo.IsDup(err) {
+			err = ErrConcurrentModification
+		}
+	}
+
+	if err != nil && versioned {
+		vm.SetVersion(vm.GetVersion() - 1)
+	}
+	return
+}
+
+func (self *MemoryRepository) FindOne(m Model) error {
+	return self.FindOneContext(context.Background(), m)
+}
+
+func (self *MemoryRepository) FindOneContext(ctx context.Context, m Model) error {
+	fields, err := contextProjection(ctx, m)
+	if err != nil {
+		return err
+	}
+	return self.findOne(ctx, m, notDeleted(ctx, m, m.Unique()), fields, m)
+}
+
+func (self *MemoryRepository) Delete(m Model) error {
+	return self.DeleteContext(context.Background(), m)
+}
+
+func (self *MemoryRepository) DeleteContext(ctx context.Context, m Model) error {
+	sm, soft := m.(SoftDeletable)
+	if !soft {
+		n, err := self.removeAll(ctx, m, m.Unique(), 1)
+		if err == nil && n == 0 {
+			err = mgo.ErrNotFound
+		}
+		return err
+	}
+
+	now := time.Now()
+	n, err := self.updateAll(ctx, m, notDeleted(ctx, m, m.Unique()), bson.M{FieldDeletedAt: now}, 1)
+	if err == nil && n == 0 {
+		err = mgo.ErrNotFound
+	}
+	if err == nil {
+		sm.SetDeletedAt(now)
+	}
+	return err
+}
+
+func (self *MemoryRepository) Page(pageQuery *data.PageQuery, m Model, list interface{}) (total int64, pageNo int64, pageSize int32, err error) {
+	return self.PageContext(context.Background(), pageQuery, m, list)
+}
+
+func (self *MemoryRepository) PageContext(ctx context.Context, pageQuery *data.PageQuery, m Model, list interface{}) (total int64, pageNo int64, pageSize int32, err error) {
+	query := *pageQuery
+	query.Filters = notDeletedFilters(ctx, m, pageQuery.Filters)
+	query.Fields, query.Exclude = projectionFields(ctx, pageQuery.Fields, pageQuery.Exclude)
+	filters, pageNo, pageSize, sorts, err := ParsePageQuery(m, &query)
+	if err != nil {
+		return
+	}
+	fields, err := BuildProjection(m, query.Fields, query.Exclude)
+	if err != nil {
+		return
+	}
+
+	if total, err = self.count(ctx, m, filters, 0); err != nil {
+		return
+	}
+	offset := int((pageNo - 1) * int64(pageSize))
+	docs, err := self.findDocs(ctx, m, filters, sorts, offset, int(pageSize), fields)
+	if err != nil {
+		return
+	}
+	err = decodeDocs(docs, list)
+	return
+}
+
+func (self *MemoryRepository) PageCursor(cursorQuery *data.CursorQuery, m Model, list interface{}) (*data.CursorInfo, error) {
+	return self.PageCursorContext(context.Background(), cursorQuery, m, list)
+}
+
+func (self *MemoryRepository) PageCursorContext(ctx context.Context, cursorQuery *data.CursorQuery, m Model, list interface{}) (*data.CursorInfo, error) {
+	query := *cursorQuery
+	query.Filters = notDeletedFilters(ctx, m, cursorQuery.Filters)
+	query.Fields, query.Exclude = projectionFields(ctx, cursorQuery.Fields, cursorQuery.Exclude)
+	plan, err := parseCursorQuery(m, &query)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := plan.projection(m, &query)
+	if err != nil {
+		return nil, err
+	}
+
+	docs, err := self.findDocs(ctx, m, plan.criteria, plan.sorts, 0, plan.limit(), fields)
+	if err != nil {
+		return nil, err
+	}
+	if err = decodeDocs(docs, list); err != nil {
+		return nil, err
+	}
+	info, err := plan.finish(list)
+	if err != nil {
+		return nil, err
+	}
+
+	var total int64
+	switch plan.total {
+	case data.TotalMode_EXACT:
+		total, err = self.count(ctx, m, plan.filters, 0)
+	case data.TotalMode_ESTIMATED:
+		total, err = self.count(ctx, m, bson.M{}, 0)
+	default:
+		return info, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	info.Total = &total
+	return info, nil
+}
+
+func (self *MemoryRepository) Execute(m Model, fn DBFunc) error {
+	return ErrMemoryNotSupported
+}
+
+func (self *MemoryRepository) ExecuteContext(ctx context.Context, m Model, fn DBFunc) error {
+	return ErrMemoryNotSupported
+}
+
+func (self *MemoryRepository) BulkWrite(ops []BulkOp, opts *BulkOptions) (*BulkResult, error) {
+	return self.BulkWriteContext(context.Background(), ops, opts)
+}
+
+func (self *MemoryRepository) BulkWriteContext(ctx context.Context, ops []BulkOp, opts *BulkOptions) (*BulkResult, error) {
+	if len(ops) == 0 {
+		return &BulkResult{}, nil
+	}
+	if err := checkBulkTenants(ctx, ops); err != nil {
+		return nil, err
+	}
+	return runBulk(ops, opts, func(batch []BulkOp, ordered bool) (*bulkBatchResult, error) {
+		return self.bulkBatch(ctx, batch, ordered)
+	})
+}
+
+// bulkBatch 与 mgo 的 Bulk 一致: update/delete 没有匹配时不算错误, 带版本的 update 除外
+func (self *MemoryRepository) bulkBatch(ctx context.Context, batch []BulkOp, ordered bool) (*bulkBatchResult, error) {
+	br := &bulkBatchResult{errs: map[int]error{}, upsertedIds: map[int]interface{}{}}
+	for i, op := range batch {
+		var err error
+		switch op.Type {
+		case BulkOpInsert:
+			var doc bson.M
+			if doc, err = toDocument(op.Model); err == nil {
+				err = self.insert(ctx, op.Model, doc)
+			}
+			if err == nil {
+				br.inserted++
+			}
+		case BulkOpUpdate, BulkOpUpsert:
+			var set, setOnInsert bson.M
+			if set, setOnInsert, err = upsertDocs(op.update()); err != nil {
+				break
+			}
+			if op.Type == BulkOpUpdate {
+				var n int64
+				if n, err = self.updateAll(ctx, op.Model, op.selector, set, 1); err == nil {
+					br.matched += int(n)
+					br.modified += int(n)
+					err = op.checkVersion(int(n))
+				}
+				break
+			}
+			var updated bool
+			var id interface{}
+			updated, id, err = self.upsert(ctx, op.Model, op.selector, set, setOnInsert)
+			if err != nil {
+				err = op.versionConflict(err, mgo.IsDup(err))
+			} else if updated {
+				br.matched++
+				br.modified++
+			} else {
+				br.upserted++
+				br.upsertedIds[i] = id
+			}
+		case BulkOpDelete:
+			var n int64
+			if n, err = self.removeAll(ctx, op.Model, op.selector, 1); err == nil {
+				br.deleted += int(n)
+			}
+		default:
+			return nil, fmt.Errorf("unknown bulk operation `%s`", op.Type)
+		}
+		if err != nil {
+			br.errs[i] = err
+			if ordered {
+				break
+			}
+		}
+	}
+	return br, nil
+}
+
+// EnsureIndexes 记录唯一索引, 之后的写入按它检查, 已有的重复文档返回错误
+func (self *MemoryRepository) EnsureIndexes(m Indexed) error {
+	return self.EnsureIndexesContext(context.Background(), m)
+}
+
+func (self *MemoryRepository) EnsureIndexesContext(ctx context.Context, m Indexed) error {
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	c, err := self.collection(ctx, m)
+	if err != nil {
+		return err
+	}
+	for _, index := range m.Indexes() {
+		c.indexes = append(c.indexes, index)
+	}
+	for i, doc := range c.docs {
+		if err := c.checkUnique(m, doc, i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WithTransaction fn 返回 error 或 panic 时恢复到开始时的数据
+func (self *MemoryRepository) WithTransaction(ctx context.Context, fn func(tx MongoRepository) error) (err error) {
+	snapshot := self.snapshot()
+	defer func() {
+		if p := recover(); p != nil {
+			self.restore(snapshot)
+			panic(p)
+		}
+		if err != nil {
+			self.restore(snapshot)
+		}
+	}()
+	return fn(self)
+}
+
+func (self *MemoryRepository) snapshot() map[string]*memCollection {
+	self.mux.RLock()
+	defer self.mux.RUnlock()
+	snapshot := make(map[string]*memCollection, len(self.collections))
+	for name, c := range self.collections {
+		snapshot[name] = &memCollection{
+			name:    c.name,
+			docs:    append([]bson.M{}, c.docs...),
+			indexes: append([]mgo.Index{}, c.indexes...),
+		}
+	}
+	return snapshot
+}
+
+func (self *MemoryRepository) restore(snapshot map[string]*memCollection) {
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	self.collections = snapshot
+}
+
+func (self *MemoryRepository) Watch(ctx context.Context, m Model, handler ChangeHandler, opts *WatchOptions) error {
+	return ErrChangeStreamNotSupported
+}
+
+// Reset 清空全部数据和索引
+func (self *MemoryRepository) Reset() {
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	self.collections = map[string]*memCollection{}
+}
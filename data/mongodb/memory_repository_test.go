@@ -0,0 +1,309 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/mofancloud/xmicro/data"
+)
+
+func TestMemoryRepository(t *testing.T) {
+	repo := NewMemoryRepository()
+	var _ MongoRepository = repo
+
+	ctime := time.Unix(1500000000, 0)
+	users := []*User{}
+	for i, nick := range []string{"alice", "bob", "carol", "dave", "Eve"} {
+		u := &User{Id: bson.NewObjectId(), Nick: nick, Age: 20 + i*10, Type: i % 2, Ctime: ctime.Add(time.Duration(i) * time.Hour), TenantId: "mem"}
+		if err := repo.Insert(u); err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, u)
+	}
+
+	// Indexes() 中 nick 的唯一索引
+	if err := repo.Insert(&User{Id: bson.NewObjectId(), Nick: "alice", TenantId: "mem"}); !mgo.IsDup(err) {
+		t.Fatalf("expect duplicate key, got %v", err)
+	}
+	if err := repo.Insert(&User{Id: users[0].Id, Nick: "other", TenantId: "mem"}); !mgo.IsDup(err) {
+		t.Fatalf("expect duplicate _id, got %v", err)
+	}
+
+	if n, err := repo.Count(&User{TenantId: "mem"}); err != nil || n != 5 {
+		t.Fatalf("count %d %v", n, err)
+	}
+	// 其他租户的库
+	if n, _ := repo.Count(&User{TenantId: "other"}); n != 0 {
+		t.Fatalf("count of other tenant %d", n)
+	}
+
+	u := &User{Id: users[1].Id, TenantId: "mem"}
+	if err := repo.FindOne(u); err != nil || u.Nick != "bob" || !u.Ctime.Equal(users[1].Ctime) {
+		t.Fatalf("%+v %v", u, err)
+	}
+	if err := repo.FindOne(&User{Id: bson.NewObjectId(), TenantId: "mem"}); err != mgo.ErrNotFound {
+		t.Fatalf("expect not found, got %v", err)
+	}
+
+	u.Age = 31
+	if n, err := repo.Update(u); err != nil || n != 1 {
+		t.Fatalf("update %d %v", n, err)
+	}
+	if err := repo.UpdateSelective(&User{Id: users[2].Id, TenantId: "mem"}, map[string]interface{}{"nick": "alice"}); !mgo.IsDup(err) {
+		t.Fatalf("expect duplicate key, got %v", err)
+	}
+	if err := repo.UpdateSelective(&User{Id: users[2].Id, TenantId: "mem"}, map[string]interface{}{"age": 41}); err != nil {
+		t.Fatal(err)
+	}
+
+	f := &User{Id: bson.NewObjectId(), Nick: "frank", Age: 70, Type: 1, Ctime: ctime, TenantId: "mem"}
+	if n, err := repo.Upsert(f); err != nil || n != 0 {
+		t.Fatalf("upsert insert %d %v", n, err)
+	}
+	f.Age = 71
+	if n, err := repo.Upsert(f); err != nil || n != 1 {
+		t.Fatalf("upsert update %d %v", n, err)
+	}
+
+	list := []*User{}
+	total, pageNo, pageSize, err := repo.Page(&data.PageQuery{
+		Filters: map[string]interface{}{
+			"age":   map[string]interface{}{"GTE": 30},
+			"ctime": map[string]interface{}{"LT": 1500000000 + 4*3600},
+			"OR": []interface{}{
+				map[string]interface{}{"nick": map[string]interface{}{"ILIKE": "^B"}},
+				map[string]interface{}{"type": map[string]interface{}{"EQ": 0}},
+			},
+		},
+		PageNo:   1,
+		PageSize: 10,
+		Sort:     []*data.SortSpec{{Property: "age", Type: data.SortType_DSC}},
+		Fields:   []string{"nick", "age"},
+	}, &User{TenantId: "mem"}, &list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// bob (31), carol (41, type 0), frank 的 ctime 满足但 type 为 1
+	if total != 2 || pageNo != 1 || pageSize != 10 || len(list) != 2 || list[0].Nick != "carol" || list[1].Nick != "bob" || list[0].Type != 0 || list[0].Id == "" {
+		t.Fatalf("total %d, %+v", total, list)
+	}
+
+	// 游标分页遍历全部
+	cursor, seen := "", []string{}
+	for {
+		page := []*User{}
+		info, err := repo.PageCursor(&data.CursorQuery{
+			Cursor:   cursor,
+			PageSize: 2,
+			Sort:     []*data.SortSpec{{Property: "type"}, {Property: "age", Type: data.SortType_DSC}},
+			Total:    data.TotalMode_EXACT,
+		}, &User{TenantId: "mem"}, &page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *info.Total != 6 {
+			t.Fatalf("total %d", *info.Total)
+		}
+		for _, u := range page {
+			seen = append(seen, u.Nick)
+		}
+		if !info.HasNext {
+			break
+		}
+		cursor = info.Next
+	}
+	expected := []string{"Eve", "carol", "alice", "frank", "dave", "bob"}
+	if len(seen) != len(expected) {
+		t.Fatalf("seen %v", seen)
+	}
+	for i := range seen {
+		if seen[i] != expected[i] {
+			t.Fatalf("seen %v, expected %v", seen, expected)
+		}
+	}
+
+	if err = repo.Delete(&User{Id: users[0].Id, TenantId: "mem"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = repo.Delete(&User{Id: users[0].Id, TenantId: "mem"}); err != mgo.ErrNotFound {
+		t.Fatalf("expect not found, got %v", err)
+	}
+
+	// 事务失败时回滚
+	err = repo.WithTransaction(context.Background(), func(tx MongoRepository) error {
+		if err := tx.Delete(&User{Id: users[1].Id, TenantId: "mem"}); err != nil {
+			return err
+		}
+		return errors.New("abort")
+	})
+	if n, _ := repo.Count(&User{TenantId: "mem"}); err == nil || n != 5 {
+		t.Fatalf("count after rollback %d, %v", n, err)
+	}
+
+	if _, _, _, err = repo.Page(&data.PageQuery{Filters: map[string]interface{}{"TEXT": "x"}}, &User{TenantId: "mem"}, &list); !errors.Is(err, data.ErrUnsupportedFilter) {
+		t.Fatalf("expect unsupported, got %v", err)
+	}
+}
+
+func TestMemoryRepositoryModels(t *testing.T) {
+	repo := NewMemoryRepository()
+	ctx := context.Background()
+
+	// 乐观锁
+	a := &Article{Id: bson.NewObjectId(), Title: "a"}
+	if err := repo.Insert(a); err != nil {
+		t.Fatal(err)
+	}
+	stale := &Article{Id: a.Id, Title: "stale"}
+	if _, err := repo.Update(a); err != nil || a.Version != 1 {
+		t.Fatalf("update %d %v", a.Version, err)
+	}
+	if _, err := repo.Update(stale); err != ErrConcurrentModification || stale.Version != 0 {
+		t.Fatalf("expect conflict, got %v", err)
+	}
+	if _, err := repo.Upsert(stale); err != ErrConcurrentModification {
+		t.Fatalf("expect conflict, got %v", err)
+	}
+	if err := repo.UpdateSelective(a, map[string]interface{}{"title": "b"}); err != nil || a.Version != 2 {
+		t.Fatalf("update selective %d %v", a.Version, err)
+	}
+
+	// 软删除
+	p := &Post{Id: bson.NewObjectId(), Title: "p"}
+	if err := repo.Insert(p); err != nil || p.CreatedAt.IsZero() {
+		t.Fatalf("insert %v", err)
+	}
+	if err := repo.Delete(p); err != nil || p.DeletedAt == nil {
+		t.Fatalf("delete %v", err)
+	}
+	if err := repo.FindOne(&Post{Id: p.Id}); err != mgo.ErrNotFound {
+		t.Fatalf("expect not found, got %v", err)
+	}
+	if err := repo.FindOneContext(IncludeDeleted(ctx), &Post{Id: p.Id}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 类型安全的仓库
+	typed := NewRepository(MongoRepository(repo), &Post{})
+	for _, title := range []string{"x", "y", "z"} {
+		if err := typed.Insert(ctx, &Post{Id: bson.NewObjectId(), Title: title}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	posts, err := typed.FindMany(ctx, map[string]interface{}{"title": map[string]interface{}{"IN": []interface{}{"x", "y", "p"}}})
+	if err != nil || len(posts) != 2 {
+		t.Fatalf("find many %d %v", len(posts), err)
+	}
+	if n, err := typed.DeleteMany(ctx, map[string]interface{}{"title": map[string]interface{}{"NE": "z"}}); err != nil || n != 2 {
+		t.Fatalf("delete many %d %v", n, err)
+	}
+	if n, err := typed.Count(ctx); err != nil || n != 1 {
+		t.Fatalf("count %d %v", n, err)
+	}
+	if _, err := typed.DeleteMany(ctx, nil); err != ErrEmptyFilter {
+		t.Fatalf("expect empty filter, got %v", err)
+	}
+	if n, err := typed.DeleteAll(ctx); err != nil || n != 1 {
+		t.Fatalf("delete all %d %v", n, err)
+	}
+
+	// 批量写
+	ids := []bson.ObjectId{bson.NewObjectId(), bson.NewObjectId()}
+	result, err := repo.BulkWrite([]BulkOp{
+		InsertOp(&Article{Id: ids[0], Title: "1"}),
+		InsertOp(&Article{Id: ids[0], Title: "dup"}),
+		UpsertOp(&Article{Id: ids[1], Title: "2"}),
+		UpdateSelectiveOp(&Article{Id: ids[0]}, map[string]interface{}{"title": "1'"}),
+		DeleteOp(&Article{Id: a.Id}),
+	}, &BulkOptions{})
+	var bulkErr *BulkError
+	if !errors.As(err, &bulkErr) || len(bulkErr.Cases) != 1 || bulkErr.Cases[0].Index != 1 {
+		t.Fatalf("expect one failed op, got %v", err)
+	}
+	if result.Inserted != 1 || result.Upserted != 1 || result.Matched != 1 || result.Deleted != 1 || result.Results[2].UpsertedId != ids[1] {
+		t.Fatalf("result %+v", result)
+	}
+}
+
+func TestMemoryRepositoryVersioned(t *testing.T) {
+	repo := NewMemoryRepository()
+	a := &Article{Id: bson.NewObjectId(), Title: "a"}
+	if err := repo.Insert(a); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Update(a); err != nil || a.Version != 1 {
+		t.Fatalf("update %d %v", a.Version, err)
+	}
+
+	// 版本 0 已过期
+	stale := func() *Article {
+		return &Article{Id: a.Id, Title: "stale"}
+	}
+	s := stale()
+	if _, err := repo.Update(s); err != ErrConcurrentModification || s.Version != 0 {
+		t.Fatalf("update: %d %v", s.Version, err)
+	}
+	if err := repo.UpdateSelective(s, map[string]interface{}{"title": "stale"}); err != ErrConcurrentModification || s.Version != 0 {
+		t.Fatalf("update selective: %d %v", s.Version, err)
+	}
+	if _, err := repo.Upsert(s); err != ErrConcurrentModification || s.Version != 0 {
+		t.Fatalf("upsert: %d %v", s.Version, err)
+	}
+	if err := repo.UpdateSelective(&Article{Id: bson.NewObjectId()}, map[string]interface{}{"title": "x"}); err != mgo.ErrNotFound {
+		t.Fatalf("expect not found, got %v", err)
+	}
+
+	ops := []BulkOp{UpdateOp(stale()), UpdateSelectiveOp(stale(), map[string]interface{}{"title": "stale"}), UpsertOp(stale()), UpdateSelectiveOp(a, map[string]interface{}{"title": "b"})}
+	result, err := repo.BulkWrite(ops, nil)
+	var bulkErr *BulkError
+	if !errors.As(err, &bulkErr) || !reflect.DeepEqual(bulkErr.Indexes(), []int{0, 1, 2}) {
+		t.Fatalf("expect conflicts, got %v", err)
+	}
+	for i, c := range bulkErr.Cases {
+		if c.Err != ErrConcurrentModification || ops[i].Model.(*Article).Version != 0 {
+			t.Fatalf("op %d: %v", i, c.Err)
+		}
+	}
+	if result.Matched != 1 || result.Upserted != 0 || a.Version != 2 {
+		t.Fatalf("result %+v, version %d", result, a.Version)
+	}
+
+	// 有序时冲突后的操作不执行, 版本不变
+	ops = []BulkOp{UpdateOp(stale()), UpdateOp(a)}
+	result, err = repo.BulkWrite(ops, &BulkOptions{Ordered: true})
+	if !errors.As(err, &bulkErr) || !result.Results[1].Skipped || a.Version != 2 {
+		t.Fatalf("ordered: %v %+v %d", err, result, a.Version)
+	}
+
+	found := &Article{Id: a.Id}
+	if err = repo.FindOne(found); err != nil || found.Version != 2 || found.Title != "b" {
+		t.Fatalf("%+v %v", found, err)
+	}
+}
+
+func TestMemoryRepositoryUpsertCreatedAt(t *testing.T) {
+	repo := NewMemoryRepository()
+	created := time.Unix(1500000000, 0)
+	p := &Post{Id: bson.NewObjectId(), Title: "p", CreatedAt: created}
+	if _, err := repo.Upsert(p); err != nil {
+		t.Fatal(err)
+	}
+
+	// 没有读回的 Model, createdAt 为零值, Upsert 时设为当前时间
+	if _, err := repo.Upsert(&Post{Id: p.Id, Title: "p'"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.BulkWrite([]BulkOp{UpsertOp(&Post{Id: p.Id, Title: "p''"})}, nil); err != nil {
+		t.Fatal(err)
+	}
+	found := &Post{Id: p.Id}
+	if err := repo.FindOne(found); err != nil || found.Title != "p''" || !found.CreatedAt.Equal(created) || found.UpdatedAt.IsZero() {
+		t.Fatalf("%+v %v", found, err)
+	}
+}
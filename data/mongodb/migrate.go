@@ -0,0 +1,462 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// MigrationsCollection 记录已执行的迁移
+	MigrationsCollection = "xmicro_migrations"
+	// MigrationLockCollection 迁移的分布式锁
+	MigrationLockCollection = "xmicro_migration_lock"
+
+	DefaultMigrationLockTTL     = time.Minute
+	DefaultMigrationLockTimeout = time.Minute * 5
+)
+
+var (
+	// ErrMigrationLocked 等待 LockTimeout 后仍有其他实例在执行迁移
+	ErrMigrationLocked = errors.New("migrations are locked by another process")
+	// ErrMigrationLockLost 执行中锁被其他实例取得, 如心跳长时间失败
+	ErrMigrationLockLost = errors.New("migration lock lost")
+	// ErrIrreversibleMigration 回滚没有 Down 的迁移
+	ErrIrreversibleMigration = errors.New("migration has no down")
+)
+
+// MigrationFunc 执行一个方向的迁移, db 上的操作都在 Migrator 的库中
+type MigrationFunc func(ctx context.Context, db *MigrationDB) error
+
+// Migration 一个版本的迁移, 按 Version 从小到大执行, 已执行的版本记录在 MigrationsCollection.
+// 迁移不在事务中执行, Up 中途失败时需保证可以重新执行
+type Migration struct {
+	Version     int64
+	Description string
+	Up          MigrationFunc
+	Down        MigrationFunc // 为 nil 时不能回滚
+}
+
+// MigrationStatus 迁移的执行状态
+type MigrationStatus struct {
+	Version     int64
+	Description string
+	Applied     bool
+	AppliedAt   time.Time
+}
+
+// Migrator 在一个库上执行迁移, 多个实例同时启动时通过锁保证只有一个在执行.
+// 可在启动时调用 Up, 或通过 xmicro.RegisterMigrator 注册后由 migrate 子命令执行
+//
+//	migrator := NewMigrator(repo, "app").Add(&Migration{
+//		Version: 1, Description: "index users.nick",
+//		Up: func(ctx context.Context, db *MigrationDB) error {
+//			return db.CreateIndex(ctx, "users", mgo.Index{Key: []string{"nick"}, Unique: true})
+//		},
+//		Down: func(ctx context.Context, db *MigrationDB) error {
+//			return db.DropIndex(ctx, "users", "nick")
+//		},
+//	})
+//	err := migrator.Up(ctx)
+type Migrator struct {
+	repo        MongoRepository
+	database    string
+	migrations  []*Migration
+	LockTTL     time.Duration // 锁的有效期, 执行中每 LockTTL/3 续期, 默认 DefaultMigrationLockTTL
+	LockTimeout time.Duration // 等待锁的时间, 默认 DefaultMigrationLockTimeout
+}
+
+// Constructor, database 为迁移所在的库, 执行记录和锁也保存在这个库
+func NewMigrator(repo MongoRepository, database string) *Migrator {
+	return &Migrator{
+		repo:        repo,
+		database:    database,
+		migrations:  []*Migration{},
+		LockTTL:     DefaultMigrationLockTTL,
+		LockTimeout: DefaultMigrationLockTimeout,
+	}
+}
+
+// Add 添加迁移, 版本重复时 Up/Down 返回错误
+func (self *Migrator) Add(migrations ...*Migration) *Migrator {
+	self.migrations = append(self.migrations, migrations...)
+	return self
+}
+
+// Up 依次执行未执行的迁移
+func (self *Migrator) Up(ctx context.Context) error {
+	return self.withLock(ctx, func(ctx context.Context, db *MigrationDB) error {
+		migrations, err := self.sorted()
+		if err != nil {
+			return err
+		}
+		applied, err := self.applied(ctx)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			if err = m.Up(ctx, db); err != nil {
+				return fmt.Errorf("migration %d (%s) up: %w", m.Version, m.Description, err)
+			}
+			record := &migrationRecord{Version: m.Version, Description: m.Description, AppliedAt: time.Now(), database: self.database}
+			if err = self.repo.InsertContext(ctx, record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Down 按版本从大到小回滚最近执行的 steps 个迁移
+func (self *Migrator) Down(ctx context.Context, steps int) error {
+	return self.withLock(ctx, func(ctx context.Context, db *MigrationDB) error {
+		migrations, err := self.sorted()
+		if err != nil {
+			return err
+		}
+		byVersion := map[int64]*Migration{}
+		for _, m := range migrations {
+			byVersion[m.Version] = m
+		}
+		applied, err := self.applied(ctx)
+		if err != nil {
+			return err
+		}
+		versions := make([]int64, 0, len(applied))
+		for v := range applied {
+			versions = append(versions, v)
+		}
+		sort.Slice(versions, func(i, j int) bool { return versions[i] > versions[j] })
+
+		for i := 0; i < steps && i < len(versions); i++ {
+			m, ok := byVersion[versions[i]]
+			if !ok || m.Down == nil {
+				return fmt.Errorf("%w: %d", ErrIrreversibleMigration, versions[i])
+			}
+			if err = m.Down(ctx, db); err != nil {
+				return fmt.Errorf("migration %d (%s) down: %w", m.Version, m.Description, err)
+			}
+			if err = self.repo.DeleteContext(ctx, &migrationRecord{Version: m.Version, database: self.database}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Status 已添加和已执行的迁移, 按版本排序
+func (self *Migrator) Status(ctx context.Context) ([]*MigrationStatus, error) {
+	migrations, err := self.sorted()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := self.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	list := []*MigrationStatus{}
+	for _, m := range migrations {
+		status := &MigrationStatus{Version: m.Version, Description: m.Description}
+		if r, ok := applied[m.Version]; ok {
+			status.Applied, status.AppliedAt = true, r.AppliedAt
+			delete(applied, m.Version)
+		}
+		list = append(list, status)
+	}
+	// 已执行但代码中已没有的迁移
+	for _, r := range applied {
+		list = append(list, &MigrationStatus{Version: r.Version, Description: r.Description, Applied: true, AppliedAt: r.AppliedAt})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Version < list[j].Version })
+	return list, nil
+}
+
+func (self *Migrator) sorted() ([]*Migration, error) {
+	list := append([]*Migration{}, self.migrations...)
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Version < list[j].Version })
+	for i, m := range list {
+		if m.Up == nil {
+			return nil, fmt.Errorf("migration %d has no up", m.Version)
+		}
+		if i > 0 && list[i-1].Version == m.Version {
+			return nil, fmt.Errorf("duplicate migration version %d", m.Version)
+		}
+	}
+	return list, nil
+}
+
+func (self *Migrator) applied(ctx context.Context) (map[int64]*migrationRecord, error) {
+	records := []*migrationRecord{}
+	if err := self.repo.AllContext(ctx, &migrationRecord{database: self.database}, &records); err != nil {
+		return nil, err
+	}
+	applied := map[int64]*migrationRecord{}
+	for _, r := range records {
+		applied[r.Version] = r
+	}
+	return applied, nil
+}
+
+// withLock 取得锁后执行 fn, 执行期间定期续期. 锁被其他实例取得, 或续期失败到锁即将过期时取消 fn 的 ctx
+func (self *Migrator) withLock(ctx context.Context, fn func(ctx context.Context, db *MigrationDB) error) error {
+	ttl := self.LockTTL
+	if ttl <= 0 {
+		ttl = DefaultMigrationLockTTL
+	}
+	hostname, _ := os.Hostname()
+	lock := &migrationLock{Id: "migrations", Owner: hostname + ":" + strconv.Itoa(os.Getpid()) + ":" + bson.NewObjectId().Hex(), database: self.database}
+	if err := self.lock(ctx, lock, ttl); err != nil {
+		return err
+	}
+	defer self.repo.DeleteContext(context.Background(), lock.owned())
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	lost := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+		expiresAt := lock.ExpiresAt
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				next := time.Now().Add(ttl)
+				err := self.repo.UpdateSelectiveContext(ctx, lock.owned(), map[string]interface{}{"expiresAt": next})
+				if err == nil {
+					expiresAt = next
+					continue
+				}
+				if ctx.Err() != nil {
+					return
+				}
+				// 锁已被其他实例取得, 或续期一直失败, 下次续期前锁就会过期
+				if isNotFound(err) || time.Until(expiresAt) < ttl/3 {
+					close(lost)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	err := fn(ctx, &MigrationDB{repo: self.repo, database: self.database})
+	select {
+	case <-lost:
+		return ErrMigrationLockLost
+	default:
+	}
+	return err
+}
+
+// lock 插入锁文档, 已存在时尝试取得过期的锁, 否则等待直到 LockTimeout
+func (self *Migrator) lock(ctx context.Context, lock *migrationLock, ttl time.Duration) error {
+	timeout := self.LockTimeout
+	if timeout <= 0 {
+		timeout = DefaultMigrationLockTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		now := time.Now()
+		lock.ExpiresAt = now.Add(ttl)
+		err := self.repo.InsertContext(ctx, lock)
+		if err == nil {
+			return nil
+		}
+		if !isDuplicateKey(err) {
+			return err
+		}
+		err = self.repo.UpdateSelectiveContext(ctx, lock.expired(now), map[string]interface{}{"owner": lock.Owner, "expiresAt": lock.ExpiresAt})
+		if err == nil {
+			return nil
+		}
+		if !isNotFound(err) {
+			return err
+		}
+
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return ErrMigrationLocked
+		}
+		if wait > time.Second {
+			wait = time.Second
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// MigrationDB 迁移中常用的操作, 其他操作可通过 Execute/ExecuteDriver 直接访问集合
+type MigrationDB struct {
+	repo     MongoRepository
+	database string
+}
+
+// Collection 库中的集合, 可作为 Model 传给 MongoRepository 的方法
+func (self *MigrationDB) Collection(name string) Model {
+	return &collectionRef{database: self.database, name: name}
+}
+
+// CreateIndex 同 EnsureIndexes, 索引已存在时不报错
+func (self *MigrationDB) CreateIndex(ctx context.Context, collection string, indexes ...mgo.Index) error {
+	return self.repo.EnsureIndexesContext(ctx, &collectionRef{database: self.database, name: collection, indexes: indexes})
+}
+
+// DropIndex 按字段删除索引, 字段格式同 mgo.Index.Key, 如 "nick", "-ctime"
+func (self *MigrationDB) DropIndex(ctx context.Context, collection string, key ...string) error {
+	c := self.Collection(collection)
+	if dr, ok := self.repo.(DriverRepository); ok {
+		name, err := indexName(key)
+		if err != nil {
+			return err
+		}
+		return dr.ExecuteDriverContext(ctx, c, func(ctx context.Context, coll *mongo.Collection) error {
+			_, err := coll.Indexes().DropOne(ctx, name)
+			return err
+		})
+	}
+	return self.repo.ExecuteContext(ctx, c, func(coll *mgo.Collection) error {
+		return coll.DropIndex(key...)
+	})
+}
+
+// RenameField 将所有文档的 from 字段改名为 to, 返回修改的文档数
+func (self *MigrationDB) RenameField(ctx context.Context, collection string, from string, to string) (int64, error) {
+	return self.updateAll(ctx, collection, bson.M{from: bson.M{"$exists": true}}, bson.M{"$rename": bson.M{from: to}})
+}
+
+// Backfill 为满足 selector 的文档设置 set 中的字段, 返回修改的文档数.
+// selector 通常排除已设置的文档, 如 bson.M{"status": bson.M{"$exists": false}}, 使迁移可以重新执行
+func (self *MigrationDB) Backfill(ctx context.Context, collection string, selector bson.M, set bson.M) (int64, error) {
+	return self.updateAll(ctx, collection, selector, bson.M{"$set": set})
+}
+
+// Execute 在 mgo 的集合上执行 fn
+func (self *MigrationDB) Execute(ctx context.Context, collection string, fn DBFunc) error {
+	return self.repo.ExecuteContext(ctx, self.Collection(collection), fn)
+}
+
+// ExecuteDriver 在官方驱动的集合上执行 fn, 仓库不是 DriverRepository 时返回 ErrDriverMismatch
+func (self *MigrationDB) ExecuteDriver(ctx context.Context, collection string, fn DriverDBFunc) error {
+	dr, ok := self.repo.(DriverRepository)
+	if !ok {
+		return ErrDriverMismatch
+	}
+	return dr.ExecuteDriverContext(ctx, self.Collection(collection), fn)
+}
+
+func (self *MigrationDB) updateAll(ctx context.Context, collection string, selector bson.M, update bson.M) (int64, error) {
+	return criteriaQuery{repo: self.repo, m: self.Collection(collection)}.updateAll(ctx, selector, update)
+}
+
+// indexName 与服务端默认的索引名一致, 如 nick_1_ctime_-1
+func indexName(key []string) (string, error) {
+	parts := []string{}
+	for _, k := range key {
+		field, value, err := parseIndexKey(k)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, fmt.Sprintf("%s_%v", field, value))
+	}
+	return strings.Join(parts, "_"), nil
+}
+
+// collectionRef 只有库名和集合名的 Model
+type collectionRef struct {
+	database string
+	name     string
+	indexes  []mgo.Index
+}
+
+func (self *collectionRef) Database() string {
+	return self.database
+}
+
+func (self *collectionRef) Collection() string {
+	return self.name
+}
+
+func (self *collectionRef) Unique() bson.M {
+	return bson.M{}
+}
+
+func (self *collectionRef) Indexes() []mgo.Index {
+	return self.indexes
+}
+
+type migrationRecord struct {
+	Version     int64     `bson:"_id"`
+	Description string    `bson:"description"`
+	AppliedAt   time.Time `bson:"appliedAt"`
+	database    string
+}
+
+func (self *migrationRecord) Database() string {
+	return self.database
+}
+
+func (self *migrationRecord) Collection() string {
+	return MigrationsCollection
+}
+
+func (self *migrationRecord) Unique() bson.M {
+	return bson.M{"_id": self.Version}
+}
+
+type migrationLock struct {
+	Id        string    `bson:"_id"`
+	Owner     string    `bson:"owner"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+	database  string
+	selector  bson.M
+}
+
+func (self *migrationLock) Database() string {
+	return self.database
+}
+
+func (self *migrationLock) Collection() string {
+	return MigrationLockCollection
+}
+
+func (self *migrationLock) Unique() bson.M {
+	if self.selector != nil {
+		return self.selector
+	}
+	return bson.M{"_id": self.Id}
+}
+
+// owned 匹配自己持有的锁
+func (self *migrationLock) owned() *migrationLock {
+	return &migrationLock{Id: self.Id, database: self.database, selector: bson.M{"_id": self.Id, "owner": self.Owner}}
+}
+
+// expired 匹配已过期的锁
+func (self *migrationLock) expired(now time.Time) *migrationLock {
+	return &migrationLock{Id: self.Id, database: self.database, selector: bson.M{"_id": self.Id, "expiresAt": bson.M{"$lt": now}}}
+}
+
+func isDuplicateKey(err error) bool {
+	return mgo.IsDup(err) || mongo.IsDuplicateKeyError(err)
+}
+
+func isNotFound(err error) bool {
+	return err == mgo.ErrNotFound || err == mongo.ErrNoDocuments
+}
@@ -0,0 +1,142 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestIndexName(t *testing.T) {
+	name, err := indexName([]string{"nick", "-ctime", "$text:title"})
+	if err != nil || name != "nick_1_ctime_-1_title_text" {
+		t.Fatal(name, err)
+	}
+	if _, err = indexName([]string{"$text"}); err == nil {
+		t.Fatal("expect invalid key")
+	}
+}
+
+func TestMigrator(t *testing.T) {
+	repo := NewMemoryRepository()
+	ctx := context.Background()
+	for _, nick := range []string{"a", "b"} {
+		if err := repo.Insert(&User{Id: bson.NewObjectId(), Nick: nick, TenantId: "m"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	downs := []int64{}
+	migrator := NewMigrator(repo, "m_user_db").Add(
+		&Migration{
+			Version:     2,
+			Description: "backfill type",
+			Up: func(ctx context.Context, db *MigrationDB) error {
+				_, err := db.Backfill(ctx, "m_users", bson.M{"type": 0}, bson.M{"type": 1})
+				return err
+			},
+			Down: func(ctx context.Context, db *MigrationDB) error {
+				downs = append(downs, 2)
+				_, err := db.Backfill(ctx, "m_users", bson.M{"type": 1}, bson.M{"type": 0})
+				return err
+			},
+		},
+		&Migration{
+			Version:     1,
+			Description: "unique nick",
+			Up: func(ctx context.Context, db *MigrationDB) error {
+				return db.CreateIndex(ctx, "m_users", mgo.Index{Key: []string{"nick"}, Unique: true})
+			},
+		},
+	)
+	if err := migrator.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// 再次执行时跳过已执行的
+	if err := migrator.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.Insert(&User{Id: bson.NewObjectId(), Nick: "a", TenantId: "m"}); !mgo.IsDup(err) {
+		t.Fatalf("expect duplicate key, got %v", err)
+	}
+	list := []*User{}
+	repo.All(&User{TenantId: "m"}, &list)
+	if len(list) != 2 || list[0].Type != 1 || list[1].Type != 1 {
+		t.Fatalf("%+v", list)
+	}
+
+	status, err := migrator.Status(ctx)
+	if err != nil || len(status) != 2 || !status[0].Applied || status[0].Version != 1 || !status[1].Applied {
+		t.Fatalf("%+v %v", status, err)
+	}
+
+	if err = migrator.Down(ctx, 1); err != nil || len(downs) != 1 {
+		t.Fatal(downs, err)
+	}
+	if status, _ = migrator.Status(ctx); status[1].Applied {
+		t.Fatal("version 2 still applied")
+	}
+	if err = migrator.Down(ctx, 1); !errors.Is(err, ErrIrreversibleMigration) {
+		t.Fatalf("expect irreversible, got %v", err)
+	}
+
+	// 其他实例持有锁
+	lock := &migrationLock{Id: "migrations", Owner: "other", ExpiresAt: time.Now().Add(time.Minute), database: "m_user_db"}
+	if err = repo.Insert(lock); err != nil {
+		t.Fatal(err)
+	}
+	migrator.LockTimeout = time.Millisecond
+	if err = migrator.Up(ctx); err != ErrMigrationLocked {
+		t.Fatalf("expect locked, got %v", err)
+	}
+	// 过期的锁可以被取得, 执行后释放
+	if err = repo.UpdateSelective(lock, map[string]interface{}{"expiresAt": time.Now().Add(-time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+	if err = migrator.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err = repo.FindOne(&migrationLock{Id: "migrations", database: "m_user_db"}); err != mgo.ErrNotFound {
+		t.Fatalf("lock not released: %v", err)
+	}
+
+	migrator.Add(&Migration{Version: 1, Up: migrator.migrations[0].Up})
+	if err = migrator.Up(ctx); err == nil {
+		t.Fatal("expect duplicate version")
+	}
+}
+
+// renewFailingRepo 续期锁时总是失败
+type renewFailingRepo struct {
+	MongoRepository
+}
+
+func (self *renewFailingRepo) UpdateSelectiveContext(ctx context.Context, m Model, updateData map[string]interface{}) error {
+	return errors.New("network error")
+}
+
+func TestMigratorLockLost(t *testing.T) {
+	migrator := NewMigrator(&renewFailingRepo{NewMemoryRepository()}, "m_user_db").Add(&Migration{
+		Version: 1,
+		Up: func(ctx context.Context, db *MigrationDB) error {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Second):
+				return nil
+			}
+		},
+	})
+	migrator.LockTTL = time.Millisecond * 30
+	start := time.Now()
+	if err := migrator.Up(context.Background()); !errors.Is(err, ErrMigrationLockLost) {
+		t.Fatalf("expect lock lost, got %v", err)
+	}
+	if d := time.Since(start); d > migrator.LockTTL*2 {
+		t.Fatalf("lock lost after %s", d)
+	}
+}
@@ -1,30 +1,89 @@
 package mongodb
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"strings"
+	"sync"
 	"time"
 
 	"gopkg.in/mgo.v2"
 )
 
+const (
+	// DriverMgo 使用 gopkg.in/mgo.v2, 默认
+	DriverMgo = "mgo"
+	// DriverMongo 使用官方驱动 go.mongodb.org/mongo-driver
+	DriverMongo = "mongo"
+)
+
+// ErrDataSourceClosed 数据源已 Close, 不能再使用
+var ErrDataSourceClosed = errors.New("DataSource is closed")
+
+// DataSource 数据源, 具体的连接由驱动实现.
+// Connect 可重复调用, 已连接时直接返回, 未连接的数据源在第一次使用时连接.
+// 并发的 Connect 共用一次连接 (含重试), ctx 取消时返回 ctx.Err(), 连接在后台继续
 type DataSource interface {
+	Driver() string
+	Connect(ctx context.Context) error
+	// Ping 检查连接是否可用, mgo 失败时会刷新会话重新建立连接
+	Ping(ctx context.Context) error
+	// Close 关闭所有连接, 之后 Connect 返回 ErrDataSourceClosed
+	Close() error
+	Stats() PoolStats
+}
+
+// PoolStats 连接池统计
+type PoolStats struct {
+	Driver    string `json:"driver"`
+	Connected bool   `json:"connected"`
+	PoolSize  int    `json:"poolSize"` // 配置的连接池上限, 0 为驱动默认
+	Open      int64  `json:"open"`     // 已建立的连接
+	InUse     int64  `json:"inUse"`    // 正在使用的连接
+	// 获取连接失败的次数, 仅官方驱动
+	CheckoutFailures int64 `json:"checkoutFailures"`
+}
+
+// MgoDataSource 基于 mgo 的数据源
+type MgoDataSource interface {
+	DataSource
 	GetSession() *mgo.Session
 }
 
 type dataSourceImpl struct {
-	config  *Config
-	session *mgo.Session
+	config *Config
+	conn   connector[mgo.Session]
 }
 
 // Constructor
-func NewDataSource(config *Config) *dataSourceImpl {
+func NewDataSource(config *Config) DataSource {
+	switch config.Driver {
+	case DriverMongo:
+		return NewDriverDataSource(config)
+	default:
+		return NewMgoDataSource(config)
+	}
+}
+
+func NewMgoDataSource(config *Config) *dataSourceImpl {
 	return &dataSourceImpl{
 		config: config,
 	}
 }
 
-func (self *dataSourceImpl) Connect() error {
+func (self *dataSourceImpl) Driver() string {
+	return DriverMgo
+}
+
+func (self *dataSourceImpl) Connect(ctx context.Context) error {
+	return self.conn.connect(ctx, self.config, func(ctx context.Context) (*mgo.Session, error) {
+		return self.dial()
+	}, (*mgo.Session).Close)
+}
+
+func (self *dataSourceImpl) dial() (*mgo.Session, error) {
 	var info = &mgo.DialInfo{
 		Addrs:     strings.Split(self.config.Addrs, ";"),
 		Username:  self.config.Username,
@@ -32,31 +91,209 @@ func (self *dataSourceImpl) Connect() error {
 		Database:  self.config.Database,
 		PoolLimit: self.config.Poolsize,
 		Source:    self.config.Source,
-		Timeout:   time.Second * 5,
+		Timeout:   self.config.connectTimeout(),
 	}
 	if len(self.config.ReplicaSetName) > 0 {
 		info.ReplicaSetName = self.config.ReplicaSetName
 	}
-	var GlobalMgoSession, err = mgo.DialWithInfo(info)
+	session, err := mgo.DialWithInfo(info)
 	if err != nil {
-		log.Fatal(err)
-		return err
+		return nil, err
 	}
-	GlobalMgoSession.SetSocketTimeout(time.Second * 10)
-	GlobalMgoSession.SetSyncTimeout(time.Second * 10)
+	session.SetSocketTimeout(self.config.socketTimeout())
+	session.SetSyncTimeout(self.config.syncTimeout())
 
 	mode := self.config.Mode
 	// 没有配置就取primary
 	if mode <= 0 {
 		mode = int(mgo.Primary)
 	}
-	GlobalMgoSession.SetMode(mgo.Mode(mode), true)
+	session.SetMode(mgo.Mode(mode), true)
+
+	return session, nil
+}
+
+// GetSession 未连接时为 nil
+func (s *dataSourceImpl) GetSession() *mgo.Session {
+	return s.conn.get()
+}
+
+func (self *dataSourceImpl) Ping(ctx context.Context) error {
+	if err := self.Connect(ctx); err != nil {
+		return err
+	}
+	session := self.GetSession()
+	if session == nil {
+		return ErrDataSourceClosed
+	}
 
-	self.session = GlobalMgoSession
+	done := make(chan error, 1)
+	go func() {
+		s := session.Copy()
+		defer s.Close()
+		err := s.Ping()
+		if err != nil {
+			// 丢弃坏掉的连接, 下次从集群重新获取
+			s.Refresh()
+			err = s.Ping()
+		}
+		done <- err
+	}()
 
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (self *dataSourceImpl) Close() error {
+	if session := self.conn.close(); session != nil {
+		session.Close()
+	}
 	return nil
 }
 
-func (s *dataSourceImpl) GetSession() *mgo.Session {
-	return s.session
+// Stats mgo 只有进程级的统计, 多个 mgo 数据源的 Open/InUse 是合计值
+func (self *dataSourceImpl) Stats() PoolStats {
+	stats := PoolStats{
+		Driver:    DriverMgo,
+		Connected: self.GetSession() != nil,
+		PoolSize:  self.config.Poolsize,
+	}
+	s := mgo.GetStats()
+	stats.Open = int64(s.SocketsAlive)
+	stats.InUse = int64(s.SocketsInUse)
+	return stats
+}
+
+// connectCall 一次进行中的连接, done 关闭后 err 为结果
+type connectCall struct {
+	done chan struct{}
+	err  error
+}
+
+// connector 数据源的连接, C 为驱动的连接类型.
+// 拨号和重试在锁外的 goroutine 中进行, 不阻塞 get, Stats 和 close, 并发的 connect 等待同一次拨号
+type connector[C any] struct {
+	mux    sync.Mutex
+	conn   *C
+	closed bool
+	call   *connectCall
+	cancel context.CancelFunc // 停止进行中的拨号
+}
+
+// get 未连接或已关闭时为 nil
+func (self *connector[C]) get() *C {
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	return self.conn
+}
+
+// connect 没有进行中的拨号时启动一次, 然后按 ctx 等待结果.
+// dial 的 ctx 在 close 时取消, 拨号成功但已 close 时用 release 释放连接
+func (self *connector[C]) connect(ctx context.Context, config *Config, dial func(ctx context.Context) (*C, error), release func(*C)) error {
+	self.mux.Lock()
+	if self.closed {
+		self.mux.Unlock()
+		return ErrDataSourceClosed
+	}
+	if self.conn != nil {
+		self.mux.Unlock()
+		return nil
+	}
+	call := self.call
+	if call == nil {
+		// 拨号不随调用方的 ctx 取消, 其他调用方可能还在等待
+		dialCtx, cancel := context.WithCancel(context.Background())
+		call = &connectCall{done: make(chan struct{})}
+		self.call, self.cancel = call, cancel
+		go self.dial(dialCtx, cancel, call, config, dial, release)
+	}
+	self.mux.Unlock()
+
+	select {
+	case <-call.done:
+		return call.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (self *connector[C]) dial(ctx context.Context, cancel context.CancelFunc, call *connectCall, config *Config, dial func(ctx context.Context) (*C, error), release func(*C)) {
+	defer close(call.done)
+	defer cancel()
+
+	var conn *C
+	err := connectWithRetry(ctx, config, func() error {
+		c, err := dial(ctx)
+		conn = c
+		return err
+	})
+
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	self.call, self.cancel = nil, nil
+	switch {
+	case self.closed:
+		if err == nil {
+			release(conn)
+		}
+		call.err = ErrDataSourceClosed
+	case err != nil:
+		call.err = err
+	default:
+		self.conn = conn
+	}
+}
+
+// close 标记为关闭并停止进行中的拨号, 返回需要释放的连接
+func (self *connector[C]) close() *C {
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	self.closed = true
+	if self.cancel != nil {
+		self.cancel()
+	}
+	conn := self.conn
+	self.conn = nil
+	return conn
+}
+
+// connectWithRetry 执行 connect, 失败后按 ConnectRetries 和 RetryInterval 重试, ctx 取消时停止重试
+func connectWithRetry(ctx context.Context, config *Config, connect func() error) error {
+	interval := config.retryInterval()
+	err := connect()
+	for i := 0; err != nil && i < config.ConnectRetries; i++ {
+		log.Printf("connect mongodb %s failed, retry in %s: %v", config.Addrs, interval, err)
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return err
+		}
+		interval *= 2
+		err = connect()
+	}
+	return err
+}
+
+func getMgoSession(ctx context.Context, ds DataSource) (*mgo.Session, error) {
+	mds, ok := ds.(MgoDataSource)
+	if !ok {
+		return nil, fmt.Errorf("DataSource driver `%s` is not %s", ds.Driver(), DriverMgo)
+	}
+	if err := ds.Connect(ctx); err != nil {
+		return nil, err
+	}
+	session := mds.GetSession()
+	if session == nil {
+		return nil, ErrDataSourceClosed
+	}
+	return session, nil
+}
+
+func init() {
+	// Stats 需要 mgo 记录统计
+	mgo.SetStats(true)
 }
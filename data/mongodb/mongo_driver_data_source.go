@@ -0,0 +1,215 @@
+package mongodb
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync/atomic"
+
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"gopkg.in/mgo.v2"
+)
+
+// DriverDataSource 基于官方驱动的数据源
+type DriverDataSource interface {
+	DataSource
+	GetClient() *mongo.Client
+}
+
+type driverDataSourceImpl struct {
+	config *Config
+	conn   connector[mongo.Client]
+
+	// 连接池事件计数
+	open, inUse, checkoutFailures int64
+}
+
+// Constructor
+func NewDriverDataSource(config *Config) *driverDataSourceImpl {
+	return &driverDataSourceImpl{
+		config: config,
+	}
+}
+
+func (self *driverDataSourceImpl) Driver() string {
+	return DriverMongo
+}
+
+// Connect 已连接时直接返回, 选项 (含 TLS 的 CA 文件) 只在拨号时读取
+func (self *driverDataSourceImpl) Connect(ctx context.Context) error {
+	return self.conn.connect(ctx, self.config, func(ctx context.Context) (*mongo.Client, error) {
+		opts, err := self.clientOptions()
+		if err != nil {
+			return nil, err
+		}
+		return self.dial(ctx, opts)
+	}, func(client *mongo.Client) {
+		client.Disconnect(context.Background())
+	})
+}
+
+func (self *driverDataSourceImpl) dial(ctx context.Context, opts *options.ClientOptions) (*mongo.Client, error) {
+	ctx, cancel := context.WithTimeout(ctx, self.config.connectTimeout())
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err = client.Ping(ctx, nil); err != nil {
+		client.Disconnect(context.Background())
+		return nil, err
+	}
+	return client, nil
+}
+
+// Ping 官方驱动会自动重连, 这里只检查当前是否有可用节点
+func (self *driverDataSourceImpl) Ping(ctx context.Context) error {
+	if err := self.Connect(ctx); err != nil {
+		return err
+	}
+	client := self.GetClient()
+	if client == nil {
+		return ErrDataSourceClosed
+	}
+	return client.Ping(ctx, nil)
+}
+
+func (self *driverDataSourceImpl) Close() error {
+	client := self.conn.close()
+	if client == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), self.config.connectTimeout())
+	defer cancel()
+	return client.Disconnect(ctx)
+}
+
+func (self *driverDataSourceImpl) Stats() PoolStats {
+	return PoolStats{
+		Driver:           DriverMongo,
+		Connected:        self.GetClient() != nil,
+		PoolSize:         self.config.Poolsize,
+		Open:             atomic.LoadInt64(&self.open),
+		InUse:            atomic.LoadInt64(&self.inUse),
+		CheckoutFailures: atomic.LoadInt64(&self.checkoutFailures),
+	}
+}
+
+func (self *driverDataSourceImpl) poolMonitor() *event.PoolMonitor {
+	return &event.PoolMonitor{
+		Event: func(e *event.PoolEvent) {
+			switch e.Type {
+			case event.ConnectionCreated:
+				atomic.AddInt64(&self.open, 1)
+			case event.ConnectionClosed:
+				atomic.AddInt64(&self.open, -1)
+			case event.GetSucceeded:
+				atomic.AddInt64(&self.inUse, 1)
+			case event.ConnectionReturned:
+				atomic.AddInt64(&self.inUse, -1)
+			case event.GetFailed:
+				atomic.AddInt64(&self.checkoutFailures, 1)
+			}
+		},
+	}
+}
+
+func (self *driverDataSourceImpl) clientOptions() (*options.ClientOptions, error) {
+	config := self.config
+	opts := options.Client()
+
+	if len(config.URI) > 0 {
+		opts.ApplyURI(config.URI)
+	} else {
+		opts.SetHosts(strings.Split(config.Addrs, ";"))
+		if len(config.ReplicaSetName) > 0 {
+			opts.SetReplicaSet(config.ReplicaSetName)
+		}
+	}
+
+	if len(config.Username) > 0 || len(config.AuthMechanism) > 0 {
+		source := config.Source
+		if len(source) == 0 {
+			source = config.Database
+		}
+		opts.SetAuth(options.Credential{
+			AuthMechanism: config.AuthMechanism,
+			AuthSource:    source,
+			Username:      config.Username,
+			Password:      config.Password,
+		})
+	}
+
+	if config.Poolsize > 0 {
+		opts.SetMaxPoolSize(uint64(config.Poolsize))
+	}
+
+	if config.TLS {
+		tlsConfig := &tls.Config{}
+		if len(config.TLSCAFile) > 0 {
+			pem, err := ioutil.ReadFile(config.TLSCAFile)
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificate found in %s", config.TLSCAFile)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	opts.SetConnectTimeout(config.connectTimeout())
+	opts.SetSocketTimeout(config.socketTimeout())
+	opts.SetServerSelectionTimeout(config.syncTimeout())
+	opts.SetReadPreference(readPrefOfMode(config.Mode))
+	opts.SetRegistry(mgoCompatRegistry)
+	opts.SetPoolMonitor(self.poolMonitor())
+
+	return opts, nil
+}
+
+// GetClient 未连接时为 nil
+func (s *driverDataSourceImpl) GetClient() *mongo.Client {
+	return s.conn.get()
+}
+
+// 将 mgo 的 Mode 转为官方驱动的 ReadPref
+func readPrefOfMode(mode int) *readpref.ReadPref {
+	switch mgo.Mode(mode) {
+	case mgo.PrimaryPreferred, mgo.Monotonic:
+		return readpref.PrimaryPreferred()
+	case mgo.Secondary:
+		return readpref.Secondary()
+	case mgo.SecondaryPreferred:
+		return readpref.SecondaryPreferred()
+	case mgo.Nearest:
+		return readpref.Nearest()
+	default:
+		// 没有配置就取primary
+		return readpref.Primary()
+	}
+}
+
+func getDriverClient(ctx context.Context, ds DataSource) (*mongo.Client, error) {
+	dds, ok := ds.(DriverDataSource)
+	if !ok {
+		return nil, fmt.Errorf("DataSource driver `%s` is not %s", ds.Driver(), DriverMongo)
+	}
+	if err := ds.Connect(ctx); err != nil {
+		return nil, err
+	}
+	client := dds.GetClient()
+	if client == nil {
+		return nil, ErrDataSourceClosed
+	}
+	return client, nil
+}
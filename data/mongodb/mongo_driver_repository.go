@@ -0,0 +1,504 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/mofancloud/xmicro/data"
+)
+
+// ErrDriverMismatch mgo 的 DBFunc 不能在官方驱动上执行, 请使用 ExecuteDriver
+var ErrDriverMismatch = errors.New("DBFunc needs the mgo driver, use ExecuteDriver instead")
+
+// DriverDBFunc 官方驱动的集合操作
+type DriverDBFunc func(ctx context.Context, c *mongo.Collection) error
+
+// DriverRepository 基于官方驱动的 MongoRepository, 可以按集合逐步从 mgo 迁移
+type DriverRepository interface {
+	MongoRepository
+	ExecuteDriver(m Model, fn DriverDBFunc) error
+	ExecuteDriverContext(ctx context.Context, m Model, fn DriverDBFunc) error
+}
+
+type mongoDriverRepositoryImpl struct {
+	dsAliasName string
+	ctx         context.Context   // 事务中为 mongo.SessionContext
+	readWrite   *ReadWriteOptions // 见 RepositoryWithReadWrite
+}
+
+// Constructor, 数据源需以 driver: mongo 注册
+func NewDriverMongoRepository() DriverRepository {
+	return &mongoDriverRepositoryImpl{dsAliasName: "default"}
+}
+
+func (self *mongoDriverRepositoryImpl) DataSource(dsAliasName string) {
+	self.dsAliasName = dsAliasName
+}
+
+func (self *mongoDriverRepositoryImpl) GetDataSource() (DataSource, error) {
+	return GetDataSource(self.dsAliasName)
+}
+
+func (self *mongoDriverRepositoryImpl) All(m Model, result interface{}) error {
+	return self.AllContext(self.context(), m, result)
+}
+
+func (self *mongoDriverRepositoryImpl) AllContext(ctx context.Context, m Model, result interface{}) error {
+	fields, err := contextProjection(ctx, m)
+	if err != nil {
+		return err
+	}
+	opts := options.Find()
+	if fields != nil {
+		opts.SetProjection(fields)
+	}
+	return self.ExecuteDriverContext(ctx, m, func(ctx context.Context, c *mongo.Collection) error {
+		cursor, err := c.Find(ctx, notDeleted(ctx, m, bson.M{}), opts)
+		if err != nil {
+			return err
+		}
+		return cursor.All(ctx, result)
+	})
+}
+
+func (self *mongoDriverRepositoryImpl) Count(m Model) (count int64, err error) {
+	return self.CountContext(self.context(), m)
+}
+
+func (self *mongoDriverRepositoryImpl) CountContext(ctx context.Context, m Model) (count int64, err error) {
+	err = self.ExecuteDriverContext(ctx, m, func(ctx context.Context, c *mongo.Collection) error {
+		count, err = c.CountDocuments(ctx, notDeleted(ctx, m, bson.M{}))
+		return err
+	})
+	return
+}
+
+func (self *mongoDriverRepositoryImpl) Update(m Model) (updated int, err error) {
+	return self.UpdateContext(self.context(), m)
+}
+
+func (self *mongoDriverRepositoryImpl) UpdateContext(ctx context.Context, m Model) (updated int, err error) {
+	stampUpdate(m)
+	selector := m.Unique()
+	vm, versioned := m.(Versioned)
+	if versioned {
+		selector = versionSelector(vm)
+		vm.SetVersion(vm.GetVersion() + 1)
+	}
+
+	err = self.ExecuteDriverContext(ctx, m, func(ctx context.Context, c *mongo.Collection) error {
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+		err := c.FindOneAndUpdate(ctx, selector, bson.M{"$set": m}, opts).Decode(m)
+		if err == mongo.ErrNoDocuments && versioned {
+			return self.versionConflict(ctx, c, m)
+		}
+		if err != nil {
+			return driverError(err)
+		}
+		updated = 1
+		return nil
+	})
+
+	if err != nil && versioned {
+		rollbackVersion(vm, err)
+	}
+	return
+}
+
+func (self *mongoDriverRepositoryImpl) UpdateSelective(m Model, updateData map[string]interface{}) error {
+	return self.UpdateSelectiveContext(self.context(), m, updateData)
+}
+
+func (self *mongoDriverRepositoryImpl) UpdateSelectiveContext(ctx context.Context, m Model, updateData map[string]interface{}) error {
+	selector, set := m.Unique(), bson.M(updateData)
+	vm, versioned := m.(Versioned)
+	if versioned {
+		selector, set = versionSelector(vm), versionedSet(vm, updateData)
+	}
+	set = stampSet(m, set)
+
+	err := self.ExecuteDriverContext(ctx, m, func(ctx context.Context, c *mongo.Collection) error {
+		result, err := c.UpdateOne(ctx, selector, bson.M{"$set": set})
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount == 0 {
+			if versioned {
+				return self.versionConflict(ctx, c, m)
+			}
+			return mgo.ErrNotFound
+		}
+		return nil
+	})
+
+	if err == nil && versioned {
+		vm.SetVersion(vm.GetVersion() + 1)
+	}
+	return err
+}
+
+func (self *mongoDriverRepositoryImpl) Insert(m Model) error {
+	return self.InsertContext(self.context(), m)
+}
+
+func (self *mongoDriverRepositoryImpl) InsertContext(ctx context.Context, m Model) error {
+	stampInsert(m)
+	return self.ExecuteDriverContext(ctx, m, func(ctx context.Context, c *mongo.Collection) error {
+		_, err := c.InsertOne(ctx, m)
+		return err
+	})
+}
+
+func (self *mongoDriverRepositoryImpl) Upsert(m Model) (upserted int, err error) {
+	return self.UpsertContext(self.context(), m)
+}
+
+func (self *mongoDriverRepositoryImpl) UpsertContext(ctx context.Context, m Model) (upserted int, err error) {
+	stampInsert(m)
+	selector := m.Unique()
+	vm, versioned := m.(Versioned)
+	if versioned {
+		selector = versionSelector(vm)
+		vm.SetVersion(vm.GetVersion() + 1)
+	}
+
+	err = self.ExecuteDriverContext(ctx, m, func(ctx context.Context, c *mongo.Collection) error {
+		update, err := upsertUpdate(m, nil)
+		if err != nil {
+			return err
+		}
+		opts := options.Update().SetUpsert(true)
+		result, err := c.UpdateOne(ctx, selector, update, opts)
+		if err != nil {
+			// 版本不匹配时按 selector 插入, 与已有文档的唯一键冲突
+			if versioned && mongo.IsDuplicateKeyError(err) {
+				return ErrConcurrentModification
+			}
+			return err
+		}
+		upserted = int(result.MatchedCount)
+		return nil
+	})
+
+	if err != nil && versioned {
+		rollbackVersion(vm, err)
+	}
+	return
+}
+
+func (self *mongoDriverRepositoryImpl) FindOne(m Model) error {
+	return self.FindOneContext(self.context(), m)
+}
+
+func (self *mongoDriverRepositoryImpl) FindOneContext(ctx context.Context, m Model) error {
+	fields, err := contextProjection(ctx, m)
+	if err != nil {
+		return err
+	}
+	opts := options.FindOne()
+	if fields != nil {
+		opts.SetProjection(fields)
+	}
+	return self.ExecuteDriverContext(ctx, m, func(ctx context.Context, c *mongo.Collection) error {
+		return driverError(c.FindOne(ctx, notDeleted(ctx, m, m.Unique()), opts).Decode(m))
+	})
+}
+
+func (self *mongoDriverRepositoryImpl) Delete(m Model) error {
+	return self.DeleteContext(self.context(), m)
+}
+
+func (self *mongoDriverRepositoryImpl) DeleteContext(ctx context.Context, m Model) error {
+	sm, soft := m.(SoftDeletable)
+	if !soft {
+		return self.ExecuteDriverContext(ctx, m, func(ctx context.Context, c *mongo.Collection) error {
+			result, err := c.DeleteOne(ctx, m.Unique())
+			if err != nil {
+				return err
+			}
+			if result.DeletedCount == 0 {
+				return mgo.ErrNotFound
+			}
+			return nil
+		})
+	}
+
+	now := time.Now()
+	err := self.ExecuteDriverContext(ctx, m, func(ctx context.Context, c *mongo.Collection) error {
+		result, err := c.UpdateOne(ctx, notDeleted(ctx, m, m.Unique()), bson.M{"$set": bson.M{FieldDeletedAt: now}})
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount == 0 {
+			return mgo.ErrNotFound
+		}
+		return nil
+	})
+	if err == nil {
+		sm.SetDeletedAt(now)
+	}
+	return err
+}
+
+func (self *mongoDriverRepositoryImpl) Page(pageQuery *data.PageQuery, m Model, list interface{}) (total int64, pageNo int64, pageSize int32, err error) {
+	return self.PageContext(self.context(), pageQuery, m, list)
+}
+
+func (self *mongoDriverRepositoryImpl) PageContext(ctx context.Context, pageQuery *data.PageQuery, m Model, list interface{}) (total int64, pageNo int64, pageSize int32, err error) {
+	query := *pageQuery
+	query.Filters = notDeletedFilters(ctx, m, pageQuery.Filters)
+	filters, pageNo, pageSize, sorts, err := ParsePageQuery(m, &query)
+	if err != nil {
+		return
+	}
+	query.Fields, query.Exclude = projectionFields(ctx, pageQuery.Fields, pageQuery.Exclude)
+	fields, err := BuildProjection(m, query.Fields, query.Exclude)
+	if err != nil {
+		return
+	}
+
+	err = self.ExecuteDriverContext(ctx, m, func(ctx context.Context, c *mongo.Collection) error {
+		t, err := c.CountDocuments(ctx, filters)
+		if err != nil {
+			return err
+		}
+		total = t
+
+		opts := options.Find().
+			SetSkip((pageNo - 1) * int64(pageSize)).
+			SetLimit(int64(pageSize))
+		if len(sorts) > 0 {
+			opts.SetSort(driverSort(sorts))
+		}
+		if fields != nil {
+			opts.SetProjection(fields)
+		}
+		cursor, err := c.Find(ctx, filters, opts)
+		if err != nil {
+			return err
+		}
+		return cursor.All(ctx, list)
+	})
+
+	return
+}
+
+func (self *mongoDriverRepositoryImpl) PageCursor(cursorQuery *data.CursorQuery, m Model, list interface{}) (*data.CursorInfo, error) {
+	return self.PageCursorContext(self.context(), cursorQuery, m, list)
+}
+
+func (self *mongoDriverRepositoryImpl) PageCursorContext(ctx context.Context, cursorQuery *data.CursorQuery, m Model, list interface{}) (info *data.CursorInfo, err error) {
+	query := *cursorQuery
+	query.Filters = notDeletedFilters(ctx, m, cursorQuery.Filters)
+	query.Fields, query.Exclude = projectionFields(ctx, cursorQuery.Fields, cursorQuery.Exclude)
+	plan, err := parseCursorQuery(m, &query)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := plan.projection(m, &query)
+	if err != nil {
+		return nil, err
+	}
+
+	err = self.ExecuteDriverContext(ctx, m, func(ctx context.Context, c *mongo.Collection) error {
+		opts := options.Find().
+			SetSort(driverSort(plan.sorts)).
+			SetLimit(int64(plan.limit()))
+		if fields != nil {
+			opts.SetProjection(fields)
+		}
+		cursor, err := c.Find(ctx, plan.criteria, opts)
+		if err != nil {
+			return err
+		}
+		if err = cursor.All(ctx, list); err != nil {
+			return err
+		}
+		if info, err = plan.finish(list); err != nil {
+			return err
+		}
+
+		var total int64
+		switch plan.total {
+		case data.TotalMode_EXACT:
+			total, err = c.CountDocuments(ctx, plan.filters)
+		case data.TotalMode_ESTIMATED:
+			total, err = c.EstimatedDocumentCount(ctx)
+		default:
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		info.Total = &total
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Watch 需要副本集或分片集群, opts.Store 不为空时从上次保存的 resume token 继续
+func (self *mongoDriverRepositoryImpl) Watch(ctx context.Context, m Model, handler ChangeHandler, opts *WatchOptions) error {
+	return self.ExecuteDriverContext(ctx, m, func(ctx context.Context, c *mongo.Collection) error {
+		return WatchCollection(ctx, c, handler, opts)
+	})
+}
+
+func (self *mongoDriverRepositoryImpl) BulkWrite(ops []BulkOp, opts *BulkOptions) (*BulkResult, error) {
+	return self.BulkWriteContext(self.context(), ops, opts)
+}
+
+func (self *mongoDriverRepositoryImpl) BulkWriteContext(ctx context.Context, ops []BulkOp, opts *BulkOptions) (result *BulkResult, err error) {
+	if len(ops) == 0 {
+		return &BulkResult{}, nil
+	}
+	if err = checkBulkTenants(ctx, ops); err != nil {
+		return nil, err
+	}
+	err = self.ExecuteDriverContext(ctx, ops[0].Model, func(ctx context.Context, c *mongo.Collection) error {
+		result, err = runBulk(ops, opts, driverBulkBatch(ctx, c))
+		return err
+	})
+	return
+}
+
+// versionConflict 按版本没有匹配到时区分并发修改和文档不存在
+func (self *mongoDriverRepositoryImpl) versionConflict(ctx context.Context, c *mongo.Collection, m Model) error {
+	n, err := c.CountDocuments(ctx, m.Unique(), options.Count().SetLimit(1))
+	if err != nil {
+		return err
+	}
+	return versionConflict(n > 0)
+}
+
+// Execute mgo 的 DBFunc 不能在官方驱动上执行
+func (self *mongoDriverRepositoryImpl) Execute(m Model, fn DBFunc) error {
+	return ErrDriverMismatch
+}
+
+func (self *mongoDriverRepositoryImpl) ExecuteContext(ctx context.Context, m Model, fn DBFunc) error {
+	return ErrDriverMismatch
+}
+
+func (self *mongoDriverRepositoryImpl) ExecuteDriver(m Model, fn DriverDBFunc) error {
+	return self.ExecuteDriverContext(self.context(), m, fn)
+}
+
+// ExecuteDriverContext ctx 或 m 带有租户时, 按租户的路由选择数据源和库,
+// 仓库或 ctx 设置了 ReadWriteOptions 时集合使用对应的读写选项
+func (self *mongoDriverRepositoryImpl) ExecuteDriverContext(ctx context.Context, m Model, fn DriverDBFunc) error {
+	aliasName, database, collectionName, err := routeModel(ctx, self.dsAliasName, m)
+	if err != nil {
+		return err
+	}
+	ds, err := GetDataSource(aliasName)
+	if err != nil {
+		return err
+	}
+	client, err := getDriverClient(ctx, ds)
+	if err != nil {
+		return err
+	}
+
+	ctx = self.bind(ctx)
+	opts := options.Collection()
+	// 事务内的读写选项由事务决定
+	if rw := mergeReadWrite(ctx, self.readWrite); rw != nil && mongo.SessionFromContext(ctx) == nil {
+		if opts, err = rw.collectionOptions(); err != nil {
+			return err
+		}
+	}
+	collection := client.Database(database).Collection(collectionName, opts)
+	return fn(ctx, collection)
+}
+
+func (self *mongoDriverRepositoryImpl) context() context.Context {
+	if self.ctx != nil {
+		return self.ctx
+	}
+	return context.Background()
+}
+
+// bind 事务中传入的 ctx 需带上事务的会话
+func (self *mongoDriverRepositoryImpl) bind(ctx context.Context) context.Context {
+	if self.ctx == nil || ctx == self.ctx || mongo.SessionFromContext(ctx) != nil {
+		return ctx
+	}
+	if session := mongo.SessionFromContext(self.ctx); session != nil {
+		return mongo.NewSessionContext(ctx, session)
+	}
+	return ctx
+}
+
+// WithTransaction 在事务中执行 fn, tx 的所有方法都在同一事务内.
+// 遇到 TransientTransactionError 会重试整个 fn, 遇到 UnknownTransactionCommitResult 会重试提交,
+// 因此 fn 可能被执行多次, 不应有事务外的副作用. 在事务内再次调用时直接加入当前事务.
+// 事务只能在一个数据源内, ctx 中有租户时使用租户的数据源
+func (self *mongoDriverRepositoryImpl) WithTransaction(ctx context.Context, fn func(tx MongoRepository) error) error {
+	if mongo.SessionFromContext(ctx) != nil {
+		return fn(&mongoDriverRepositoryImpl{dsAliasName: self.dsAliasName, ctx: ctx, readWrite: self.readWrite})
+	}
+
+	aliasName, err := routeAlias(ctx, self.dsAliasName)
+	if err != nil {
+		return err
+	}
+	ds, err := GetDataSource(aliasName)
+	if err != nil {
+		return err
+	}
+	client, err := getDriverClient(ctx, ds)
+	if err != nil {
+		return err
+	}
+
+	session, err := client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(context.Background())
+
+	opts := options.Transaction().
+		SetReadPreference(readpref.Primary()).
+		SetReadConcern(readconcern.Snapshot()).
+		SetWriteConcern(writeconcern.Majority())
+
+	_, err = session.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		tx := &mongoDriverRepositoryImpl{dsAliasName: aliasName, ctx: sessCtx, readWrite: self.readWrite}
+		return nil, fn(tx)
+	}, opts)
+	return err
+}
+
+func (self *mongoDriverRepositoryImpl) EnsureIndexes(m Indexed) error {
+	return self.EnsureIndexesContext(self.context(), m)
+}
+
+func (self *mongoDriverRepositoryImpl) EnsureIndexesContext(ctx context.Context, m Indexed) error {
+	return self.ExecuteDriverContext(ctx, m, func(ctx context.Context, c *mongo.Collection) error {
+		models := []mongo.IndexModel{}
+		for _, i := range m.Indexes() {
+			model, err := driverIndex(i)
+			if err != nil {
+				return err
+			}
+			models = append(models, model)
+		}
+		if len(models) == 0 {
+			return nil
+		}
+		_, err := c.Indexes().CreateMany(ctx, models)
+		return err
+	})
+}
@@ -0,0 +1,79 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestDriverMongoRepository(t *testing.T) {
+	config := &Config{
+		Driver:   DriverMongo,
+		Addrs:    "localhost:27017",
+		Username: "admin",
+		Password: "admin",
+		Database: "admin",
+		Poolsize: 200,
+		Source:   "admin",
+	}
+
+	err := RegisterDataSource("driver", config)
+	if err != nil {
+		t.Errorf("register dataSource err: %v\n", err)
+		return
+	}
+
+	repository := &mongoDriverRepositoryImpl{dsAliasName: "driver"}
+
+	user := User{
+		Id:       bson.NewObjectId(),
+		Nick:     "Marry李",
+		Age:      23,
+		Ctime:    time.Now(),
+		TenantId: "t2",
+	}
+
+	if err = repository.EnsureIndexes(&user); err != nil {
+		t.Errorf("ensure indexes err: %v", err)
+	}
+
+	if err = repository.Insert(&user); err != nil {
+		t.Errorf("insert err: %v", err)
+	}
+
+	user.Nick = "呵呵"
+	if _, err = repository.Update(&user); err != nil {
+		t.Errorf("update err: %v", err)
+	}
+
+	m := User{Id: user.Id, TenantId: "t2"}
+	if err = repository.FindOne(&m); err != nil || m.Nick != "呵呵" {
+		t.Errorf("find err: %v, %v", err, m)
+	}
+
+	// 事务回滚
+	rollback := errors.New("rollback")
+	err = repository.WithTransaction(context.Background(), func(tx MongoRepository) error {
+		if err := tx.UpdateSelective(&m, map[string]interface{}{"age": 30}); err != nil {
+			return err
+		}
+		return rollback
+	})
+	if err != rollback {
+		t.Errorf("transaction err: %v", err)
+	}
+	if err = repository.FindOne(&m); err != nil || m.Age != 23 {
+		t.Errorf("transaction not rolled back: %v, %v", err, m)
+	}
+
+	if err = repository.Delete(&m); err != nil {
+		t.Errorf("delete err: %v", err)
+	}
+	if err = repository.FindOne(&m); err != mgo.ErrNotFound {
+		t.Errorf("find deleted err: %v", err)
+	}
+}
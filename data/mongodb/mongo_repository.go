@@ -1,12 +1,17 @@
 package mongodb
 
 import (
+	"context"
+	"errors"
+	"time"
+
 	"github.com/mofancloud/xmicro/data"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
 type Config struct {
+	Driver         string `json:"driver"` // mgo(默认) 或 mongo
 	Addrs          string `json:"addrs"`
 	Username       string `json:"username"`
 	Password       string `json:"password"`
@@ -15,8 +20,48 @@ type Config struct {
 	Poolsize       int    `json:"poolsize"`
 	Source         string `json:"source"`
 	Mode           int    `json:"mode"`
+
+	// 超时, 单位毫秒, 不配置时分别为 5s, 10s, 10s
+	ConnectTimeout int `json:"connectTimeout"` // 建立连接
+	SocketTimeout  int `json:"socketTimeout"`  // 单次读写
+	SyncTimeout    int `json:"syncTimeout"`    // 等待可用节点
+
+	Lazy           bool `json:"lazy"`           // 注册时不连接, 第一次使用时连接
+	ConnectRetries int  `json:"connectRetries"` // 连接失败后的重试次数, 默认不重试
+	RetryInterval  int  `json:"retryInterval"`  // 第一次重试前等待的毫秒数, 默认 1s, 之后每次翻倍
+
+	// 以下仅官方驱动支持
+	URI           string `json:"uri"`           // mongodb:// 或 mongodb+srv:// 连接串, 设置后 Addrs 等被覆盖
+	AuthMechanism string `json:"authMechanism"` // SCRAM-SHA-256, MONGODB-X509 ...
+	TLS           bool   `json:"tls"`
+	TLSCAFile     string `json:"tlsCAFile"`
+}
+
+func timeoutOf(ms int, def time.Duration) time.Duration {
+	if ms <= 0 {
+		return def
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+func (c *Config) connectTimeout() time.Duration {
+	return timeoutOf(c.ConnectTimeout, time.Second*5)
+}
+
+func (c *Config) socketTimeout() time.Duration {
+	return timeoutOf(c.SocketTimeout, time.Second*10)
+}
+
+func (c *Config) syncTimeout() time.Duration {
+	return timeoutOf(c.SyncTimeout, time.Second*10)
+}
+
+func (c *Config) retryInterval() time.Duration {
+	return timeoutOf(c.RetryInterval, time.Second)
 }
 
+// MongoRepository 的每个方法都有一个 ...Context 版本,
+// ctx 的 deadline 和取消会作用于正在执行的查询, ctx 中的租户 (WithTenant) 决定数据源和库
 type MongoRepository interface {
 	All(m Model, result interface{}) error
 	Count(m Model) (count int64, err error)
@@ -27,12 +72,38 @@ type MongoRepository interface {
 	FindOne(m Model) error
 	Delete(m Model) error
 	Page(pageQuery *data.PageQuery, m Model, list interface{}) (total int64, pageNo int64, pageSize int32, err error)
+	PageCursor(cursorQuery *data.CursorQuery, m Model, list interface{}) (*data.CursorInfo, error)
 	Execute(m Model, fn DBFunc) error
+	BulkWrite(ops []BulkOp, opts *BulkOptions) (*BulkResult, error)
 	EnsureIndexes(m Indexed) error
+
+	AllContext(ctx context.Context, m Model, result interface{}) error
+	CountContext(ctx context.Context, m Model) (count int64, err error)
+	UpdateContext(ctx context.Context, m Model) (updated int, err error)
+	UpdateSelectiveContext(ctx context.Context, m Model, updateData map[string]interface{}) error
+	InsertContext(ctx context.Context, m Model) error
+	UpsertContext(ctx context.Context, m Model) (upserted int, err error)
+	FindOneContext(ctx context.Context, m Model) error
+	DeleteContext(ctx context.Context, m Model) error
+	PageContext(ctx context.Context, pageQuery *data.PageQuery, m Model, list interface{}) (total int64, pageNo int64, pageSize int32, err error)
+	PageCursorContext(ctx context.Context, cursorQuery *data.CursorQuery, m Model, list interface{}) (*data.CursorInfo, error)
+	ExecuteContext(ctx context.Context, m Model, fn DBFunc) error
+	BulkWriteContext(ctx context.Context, ops []BulkOp, opts *BulkOptions) (*BulkResult, error)
+	EnsureIndexesContext(ctx context.Context, m Indexed) error
+
+	// 多文档事务, fn 内通过 tx 执行的操作在同一事务中提交或回滚
+	WithTransaction(ctx context.Context, fn func(tx MongoRepository) error) error
+
+	// 监听 m 所在集合的变更, 阻塞直到 ctx 取消或 handler 返回 error
+	Watch(ctx context.Context, m Model, handler ChangeHandler, opts *WatchOptions) error
 }
 
+// ErrTransactionNotSupported mgo 不支持多文档事务, 需使用官方驱动的数据源
+var ErrTransactionNotSupported = errors.New("transactions need the mongo driver")
+
 type mongoRepositoryImpl struct {
 	dsAliasName string
+	readWrite   *ReadWriteOptions // 见 RepositoryWithReadWrite
 }
 
 // Constructor
@@ -49,121 +120,345 @@ func (self *mongoRepositoryImpl) GetDataSource() (DataSource, error) {
 }
 
 func (self *mongoRepositoryImpl) All(m Model, result interface{}) error {
-	err := self.Execute(m, func(c *mgo.Collection) error {
-		return Where(c, nil).All(result)
+	return self.AllContext(context.Background(), m, result)
+}
+
+func (self *mongoRepositoryImpl) AllContext(ctx context.Context, m Model, result interface{}) error {
+	fields, err := contextProjection(ctx, m)
+	if err != nil {
+		return err
+	}
+	criteria := notDeleted(ctx, m, nil)
+	out, commit := shadow(result)
+	err = self.ExecuteContext(ctx, m, func(c *mgo.Collection) error {
+		return Where(c, criteria).Select(fields).All(out)
 	})
+	if err == nil {
+		commit()
+	}
 	return err
 }
 
 func (self *mongoRepositoryImpl) Count(m Model) (count int64, err error) {
-	self.Execute(m, func(c *mgo.Collection) error {
-		c1, err := Where(c, nil).Count()
-		count = int64(c1)
+	return self.CountContext(context.Background(), m)
+}
+
+func (self *mongoRepositoryImpl) CountContext(ctx context.Context, m Model) (int64, error) {
+	criteria := notDeleted(ctx, m, nil)
+	var count int
+	err := self.ExecuteContext(ctx, m, func(c *mgo.Collection) error {
+		var err error
+		count, err = Where(c, criteria).Count()
 		return err
 	})
-	return
+	if err != nil {
+		return 0, err
+	}
+	return int64(count), nil
 }
 
 func (self *mongoRepositoryImpl) Update(m Model) (updated int, err error) {
-	self.Execute(m, func(c *mgo.Collection) error {
-		info, err := c.Find(m.Unique()).Apply(mgo.Change{
-			ReturnNew: true,
-			Update: bson.M{
-				"$set": m,
-			},
-		}, m)
-
-		if err != nil {
-			return err
-		}
+	return self.UpdateContext(context.Background(), m)
+}
 
-		updated = info.Updated
-		return nil
-	})
+func (self *mongoRepositoryImpl) UpdateContext(ctx context.Context, m Model) (updated int, err error) {
+	stampUpdate(m)
+	selector := m.Unique()
+	vm, versioned := m.(Versioned)
+	if versioned {
+		selector = versionSelector(vm)
+		vm.SetVersion(vm.GetVersion() + 1)
+	}
+
+	unique := m.Unique()
+	set, err := toDocument(m)
+	if err == nil {
+		out, commit := shadow(m)
+		var n int
+		err = self.ExecuteContext(ctx, m, func(c *mgo.Collection) error {
+			info, err := c.Find(selector).Apply(mgo.Change{
+				ReturnNew: true,
+				Update: bson.M{
+					"$set": set,
+				},
+			}, out)
+
+			if err == mgo.ErrNotFound && versioned {
+				count, cerr := c.Find(unique).Count()
+				if cerr != nil {
+					return cerr
+				}
+				return versionConflict(count > 0)
+			}
+			if err != nil {
+				return err
+			}
+
+			n = info.Updated
+			return nil
+		})
+		if err == nil {
+			commit()
+			updated = n
+		}
+	}
 
+	if err != nil && versioned {
+		rollbackVersion(vm, err)
+	}
 	return
 }
 
 func (self *mongoRepositoryImpl) UpdateSelective(m Model, updateData map[string]interface{}) error {
-	err := self.Execute(m, func(c *mgo.Collection) error {
-		return c.Update(m, bson.M{"$set": updateData})
+	return self.UpdateSelectiveContext(context.Background(), m, updateData)
+}
+
+func (self *mongoRepositoryImpl) UpdateSelectiveContext(ctx context.Context, m Model, updateData map[string]interface{}) error {
+	selector, set := m.Unique(), bson.M(updateData)
+	vm, versioned := m.(Versioned)
+	if versioned {
+		selector, set = versionSelector(vm), versionedSet(vm, updateData)
+	}
+	set = stampSet(m, set)
+
+	unique := m.Unique()
+	err := self.ExecuteContext(ctx, m, func(c *mgo.Collection) error {
+		err := c.Update(selector, bson.M{"$set": set})
+		if err == mgo.ErrNotFound && versioned {
+			n, cerr := c.Find(unique).Count()
+			if cerr != nil {
+				return cerr
+			}
+			return versionConflict(n > 0)
+		}
+		return err
 	})
+
+	if err == nil && versioned {
+		vm.SetVersion(vm.GetVersion() + 1)
+	}
 	return err
 }
 
 func (self *mongoRepositoryImpl) Insert(m Model) error {
-	err := self.Execute(m, func(c *mgo.Collection) error {
-		return c.Insert(m)
+	return self.InsertContext(context.Background(), m)
+}
+
+func (self *mongoRepositoryImpl) InsertContext(ctx context.Context, m Model) error {
+	stampInsert(m)
+	doc, err := toDocument(m)
+	if err != nil {
+		return err
+	}
+	return self.ExecuteContext(ctx, m, func(c *mgo.Collection) error {
+		return c.Insert(doc)
 	})
-	return err
 }
 
 func (self *mongoRepositoryImpl) Upsert(m Model) (upserted int, err error) {
-	self.Execute(m, func(c *mgo.Collection) error {
-		changeInfo, err := c.Upsert(m.Unique(), bson.M{"$set": m})
-		if err != nil {
-			return err
+	return self.UpsertContext(context.Background(), m)
+}
+
+func (self *mongoRepositoryImpl) UpsertContext(ctx context.Context, m Model) (upserted int, err error) {
+	stampInsert(m)
+	selector := m.Unique()
+	vm, versioned := m.(Versioned)
+	if versioned {
+		selector = versionSelector(vm)
+		vm.SetVersion(vm.GetVersion() + 1)
+	}
+
+	update, err := upsertUpdate(m, nil)
+	if err == nil {
+		var n int
+		err = self.ExecuteContext(ctx, m, func(c *mgo.Collection) error {
+			changeInfo, err := c.Upsert(selector, update)
+			if err != nil {
+				// 版本不匹配时按 selector 插入, 与已有文档的唯一键冲突
+				if versioned && mgo.IsDup(err) {
+					return ErrConcurrentModification
+				}
+				return err
+			}
+			n = changeInfo.Updated
+			return nil
+		})
+		if err == nil {
+			upserted = n
 		}
-		upserted = changeInfo.Updated
-		return nil
-	})
+	}
 
+	if err != nil && versioned {
+		rollbackVersion(vm, err)
+	}
 	return
 }
 
 func (self *mongoRepositoryImpl) FindOne(m Model) error {
-	return self.Execute(m, func(c *mgo.Collection) error {
-		err := c.Find(m.Unique()).One(m)
+	return self.FindOneContext(context.Background(), m)
+}
+
+func (self *mongoRepositoryImpl) FindOneContext(ctx context.Context, m Model) error {
+	fields, err := contextProjection(ctx, m)
+	if err != nil {
 		return err
+	}
+	criteria := notDeleted(ctx, m, m.Unique())
+	out, commit := shadow(m)
+	err = self.ExecuteContext(ctx, m, func(c *mgo.Collection) error {
+		return c.Find(criteria).Select(fields).One(out)
 	})
+	if err == nil {
+		commit()
+	}
+	return err
 }
 
 func (self *mongoRepositoryImpl) Delete(m Model) error {
-	return self.Execute(m, func(c *mgo.Collection) error {
-		return c.Remove(m.Unique())
+	return self.DeleteContext(context.Background(), m)
+}
+
+func (self *mongoRepositoryImpl) DeleteContext(ctx context.Context, m Model) error {
+	sm, soft := m.(SoftDeletable)
+	if !soft {
+		unique := m.Unique()
+		return self.ExecuteContext(ctx, m, func(c *mgo.Collection) error {
+			return c.Remove(unique)
+		})
+	}
+
+	now := time.Now()
+	criteria := notDeleted(ctx, m, m.Unique())
+	err := self.ExecuteContext(ctx, m, func(c *mgo.Collection) error {
+		return c.Update(criteria, bson.M{"$set": bson.M{FieldDeletedAt: now}})
 	})
+	if err == nil {
+		sm.SetDeletedAt(now)
+	}
+	return err
 }
 
 func (self *mongoRepositoryImpl) Page(pageQuery *data.PageQuery, m Model, list interface{}) (total int64, pageNo int64, pageSize int32, err error) {
-	filters, pageNo, pageSize, _ := ParsePageQuery(m, pageQuery)
+	return self.PageContext(context.Background(), pageQuery, m, list)
+}
 
-	self.Execute(m, func(c *mgo.Collection) error {
-		t, err := c.Find(filters).Count()
-		total = int64(t)
+func (self *mongoRepositoryImpl) PageContext(ctx context.Context, pageQuery *data.PageQuery, m Model, list interface{}) (total int64, pageNo int64, pageSize int32, err error) {
+	query := *pageQuery
+	query.Filters = notDeletedFilters(ctx, m, pageQuery.Filters)
+	query.Fields, query.Exclude = projectionFields(ctx, pageQuery.Fields, pageQuery.Exclude)
+	filters, pageNo, pageSize, _, err := ParsePageQuery(m, &query)
+	if err != nil {
+		return
+	}
 
-		if err != nil {
+	out, commit := shadow(list)
+	var t int
+	err = self.ExecuteContext(ctx, m, func(c *mgo.Collection) error {
+		var err error
+		if t, err = c.Find(filters).Count(); err != nil {
 			return err
 		}
 
-		return Page(c, pageQuery, m, list)
+		return Page(c, &query, m, out)
 	})
+	if err == nil {
+		commit()
+		total = int64(t)
+	}
 
 	return
 }
 
+// PageCursor 按 Sort 字段的游标分页, 不用 skip, 总数按 cursorQuery.Total 可选
+func (self *mongoRepositoryImpl) PageCursor(cursorQuery *data.CursorQuery, m Model, list interface{}) (*data.CursorInfo, error) {
+	return self.PageCursorContext(context.Background(), cursorQuery, m, list)
+}
+
+func (self *mongoRepositoryImpl) PageCursorContext(ctx context.Context, cursorQuery *data.CursorQuery, m Model, list interface{}) (*data.CursorInfo, error) {
+	query := *cursorQuery
+	query.Filters = notDeletedFilters(ctx, m, cursorQuery.Filters)
+	query.Fields, query.Exclude = projectionFields(ctx, cursorQuery.Fields, cursorQuery.Exclude)
+	out, commit := shadow(list)
+	var info *data.CursorInfo
+	err := self.ExecuteContext(ctx, m, func(c *mgo.Collection) error {
+		var err error
+		info, err = PageCursor(c, &query, m, out)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	commit()
+	return info, nil
+}
+
 func (self *mongoRepositoryImpl) Execute(m Model, fn DBFunc) error {
-	ds, err := self.GetDataSource()
+	return self.ExecuteContext(context.Background(), m, fn)
+}
+
+// ExecuteContext ctx 或 m 带有租户时, 按租户的路由选择数据源和库,
+// 仓库或 ctx 设置了 ReadWriteOptions 时在会话副本上执行
+func (self *mongoRepositoryImpl) ExecuteContext(ctx context.Context, m Model, fn DBFunc) error {
+	aliasName, database, collection, err := routeModel(ctx, self.dsAliasName, m)
+	if err != nil {
+		return err
+	}
+	ds, err := GetDataSource(aliasName)
+	if err != nil {
+		return err
+	}
+	session, err := getMgoSession(ctx, ds)
 	if err != nil {
 		return err
 	}
+	if opts := mergeReadWrite(ctx, self.readWrite); opts != nil {
+		if session, err = opts.applyMgo(session); err != nil {
+			return err
+		}
+		defer session.Close()
+	}
 
-	return Execute(ds.GetSession(), m.Database(), m.Collection(), fn)
+	return ExecuteContext(ctx, session, database, collection, fn)
 }
 
-func (self *mongoRepositoryImpl) EnsureIndexes(m Indexed) error {
-	ds, err := self.GetDataSource()
-	if err != nil {
+// BulkWrite ops 需在同一个集合, 部分失败时返回 *BulkError, 结果中包含每个操作的状态
+func (self *mongoRepositoryImpl) BulkWrite(ops []BulkOp, opts *BulkOptions) (*BulkResult, error) {
+	return self.BulkWriteContext(context.Background(), ops, opts)
+}
+
+func (self *mongoRepositoryImpl) BulkWriteContext(ctx context.Context, ops []BulkOp, opts *BulkOptions) (result *BulkResult, err error) {
+	if len(ops) == 0 {
+		return &BulkResult{}, nil
+	}
+	if err = checkBulkTenants(ctx, ops); err != nil {
+		return nil, err
+	}
+	var r *BulkResult
+	err = self.ExecuteContext(ctx, ops[0].Model, func(c *mgo.Collection) error {
+		var err error
+		r, err = runBulk(ops, opts, mgoBulkBatch(c))
 		return err
+	})
+	if err != nil && r == nil {
+		return nil, err
 	}
+	return r, err
+}
 
-	return Execute(ds.GetSession(), m.Database(), m.Collection(), func(c *mgo.Collection) error {
-		for _, i := range m.Indexes() {
-			err = c.EnsureIndex(i)
-			if err != nil {
-				return err
-			}
-		}
+func (self *mongoRepositoryImpl) EnsureIndexes(m Indexed) error {
+	return self.EnsureIndexesContext(context.Background(), m)
+}
 
-		return nil
+func (self *mongoRepositoryImpl) EnsureIndexesContext(ctx context.Context, m Indexed) error {
+	return self.ExecuteContext(ctx, m, func(c *mgo.Collection) error {
+		return ensureIndexes(c, m.Indexes())
 	})
 }
+
+func (self *mongoRepositoryImpl) WithTransaction(ctx context.Context, fn func(tx MongoRepository) error) error {
+	return ErrTransactionNotSupported
+}
+
+func (self *mongoRepositoryImpl) Watch(ctx context.Context, m Model, handler ChangeHandler, opts *WatchOptions) error {
+	return ErrChangeStreamNotSupported
+}
@@ -1,6 +1,7 @@
 package mongodb
 
 import (
+	"context"
 	"fmt"
 	"testing"
 	"time"
@@ -26,6 +27,14 @@ func (self *User) Collection() string {
 	return fmt.Sprintf("%s_users", self.TenantId)
 }
 
+func (self *User) Tenant() string {
+	return self.TenantId
+}
+
+func (self *User) SetTenant(tenantId string) {
+	self.TenantId = tenantId
+}
+
 func (self *User) Unique() bson.M {
 	return bson.M{"_id": self.Id}
 }
@@ -96,6 +105,18 @@ func TestMongoRepository(t *testing.T) {
 	}
 	t.Logf("find: %v\n", m)
 
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err = userRepository.FindOneContext(ctx, &m); err != context.Canceled {
+		t.Errorf("find with canceled context err: %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err = userRepository.CountContext(ctx, &m); err != nil {
+		t.Errorf("count with timeout err: %v", err)
+	}
+
 	err = userRepository.Delete(&m)
 	if err != nil {
 		t.Errorf("delete err: %v", err)
@@ -0,0 +1,259 @@
+package mongodb
+
+import (
+	"strings"
+
+	"github.com/mofancloud/xmicro/data"
+	xreflect "github.com/mofancloud/xmicro/reflect"
+)
+
+// DefaultMaxRegexLength FilterPolicy.MaxRegexLength 为 0 时的正则最大长度
+const DefaultMaxRegexLength = 128
+
+// FilterPolicy 限制客户端 filters 和 sort 可用的字段与运算符
+type FilterPolicy struct {
+	// 可过滤的字段及允许的运算符, 运算符为空时允许全部; 为 nil 时为 Model 的全部 bson 字段
+	Fields map[string][]data.FilterType
+	// 可排序的字段, 为 nil 时为 Model 的全部 bson 字段
+	Sortable []string
+	// LIKE/ILIKE/NOT_LIKE/MATCH 的正则最大长度
+	MaxRegexLength int
+	// 是否允许 TEXT 全文检索
+	Text bool
+}
+
+// Filterable 实现了的 Model 在 BuildCriteria 和 ParsePageQuery 时按 FilterPolicy 校验,
+// 没有实现的 Model 不限制字段
+type Filterable interface {
+	Model
+	FilterPolicy() *FilterPolicy
+}
+
+// ValidationError 按 FilterPolicy 校验未通过的全部条目, errors.Is(err, ErrInvalidFilter) 为 true
+type ValidationError struct {
+	Errors []*FilterError `json:"errors"`
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, fe := range e.Errors {
+		msgs[i] = fe.Error()
+	}
+	return "invalid filter: " + strings.Join(msgs, "; ")
+}
+
+func (e *ValidationError) Unwrap() error {
+	return ErrInvalidFilter
+}
+
+func (e *ValidationError) add(field string, op data.FilterType, format string, args ...interface{}) {
+	e.Errors = append(e.Errors, filterError(field, op, format, args...).(*FilterError))
+}
+
+// 没有错误时返回 nil
+func (e *ValidationError) err() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return e
+}
+
+func modelPolicy(m Model) *FilterPolicy {
+	if f, ok := m.(Filterable); ok {
+		return f.FilterPolicy()
+	}
+	return nil
+}
+
+// policyChecker 一次校验用到的 policy 和 Model 的字段
+type policyChecker struct {
+	policy  *FilterPolicy
+	m       Model
+	mStruct *xreflect.StructInfo
+	errs    *ValidationError
+}
+
+func newPolicyChecker(m Model, policy *FilterPolicy, mStruct *xreflect.StructInfo) *policyChecker {
+	return &policyChecker{policy: policy, m: m, mStruct: mStruct, errs: &ValidationError{}}
+}
+
+// 字段属于 Model, a.b 形式的字段只看第一级
+func (c *policyChecker) inSchema(field string) bool {
+	if c.mStruct == nil {
+		return false
+	}
+	_, ok := c.mStruct.FieldsMap[strings.Split(field, ".")[0]]
+	return ok
+}
+
+func (c *policyChecker) maxRegexLength() int {
+	if c.policy.MaxRegexLength > 0 {
+		return c.policy.MaxRegexLength
+	}
+	return DefaultMaxRegexLength
+}
+
+// 软删除时自动加上的 deletedAt: {EQ: nil} 不受 policy 限制
+func (c *policyChecker) isSoftDeleteFilter(field string, ops map[string]interface{}) bool {
+	if _, ok := c.m.(SoftDeletable); !ok || field != FieldDeletedAt || len(ops) != 1 {
+		return false
+	}
+	v, ok := ops[string(data.FilterType_EQ)]
+	return ok && v == nil
+}
+
+// 格式错误留给 data.ParseFilter 处理, 这里只校验字段, 运算符和正则长度
+func (c *policyChecker) checkFilters(filters map[string]interface{}) {
+	for k, v := range filters {
+		switch filterType := data.FilterType(k); filterType {
+		case data.FilterType_AND, data.FilterType_OR, data.FilterType_NOR:
+			for _, sub := range logicalItems(v) {
+				c.checkFilters(sub)
+			}
+		case data.FilterType_TEXT:
+			if !c.policy.Text {
+				c.errs.add(k, "", "not allowed")
+			}
+		default:
+			ops, _ := v.(map[string]interface{})
+			c.checkField(k, ops)
+		}
+	}
+}
+
+func (c *policyChecker) checkField(field string, ops map[string]interface{}) {
+	if c.isSoftDeleteFilter(field, ops) {
+		return
+	}
+
+	var allowed []data.FilterType
+	if c.policy.Fields != nil {
+		var ok bool
+		if allowed, ok = c.policy.Fields[field]; !ok {
+			c.errs.add(field, "", "not filterable")
+			return
+		}
+	} else if !c.inSchema(field) {
+		c.errs.add(field, "", "not filterable")
+		return
+	}
+
+	for vKey, vValue := range ops {
+		op := data.FilterType(vKey)
+		if len(allowed) > 0 && !containsFilterType(allowed, op) {
+			c.errs.add(field, op, "operator not allowed")
+			continue
+		}
+		switch op {
+		case data.FilterType_LIKE, data.FilterType_ILIKE, data.FilterType_NOT_LIKE, data.FilterType_MATCH:
+			c.checkPattern(field, op, vValue)
+		case data.FilterType_ELEM_MATCH:
+			c.checkElemMatch(field, vValue)
+		}
+	}
+}
+
+// checkPattern 正则为字符串或 {pattern, options}
+func (c *policyChecker) checkPattern(field string, op data.FilterType, v interface{}) {
+	pattern, _ := v.(string)
+	if m, ok := v.(map[string]interface{}); ok {
+		pattern, _ = m["pattern"].(string)
+	}
+	if len(pattern) > c.maxRegexLength() {
+		c.errs.add(field, op, "pattern longer than %d", c.maxRegexLength())
+	}
+}
+
+// logicalItems AND/OR/NOR 的子条件, 格式不对的元素跳过
+func logicalItems(v interface{}) []map[string]interface{} {
+	if subs, ok := v.([]map[string]interface{}); ok {
+		return subs
+	}
+	items, _ := v.([]interface{})
+	subs := make([]map[string]interface{}, 0, len(items))
+	for _, item := range items {
+		if sub, ok := item.(map[string]interface{}); ok {
+			subs = append(subs, sub)
+		}
+	}
+	return subs
+}
+
+// ELEM_MATCH 的元素字段按 field.sub 校验, 运算符形式的按 field 本身的正则长度校验,
+// AND/OR/NOR 中的子条件同样按 field.sub 校验
+func (c *policyChecker) checkElemMatch(field string, v interface{}) {
+	sub, ok := v.(map[string]interface{})
+	if !ok {
+		return
+	}
+	for k, val := range sub {
+		op := data.FilterType(k)
+		switch op {
+		case data.FilterType_AND, data.FilterType_OR, data.FilterType_NOR:
+			for _, item := range logicalItems(val) {
+				c.checkElemMatch(field, item)
+			}
+			continue
+		case data.FilterType_TEXT:
+			c.errs.add(field, op, "not allowed in ELEM_MATCH")
+			continue
+		}
+		if data.IsFieldOperator(op) {
+			switch op {
+			case data.FilterType_LIKE, data.FilterType_ILIKE, data.FilterType_NOT_LIKE, data.FilterType_MATCH:
+				c.checkPattern(field, op, val)
+			}
+			continue
+		}
+		if ops, ok := val.(map[string]interface{}); ok {
+			c.checkField(field+"."+k, ops)
+		}
+	}
+}
+
+func (c *policyChecker) checkSorts(sorts []*data.SortSpec) {
+	for _, s := range sorts {
+		if s == nil {
+			continue
+		}
+		if c.policy.Sortable != nil {
+			if !containsString(c.policy.Sortable, s.Property) {
+				c.errs.add(s.Property, "", "not sortable")
+			}
+		} else if !c.inSchema(s.Property) {
+			c.errs.add(s.Property, "", "not sortable")
+		}
+	}
+}
+
+func containsFilterType(types []data.FilterType, t data.FilterType) bool {
+	for _, v := range types {
+		if v == t {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateQuery 按 m 的 FilterPolicy 校验 filters 和 sorts, m 没有实现 Filterable 时返回 nil,
+// 否则返回 *ValidationError
+func ValidateQuery(m Model, filters map[string]interface{}, sorts []*data.SortSpec) error {
+	policy := modelPolicy(m)
+	if policy == nil {
+		return nil
+	}
+	mStruct, _ := xreflect.GetStructInfo(m)
+	c := newPolicyChecker(m, policy, mStruct)
+	c.checkFilters(filters)
+	c.checkSorts(sorts)
+	return c.errs.err()
+}
@@ -0,0 +1,138 @@
+package mongodb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/mofancloud/xmicro/data"
+)
+
+type Product struct {
+	Id        bson.ObjectId `bson:"_id"`
+	Name      string        `bson:"name"`
+	Price     int64         `bson:"price"`
+	Secret    string        `bson:"secret"`
+	Tags      []string      `bson:"tags"`
+	Specs     []bson.M      `bson:"specs"`
+	DeletedAt *time.Time    `bson:"deletedAt,omitempty"`
+}
+
+func (self *Product) Database() string {
+	return "shop"
+}
+
+func (self *Product) Collection() string {
+	return "products"
+}
+
+func (self *Product) Unique() bson.M {
+	return bson.M{"_id": self.Id}
+}
+
+func (self *Product) SetDeletedAt(t time.Time) {
+	self.DeletedAt = &t
+}
+
+func (self *Product) FilterPolicy() *FilterPolicy {
+	return &FilterPolicy{
+		Fields: map[string][]data.FilterType{
+			"name":       {data.FilterType_EQ, data.FilterType_LIKE},
+			"price":      {data.FilterType_GTE, data.FilterType_LTE},
+			"tags":       nil,
+			"specs":      {data.FilterType_ELEM_MATCH},
+			"specs.size": {data.FilterType_EQ},
+		},
+		Sortable:       []string{"price"},
+		MaxRegexLength: 8,
+	}
+}
+
+func TestValidateQuery(t *testing.T) {
+	tests := []struct {
+		name    string
+		filters string
+		sort    []*data.SortSpec
+		invalid []string // 未通过的字段
+	}{
+		{"allowed", `{"name": {"LIKE": "^ab"}, "price": {"GTE": 1, "LTE": 9}}`, nil, nil},
+		{"any operator", `{"tags": {"SIZE": 2}}`, nil, nil},
+		{"nested", `{"OR": [{"name": {"EQ": "a"}}, {"AND": [{"secret": {"EQ": "x"}}]}]}`, nil, []string{"secret"}},
+		{"not filterable", `{"secret": {"EQ": "x"}}`, nil, []string{"secret"}},
+		{"operator", `{"price": {"GT": 1}}`, nil, []string{"price"}},
+		{"regex length", `{"name": {"LIKE": "^(a+)+(b+)+$"}}`, nil, []string{"name"}},
+		{"elem match regex", `{"tags": {"ELEM_MATCH": {"MATCH": {"pattern": "^(a+)+(b+)+$"}}}}`, nil, []string{"tags"}},
+		{"elem match or", `{"tags": {"ELEM_MATCH": {"OR": [{"secret": {"LIKE": "^(a+)+(b+)+$"}}]}}}`, nil, []string{"tags.secret"}},
+		{"elem match nested and", `{"specs": {"ELEM_MATCH": {"AND": [{"size": {"EQ": 1}}, {"NOR": [{"size": {"GT": 1}}, {"color": {"EQ": "red"}}]}]}}}`,
+			nil, []string{"specs.size", "specs.color"}},
+		{"text", `{"TEXT": "coffee"}`, nil, []string{"TEXT"}},
+		{"elem match", `{"specs": {"ELEM_MATCH": {"size": {"EQ": 1}, "color": {"EQ": "red"}}}}`, nil, []string{"specs.color"}},
+		{"sort", `{}`, []*data.SortSpec{{Property: "price"}, {Property: "name", Type: data.SortType_DSC}}, []string{"name"}},
+		{"soft delete", `{"deletedAt": {"EQ": null}}`, nil, nil},
+		{"deleted at", `{"deletedAt": {"NE": null}}`, nil, []string{"deletedAt"}},
+		{"all errors", `{"secret": {"EQ": "x"}, "price": {"IN": [1]}}`, []*data.SortSpec{{Property: "secret"}}, []string{"secret", "price", "secret"}},
+	}
+
+	for _, test := range tests {
+		var filters map[string]interface{}
+		if err := json.Unmarshal([]byte(test.filters), &filters); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		err := ValidateQuery(&Product{}, filters, test.sort)
+		if len(test.invalid) == 0 {
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			}
+			continue
+		}
+
+		var verr *ValidationError
+		if !errors.As(err, &verr) || !errors.Is(err, ErrInvalidFilter) {
+			t.Errorf("%s: expect a ValidationError, got %v", test.name, err)
+			continue
+		}
+		fields := map[string]int{}
+		for _, fe := range verr.Errors {
+			fields[fe.Field]++
+		}
+		for _, f := range test.invalid {
+			fields[f]--
+		}
+		for f, n := range fields {
+			if n != 0 {
+				t.Errorf("%s: field %s, got %v", test.name, f, verr)
+			}
+		}
+	}
+}
+
+func TestParsePageQueryPolicy(t *testing.T) {
+	pageQuery := &data.PageQuery{
+		Filters: map[string]interface{}{"secret": map[string]interface{}{"EQ": "x"}},
+		Sort:    []*data.SortSpec{{Property: "price", Type: data.SortType_DSC}},
+	}
+	if _, _, _, _, err := ParsePageQuery(&Product{}, pageQuery); !errors.Is(err, ErrInvalidFilter) {
+		t.Fatalf("expect invalid filter, got %v", err)
+	}
+
+	// 软删除自动加上的条件不受 policy 限制
+	pageQuery.Filters = notDeletedFilters(context.Background(), &Product{}, map[string]interface{}{
+		"name": map[string]interface{}{"EQ": "a"},
+	})
+	criteria, _, _, sorts, err := ParsePageQuery(&Product{}, pageQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(criteria) != 2 || len(sorts) != 1 || sorts[0] != "-price" {
+		t.Fatalf("criteria %v, sorts %v", criteria, sorts)
+	}
+
+	// 没有 policy 的 Model 不限制字段, 但字段名不能以 $ 开头
+	if _, err := BuildCriteria(&User{}, map[string]interface{}{"$where": map[string]interface{}{"EQ": "1"}}); !errors.Is(err, ErrInvalidFilter) {
+		t.Fatalf("expect invalid filter, got %v", err)
+	}
+}
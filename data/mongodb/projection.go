@@ -0,0 +1,85 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+
+	xreflect "github.com/mofancloud/xmicro/reflect"
+)
+
+// ErrInvalidProjection 字段不存在, 或同时指定了 Fields 和 Exclude
+var ErrInvalidProjection = errors.New("invalid projection")
+
+type projectionKey struct{}
+
+type projection struct {
+	fields  []string
+	exclude []string
+}
+
+// WithProjection 在 ctx 上指定 All/FindOne 等读方法返回的字段,
+// 只加载部分字段的 Model 不要再用 Update 整体写回
+func WithProjection(ctx context.Context, fields []string, exclude []string) context.Context {
+	return context.WithValue(ctx, projectionKey{}, &projection{fields: fields, exclude: exclude})
+}
+
+// BuildProjection 按 m 的 bson 字段校验, fields 和 exclude 都为空时返回 nil.
+// a.b 形式的字段只校验第一级, Fields 中可以 Exclude _id
+func BuildProjection(m Model, fields []string, exclude []string) (bson.M, error) {
+	if len(fields) == 0 && len(exclude) == 0 {
+		return nil, nil
+	}
+
+	mStruct, err := xreflect.GetStructInfo(m)
+	if err != nil {
+		return nil, err
+	}
+	check := func(f string) error {
+		if _, ok := mStruct.FieldsMap[strings.Split(f, ".")[0]]; !ok {
+			return fmt.Errorf("%w: field `%s` not exist", ErrInvalidProjection, f)
+		}
+		return nil
+	}
+
+	p := bson.M{}
+	for _, f := range fields {
+		if err = check(f); err != nil {
+			return nil, err
+		}
+		p[f] = 1
+	}
+	for _, f := range exclude {
+		if err = check(f); err != nil {
+			return nil, err
+		}
+		if len(fields) > 0 && f != "_id" {
+			return nil, fmt.Errorf("%w: fields and exclude can not be used together", ErrInvalidProjection)
+		}
+		p[f] = 0
+	}
+	return p, nil
+}
+
+// contextProjection ctx 上的 projection
+func contextProjection(ctx context.Context, m Model) (bson.M, error) {
+	p, ok := ctx.Value(projectionKey{}).(*projection)
+	if !ok {
+		return nil, nil
+	}
+	return BuildProjection(m, p.fields, p.exclude)
+}
+
+// projectionFields PageQuery/CursorQuery 上的 projection 优先, 没有时取 ctx 上的
+func projectionFields(ctx context.Context, fields []string, exclude []string) ([]string, []string) {
+	if len(fields) > 0 || len(exclude) > 0 {
+		return fields, exclude
+	}
+	if p, ok := ctx.Value(projectionKey{}).(*projection); ok {
+		return p.fields, p.exclude
+	}
+	return nil, nil
+}
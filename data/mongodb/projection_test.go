@@ -0,0 +1,79 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/mofancloud/xmicro/data"
+)
+
+type profileAudit struct {
+	Creator string `bson:"creator"`
+}
+
+// Profile 没有标签的字段和 inline 的字段
+type Profile struct {
+	Id       bson.ObjectId `bson:"_id"`
+	Nickname string
+	Audit    profileAudit `bson:",inline"`
+}
+
+func (self *Profile) Database() string {
+	return "user_db"
+}
+
+func (self *Profile) Collection() string {
+	return "profiles"
+}
+
+func (self *Profile) Unique() bson.M {
+	return bson.M{"_id": self.Id}
+}
+
+func TestBuildProjection(t *testing.T) {
+	p, err := BuildProjection(&User{}, []string{"nick", "age"}, []string{"_id"})
+	if err != nil || !reflect.DeepEqual(p, bson.M{"nick": 1, "age": 1, "_id": 0}) {
+		t.Errorf("fields: %v, %v", p, err)
+	}
+
+	// omitempty 的字段也能识别
+	p, err = BuildProjection(&Post{}, nil, []string{"deletedAt"})
+	if err != nil || !reflect.DeepEqual(p, bson.M{"deletedAt": 0}) {
+		t.Errorf("exclude: %v, %v", p, err)
+	}
+
+	// 与 mgo 一致, 没有标签的字段为小写的字段名, inline 的字段展开
+	p, err = BuildProjection(&Profile{}, []string{"nickname", "creator"}, nil)
+	if err != nil || !reflect.DeepEqual(p, bson.M{"nickname": 1, "creator": 1}) {
+		t.Errorf("untagged and inline: %v, %v", p, err)
+	}
+
+	if p, err = BuildProjection(&User{}, nil, nil); p != nil || err != nil {
+		t.Errorf("empty: %v, %v", p, err)
+	}
+	if _, err = BuildProjection(&User{}, []string{"password"}, nil); !errors.Is(err, ErrInvalidProjection) {
+		t.Errorf("unknown field err: %v", err)
+	}
+	if _, err = BuildProjection(&User{}, []string{"nick"}, []string{"age"}); !errors.Is(err, ErrInvalidProjection) {
+		t.Errorf("mixed err: %v", err)
+	}
+
+	ctx := WithProjection(context.Background(), []string{"nick"}, nil)
+	if p, err = contextProjection(ctx, &User{}); err != nil || !reflect.DeepEqual(p, bson.M{"nick": 1}) {
+		t.Errorf("context: %v, %v", p, err)
+	}
+	if fields, _ := projectionFields(ctx, []string{"age"}, nil); !reflect.DeepEqual(fields, []string{"age"}) {
+		t.Errorf("query fields should win: %v", fields)
+	}
+
+	// 游标分页需要返回排序字段
+	query := &data.CursorQuery{Fields: []string{"nick"}, Sort: []*data.SortSpec{{Property: "age"}}}
+	plan, _ := parseCursorQuery(&User{}, query)
+	if p, err = plan.projection(&User{}, query); err != nil || !reflect.DeepEqual(p, bson.M{"nick": 1, "age": 1, "_id": 1}) {
+		t.Errorf("cursor projection: %v, %v", p, err)
+	}
+}
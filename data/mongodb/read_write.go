@@ -0,0 +1,195 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	"gopkg.in/mgo.v2"
+)
+
+// ErrReadConcernNotSupported mgo 不支持读关注, 需使用官方驱动的数据源
+var ErrReadConcernNotSupported = errors.New("read concern needs the mongo driver")
+
+// ReadPreference 读偏好, 决定读操作发往哪些节点
+type ReadPreference string
+
+const (
+	ReadPrimary            ReadPreference = "primary"
+	ReadPrimaryPreferred   ReadPreference = "primaryPreferred"
+	ReadSecondary          ReadPreference = "secondary"
+	ReadSecondaryPreferred ReadPreference = "secondaryPreferred"
+	ReadNearest            ReadPreference = "nearest"
+)
+
+// ReadConcern 读关注, 仅官方驱动支持
+type ReadConcern string
+
+const (
+	ReadConcernLocal        ReadConcern = "local"
+	ReadConcernAvailable    ReadConcern = "available"
+	ReadConcernMajority     ReadConcern = "majority"
+	ReadConcernLinearizable ReadConcern = "linearizable"
+	ReadConcernSnapshot     ReadConcern = "snapshot"
+)
+
+// WriteConcern 写关注, W 和 WMode 都为空时为 w: 1
+type WriteConcern struct {
+	W              int    `json:"w"`              // 需确认写入的节点数
+	WMode          string `json:"wmode"`          // 如 "majority" 或标签集名, 设置后忽略 W
+	Journal        bool   `json:"j"`              // 等待写入 journal
+	WTimeout       int    `json:"wtimeout"`       // 等待确认的毫秒数, 0 为不限
+	Unacknowledged bool   `json:"unacknowledged"` // 不等待确认 (w: 0), 忽略其他字段
+}
+
+// ReadWriteOptions 读写选项, 零值的字段使用数据源的配置 (Config.Mode 等).
+// 读偏好只作用于读操作, 写操作总是发往 primary. 事务内使用事务的设置
+type ReadWriteOptions struct {
+	ReadPreference ReadPreference `json:"readPreference"`
+	ReadConcern    ReadConcern    `json:"readConcern"`
+	WriteConcern   *WriteConcern  `json:"writeConcern"`
+}
+
+type readWriteKey struct{}
+
+// WithReadWrite 之后通过 ctx 执行的操作使用 opts, 非零的字段覆盖仓库的设置
+func WithReadWrite(ctx context.Context, opts *ReadWriteOptions) context.Context {
+	return context.WithValue(ctx, readWriteKey{}, opts)
+}
+
+// WithReadPreference 同 WithReadWrite, 只设置读偏好, 如统计查询使用 ReadSecondaryPreferred
+func WithReadPreference(ctx context.Context, pref ReadPreference) context.Context {
+	return WithReadWrite(ctx, &ReadWriteOptions{ReadPreference: pref})
+}
+
+// RepositoryWithReadWrite 返回使用 opts 的 repo 副本, 与 repo 共用数据源, 不需要重复注册别名.
+// 不支持的仓库 (如 MemoryRepository) 原样返回
+//
+//	analytics := RepositoryWithReadWrite(repo, &ReadWriteOptions{ReadPreference: ReadSecondaryPreferred})
+func RepositoryWithReadWrite(repo MongoRepository, opts *ReadWriteOptions) MongoRepository {
+	switch r := repo.(type) {
+	case *mongoRepositoryImpl:
+		cp := *r
+		cp.readWrite = opts
+		return &cp
+	case *mongoDriverRepositoryImpl:
+		cp := *r
+		cp.readWrite = opts
+		return &cp
+	}
+	return repo
+}
+
+// mergeReadWrite ctx 中的选项覆盖仓库的选项, 都没有时返回 nil
+func mergeReadWrite(ctx context.Context, base *ReadWriteOptions) *ReadWriteOptions {
+	opts, _ := ctx.Value(readWriteKey{}).(*ReadWriteOptions)
+	if opts == nil {
+		return base
+	}
+	if base == nil {
+		return opts
+	}
+	merged := *base
+	if opts.ReadPreference != "" {
+		merged.ReadPreference = opts.ReadPreference
+	}
+	if opts.ReadConcern != "" {
+		merged.ReadConcern = opts.ReadConcern
+	}
+	if opts.WriteConcern != nil {
+		merged.WriteConcern = opts.WriteConcern
+	}
+	return &merged
+}
+
+func (self ReadPreference) mgoMode() (mgo.Mode, error) {
+	switch self {
+	case ReadPrimary:
+		return mgo.Primary, nil
+	case ReadPrimaryPreferred:
+		return mgo.PrimaryPreferred, nil
+	case ReadSecondary:
+		return mgo.Secondary, nil
+	case ReadSecondaryPreferred:
+		return mgo.SecondaryPreferred, nil
+	case ReadNearest:
+		return mgo.Nearest, nil
+	}
+	return 0, fmt.Errorf("unknown read preference `%s`", self)
+}
+
+func (self ReadPreference) readPref() (*readpref.ReadPref, error) {
+	mode, err := readpref.ModeFromString(string(self))
+	if err != nil {
+		return nil, fmt.Errorf("unknown read preference `%s`", self)
+	}
+	return readpref.New(mode)
+}
+
+func (self *WriteConcern) mgoSafe() *mgo.Safe {
+	if self.Unacknowledged {
+		return nil
+	}
+	return &mgo.Safe{W: self.W, WMode: self.WMode, WTimeout: self.WTimeout, J: self.Journal}
+}
+
+func (self *WriteConcern) driverWriteConcern() *writeconcern.WriteConcern {
+	if self.Unacknowledged {
+		return writeconcern.Unacknowledged()
+	}
+	wc := &writeconcern.WriteConcern{WTimeout: time.Duration(self.WTimeout) * time.Millisecond}
+	switch {
+	case self.WMode != "":
+		wc.W = self.WMode
+	case self.W > 0:
+		wc.W = self.W
+	}
+	if self.Journal {
+		journal := true
+		wc.Journal = &journal
+	}
+	return wc
+}
+
+// applyMgo 返回按 opts 设置的会话副本, 调用方需 Close
+func (self *ReadWriteOptions) applyMgo(session *mgo.Session) (*mgo.Session, error) {
+	if self.ReadConcern != "" {
+		return nil, ErrReadConcernNotSupported
+	}
+	session = session.Clone()
+	if self.ReadPreference != "" {
+		mode, err := self.ReadPreference.mgoMode()
+		if err != nil {
+			session.Close()
+			return nil, err
+		}
+		session.SetMode(mode, true)
+	}
+	if self.WriteConcern != nil {
+		session.SetSafe(self.WriteConcern.mgoSafe())
+	}
+	return session, nil
+}
+
+func (self *ReadWriteOptions) collectionOptions() (*options.CollectionOptions, error) {
+	opts := options.Collection()
+	if self.ReadPreference != "" {
+		rp, err := self.ReadPreference.readPref()
+		if err != nil {
+			return nil, err
+		}
+		opts.SetReadPreference(rp)
+	}
+	if self.ReadConcern != "" {
+		opts.SetReadConcern(readconcern.New(readconcern.Level(string(self.ReadConcern))))
+	}
+	if self.WriteConcern != nil {
+		opts.SetWriteConcern(self.WriteConcern.driverWriteConcern())
+	}
+	return opts, nil
+}
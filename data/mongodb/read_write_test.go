@@ -0,0 +1,71 @@
+package mongodb
+
+import (
+	"context"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"gopkg.in/mgo.v2"
+)
+
+func TestReadWriteOptions(t *testing.T) {
+	base := &ReadWriteOptions{ReadPreference: ReadSecondaryPreferred, WriteConcern: &WriteConcern{WMode: "majority"}}
+	ctx := context.Background()
+
+	if opts := mergeReadWrite(ctx, nil); opts != nil {
+		t.Fatalf("%+v", opts)
+	}
+	if opts := mergeReadWrite(ctx, base); opts != base {
+		t.Fatalf("%+v", opts)
+	}
+	opts := mergeReadWrite(WithReadWrite(ctx, &ReadWriteOptions{ReadPreference: ReadNearest, ReadConcern: ReadConcernMajority}), base)
+	if opts.ReadPreference != ReadNearest || opts.ReadConcern != ReadConcernMajority || opts.WriteConcern != base.WriteConcern || base.ReadPreference != ReadSecondaryPreferred {
+		t.Fatalf("%+v", opts)
+	}
+
+	collOpts, err := opts.collectionOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if collOpts.ReadPreference.Mode() != readpref.NearestMode || collOpts.ReadConcern.Level != "majority" || collOpts.WriteConcern.W != "majority" {
+		t.Fatalf("%+v", collOpts)
+	}
+	if _, err = (&ReadWriteOptions{ReadPreference: "any"}).collectionOptions(); err == nil {
+		t.Fatal("expect unknown read preference")
+	}
+	if _, err = ReadPreference("any").mgoMode(); err == nil {
+		t.Fatal("expect unknown read preference")
+	}
+	if mode, _ := ReadSecondaryPreferred.mgoMode(); mode != mgo.SecondaryPreferred {
+		t.Fatal(mode)
+	}
+
+	wc := (&WriteConcern{W: 2, Journal: true, WTimeout: 500}).driverWriteConcern()
+	if wc.W != 2 || !*wc.Journal || wc.WTimeout.Milliseconds() != 500 {
+		t.Fatalf("%+v", wc)
+	}
+	if (&WriteConcern{Unacknowledged: true}).driverWriteConcern().Acknowledged() {
+		t.Fatal("expect unacknowledged")
+	}
+	if safe := (&WriteConcern{Unacknowledged: true}).mgoSafe(); safe != nil {
+		t.Fatalf("%+v", safe)
+	}
+	if safe := (&WriteConcern{WMode: "majority", WTimeout: 100}).mgoSafe(); safe.WMode != "majority" || safe.WTimeout != 100 {
+		t.Fatalf("%+v", safe)
+	}
+
+	// 副本不影响原仓库
+	repo := NewDriverMongoRepository()
+	analytics := RepositoryWithReadWrite(repo, base)
+	if _, ok := analytics.(DriverRepository); !ok || repo.(*mongoDriverRepositoryImpl).readWrite != nil || analytics.(*mongoDriverRepositoryImpl).readWrite != base {
+		t.Fatal("driver repository not copied")
+	}
+	mgoRepo := NewMongoRepository()
+	if RepositoryWithReadWrite(mgoRepo, base).(*mongoRepositoryImpl).readWrite != base || mgoRepo.(*mongoRepositoryImpl).readWrite != nil {
+		t.Fatal("mgo repository not copied")
+	}
+	memory := NewMemoryRepository()
+	if RepositoryWithReadWrite(memory, base) != MongoRepository(memory) {
+		t.Fatal("memory repository changed")
+	}
+}
@@ -0,0 +1,282 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+var (
+	// ErrCrossTenant Model 的租户与 ctx 中的租户不一致
+	ErrCrossTenant = errors.New("cross-tenant access")
+	// ErrTenantRequired 开启 RequireTenant 后, TenantScoped 的 Model 和 ctx 都没有租户
+	ErrTenantRequired = errors.New("tenant is required")
+	// ErrTenantNotFound TenantResolver 找不到租户时应返回它
+	ErrTenantNotFound = errors.New("tenant not found")
+)
+
+type tenantKey struct{}
+
+// WithTenant 之后通过 ctx 执行的操作路由到该租户的数据源和库
+func WithTenant(ctx context.Context, tenantId string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenantId)
+}
+
+// TenantFromContext ctx 中的租户, 没有时第二个返回值为 false
+func TenantFromContext(ctx context.Context) (string, bool) {
+	tenantId, ok := ctx.Value(tenantKey{}).(string)
+	return tenantId, ok && tenantId != ""
+}
+
+// TenantScoped 属于某个租户的 Model, 如按 TenantId 计算 Database() 的 Model.
+// ctx 中有租户时, Tenant() 为空的 Model 按 ctx 的租户计算库名和集合名, 不一致时返回 ErrCrossTenant.
+// 写入的文档不会自动填上租户字段
+type TenantScoped interface {
+	Model
+	Tenant() string
+	SetTenant(tenantId string)
+}
+
+// TenantRoute 租户所在的数据源和库
+type TenantRoute struct {
+	Alias    string `json:"alias"`    // 数据源别名, 为空时用仓库的数据源
+	Database string `json:"database"` // 库名, 为空时用 Model.Database()
+}
+
+// TenantResolver 按租户查找路由, 用于没有通过 ProvisionTenant 注册的租户, 如从配置中心读取.
+// 返回 nil 时使用仓库的数据源和 Model.Database()
+type TenantResolver func(ctx context.Context, tenantId string) (*TenantRoute, error)
+
+// TenantHook 租户开通或注销时执行, 如创建索引或删除库, ctx 已带上该租户
+type TenantHook func(ctx context.Context, tenantId string, route *TenantRoute) error
+
+type tenantRegistry struct {
+	mux          sync.RWMutex
+	routes       map[string]*TenantRoute
+	resolver     TenantResolver
+	provisions   []TenantHook
+	deprovisions []TenantHook
+	strict       bool
+}
+
+var tenants = &tenantRegistry{routes: make(map[string]*TenantRoute)}
+
+// SetTenantResolver 设置未注册租户的路由查找
+func SetTenantResolver(resolver TenantResolver) {
+	tenants.mux.Lock()
+	defer tenants.mux.Unlock()
+	tenants.resolver = resolver
+}
+
+// RequireTenant 开启后, TenantScoped 的 Model 必须有租户, 避免漏传租户时查到共享的库
+func RequireTenant(strict bool) {
+	tenants.mux.Lock()
+	defer tenants.mux.Unlock()
+	tenants.strict = strict
+}
+
+// OnTenantProvision 添加开通租户时执行的钩子, 按添加顺序执行
+func OnTenantProvision(hook TenantHook) {
+	tenants.mux.Lock()
+	defer tenants.mux.Unlock()
+	tenants.provisions = append(tenants.provisions, hook)
+}
+
+// OnTenantDeprovision 添加注销租户时执行的钩子, 按添加顺序执行
+func OnTenantDeprovision(hook TenantHook) {
+	tenants.mux.Lock()
+	defer tenants.mux.Unlock()
+	tenants.deprovisions = append(tenants.deprovisions, hook)
+}
+
+// ProvisionTenant 注册租户的路由并执行开通钩子, 钩子失败时撤销注册.
+// route.Alias 需已通过 RegisterDataSource 注册
+func ProvisionTenant(ctx context.Context, tenantId string, route *TenantRoute) error {
+	if tenantId == "" {
+		return ErrTenantRequired
+	}
+	if route == nil {
+		route = &TenantRoute{}
+	}
+	if route.Alias != "" {
+		if _, err := GetDataSource(route.Alias); err != nil {
+			return err
+		}
+	}
+
+	tenants.mux.Lock()
+	if _, ok := tenants.routes[tenantId]; ok {
+		tenants.mux.Unlock()
+		return fmt.Errorf("tenant `%s` already provisioned", tenantId)
+	}
+	tenants.routes[tenantId] = route
+	hooks := tenants.provisions
+	tenants.mux.Unlock()
+
+	ctx = WithTenant(ctx, tenantId)
+	for _, hook := range hooks {
+		if err := hook(ctx, tenantId, route); err != nil {
+			tenants.remove(tenantId)
+			return fmt.Errorf("provision tenant `%s`: %w", tenantId, err)
+		}
+	}
+	return nil
+}
+
+// DeprovisionTenant 执行注销钩子后移除租户的路由, 钩子失败时保留路由以便重试
+func DeprovisionTenant(ctx context.Context, tenantId string) error {
+	tenants.mux.RLock()
+	route, ok := tenants.routes[tenantId]
+	hooks := tenants.deprovisions
+	tenants.mux.RUnlock()
+	if !ok {
+		return ErrTenantNotFound
+	}
+
+	ctx = WithTenant(ctx, tenantId)
+	for _, hook := range hooks {
+		if err := hook(ctx, tenantId, route); err != nil {
+			return fmt.Errorf("deprovision tenant `%s`: %w", tenantId, err)
+		}
+	}
+	tenants.remove(tenantId)
+	return nil
+}
+
+// GetTenantRoute 租户的路由, 先查已注册的, 再查 TenantResolver, 都没有时返回 nil
+func GetTenantRoute(ctx context.Context, tenantId string) (*TenantRoute, error) {
+	tenants.mux.RLock()
+	route, ok := tenants.routes[tenantId]
+	resolver := tenants.resolver
+	tenants.mux.RUnlock()
+	if ok || resolver == nil {
+		return route, nil
+	}
+	return resolver(ctx, tenantId)
+}
+
+// EnsureIndexesHook 开通租户时在 repo 上为 models 返回的 Model 创建索引
+func EnsureIndexesHook(repo MongoRepository, models func(tenantId string) []Indexed) TenantHook {
+	return func(ctx context.Context, tenantId string, route *TenantRoute) error {
+		for _, m := range models(tenantId) {
+			if err := repo.EnsureIndexesContext(ctx, m); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func (self *tenantRegistry) remove(tenantId string) {
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	delete(self.routes, tenantId)
+}
+
+func (self *tenantRegistry) isStrict() bool {
+	self.mux.RLock()
+	defer self.mux.RUnlock()
+	return self.strict
+}
+
+// modelTenant m 在 ctx 下的租户, 没有租户时为空.
+// m 没有租户而 ctx 有时, 返回填上租户的副本, 不修改 m (m 可能是共享的, 如 Repository[T] 的 scope)
+func modelTenant(ctx context.Context, m Model) (string, Model, error) {
+	tenantId, _ := TenantFromContext(ctx)
+	ts, ok := m.(TenantScoped)
+	if !ok {
+		return tenantId, m, nil
+	}
+
+	owner := ts.Tenant()
+	switch {
+	case owner == "" && tenantId == "":
+		if tenants.isStrict() {
+			return "", nil, fmt.Errorf("%w: %s.%s", ErrTenantRequired, m.Database(), m.Collection())
+		}
+		return "", m, nil
+	case owner == "":
+		return tenantId, withTenant(ts, tenantId), nil
+	case tenantId != "" && owner != tenantId:
+		return "", nil, fmt.Errorf("%w: model of tenant `%s` used by tenant `%s`", ErrCrossTenant, owner, tenantId)
+	}
+	return owner, m, nil
+}
+
+// withTenant 结构体指针的浅拷贝, 设置租户后用于计算库名和集合名
+func withTenant(m TenantScoped, tenantId string) Model {
+	rv := reflect.ValueOf(m)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return m
+	}
+	cp := reflect.New(rv.Elem().Type())
+	cp.Elem().Set(rv.Elem())
+	view, ok := cp.Interface().(TenantScoped)
+	if !ok {
+		return m
+	}
+	view.SetTenant(tenantId)
+	return view
+}
+
+// routeModel m 在 ctx 下的数据源别名, 库名和集合名, aliasName 为仓库的数据源
+func routeModel(ctx context.Context, aliasName string, m Model) (string, string, string, error) {
+	tenantId, view, err := modelTenant(ctx, m)
+	if err != nil {
+		return "", "", "", err
+	}
+	database, collection := view.Database(), view.Collection()
+	if tenantId == "" {
+		return aliasName, database, collection, nil
+	}
+	route, err := GetTenantRoute(ctx, tenantId)
+	if err != nil {
+		return "", "", "", err
+	}
+	if route != nil {
+		if route.Alias != "" {
+			aliasName = route.Alias
+		}
+		if route.Database != "" {
+			database = route.Database
+		}
+	}
+	return aliasName, database, collection, nil
+}
+
+// routeAlias 没有 Model 时 (如开启事务) 按 ctx 中的租户选数据源
+func routeAlias(ctx context.Context, aliasName string) (string, error) {
+	tenantId, ok := TenantFromContext(ctx)
+	if !ok {
+		return aliasName, nil
+	}
+	route, err := GetTenantRoute(ctx, tenantId)
+	if err != nil {
+		return "", err
+	}
+	if route != nil && route.Alias != "" {
+		return route.Alias, nil
+	}
+	return aliasName, nil
+}
+
+// checkBulkTenants 批量操作在同一个集合上执行, 所有 Model 需属于同一租户
+func checkBulkTenants(ctx context.Context, ops []BulkOp) error {
+	first := ""
+	for i, op := range ops {
+		tenantId, _, err := modelTenant(ctx, op.Model)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			first = tenantId
+			continue
+		}
+		if tenantId != first {
+			return fmt.Errorf("%w: bulk ops of tenants `%s` and `%s`", ErrCrossTenant, first, tenantId)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestRouteModel(t *testing.T) {
+	dataSourceCache.add("tenant_cluster", &alias{Name: "tenant_cluster", DataSource: NewDataSource(&Config{})})
+	defer dataSourceCache.remove("tenant_cluster")
+	defer func() {
+		tenants.routes = make(map[string]*TenantRoute)
+		tenants.resolver = nil
+		tenants.provisions, tenants.deprovisions = nil, nil
+		tenants.strict = false
+	}()
+
+	ctx := context.Background()
+	if err := ProvisionTenant(ctx, "t1", &TenantRoute{Alias: "tenant_cluster", Database: "t1_db"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ProvisionTenant(ctx, "t2", &TenantRoute{Alias: "missing"}); err == nil {
+		t.Fatal("expect unknown alias error")
+	}
+
+	// 没有租户时不路由
+	aliasName, database, collection, err := routeModel(ctx, "default", &User{TenantId: "t0"})
+	if err != nil || aliasName != "default" || database != "t0_user_db" || collection != "t0_users" {
+		t.Fatal(aliasName, database, collection, err)
+	}
+
+	// 按 ctx 的租户计算, 不修改共享的 Model
+	scope := &User{}
+	aliasName, database, collection, err = routeModel(WithTenant(ctx, "t1"), "default", scope)
+	if err != nil || aliasName != "tenant_cluster" || database != "t1_db" || collection != "t1_users" || scope.TenantId != "" {
+		t.Fatal(aliasName, database, collection, err)
+	}
+	// Model 自身的租户
+	if aliasName, _, _, _ = routeModel(ctx, "default", &User{TenantId: "t1"}); aliasName != "tenant_cluster" {
+		t.Fatal(aliasName)
+	}
+
+	if _, _, _, err = routeModel(WithTenant(ctx, "t1"), "default", &User{TenantId: "t2"}); !errors.Is(err, ErrCrossTenant) {
+		t.Fatalf("expect cross tenant, got %v", err)
+	}
+	ops := []BulkOp{InsertOp(&User{Id: bson.NewObjectId()}), InsertOp(&User{Id: bson.NewObjectId(), TenantId: "t2"})}
+	if err = checkBulkTenants(WithTenant(ctx, "t2"), ops); err != nil {
+		t.Fatal(err)
+	}
+	if err = checkBulkTenants(ctx, ops); !errors.Is(err, ErrCrossTenant) {
+		t.Fatalf("expect cross tenant, got %v", err)
+	}
+
+	RequireTenant(true)
+	if _, _, _, err = routeModel(ctx, "default", &User{}); !errors.Is(err, ErrTenantRequired) {
+		t.Fatalf("expect tenant required, got %v", err)
+	}
+	RequireTenant(false)
+
+	SetTenantResolver(func(ctx context.Context, tenantId string) (*TenantRoute, error) {
+		if tenantId == "t3" {
+			return &TenantRoute{Alias: "tenant_cluster"}, nil
+		}
+		return nil, ErrTenantNotFound
+	})
+	if aliasName, database, _, err = routeModel(WithTenant(ctx, "t3"), "default", &User{}); err != nil || aliasName != "tenant_cluster" || database != "t3_user_db" {
+		t.Fatal(aliasName, database, err)
+	}
+	if _, _, _, err = routeModel(WithTenant(ctx, "t4"), "default", &User{}); !errors.Is(err, ErrTenantNotFound) {
+		t.Fatalf("expect not found, got %v", err)
+	}
+	if aliasName, err = routeAlias(WithTenant(ctx, "t1"), "default"); err != nil || aliasName != "tenant_cluster" {
+		t.Fatal(aliasName, err)
+	}
+}
+
+func TestProvisionTenant(t *testing.T) {
+	defer func() {
+		tenants.routes = make(map[string]*TenantRoute)
+		tenants.provisions, tenants.deprovisions = nil, nil
+		tenants.strict = false
+	}()
+
+	repo := NewMemoryRepository()
+	OnTenantProvision(EnsureIndexesHook(repo, func(tenantId string) []Indexed {
+		return []Indexed{&User{TenantId: tenantId}}
+	}))
+	failed := errors.New("failed")
+	OnTenantProvision(func(ctx context.Context, tenantId string, route *TenantRoute) error {
+		if id, _ := TenantFromContext(ctx); id != tenantId {
+			t.Fatalf("hook ctx tenant %s", id)
+		}
+		if tenantId == "bad" {
+			return failed
+		}
+		return nil
+	})
+	dropped := []string{}
+	OnTenantDeprovision(func(ctx context.Context, tenantId string, route *TenantRoute) error {
+		dropped = append(dropped, tenantId)
+		return nil
+	})
+
+	ctx := context.Background()
+	if err := ProvisionTenant(ctx, "bad", nil); !errors.Is(err, failed) {
+		t.Fatalf("expect hook error, got %v", err)
+	}
+	if route, _ := GetTenantRoute(ctx, "bad"); route != nil {
+		t.Fatal("route of failed tenant kept")
+	}
+
+	if err := ProvisionTenant(ctx, "good", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ProvisionTenant(ctx, "good", nil); err == nil {
+		t.Fatal("expect already provisioned")
+	}
+	// 开通时创建的唯一索引
+	repo.Insert(&User{Id: bson.NewObjectId(), Nick: "a", TenantId: "good"})
+	if err := repo.Insert(&User{Id: bson.NewObjectId(), Nick: "a", TenantId: "good"}); err == nil {
+		t.Fatal("expect duplicate key")
+	}
+
+	// 内存仓库同样按租户路由和检查
+	if n, err := repo.CountContext(WithTenant(ctx, "good"), &User{}); err != nil || n != 1 {
+		t.Fatalf("count of tenant %d %v", n, err)
+	}
+	if err := repo.InsertContext(WithTenant(ctx, "other"), &User{Id: bson.NewObjectId(), TenantId: "good"}); !errors.Is(err, ErrCrossTenant) {
+		t.Fatalf("expect cross tenant, got %v", err)
+	}
+	RequireTenant(true)
+	if _, err := repo.Count(&User{}); !errors.Is(err, ErrTenantRequired) {
+		t.Fatalf("expect tenant required, got %v", err)
+	}
+	RequireTenant(false)
+
+	if err := DeprovisionTenant(ctx, "good"); err != nil || len(dropped) != 1 {
+		t.Fatal(dropped, err)
+	}
+	if err := DeprovisionTenant(ctx, "good"); !errors.Is(err, ErrTenantNotFound) {
+		t.Fatalf("expect not found, got %v", err)
+	}
+}
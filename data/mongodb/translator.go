@@ -0,0 +1,151 @@
+package mongodb
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/mofancloud/xmicro/data"
+	xreflect "github.com/mofancloud/xmicro/reflect"
+)
+
+// Translator 将 data.Filter 转为查询条件, BuildCriteria 即 data.ParseFilter 的结果经 Translator 转换
+type Translator struct {
+	mStruct *xreflect.StructInfo
+}
+
+// NewTranslator m 用于时间字段的转换, 可以为 nil
+func NewTranslator(m Model) *Translator {
+	t := &Translator{}
+	if m != nil {
+		t.mStruct, _ = xreflect.GetStructInfo(m)
+	}
+	return t
+}
+
+// Translate 实现 data.Translator, 返回 bson.M
+func (t *Translator) Translate(f data.Filter) (interface{}, error) {
+	return t.Criteria(f)
+}
+
+// Criteria 同 Translate, 返回 bson.M
+func (t *Translator) Criteria(f data.Filter) (bson.M, error) {
+	if f == nil {
+		return bson.M{}, nil
+	}
+	switch n := f.(type) {
+	case *data.Condition:
+		if strings.HasPrefix(n.Field, "$") {
+			return nil, filterError(n.Field, "", "invalid field name")
+		}
+		ops, err := t.operators(n)
+		if err != nil {
+			return nil, err
+		}
+		return bson.M{n.Field: ops}, nil
+	case *data.TextSearch:
+		text := bson.M{"$search": n.Search}
+		if n.Language != "" {
+			text["$language"] = n.Language
+		}
+		if n.CaseSensitive {
+			text["$caseSensitive"] = true
+		}
+		if n.DiacriticSensitive {
+			text["$diacriticSensitive"] = true
+		}
+		return bson.M{"$text": text}, nil
+	case *data.Logical:
+		return t.logical(n)
+	}
+	return nil, fmt.Errorf("%w: %T", data.ErrUnsupportedFilter, f)
+}
+
+func (t *Translator) logical(l *data.Logical) (bson.M, error) {
+	subs := []bson.M{}
+	for _, sub := range l.Filters {
+		c, err := t.Criteria(sub)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, c)
+	}
+
+	switch l.Op {
+	case data.FilterType_AND:
+		if merged, ok := mergeCriteria(subs); ok {
+			return merged, nil
+		}
+		return bson.M{"$and": subs}, nil
+	case data.FilterType_OR, data.FilterType_NOR:
+		if len(subs) == 0 {
+			return nil, filterError(string(l.Op), "", "empty array")
+		}
+		if l.Op == data.FilterType_OR {
+			return bson.M{"$or": subs}, nil
+		}
+		return bson.M{"$nor": subs}, nil
+	}
+	return nil, filterError(string(l.Op), "", "unknown logical operator")
+}
+
+// 字段上的运算复用 fieldCriteria, ELEM_MATCH 的子条件递归转换
+func (t *Translator) operators(c *data.Condition) (bson.M, error) {
+	if c.Op != data.FilterType_ELEM_MATCH {
+		return fieldCriteria(t.mStruct, c.Field, map[string]interface{}{string(c.Op): c.Value})
+	}
+
+	sub, ok := c.Value.(data.Filter)
+	if !ok {
+		// 构造时传入了 JSON 格式的值, 按 data.ParseFilter 的语法解析
+		parsed, err := data.ParseFilter(map[string]interface{}{c.Field: map[string]interface{}{string(c.Op): c.Value}})
+		if err != nil {
+			return nil, err
+		}
+		sub = parsed.Filters[0].(*data.Condition).Value.(data.Filter)
+	}
+	elem, err := (&Translator{}).Criteria(sub)
+	if err != nil {
+		return nil, err
+	}
+	// 作用于元素本身的运算符
+	if ops, ok := elem[""].(bson.M); ok && len(elem) == 1 {
+		elem = ops
+	}
+	if len(elem) == 0 {
+		return nil, filterError(c.Field, c.Op, "empty condition")
+	}
+	return bson.M{"$elemMatch": elem}, nil
+}
+
+// AND 的子条件没有冲突时合并为一个文档, 同一字段的运算合并
+func mergeCriteria(subs []bson.M) (bson.M, bool) {
+	merged := bson.M{}
+	for _, sub := range subs {
+		for k, v := range sub {
+			exist, ok := merged[k]
+			if !ok {
+				merged[k] = v
+				continue
+			}
+			existOps, ok1 := exist.(bson.M)
+			ops, ok2 := v.(bson.M)
+			if !ok1 || !ok2 || len(k) > 0 && k[0] == '$' {
+				return nil, false
+			}
+			union := bson.M{}
+			for op, val := range existOps {
+				union[op] = val
+			}
+			for op, val := range ops {
+				if _, dup := union[op]; dup {
+					return nil, false
+				}
+				union[op] = val
+			}
+			merged[k] = union
+		}
+	}
+	return merged, true
+}
@@ -0,0 +1,88 @@
+package mongodb
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/mofancloud/xmicro/data"
+)
+
+func TestTranslator(t *testing.T) {
+	// 用 data 包构造的条件与 BuildCriteria 解析同样的 JSON 结果一致
+	tests := []struct {
+		filter data.Filter
+		json   string
+	}{
+		{data.Field("nick").Eq("a"), `{"nick": {"EQ": "a"}}`},
+		{data.And(data.Field("age").Gt(1.0), data.Field("age").Lt(9.0)), `{"AND": [{"age": {"GT": 1}}, {"age": {"LT": 9}}]}`},
+		{data.Or(data.Field("nick").Eq("a"), data.Field("type").Eq(1.0)), `{"OR": [{"nick": {"EQ": "a"}}, {"type": {"EQ": 1}}]}`},
+		// ELEM_MATCH 的值为 JSON 格式时按 data.ParseFilter 的语法解析
+		{&data.Condition{Field: "orders", Op: data.FilterType_ELEM_MATCH, Value: map[string]interface{}{"amount": map[string]interface{}{"GT": 10.0}}},
+			`{"orders": {"ELEM_MATCH": {"amount": {"GT": 10}}}}`},
+	}
+
+	translator := NewTranslator(&User{})
+	for _, test := range tests {
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(test.json), &m); err != nil {
+			t.Fatal(err)
+		}
+		expected, err := BuildCriteria(&User{}, m)
+		if err != nil {
+			t.Fatalf("%s: %v", test.json, err)
+		}
+		criteria, err := translator.Criteria(test.filter)
+		if err != nil {
+			t.Fatalf("%s: %v", test.json, err)
+		}
+		if !reflect.DeepEqual(criteria, expected) {
+			t.Errorf("%s:\n%#v\nexpected:\n%#v", test.json, criteria, expected)
+		}
+	}
+
+	bad := &data.Condition{Field: "orders", Op: data.FilterType_ELEM_MATCH, Value: map[string]interface{}{}}
+	if _, err := translator.Criteria(bad); !errors.Is(err, ErrInvalidFilter) {
+		t.Fatalf("expect invalid filter, got %v", err)
+	}
+}
+
+func TestTranslatorBuilder(t *testing.T) {
+	f := data.And(
+		data.Field("age").Gte(18),
+		data.Field("age").Lt(60),
+		data.Or(data.Field("nick").Like("^a"), data.Field("type").In(1, 2)),
+		data.Field("scores").ElemMatch(data.Field("").Gt(90)),
+	)
+	criteria, err := NewTranslator(&User{}).Criteria(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := bson.M{
+		"age": bson.M{"$gte": 18, "$lt": 60},
+		"$or": []bson.M{
+			{"nick": bson.M{"$regex": "^a"}},
+			{"type": bson.M{"$in": []interface{}{1, 2}}},
+		},
+		"scores": bson.M{"$elemMatch": bson.M{"$gt": 90}},
+	}
+	if !reflect.DeepEqual(criteria, expected) {
+		t.Fatalf("%#v\nexpected:\n%#v", criteria, expected)
+	}
+
+	// 同一字段相同的运算不能合并
+	criteria, _ = NewTranslator(nil).Criteria(data.And(data.Field("nick").Like("a"), data.Field("nick").Like("b")))
+	if _, ok := criteria["$and"]; !ok {
+		t.Fatalf("expect $and, got %v", criteria)
+	}
+
+	if _, err = NewTranslator(nil).Criteria(data.Field("$where").Eq("1")); !errors.Is(err, ErrInvalidFilter) {
+		t.Fatalf("expect invalid filter, got %v", err)
+	}
+	if _, err = NewTranslator(nil).Criteria(data.Or()); !errors.Is(err, ErrInvalidFilter) {
+		t.Fatalf("expect invalid filter, got %v", err)
+	}
+}
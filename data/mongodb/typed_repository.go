@@ -0,0 +1,351 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/mofancloud/xmicro/data"
+)
+
+// ErrEmptyFilter DeleteMany 的条件为空, 避免误删整个集合
+var ErrEmptyFilter = errors.New("empty filter, use DeleteAll to delete all documents")
+
+// PageResult 分页结果
+type PageResult[T Model] struct {
+	Total    int64 `json:"total"`
+	PageNo   int64 `json:"pageNo"`
+	PageSize int32 `json:"pageSize"`
+	List     []T   `json:"list"`
+}
+
+// CursorResult 游标分页结果
+type CursorResult[T Model] struct {
+	data.CursorInfo
+	List []T `json:"list"`
+}
+
+// Repository 类型安全的仓库, T 为 Model 的指针类型, 如 *User.
+// scope 决定数据库和集合 (如按 TenantId 分库的 Model), 查询条件按 T 的 bson 字段构造.
+type Repository[T Model] struct {
+	base  MongoRepository
+	scope T
+}
+
+// Constructor, base 可以是 mgo, 官方驱动或内存的 MongoRepository
+func NewRepository[T Model](base MongoRepository, scope T) *Repository[T] {
+	return &Repository[T]{base: base, scope: scope}
+}
+
+// Scope 返回作用于另一个库/集合的仓库, 如切换租户
+func (self *Repository[T]) Scope(scope T) *Repository[T] {
+	return &Repository[T]{base: self.base, scope: scope}
+}
+
+// Base 返回底层的 MongoRepository
+func (self *Repository[T]) Base() MongoRepository {
+	return self.base
+}
+
+func (self *Repository[T]) newModel() T {
+	t := reflect.TypeOf(self.scope)
+	return reflect.New(t.Elem()).Interface().(T)
+}
+
+func (self *Repository[T]) All(ctx context.Context) ([]T, error) {
+	list := []T{}
+	err := self.base.AllContext(ctx, self.scope, &list)
+	return list, err
+}
+
+func (self *Repository[T]) Count(ctx context.Context) (int64, error) {
+	return self.base.CountContext(ctx, self.scope)
+}
+
+// FindByID 按 _id 查询, 不存在时返回 mgo.ErrNotFound
+func (self *Repository[T]) FindByID(ctx context.Context, id interface{}) (T, error) {
+	m := self.newModel()
+	err := self.findOne(ctx, notDeleted(ctx, self.scope, bson.M{"_id": id}), m)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return m, nil
+}
+
+// FindOne 按 m.Unique() 查询并填充 m
+func (self *Repository[T]) FindOne(ctx context.Context, m T) error {
+	return self.base.FindOneContext(ctx, m)
+}
+
+// FindMany 按 data.PageQuery.Filters 格式的条件查询
+func (self *Repository[T]) FindMany(ctx context.Context, filter map[string]interface{}) ([]T, error) {
+	criteria, err := BuildCriteria(self.scope, filter)
+	if err != nil {
+		return nil, err
+	}
+	list := []T{}
+	err = self.find(ctx, notDeleted(ctx, self.scope, criteria), &list)
+	return list, err
+}
+
+// Exists 是否存在满足条件的文档
+func (self *Repository[T]) Exists(ctx context.Context, filter map[string]interface{}) (bool, error) {
+	criteria, err := BuildCriteria(self.scope, filter)
+	if err != nil {
+		return false, err
+	}
+	n, err := self.count(ctx, notDeleted(ctx, self.scope, criteria), 1)
+	return n > 0, err
+}
+
+// DeleteMany 删除满足条件的文档, 返回删除的数量, SoftDeletable 只设置 deletedAt.
+// filter 为空时返回 ErrEmptyFilter, 删除全部需调用 DeleteAll
+func (self *Repository[T]) DeleteMany(ctx context.Context, filter map[string]interface{}) (int64, error) {
+	if len(filter) == 0 {
+		return 0, ErrEmptyFilter
+	}
+	criteria, err := BuildCriteria(self.scope, filter)
+	if err != nil {
+		return 0, err
+	}
+	return self.deleteAll(ctx, criteria)
+}
+
+// DeleteAll 删除集合中的全部文档, 同 DeleteMany
+func (self *Repository[T]) DeleteAll(ctx context.Context) (int64, error) {
+	return self.deleteAll(ctx, bson.M{})
+}
+
+func (self *Repository[T]) deleteAll(ctx context.Context, criteria bson.M) (int64, error) {
+	criteria = notDeleted(ctx, self.scope, criteria)
+	if _, soft := Model(self.scope).(SoftDeletable); soft {
+		return self.updateAll(ctx, criteria, bson.M{"$set": bson.M{FieldDeletedAt: time.Now()}})
+	}
+	return self.remove(ctx, criteria)
+}
+
+func (self *Repository[T]) Page(ctx context.Context, pageQuery *data.PageQuery) (*PageResult[T], error) {
+	page := &PageResult[T]{List: []T{}}
+	var err error
+	page.Total, page.PageNo, page.PageSize, err = self.base.PageContext(ctx, pageQuery, self.scope, &page.List)
+	if err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+func (self *Repository[T]) PageCursor(ctx context.Context, cursorQuery *data.CursorQuery) (*CursorResult[T], error) {
+	list := []T{}
+	info, err := self.base.PageCursorContext(ctx, cursorQuery, self.scope, &list)
+	if err != nil {
+		return nil, err
+	}
+	return &CursorResult[T]{CursorInfo: *info, List: list}, nil
+}
+
+func (self *Repository[T]) Insert(ctx context.Context, m T) error {
+	return self.base.InsertContext(ctx, m)
+}
+
+func (self *Repository[T]) Update(ctx context.Context, m T) (int, error) {
+	return self.base.UpdateContext(ctx, m)
+}
+
+func (self *Repository[T]) UpdateSelective(ctx context.Context, m T, updateData map[string]interface{}) error {
+	return self.base.UpdateSelectiveContext(ctx, m, updateData)
+}
+
+func (self *Repository[T]) Upsert(ctx context.Context, m T) (int, error) {
+	return self.base.UpsertContext(ctx, m)
+}
+
+func (self *Repository[T]) Delete(ctx context.Context, m T) error {
+	return self.base.DeleteContext(ctx, m)
+}
+
+func (self *Repository[T]) find(ctx context.Context, criteria bson.M, list *[]T) error {
+	return criteriaQuery{repo: self.base, m: self.scope}.find(ctx, criteria, list)
+}
+
+func (self *Repository[T]) findOne(ctx context.Context, criteria bson.M, m T) error {
+	return criteriaQuery{repo: self.base, m: self.scope}.findOne(ctx, criteria, m)
+}
+
+func (self *Repository[T]) count(ctx context.Context, criteria bson.M, limit int) (int64, error) {
+	return criteriaQuery{repo: self.base, m: self.scope}.count(ctx, criteria, limit)
+}
+
+func (self *Repository[T]) remove(ctx context.Context, criteria bson.M) (int64, error) {
+	return criteriaQuery{repo: self.base, m: self.scope}.removeAll(ctx, criteria)
+}
+
+func (self *Repository[T]) updateAll(ctx context.Context, criteria bson.M, update bson.M) (int64, error) {
+	return criteriaQuery{repo: self.base, m: self.scope}.updateAll(ctx, criteria, update)
+}
+
+// criteriaQuery 在 m 的集合上按驱动 (或内存仓库) 分别执行任意条件的查询和修改,
+// MongoRepository 只支持按 Model 操作, Repository[T] 和 MigrationDB 共用这里的实现
+type criteriaQuery struct {
+	repo MongoRepository
+	m    Model
+}
+
+func (self criteriaQuery) find(ctx context.Context, criteria bson.M, list interface{}) error {
+	fields, err := contextProjection(ctx, self.m)
+	if err != nil {
+		return err
+	}
+	if mr, ok := self.repo.(*MemoryRepository); ok {
+		docs, err := mr.findDocs(ctx, self.m, criteria, nil, 0, 0, fields)
+		if err != nil {
+			return err
+		}
+		return decodeDocs(docs, list)
+	}
+	if dr, ok := self.repo.(DriverRepository); ok {
+		opts := options.Find()
+		if fields != nil {
+			opts.SetProjection(fields)
+		}
+		return dr.ExecuteDriverContext(ctx, self.m, func(ctx context.Context, c *mongo.Collection) error {
+			cursor, err := c.Find(ctx, criteria, opts)
+			if err != nil {
+				return err
+			}
+			return cursor.All(ctx, list)
+		})
+	}
+	out, commit := shadow(list)
+	err = self.repo.ExecuteContext(ctx, self.m, func(c *mgo.Collection) error {
+		return c.Find(criteria).Select(fields).All(out)
+	})
+	if err == nil {
+		commit()
+	}
+	return err
+}
+
+func (self criteriaQuery) findOne(ctx context.Context, criteria bson.M, out interface{}) error {
+	fields, err := contextProjection(ctx, self.m)
+	if err != nil {
+		return err
+	}
+	if mr, ok := self.repo.(*MemoryRepository); ok {
+		return mr.findOne(ctx, self.m, criteria, fields, out)
+	}
+	if dr, ok := self.repo.(DriverRepository); ok {
+		opts := options.FindOne()
+		if fields != nil {
+			opts.SetProjection(fields)
+		}
+		return dr.ExecuteDriverContext(ctx, self.m, func(ctx context.Context, c *mongo.Collection) error {
+			return driverError(c.FindOne(ctx, criteria, opts).Decode(out))
+		})
+	}
+	shadowed, commit := shadow(out)
+	err = self.repo.ExecuteContext(ctx, self.m, func(c *mgo.Collection) error {
+		return c.Find(criteria).Select(fields).One(shadowed)
+	})
+	if err == nil {
+		commit()
+	}
+	return err
+}
+
+func (self criteriaQuery) count(ctx context.Context, criteria bson.M, limit int) (count int64, err error) {
+	if mr, ok := self.repo.(*MemoryRepository); ok {
+		return mr.count(ctx, self.m, criteria, limit)
+	}
+	if dr, ok := self.repo.(DriverRepository); ok {
+		err = dr.ExecuteDriverContext(ctx, self.m, func(ctx context.Context, c *mongo.Collection) error {
+			opts := options.Count()
+			if limit > 0 {
+				opts.SetLimit(int64(limit))
+			}
+			count, err = c.CountDocuments(ctx, criteria, opts)
+			return err
+		})
+		return
+	}
+	// 结果在 fn 完成后才赋给返回值, 见 ExecuteContext
+	var n int
+	err = self.repo.ExecuteContext(ctx, self.m, func(c *mgo.Collection) error {
+		var err error
+		n, err = c.Find(criteria).Limit(limit).Count()
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int64(n), nil
+}
+
+func (self criteriaQuery) removeAll(ctx context.Context, criteria bson.M) (removed int64, err error) {
+	if mr, ok := self.repo.(*MemoryRepository); ok {
+		return mr.removeAll(ctx, self.m, criteria, 0)
+	}
+	if dr, ok := self.repo.(DriverRepository); ok {
+		err = dr.ExecuteDriverContext(ctx, self.m, func(ctx context.Context, c *mongo.Collection) error {
+			result, err := c.DeleteMany(ctx, criteria)
+			if err != nil {
+				return err
+			}
+			removed = result.DeletedCount
+			return nil
+		})
+		return
+	}
+	var info *mgo.ChangeInfo
+	err = self.repo.ExecuteContext(ctx, self.m, func(c *mgo.Collection) error {
+		var err error
+		info, err = c.RemoveAll(criteria)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int64(info.Removed), nil
+}
+
+// updateAll 内存仓库只支持 $set
+func (self criteriaQuery) updateAll(ctx context.Context, criteria bson.M, update bson.M) (updated int64, err error) {
+	if mr, ok := self.repo.(*MemoryRepository); ok {
+		set, ok := update["$set"]
+		if !ok || len(update) != 1 {
+			return 0, ErrMemoryNotSupported
+		}
+		doc, err := toDocument(set)
+		if err != nil {
+			return 0, err
+		}
+		return mr.updateAll(ctx, self.m, criteria, doc, 0)
+	}
+	if dr, ok := self.repo.(DriverRepository); ok {
+		err = dr.ExecuteDriverContext(ctx, self.m, func(ctx context.Context, c *mongo.Collection) error {
+			result, err := c.UpdateMany(ctx, criteria, update)
+			if err != nil {
+				return err
+			}
+			updated = result.ModifiedCount
+			return nil
+		})
+		return
+	}
+	var info *mgo.ChangeInfo
+	err = self.repo.ExecuteContext(ctx, self.m, func(c *mgo.Collection) error {
+		var err error
+		info, err = c.UpdateAll(criteria, update)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int64(info.Updated), nil
+}
@@ -0,0 +1,69 @@
+package mongodb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/mofancloud/xmicro/data"
+)
+
+func TestTypedRepository(t *testing.T) {
+	config := &Config{
+		Driver:   DriverMongo,
+		Addrs:    "localhost:27017",
+		Username: "admin",
+		Password: "admin",
+		Database: "admin",
+		Poolsize: 200,
+		Source:   "admin",
+	}
+
+	err := RegisterDataSource("typed", config)
+	if err != nil {
+		t.Errorf("register dataSource err: %v\n", err)
+		return
+	}
+
+	ctx := context.Background()
+	users := NewRepository(&mongoDriverRepositoryImpl{dsAliasName: "typed"}, &User{TenantId: "t3"})
+
+	user := &User{
+		Id:       bson.NewObjectId(),
+		Nick:     "typed",
+		Age:      18,
+		Ctime:    time.Now(),
+		TenantId: "t3",
+	}
+	if err = users.Insert(ctx, user); err != nil {
+		t.Errorf("insert err: %v", err)
+	}
+
+	found, err := users.FindByID(ctx, user.Id)
+	if err != nil || found.Nick != "typed" {
+		t.Errorf("find by id err: %v, %v", err, found)
+	}
+
+	filter := map[string]interface{}{"nick": map[string]interface{}{"EQ": "typed"}}
+	list, err := users.FindMany(ctx, filter)
+	if err != nil || len(list) != 1 {
+		t.Errorf("find many err: %v, %v", err, list)
+	}
+
+	page, err := users.Page(ctx, &data.PageQuery{PageNo: 1, PageSize: 10})
+	if err != nil || page.Total < 1 {
+		t.Errorf("page err: %v, %v", err, page)
+	}
+
+	deleted, err := users.DeleteMany(ctx, filter)
+	if err != nil || deleted != 1 {
+		t.Errorf("delete many err: %v, %d", err, deleted)
+	}
+
+	exists, err := users.Exists(ctx, filter)
+	if err != nil || exists {
+		t.Errorf("exists err: %v, %v", err, exists)
+	}
+}
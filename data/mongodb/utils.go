@@ -1,16 +1,17 @@
 package mongodb
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"reflect"
+	"time"
 
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 
 	"github.com/mofancloud/xmicro/data"
 	xreflect "github.com/mofancloud/xmicro/reflect"
-	"github.com/mofancloud/xmicro/utils"
 )
 
 func All(c *mgo.Collection, m Model) *mgo.Query {
@@ -43,20 +44,33 @@ func Delete(c *mgo.Collection, m Model) error {
 }
 
 func Page(c *mgo.Collection, pageQuery *data.PageQuery, m Model, list interface{}) error {
-	filters, pageNo, pageSize, sorts := ParsePageQuery(m, pageQuery)
+	filters, pageNo, pageSize, sorts, err := ParsePageQuery(m, pageQuery)
+	if err != nil {
+		return err
+	}
 
 	offset := int((int32(pageNo) - 1) * pageSize)
 	limit := int(pageSize)
 
-	err := c.Find(bson.M(filters)).Skip(offset).Limit(limit).Sort(sorts...).All(list)
-	return err
+	fields, err := BuildProjection(m, pageQuery.Fields, pageQuery.Exclude)
+	if err != nil {
+		return err
+	}
+
+	q := c.Find(bson.M(filters)).Skip(offset).Limit(limit).Sort(sorts...)
+	if fields != nil {
+		q = q.Select(fields)
+	}
+	return q.All(list)
 }
 
-func ensureIndexes(db *mgo.Database, m Indexed) {
-	coll := db.C(m.Collection())
-	for _, i := range m.Indexes() {
-		coll.EnsureIndex(i)
+func ensureIndexes(coll *mgo.Collection, indexes []mgo.Index) error {
+	for _, i := range indexes {
+		if err := coll.EnsureIndex(i); err != nil {
+			return fmt.Errorf("ensure index %v on %s: %w", i.Key, coll.FullName, err)
+		}
 	}
+	return nil
 }
 
 type DBFunc func(*mgo.Collection) error
@@ -80,6 +94,62 @@ func Execute(mongoSession *mgo.Session, databaseName string, collectionName stri
 	return nil
 }
 
+// ExecuteContext 同 Execute, ctx 的 deadline 设为会话的 socket/sync 超时.
+// ctx 取消时立即返回 ctx.Err(), fn 仍在后台执行到完成或超时, 写操作可能仍会生效.
+// 因此 fn 不能读写调用方的内存: 参数在调用前转为文档, 结果解码到 shadow 返回的值,
+// ExecuteContext 返回 nil 时 fn 已完成, 再复制给调用方
+func ExecuteContext(ctx context.Context, mongoSession *mgo.Session, databaseName string, collectionName string, fn DBFunc) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ctx.Done() == nil {
+		return Execute(mongoSession, databaseName, collectionName, fn)
+	}
+
+	var timeout time.Duration
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+		if timeout <= 0 {
+			return context.DeadlineExceeded
+		}
+	}
+
+	session := mongoSession.Clone()
+	if timeout > 0 {
+		session.SetSocketTimeout(timeout)
+		session.SetSyncTimeout(timeout)
+	}
+
+	collection := session.DB(databaseName).C(collectionName)
+
+	done := make(chan error, 1)
+	go func() {
+		// 会话在 fn 返回后才关闭, ctx 取消时 fn 可能仍在使用它, 提前关闭会导致 mgo panic
+		defer session.Close()
+		done <- fn(collection)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// shadow 返回与 out 同类型的新值, 在 ExecuteContext 的 fn 中代替 out 解码,
+// fn 完成后调用 commit 复制到 out. out 不是非 nil 的指针时原样返回
+func shadow(out interface{}) (interface{}, func()) {
+	rv := reflect.ValueOf(out)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return out, func() {}
+	}
+	tmp := reflect.New(rv.Elem().Type())
+	return tmp.Interface(), func() {
+		rv.Elem().Set(tmp.Elem())
+	}
+}
+
 /**
  * 根据 model的类型来验证 data的字段是否合法，并转为 bson
  */
@@ -112,142 +182,38 @@ func I2bson(m Model, data map[string]interface{}) (bson.M, error) {
 	return r, nil
 }
 
-func BuildCriteria(m Model, filters map[string]interface{}) bson.M {
-	mStruct, _ := xreflect.GetStructInfo(m)
-
-	criteria := bson.M{}
-
-	if filters == nil || len(filters) == 0 {
-		return criteria
+// BuildCriteria 将 data.PageQuery.Filters 转为查询条件, 格式不正确时返回 *FilterError,
+// m 实现了 Filterable 时先按 FilterPolicy 校验, 未通过时返回 *ValidationError
+func BuildCriteria(m Model, filters map[string]interface{}) (bson.M, error) {
+	if err := ValidateQuery(m, filters, nil); err != nil {
+		return nil, err
 	}
+	return buildModelCriteria(m, filters)
+}
 
-	for k, v := range filters {
-		filterType := data.FilterType(k)
-
-		switch filterType {
-		case data.FilterType_AND:
-			{
-				//fmt.Printf("filter value %v", v)
-				//subFilters := v.([]map[string]interface{})
-				subFilters := v.([]interface{})
-
-				subCriterias := []bson.M{}
-				for _, item := range subFilters {
-					subFilter := item.(map[string]interface{})
-					subCriterias = append(subCriterias, BuildCriteria(m, subFilter))
-				}
-
-				criteria["$and"] = subCriterias // 同一级别只允许一个
-			}
-		case data.FilterType_OR:
-			{
-				//fmt.Printf("filter value %v", v)
-				//subFilters := v.([]map[string]interface{})
-				subFilters := v.([]interface{})
-
-				subCriterias := []bson.M{}
-				for _, item := range subFilters {
-					subFilter := item.(map[string]interface{})
-					subCriterias = append(subCriterias, BuildCriteria(m, subFilter))
-				}
-
-				criteria["$or"] = subCriterias // 同一级别只允许一个
-			}
-		case data.FilterType_NOR:
-			{
-				subFilters := v.([]map[string]interface{})
-
-				subCriterias := []bson.M{}
-				for _, subFilter := range subFilters {
-					subFilter = subFilter
-					subCriterias = append(subCriterias, BuildCriteria(m, subFilter))
-				}
-
-				criteria["$nor"] = subCriterias // 同一级别只允许一个
-			}
-		default:
-			{
-				vMap := v.(map[string]interface{})
-
-				subCriteria := bson.M{}
-
-				for vKey, vValue := range vMap {
-					filterType = data.FilterType(vKey)
-					// time类型转换
-					if mStruct != nil {
-						fieldInfo, ok := mStruct.FieldsMap[k]
-						if ok {
-							// 如果字段是时间类型
-							if fieldInfo.FieldType == xreflect.TimeType {
-								// 并且传入的值是int64, 则把int64转成 time格式先
-								fieldType := fieldInfo.FieldType
-
-								if fieldType == xreflect.TimeType {
-									// 并且传入的值是int64, 则把int64转成 time格式先
-									if v, ok := vValue.(int64); ok {
-										vValue = utils.Unix(v, 0)
-
-									} else if v, ok := vValue.(int); ok {
-										vValue = utils.Unix(int64(v), 0)
-									} else if v, ok := vValue.(float64); ok {
-										vValue = utils.Unix(int64(v), 0)
-									} else if v, ok := vValue.(int32); ok {
-										vValue = utils.Unix(int64(v), 0)
-									}
-								}
-							}
-						}
-					}
-
-					switch filterType {
-					case data.FilterType_EQ:
-						{
-							subCriteria["$eq"] = vValue
-						}
-					case data.FilterType_GT:
-						{
-							subCriteria["$gt"] = vValue
-						}
-					case data.FilterType_GTE:
-						{
-							subCriteria["$gte"] = vValue
-						}
-					case data.FilterType_LT:
-						{
-							subCriteria["$lt"] = vValue
-						}
-					case data.FilterType_LTE:
-						{
-							subCriteria["$lte"] = vValue
-						}
-					case data.FilterType_LIKE:
-						{
-							subCriteria["$regex"] = vValue
-						}
-					case data.FilterType_NE:
-						{
-							subCriteria["$ne"] = vValue
-						}
-					case data.FilterType_NOT_IN:
-						{
-							subCriteria["$nin"] = vValue
-						}
-					case data.FilterType_IN:
-						{
-							subCriteria["$in"] = vValue
-						}
-					}
-				}
-				criteria[k] = subCriteria // 这里是否有必要
-			}
-		}
+// buildModelCriteria 按 data.ParseFilter 解析, 再由 Translator 转换, 与 data 包共用同一种语法
+func buildModelCriteria(m Model, filters map[string]interface{}) (bson.M, error) {
+	if len(filters) == 0 {
+		return bson.M{}, nil
 	}
-	return criteria
+	f, err := data.ParseFilter(filters)
+	if err != nil {
+		return nil, err
+	}
+	return NewTranslator(m).Criteria(f)
 }
 
-func ParsePageQuery(m Model, pageQuery *data.PageQuery) (criteria bson.M, pageNo int64, pageSize int32, sorts []string) {
+// ParsePageQuery filters 和 sort 未通过 FilterPolicy 校验时返回 *ValidationError
+func ParsePageQuery(m Model, pageQuery *data.PageQuery) (criteria bson.M, pageNo int64, pageSize int32, sorts []string, err error) {
+	if err = ValidateQuery(m, pageQuery.Filters, pageQuery.Sort); err != nil {
+		return
+	}
+
 	// 构造 filterMap排重, 每个 property 都构造一个 子filter数组, 应对 <, > 各种情况
-	criteria = BuildCriteria(m, pageQuery.Filters)
+	criteria, err = buildModelCriteria(m, pageQuery.Filters)
+	if err != nil {
+		return
+	}
 
 	pageNo = pageQuery.PageNo
 	if pageQuery.PageNo < 1 {
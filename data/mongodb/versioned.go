@@ -0,0 +1,62 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Versioned 乐观锁, Update/UpdateSelective/Upsert 时匹配当前版本, 成功后版本加 1.
+// 版本为 0 时也匹配没有版本字段的旧文档.
+// 因 ctx 取消或超时失败时写入可能仍会完成, 版本不确定, 需重新读取后再更新
+type Versioned interface {
+	Model
+	VersionField() string // bson 字段名, 如 "version"
+	GetVersion() int64
+	SetVersion(version int64)
+}
+
+// ErrConcurrentModification 文档已被其他人修改, 需重新读取后再更新
+var ErrConcurrentModification = errors.New("concurrent modification")
+
+// rollbackVersion 写入失败时恢复 Update/Upsert 前加上的版本, ctx 的错误不恢复, 见 Versioned
+func rollbackVersion(v Versioned, err error) {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return
+	}
+	v.SetVersion(v.GetVersion() - 1)
+}
+
+// versionSelector m.Unique() 加上当前版本
+func versionSelector(v Versioned) bson.M {
+	selector := bson.M{}
+	for k, val := range v.Unique() {
+		selector[k] = val
+	}
+	if v.GetVersion() == 0 {
+		selector[v.VersionField()] = bson.M{"$in": []interface{}{0, nil}}
+	} else {
+		selector[v.VersionField()] = v.GetVersion()
+	}
+	return selector
+}
+
+// versionedSet 在 updateData 上加上新版本, 不修改 updateData
+func versionedSet(v Versioned, updateData map[string]interface{}) bson.M {
+	set := bson.M{}
+	for k, val := range updateData {
+		set[k] = val
+	}
+	set[v.VersionField()] = v.GetVersion() + 1
+	return set
+}
+
+// versionConflict 按版本没有匹配到时, 文档存在即为并发修改
+func versionConflict(exists bool) error {
+	if exists {
+		return ErrConcurrentModification
+	}
+	return mgo.ErrNotFound
+}
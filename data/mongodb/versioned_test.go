@@ -0,0 +1,99 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+type Article struct {
+	Id      bson.ObjectId `bson:"_id"`
+	Title   string        `bson:"title"`
+	Version int64         `bson:"version"`
+}
+
+func (self *Article) Database() string {
+	return "cms"
+}
+
+func (self *Article) Collection() string {
+	return "articles"
+}
+
+func (self *Article) Unique() bson.M {
+	return bson.M{"_id": self.Id}
+}
+
+func (self *Article) VersionField() string {
+	return "version"
+}
+
+func (self *Article) GetVersion() int64 {
+	return self.Version
+}
+
+func (self *Article) SetVersion(version int64) {
+	self.Version = version
+}
+
+func TestVersionSelector(t *testing.T) {
+	a := &Article{Id: bson.NewObjectId()}
+
+	expected := bson.M{"_id": a.Id, "version": bson.M{"$in": []interface{}{0, nil}}}
+	if s := versionSelector(a); !reflect.DeepEqual(s, expected) {
+		t.Errorf("selector of version 0: %v", s)
+	}
+
+	a.Version = 3
+	if s := versionSelector(a); !reflect.DeepEqual(s, bson.M{"_id": a.Id, "version": int64(3)}) {
+		t.Errorf("selector of version 3: %v", s)
+	}
+
+	data := map[string]interface{}{"title": "t"}
+	set := versionedSet(a, data)
+	if !reflect.DeepEqual(set, bson.M{"title": "t", "version": int64(4)}) || len(data) != 1 {
+		t.Errorf("set: %v, %v", set, data)
+	}
+
+	if versionConflict(true) != ErrConcurrentModification {
+		t.Errorf("conflict of existing document")
+	}
+}
+
+func TestRollbackVersion(t *testing.T) {
+	a := &Article{Version: 2}
+	rollbackVersion(a, errors.New("E11000"))
+	if a.Version != 1 {
+		t.Fatalf("version after db error: %d", a.Version)
+	}
+	// ctx 的错误时写入可能仍会完成, 不恢复
+	rollbackVersion(a, fmt.Errorf("update: %w", context.DeadlineExceeded))
+	if a.Version != 1 {
+		t.Fatalf("version after ctx error: %d", a.Version)
+	}
+}
+
+func TestShadow(t *testing.T) {
+	a := &Article{Id: bson.NewObjectId(), Title: "a"}
+	out, commit := shadow(a)
+	out.(*Article).Title = "b"
+	if a.Title != "a" {
+		t.Fatal("shadow shares memory")
+	}
+	commit()
+	if a.Title != "b" || a.Id != "" {
+		t.Fatalf("after commit: %+v", a)
+	}
+
+	list := []*Article{}
+	outList, commit := shadow(&list)
+	*outList.(*[]*Article) = append(*outList.(*[]*Article), a)
+	commit()
+	if len(list) != 1 {
+		t.Fatal(list)
+	}
+}
@@ -0,0 +1,318 @@
+package sql
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/mofancloud/xmicro/data"
+)
+
+// Where 参数化的条件, SQL 为空时没有条件
+type Where struct {
+	SQL  string
+	Args []interface{}
+}
+
+// Translator 将 data.Filter 转为参数化的 WHERE 条件, 列名必须属于 Model.
+// LIKE/ILIKE/NOT_LIKE 与 Mongo 一样为正则, 只支持能转为 LIKE 的部分: ^ $ 锚定, . 和 .* 通配, \ 转义,
+// 其他正则语法返回 data.ErrUnsupportedFilter;
+// MATCH 为正则, 依赖数据库支持; SIZE/ELEM_MATCH/GEO_WITHIN/TEXT 返回 data.ErrUnsupportedFilter
+type Translator struct {
+	dialect Dialect
+	table   *table
+	args    []interface{}
+}
+
+// Constructor
+func NewTranslator(d Dialect, m Model) (*Translator, error) {
+	t, _, err := modelTable(m)
+	if err != nil {
+		return nil, err
+	}
+	return &Translator{dialect: d, table: t}, nil
+}
+
+// Translate 实现 data.Translator, 返回 *Where
+func (self *Translator) Translate(f data.Filter) (interface{}, error) {
+	return self.Where(f)
+}
+
+func (self *Translator) Where(f data.Filter) (*Where, error) {
+	self.args = nil
+	s, err := self.filter(f)
+	if err != nil {
+		return nil, err
+	}
+	return &Where{SQL: s, Args: self.args}, nil
+}
+
+func (self *Translator) arg(v interface{}) string {
+	self.args = append(self.args, v)
+	return self.dialect.Placeholder(len(self.args))
+}
+
+func (self *Translator) filter(f data.Filter) (string, error) {
+	if f == nil {
+		return "", nil
+	}
+	switch n := f.(type) {
+	case *data.Logical:
+		return self.logical(n)
+	case *data.Condition:
+		return self.condition(n)
+	}
+	return "", fmt.Errorf("%w: %T", data.ErrUnsupportedFilter, f)
+}
+
+func (self *Translator) logical(l *data.Logical) (string, error) {
+	subs := []string{}
+	for _, sub := range l.Filters {
+		s, err := self.filter(sub)
+		if err != nil {
+			return "", err
+		}
+		if s != "" {
+			subs = append(subs, s)
+		}
+	}
+
+	switch l.Op {
+	case data.FilterType_AND:
+		if len(subs) == 0 {
+			return "", nil
+		}
+		if len(subs) == 1 {
+			return subs[0], nil
+		}
+		return "(" + strings.Join(subs, " AND ") + ")", nil
+	case data.FilterType_OR, data.FilterType_NOR:
+		if len(l.Filters) == 0 {
+			return "", fmt.Errorf("%w: %s: empty array", data.ErrInvalidFilter, l.Op)
+		}
+		// 空的子条件恒为真
+		if len(subs) < len(l.Filters) {
+			subs = append(subs, "1=1")
+		}
+		or := "(" + strings.Join(subs, " OR ") + ")"
+		if l.Op == data.FilterType_NOR {
+			return "NOT " + or, nil
+		}
+		return or, nil
+	}
+	return "", fmt.Errorf("%w: %s", data.ErrUnsupportedFilter, l.Op)
+}
+
+// NE/NOT_IN/NOT_LIKE 与 Mongo 一致, 也匹配 NULL
+func (self *Translator) condition(c *data.Condition) (string, error) {
+	if _, err := self.table.column(c.Field); err != nil {
+		return "", fmt.Errorf("%w: %v", data.ErrInvalidFilter, err)
+	}
+	col := self.dialect.Quote(c.Field)
+
+	switch c.Op {
+	case data.FilterType_EQ:
+		if c.Value == nil {
+			return col + " IS NULL", nil
+		}
+		return col + " = " + self.arg(c.Value), nil
+	case data.FilterType_NE:
+		if c.Value == nil {
+			return col + " IS NOT NULL", nil
+		}
+		return fmt.Sprintf("(%s <> %s OR %s IS NULL)", col, self.arg(c.Value), col), nil
+	case data.FilterType_GT:
+		return col + " > " + self.arg(c.Value), nil
+	case data.FilterType_GTE:
+		return col + " >= " + self.arg(c.Value), nil
+	case data.FilterType_LT:
+		return col + " < " + self.arg(c.Value), nil
+	case data.FilterType_LTE:
+		return col + " <= " + self.arg(c.Value), nil
+	case data.FilterType_IN, data.FilterType_NOT_IN:
+		return self.in(c, col)
+	case data.FilterType_LIKE, data.FilterType_ILIKE, data.FilterType_NOT_LIKE:
+		pattern, ok := c.Value.(string)
+		if !ok {
+			return "", fmt.Errorf("%w: `%s` %s: expect a string, got %T", data.ErrInvalidFilter, c.Field, c.Op, c.Value)
+		}
+		like, err := likePattern(pattern)
+		if err != nil {
+			return "", fmt.Errorf("%w: `%s` %s: %v", data.ErrUnsupportedFilter, c.Field, c.Op, err)
+		}
+		ph := self.arg(like)
+		switch c.Op {
+		case data.FilterType_ILIKE:
+			return self.dialect.ILike(col, ph), nil
+		case data.FilterType_NOT_LIKE:
+			return fmt.Sprintf("(%s NOT LIKE %s %s OR %s IS NULL)", col, ph, likeEscape(self.dialect), col), nil
+		}
+		return fmt.Sprintf("%s LIKE %s %s", col, ph, likeEscape(self.dialect)), nil
+	case data.FilterType_MATCH:
+		pattern, options := "", ""
+		switch v := c.Value.(type) {
+		case string:
+			pattern = v
+		case map[string]interface{}:
+			pattern, _ = v["pattern"].(string)
+			options, _ = v["options"].(string)
+		}
+		s, err := self.dialect.Regexp(col, self.arg(pattern), strings.Contains(options, "i"))
+		if err != nil {
+			return "", fmt.Errorf("%w: %s: %v", data.ErrUnsupportedFilter, c.Op, err)
+		}
+		return s, nil
+	case data.FilterType_EXISTS:
+		if exists, _ := c.Value.(bool); exists {
+			return col + " IS NOT NULL", nil
+		}
+		return col + " IS NULL", nil
+	}
+	return "", fmt.Errorf("%w: %s", data.ErrUnsupportedFilter, c.Op)
+}
+
+func (self *Translator) in(c *data.Condition, col string) (string, error) {
+	rv := reflect.ValueOf(c.Value)
+	if c.Value == nil || (rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array) {
+		return "", fmt.Errorf("%w: `%s` %s: expect an array, got %T", data.ErrInvalidFilter, c.Field, c.Op, c.Value)
+	}
+
+	phs, hasNil := []string{}, false
+	for i := 0; i < rv.Len(); i++ {
+		v := rv.Index(i).Interface()
+		if v == nil {
+			hasNil = true
+			continue
+		}
+		phs = append(phs, self.arg(v))
+	}
+
+	if c.Op == data.FilterType_IN {
+		parts := []string{}
+		if len(phs) > 0 {
+			parts = append(parts, fmt.Sprintf("%s IN (%s)", col, strings.Join(phs, ", ")))
+		}
+		if hasNil {
+			parts = append(parts, col+" IS NULL")
+		}
+		if len(parts) == 0 {
+			return "1=0", nil
+		}
+		if len(parts) == 1 {
+			return parts[0], nil
+		}
+		return "(" + strings.Join(parts, " OR ") + ")", nil
+	}
+
+	if len(phs) == 0 {
+		if hasNil {
+			return col + " IS NOT NULL", nil
+		}
+		return "1=1", nil
+	}
+	if hasNil {
+		return fmt.Sprintf("%s NOT IN (%s)", col, strings.Join(phs, ", ")), nil
+	}
+	return fmt.Sprintf("(%s NOT IN (%s) OR %s IS NULL)", col, strings.Join(phs, ", "), col), nil
+}
+
+// 正则的元字符, 前面加 \ 时按字面匹配
+const regexMeta = `\.+*?()|[]{}^$`
+
+// likePattern 将正则转为 LIKE 的模式: 不锚定时前后加 %, . 为 _, .* 为 %, 字面的 % _ \ 转义.
+// 其余正则语法 (字符类, 分组, 量词等) 没有对应的 LIKE, 返回错误
+func likePattern(pattern string) (string, error) {
+	var b strings.Builder
+	prefix, suffix := "%", "%"
+	rs := []rune(pattern)
+	for i := 0; i < len(rs); i++ {
+		r := rs[i]
+		switch {
+		case r == '^' && i == 0:
+			prefix = ""
+		case r == '$' && i == len(rs)-1:
+			suffix = ""
+		case r == '\\':
+			if i+1 == len(rs) || !strings.ContainsRune(regexMeta, rs[i+1]) {
+				return "", fmt.Errorf("regex `%s` has no LIKE equivalent, use MATCH", pattern)
+			}
+			i++
+			writeLikeLiteral(&b, rs[i])
+		case r == '.':
+			if i+1 < len(rs) && rs[i+1] == '*' {
+				b.WriteByte('%')
+				i++
+			} else {
+				b.WriteByte('_')
+			}
+		case strings.ContainsRune(regexMeta, r):
+			return "", fmt.Errorf("regex `%s` has no LIKE equivalent, use MATCH", pattern)
+		default:
+			writeLikeLiteral(&b, r)
+		}
+	}
+	return prefix + b.String() + suffix, nil
+}
+
+func writeLikeLiteral(b *strings.Builder, r rune) {
+	if r == '%' || r == '_' || r == '\\' {
+		b.WriteByte('\\')
+	}
+	b.WriteRune(r)
+}
+
+// BuildWhere 将 data.PageQuery.Filters 转为参数化的条件
+func BuildWhere(d Dialect, m Model, filters map[string]interface{}) (*Where, error) {
+	f, err := data.ParseFilter(filters)
+	if err != nil {
+		return nil, err
+	}
+	t, err := NewTranslator(d, m)
+	if err != nil {
+		return nil, err
+	}
+	return t.Where(f)
+}
+
+// ParsePageQuery 同 mongodb.ParsePageQuery, orderBy 为 ORDER BY 之后的部分, 列名已校验并引用
+func ParsePageQuery(d Dialect, m Model, pageQuery *data.PageQuery) (where *Where, pageNo int64, pageSize int32, orderBy string, err error) {
+	where, err = BuildWhere(d, m, pageQuery.Filters)
+	if err != nil {
+		return
+	}
+
+	pageNo = pageQuery.PageNo
+	if pageNo < 1 {
+		pageNo = 1
+	}
+
+	pageSize = pageQuery.PageSize
+	if pageSize < 1 {
+		pageSize = 20
+	} else if pageSize > 1000 {
+		pageSize = 1000
+	}
+
+	t, _, _ := modelTable(m)
+	sorts := []string{}
+	for _, s := range pageQuery.Sort {
+		if s == nil {
+			continue
+		}
+		if _, err = t.column(s.Property); err != nil {
+			err = fmt.Errorf("%w: sort: %v", data.ErrInvalidFilter, err)
+			return
+		}
+		col := d.Quote(s.Property)
+		if s.IgnoreCase {
+			col = "LOWER(" + col + ")"
+		}
+		if s.Type == data.SortType_DSC {
+			sorts = append(sorts, col+" DESC")
+		} else {
+			sorts = append(sorts, col+" ASC")
+		}
+	}
+	orderBy = strings.Join(sorts, ", ")
+	return
+}
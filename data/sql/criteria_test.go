@@ -0,0 +1,96 @@
+package sql
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/mofancloud/xmicro/data"
+)
+
+func TestBuildWhere(t *testing.T) {
+	pg, _ := GetDialect(DialectPostgres)
+	tests := []struct {
+		filters string
+		sql     string
+		args    []interface{}
+	}{
+		{`{}`, ``, nil},
+		{`{"name": {"EQ": "a"}}`, `"name" = $1`, []interface{}{"a"}},
+		{`{"age": {"GT": 1, "LTE": 9}}`, `("age" > $1 AND "age" <= $2)`, []interface{}{float64(1), float64(9)}},
+		{`{"note": {"EQ": null}}`, `"note" IS NULL`, nil},
+		{`{"name": {"NE": "a"}}`, `("name" <> $1 OR "name" IS NULL)`, []interface{}{"a"}},
+		{`{"age": {"IN": [1, 2]}}`, `"age" IN ($1, $2)`, []interface{}{float64(1), float64(2)}},
+		{`{"age": {"IN": []}}`, `1=0`, nil},
+		{`{"age": {"NOT_IN": [1, null]}}`, `"age" NOT IN ($1)`, []interface{}{float64(1)}},
+		{`{"name": {"LIKE": "^a_b"}}`, `"name" LIKE $1 ESCAPE '\'`, []interface{}{`a\_b%`}},
+		{`{"name": {"ILIKE": "50%$"}}`, `"name" ILIKE $1 ESCAPE '\'`, []interface{}{`%50\%`}},
+		{`{"name": {"LIKE": "^a.*b\\.c.$"}}`, `"name" LIKE $1 ESCAPE '\'`, []interface{}{`a%b.c_`}},
+		{`{"name": {"MATCH": {"pattern": "^a", "options": "i"}}}`, `"name" ~* $1`, []interface{}{"^a"}},
+		{`{"note": {"EXISTS": true}}`, `"note" IS NOT NULL`, nil},
+		{`{"OR": [{"name": {"EQ": "a"}}, {"age": {"LT": 3}}], "NOR": [{"age": {"EQ": 5}}]}`,
+			`(NOT ("age" = $1) AND ("name" = $2 OR "age" < $3))`, []interface{}{float64(5), "a", float64(3)}},
+	}
+	for _, test := range tests {
+		var filters map[string]interface{}
+		if err := json.Unmarshal([]byte(test.filters), &filters); err != nil {
+			t.Fatal(err)
+		}
+		w, err := BuildWhere(pg, &Account{}, filters)
+		if err != nil {
+			t.Errorf("%s: %v", test.filters, err)
+			continue
+		}
+		if w.SQL != test.sql || !reflect.DeepEqual(w.Args, test.args) {
+			t.Errorf("%s: got %s %v", test.filters, w.SQL, w.Args)
+		}
+	}
+
+	invalid := []string{
+		`{"password": {"EQ": "a"}}`,
+		`{"name\" = '' OR 1=1 --": {"EQ": "a"}}`,
+		`{"tags": {"SIZE": 1}}`,
+		`{"TEXT": "coffee"}`,
+		`{"name": {"LIKE": "^(a|b)"}}`,
+		`{"name": {"NOT_LIKE": "a+"}}`,
+		`{"name": {"ILIKE": "\\d"}}`,
+	}
+	for _, s := range invalid {
+		var filters map[string]interface{}
+		json.Unmarshal([]byte(s), &filters)
+		_, err := BuildWhere(pg, &Account{}, filters)
+		if !errors.Is(err, data.ErrInvalidFilter) && !errors.Is(err, data.ErrUnsupportedFilter) {
+			t.Errorf("%s: expect an error, got %v", s, err)
+		}
+	}
+
+	sqlite, _ := GetDialect(DialectSQLite)
+	if _, err := BuildWhere(sqlite, &Account{}, map[string]interface{}{"name": map[string]interface{}{"MATCH": "^a"}}); !errors.Is(err, data.ErrUnsupportedFilter) {
+		t.Fatalf("expect unsupported, got %v", err)
+	}
+}
+
+func TestParsePageQuerySort(t *testing.T) {
+	mysql, _ := GetDialect(DialectMySQL)
+	pageQuery := &data.PageQuery{
+		PageSize: 5000,
+		Sort: []*data.SortSpec{
+			{Property: "age", Type: data.SortType_DSC},
+			nil,
+			{Property: "name", IgnoreCase: true},
+		},
+	}
+	_, pageNo, pageSize, orderBy, err := ParsePageQuery(mysql, &Account{}, pageQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pageNo != 1 || pageSize != 1000 || orderBy != "`age` DESC, LOWER(`name`) ASC" {
+		t.Fatalf("%d %d %s", pageNo, pageSize, orderBy)
+	}
+
+	pageQuery.Sort = []*data.SortSpec{{Property: "age; DROP TABLE accounts"}}
+	if _, _, _, _, err = ParsePageQuery(mysql, &Account{}, pageQuery); !errors.Is(err, data.ErrInvalidFilter) {
+		t.Fatalf("expect invalid filter, got %v", err)
+	}
+}
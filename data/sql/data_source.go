@@ -0,0 +1,123 @@
+package sql
+
+import (
+	dbsql "database/sql"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type Config struct {
+	Driver          string `json:"driver"`          // database/sql 注册的驱动名, 如 sqlite3, mysql, postgres, pgx
+	DSN             string `json:"dsn"`             // 连接串
+	Dialect         string `json:"dialect"`         // 不配置时按 Driver 推断
+	MaxOpenConns    int    `json:"maxOpenConns"`    // 0 为不限制
+	MaxIdleConns    int    `json:"maxIdleConns"`    // 0 为默认值 2
+	ConnMaxLifetime int    `json:"connMaxLifetime"` // 单位毫秒, 0 为不限制
+}
+
+// DataSource 数据源, 驱动需由调用方导入, 如 _ "github.com/mattn/go-sqlite3"
+type DataSource interface {
+	Connect() error
+	DB() *dbsql.DB
+	Dialect() Dialect
+}
+
+type dataSourceImpl struct {
+	config  *Config
+	db      *dbsql.DB
+	dialect Dialect
+}
+
+// Constructor
+func NewDataSource(config *Config) DataSource {
+	return &dataSourceImpl{config: config}
+}
+
+// NewDataSourceWithDB 使用已打开的 *sql.DB
+func NewDataSourceWithDB(db *dbsql.DB, dialect Dialect) DataSource {
+	return &dataSourceImpl{config: &Config{}, db: db, dialect: dialect}
+}
+
+func (self *dataSourceImpl) Connect() error {
+	name := self.config.Dialect
+	if name == "" {
+		name = self.config.Driver
+	}
+	dialect, err := GetDialect(name)
+	if err != nil {
+		return err
+	}
+
+	db, err := dbsql.Open(self.config.Driver, self.config.DSN)
+	if err != nil {
+		return err
+	}
+	db.SetMaxOpenConns(self.config.MaxOpenConns)
+	if self.config.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(self.config.MaxIdleConns)
+	}
+	if self.config.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(time.Duration(self.config.ConnMaxLifetime) * time.Millisecond)
+	}
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return err
+	}
+
+	self.db = db
+	self.dialect = dialect
+	return nil
+}
+
+func (self *dataSourceImpl) DB() *dbsql.DB {
+	return self.db
+}
+
+func (self *dataSourceImpl) Dialect() Dialect {
+	return self.dialect
+}
+
+var (
+	dataSourceMux   sync.RWMutex
+	dataSourceCache = map[string]DataSource{}
+)
+
+func RegisterDataSource(aliasName string, config *Config) error {
+	ds := NewDataSource(config)
+	if _, err := GetDataSource(aliasName); err == nil {
+		return fmt.Errorf("DataBase alias name `%s` already registered, cannot reuse", aliasName)
+	}
+	if err := ds.Connect(); err != nil {
+		return err
+	}
+	if err := AddDataSource(aliasName, ds); err != nil {
+		ds.DB().Close()
+		return err
+	}
+	return nil
+}
+
+// AddDataSource 注册已连接的数据源
+func AddDataSource(aliasName string, ds DataSource) error {
+	dataSourceMux.Lock()
+	defer dataSourceMux.Unlock()
+	if _, ok := dataSourceCache[aliasName]; ok {
+		return fmt.Errorf("DataBase alias name `%s` already registered, cannot reuse", aliasName)
+	}
+	dataSourceCache[aliasName] = ds
+	return nil
+}
+
+func GetDataSource(aliasNames ...string) (DataSource, error) {
+	name := "default"
+	if len(aliasNames) > 0 {
+		name = aliasNames[0]
+	}
+	dataSourceMux.RLock()
+	defer dataSourceMux.RUnlock()
+	if ds, ok := dataSourceCache[name]; ok {
+		return ds, nil
+	}
+	return nil, fmt.Errorf("DataSource of alias name `%s` not found", name)
+}
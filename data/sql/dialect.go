@@ -0,0 +1,117 @@
+package sql
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Dialect 不同数据库在占位符, 标识符引用和部分运算上的差异
+type Dialect interface {
+	Name() string
+	// Placeholder 第 n 个参数的占位符, n 从 1 开始
+	Placeholder(n int) string
+	Quote(ident string) string
+	// ILike 忽略大小写的 LIKE
+	ILike(col string, placeholder string) string
+	// Regexp 正则匹配, 不支持时返回 error
+	Regexp(col string, placeholder string, caseInsensitive bool) (string, error)
+	// Returning INSERT 是否用 RETURNING 取自增主键, 否则用 LastInsertId
+	Returning() bool
+}
+
+const (
+	DialectSQLite   = "sqlite3"
+	DialectMySQL    = "mysql"
+	DialectPostgres = "postgres"
+)
+
+// GetDialect 按名字取 Dialect, pgx 等同 postgres, sqlite 等同 sqlite3
+func GetDialect(name string) (Dialect, error) {
+	switch name {
+	case DialectSQLite, "sqlite":
+		return sqliteDialect{}, nil
+	case DialectMySQL:
+		return mysqlDialect{}, nil
+	case DialectPostgres, "pgx":
+		return postgresDialect{}, nil
+	}
+	return nil, fmt.Errorf("unknown sql dialect `%s`", name)
+}
+
+func quoteWith(ident string, q string) string {
+	// a.b 分别引用
+	parts := strings.Split(ident, ".")
+	for i, p := range parts {
+		parts[i] = q + strings.Replace(p, q, q+q, -1) + q
+	}
+	return strings.Join(parts, ".")
+}
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) Name() string             { return DialectSQLite }
+func (sqliteDialect) Placeholder(n int) string { return "?" }
+func (sqliteDialect) Quote(ident string) string {
+	return quoteWith(ident, `"`)
+}
+
+// SQLite 的 LIKE 默认对 ASCII 不区分大小写
+func (sqliteDialect) ILike(col string, placeholder string) string {
+	return fmt.Sprintf("LOWER(%s) LIKE LOWER(%s) ESCAPE '\\'", col, placeholder)
+}
+
+func (sqliteDialect) Regexp(col string, placeholder string, caseInsensitive bool) (string, error) {
+	return "", fmt.Errorf("sqlite3 has no built-in REGEXP")
+}
+
+func (sqliteDialect) Returning() bool { return false }
+
+type mysqlDialect struct{}
+
+func (mysqlDialect) Name() string             { return DialectMySQL }
+func (mysqlDialect) Placeholder(n int) string { return "?" }
+func (mysqlDialect) Quote(ident string) string {
+	return quoteWith(ident, "`")
+}
+
+func (mysqlDialect) ILike(col string, placeholder string) string {
+	return fmt.Sprintf("LOWER(%s) LIKE LOWER(%s) ESCAPE '\\\\'", col, placeholder)
+}
+
+func (mysqlDialect) Regexp(col string, placeholder string, caseInsensitive bool) (string, error) {
+	if caseInsensitive {
+		return fmt.Sprintf("REGEXP_LIKE(%s, %s, 'i')", col, placeholder), nil
+	}
+	return fmt.Sprintf("REGEXP_LIKE(%s, %s, 'c')", col, placeholder), nil
+}
+
+func (mysqlDialect) Returning() bool { return false }
+
+type postgresDialect struct{}
+
+func (postgresDialect) Name() string             { return DialectPostgres }
+func (postgresDialect) Placeholder(n int) string { return fmt.Sprintf("$%d", n) }
+func (postgresDialect) Quote(ident string) string {
+	return quoteWith(ident, `"`)
+}
+
+func (postgresDialect) ILike(col string, placeholder string) string {
+	return fmt.Sprintf("%s ILIKE %s ESCAPE '\\'", col, placeholder)
+}
+
+func (postgresDialect) Regexp(col string, placeholder string, caseInsensitive bool) (string, error) {
+	if caseInsensitive {
+		return fmt.Sprintf("%s ~* %s", col, placeholder), nil
+	}
+	return fmt.Sprintf("%s ~ %s", col, placeholder), nil
+}
+
+func (postgresDialect) Returning() bool { return true }
+
+// likeEscape LIKE 的模式, MySQL 的字符串中 \ 需要转义
+func likeEscape(d Dialect) string {
+	if d.Name() == DialectMySQL {
+		return `ESCAPE '\\'`
+	}
+	return `ESCAPE '\'`
+}
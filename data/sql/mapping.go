@@ -0,0 +1,114 @@
+package sql
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// column 结构体字段与列的对应
+type column struct {
+	name  string
+	index []int
+	auto  bool // 自增, 插入时为零值则不写入
+}
+
+type table struct {
+	columns []*column
+	byName  map[string]*column
+}
+
+var tableCache sync.Map // reflect.Type -> *table
+
+// tableOf 解析结构体的 db 标签, 没有标签或为 - 的字段忽略
+func tableOf(t reflect.Type) *table {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if cached, ok := tableCache.Load(t); ok {
+		return cached.(*table)
+	}
+
+	tb := &table{byName: map[string]*column{}}
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+		parts := strings.Split(sf.Tag.Get("db"), ",")
+		name := strings.TrimSpace(parts[0])
+		if name == "" || name == "-" {
+			continue
+		}
+		col := &column{name: name, index: sf.Index}
+		for _, opt := range parts[1:] {
+			if strings.TrimSpace(opt) == "auto" {
+				col.auto = true
+			}
+		}
+		tb.columns = append(tb.columns, col)
+		tb.byName[name] = col
+	}
+	tableCache.Store(t, tb)
+	return tb
+}
+
+func modelTable(m Model) (*table, reflect.Value, error) {
+	v := reflect.ValueOf(m)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return nil, reflect.Value{}, fmt.Errorf("model must be a pointer to struct, got %T", m)
+	}
+	return tableOf(v.Type()), v.Elem(), nil
+}
+
+// column 名必须属于表, 防止条件和排序中的列名注入
+func (t *table) column(name string) (*column, error) {
+	col, ok := t.byName[name]
+	if !ok {
+		return nil, fmt.Errorf("column `%s` not exist", name)
+	}
+	return col, nil
+}
+
+// names 全部列名, 或按 fields/exclude 选择的列名
+func (t *table) names(fields []string, exclude []string) ([]string, error) {
+	if len(fields) > 0 && len(exclude) > 0 {
+		return nil, fmt.Errorf("fields and exclude can not be used together")
+	}
+	if len(fields) > 0 {
+		for _, f := range fields {
+			if _, err := t.column(f); err != nil {
+				return nil, err
+			}
+		}
+		return fields, nil
+	}
+	skip := map[string]bool{}
+	for _, f := range exclude {
+		if _, err := t.column(f); err != nil {
+			return nil, err
+		}
+		skip[f] = true
+	}
+	names := []string{}
+	for _, col := range t.columns {
+		if !skip[col.name] {
+			names = append(names, col.name)
+		}
+	}
+	return names, nil
+}
+
+// scanTargets 按查询返回的列取字段的指针, 不认识的列丢弃
+func (t *table) scanTargets(v reflect.Value, columns []string) []interface{} {
+	targets := make([]interface{}, len(columns))
+	for i, name := range columns {
+		if col, ok := t.byName[name]; ok {
+			targets[i] = v.FieldByIndex(col.index).Addr().Interface()
+		} else {
+			targets[i] = new(interface{})
+		}
+	}
+	return targets
+}
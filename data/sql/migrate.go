@@ -0,0 +1,60 @@
+package sql
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// MigrationsTable 记录每张表已执行的 Migrations
+const MigrationsTable = "xmicro_migrations"
+
+func (self *repositoryImpl) Migrate(m Migrated) error {
+	return self.MigrateContext(context.Background(), m)
+}
+
+// MigrateContext 依次执行 m.Migrations() 中未执行过的语句, 每条在各自的事务中执行并记录版本,
+// 版本为语句的序号, 从 1 开始. MySQL 的 DDL 会隐式提交, 失败时需人工处理
+func (self *repositoryImpl) MigrateContext(ctx context.Context, m Migrated) error {
+	q, d, err := self.querier()
+	if err != nil {
+		return err
+	}
+	_, err = q.ExecContext(ctx, fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s (%s VARCHAR(255) NOT NULL, %s INTEGER NOT NULL, %s VARCHAR(64) NOT NULL, PRIMARY KEY (%s, %s))",
+		d.Quote(MigrationsTable), d.Quote("tbl"), d.Quote("version"), d.Quote("applied_at"), d.Quote("tbl"), d.Quote("version")))
+	if err != nil {
+		return err
+	}
+
+	var applied int
+	st := newStatement(d, "SELECT COALESCE(MAX(%s), 0) FROM %s WHERE %s = ", d.Quote("version"), d.Quote(MigrationsTable), d.Quote("tbl"))
+	st.write("%s", st.arg(m.Table()))
+	if err = q.QueryRowContext(ctx, st.String(), st.args...).Scan(&applied); err != nil {
+		return err
+	}
+
+	migrations := m.Migrations()
+	for i := applied; i < len(migrations); i++ {
+		version := i + 1
+		err = self.WithTransaction(ctx, func(tx Repository) error {
+			tq, _, err := tx.(*repositoryImpl).querier()
+			if err != nil {
+				return err
+			}
+			if _, err = tq.ExecContext(ctx, migrations[i]); err != nil {
+				return fmt.Errorf("migration %s#%d: %w", m.Table(), version, err)
+			}
+			st := newStatement(d, "")
+			phs := []string{st.arg(m.Table()), st.arg(version), st.arg(time.Now().UTC().Format(time.RFC3339))}
+			st.write("INSERT INTO %s (%s, %s, %s) VALUES (%s, %s, %s)", d.Quote(MigrationsTable),
+				d.Quote("tbl"), d.Quote("version"), d.Quote("applied_at"), phs[0], phs[1], phs[2])
+			_, err = tq.ExecContext(ctx, st.String(), st.args...)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
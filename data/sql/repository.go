@@ -0,0 +1,546 @@
+package sql
+
+import (
+	"context"
+	dbsql "database/sql"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mofancloud/xmicro/data"
+)
+
+// Repository 与 mongodb.MongoRepository 相同的操作, 每个方法都有一个 ...Context 版本
+type Repository interface {
+	All(m Model, result interface{}) error
+	Count(m Model) (count int64, err error)
+	Update(m Model) (updated int, err error)
+	UpdateSelective(m Model, updateData map[string]interface{}) error
+	Insert(m Model) error
+	Upsert(m Model) (upserted int, err error)
+	FindOne(m Model) error
+	Delete(m Model) error
+	Page(pageQuery *data.PageQuery, m Model, list interface{}) (total int64, pageNo int64, pageSize int32, err error)
+	Migrate(m Migrated) error
+
+	AllContext(ctx context.Context, m Model, result interface{}) error
+	CountContext(ctx context.Context, m Model) (count int64, err error)
+	UpdateContext(ctx context.Context, m Model) (updated int, err error)
+	UpdateSelectiveContext(ctx context.Context, m Model, updateData map[string]interface{}) error
+	InsertContext(ctx context.Context, m Model) error
+	UpsertContext(ctx context.Context, m Model) (upserted int, err error)
+	FindOneContext(ctx context.Context, m Model) error
+	DeleteContext(ctx context.Context, m Model) error
+	PageContext(ctx context.Context, pageQuery *data.PageQuery, m Model, list interface{}) (total int64, pageNo int64, pageSize int32, err error)
+	MigrateContext(ctx context.Context, m Migrated) error
+
+	// 事务, fn 内通过 tx 执行的操作在同一事务中提交或回滚
+	WithTransaction(ctx context.Context, fn func(tx Repository) error) error
+}
+
+// querier *sql.DB 和 *sql.Tx 共有的方法
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (dbsql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*dbsql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *dbsql.Row
+}
+
+type repositoryImpl struct {
+	dsAliasName string
+	ds          DataSource
+	tx          *dbsql.Tx
+}
+
+// Constructor
+func NewRepository() Repository {
+	return &repositoryImpl{dsAliasName: "default"}
+}
+
+// NewRepositoryWithDataSource 不经过别名, 直接使用 ds
+func NewRepositoryWithDataSource(ds DataSource) Repository {
+	return &repositoryImpl{ds: ds}
+}
+
+func (self *repositoryImpl) DataSource(dsAliasName string) {
+	self.dsAliasName = dsAliasName
+}
+
+func (self *repositoryImpl) GetDataSource() (DataSource, error) {
+	if self.ds != nil {
+		return self.ds, nil
+	}
+	return GetDataSource(self.dsAliasName)
+}
+
+func (self *repositoryImpl) querier() (querier, Dialect, error) {
+	ds, err := self.GetDataSource()
+	if err != nil {
+		return nil, nil, err
+	}
+	if self.tx != nil {
+		return self.tx, ds.Dialect(), nil
+	}
+	if ds.DB() == nil {
+		return nil, nil, fmt.Errorf("DataSource is not connected")
+	}
+	return ds.DB(), ds.Dialect(), nil
+}
+
+// statement 拼接 SQL 和参数, 占位符按 Dialect 编号
+type statement struct {
+	dialect Dialect
+	sql     strings.Builder
+	args    []interface{}
+}
+
+func newStatement(d Dialect, format string, a ...interface{}) *statement {
+	st := &statement{dialect: d}
+	fmt.Fprintf(&st.sql, format, a...)
+	return st
+}
+
+func (st *statement) write(format string, a ...interface{}) *statement {
+	fmt.Fprintf(&st.sql, format, a...)
+	return st
+}
+
+func (st *statement) arg(v interface{}) string {
+	st.args = append(st.args, v)
+	return st.dialect.Placeholder(len(st.args))
+}
+
+var placeholderPattern = regexp.MustCompile(`\$[0-9]+`)
+
+// where 追加 WHERE, w 中的占位符从 1 编号, Postgres 时重新编号
+func (st *statement) where(w *Where) *statement {
+	if w == nil || w.SQL == "" {
+		return st
+	}
+	s := w.SQL
+	if offset := len(st.args); st.dialect.Placeholder(1) != "?" && offset > 0 {
+		s = placeholderPattern.ReplaceAllStringFunc(s, func(ph string) string {
+			n, _ := strconv.Atoi(ph[1:])
+			return st.dialect.Placeholder(n + offset)
+		})
+	}
+	st.args = append(st.args, w.Args...)
+	return st.write(" WHERE %s", s)
+}
+
+func (st *statement) String() string {
+	return st.sql.String()
+}
+
+func quoteNames(d Dialect, names []string) string {
+	quoted := make([]string, len(names))
+	for i, n := range names {
+		quoted[i] = d.Quote(n)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// uniqueWhere 按 m.Unique() 定位, 列按名字排序
+func uniqueWhere(d Dialect, t *table, m Model) (*Where, error) {
+	unique := m.Unique()
+	if len(unique) == 0 {
+		return nil, ErrNoUnique
+	}
+	keys := make([]string, 0, len(unique))
+	for k := range unique {
+		if _, err := t.column(k); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	w := &Where{}
+	conds := []string{}
+	for _, k := range keys {
+		w.Args = append(w.Args, unique[k])
+		conds = append(conds, fmt.Sprintf("%s = %s", d.Quote(k), d.Placeholder(len(w.Args))))
+	}
+	w.SQL = strings.Join(conds, " AND ")
+	return w, nil
+}
+
+// scanAll result 为 slice 的指针, 元素为结构体或结构体指针
+func scanAll(rows *dbsql.Rows, result interface{}) error {
+	defer rows.Close()
+
+	rv := reflect.ValueOf(result)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("result must be a pointer to slice, got %T", result)
+	}
+	slice := rv.Elem()
+	elemType := slice.Type().Elem()
+	isPtr := elemType.Kind() == reflect.Ptr
+	structType := elemType
+	if isPtr {
+		structType = elemType.Elem()
+	}
+	if structType.Kind() != reflect.Struct {
+		return fmt.Errorf("result must be a slice of struct, got %T", result)
+	}
+	t := tableOf(structType)
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	list := reflect.MakeSlice(slice.Type(), 0, 0)
+	for rows.Next() {
+		elem := reflect.New(structType)
+		if err = rows.Scan(t.scanTargets(elem.Elem(), columns)...); err != nil {
+			return err
+		}
+		if isPtr {
+			list = reflect.Append(list, elem)
+		} else {
+			list = reflect.Append(list, elem.Elem())
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	slice.Set(list)
+	return nil
+}
+
+func (self *repositoryImpl) All(m Model, result interface{}) error {
+	return self.AllContext(context.Background(), m, result)
+}
+
+func (self *repositoryImpl) AllContext(ctx context.Context, m Model, result interface{}) error {
+	q, d, err := self.querier()
+	if err != nil {
+		return err
+	}
+	t, _, err := modelTable(m)
+	if err != nil {
+		return err
+	}
+	names, _ := t.names(nil, nil)
+	rows, err := q.QueryContext(ctx, fmt.Sprintf("SELECT %s FROM %s", quoteNames(d, names), d.Quote(m.Table())))
+	if err != nil {
+		return err
+	}
+	return scanAll(rows, result)
+}
+
+func (self *repositoryImpl) Count(m Model) (count int64, err error) {
+	return self.CountContext(context.Background(), m)
+}
+
+func (self *repositoryImpl) CountContext(ctx context.Context, m Model) (count int64, err error) {
+	q, d, err := self.querier()
+	if err != nil {
+		return 0, err
+	}
+	err = q.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(*) FROM %s", d.Quote(m.Table()))).Scan(&count)
+	return
+}
+
+func (self *repositoryImpl) FindOne(m Model) error {
+	return self.FindOneContext(context.Background(), m)
+}
+
+// FindOneContext 没有匹配的行时返回 ErrNotFound
+func (self *repositoryImpl) FindOneContext(ctx context.Context, m Model) error {
+	q, d, err := self.querier()
+	if err != nil {
+		return err
+	}
+	t, v, err := modelTable(m)
+	if err != nil {
+		return err
+	}
+	w, err := uniqueWhere(d, t, m)
+	if err != nil {
+		return err
+	}
+	names, _ := t.names(nil, nil)
+	st := newStatement(d, "SELECT %s FROM %s", quoteNames(d, names), d.Quote(m.Table())).where(w).write(" LIMIT 1")
+	return q.QueryRowContext(ctx, st.String(), st.args...).Scan(t.scanTargets(v, names)...)
+}
+
+func (self *repositoryImpl) Insert(m Model) error {
+	return self.InsertContext(context.Background(), m)
+}
+
+// InsertContext 自增主键为零值时由数据库生成, 并写回 m
+func (self *repositoryImpl) InsertContext(ctx context.Context, m Model) error {
+	q, d, err := self.querier()
+	if err != nil {
+		return err
+	}
+	t, v, err := modelTable(m)
+	if err != nil {
+		return err
+	}
+
+	var auto *column
+	names, phs := []string{}, []string{}
+	st := newStatement(d, "")
+	for _, col := range t.columns {
+		fv := v.FieldByIndex(col.index)
+		if col.auto && fv.IsZero() {
+			auto = col
+			continue
+		}
+		names = append(names, col.name)
+		phs = append(phs, st.arg(fv.Interface()))
+	}
+	st.write("INSERT INTO %s (%s) VALUES (%s)", d.Quote(m.Table()), quoteNames(d, names), strings.Join(phs, ", "))
+
+	if auto == nil {
+		_, err = q.ExecContext(ctx, st.String(), st.args...)
+		return err
+	}
+	fv := v.FieldByIndex(auto.index)
+	if d.Returning() {
+		st.write(" RETURNING %s", d.Quote(auto.name))
+		return q.QueryRowContext(ctx, st.String(), st.args...).Scan(fv.Addr().Interface())
+	}
+	res, err := q.ExecContext(ctx, st.String(), st.args...)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	switch fv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		fv.SetInt(id)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		fv.SetUint(uint64(id))
+	}
+	return nil
+}
+
+func (self *repositoryImpl) Update(m Model) (updated int, err error) {
+	return self.UpdateContext(context.Background(), m)
+}
+
+// UpdateContext 更新唯一键和自增列以外的全部列, 没有匹配的行时返回 ErrNotFound.
+// MySQL 对值未变化的行返回 0, 需要在 DSN 中设置 clientFoundRows=true
+func (self *repositoryImpl) UpdateContext(ctx context.Context, m Model) (updated int, err error) {
+	t, v, err := modelTable(m)
+	if err != nil {
+		return 0, err
+	}
+	unique := m.Unique()
+	set := map[string]interface{}{}
+	for _, col := range t.columns {
+		if _, ok := unique[col.name]; ok || col.auto {
+			continue
+		}
+		set[col.name] = v.FieldByIndex(col.index).Interface()
+	}
+	return self.update(ctx, m, t, set)
+}
+
+func (self *repositoryImpl) UpdateSelective(m Model, updateData map[string]interface{}) error {
+	return self.UpdateSelectiveContext(context.Background(), m, updateData)
+}
+
+// UpdateSelectiveContext 只更新 updateData 中的列, 没有匹配的行时返回 ErrNotFound
+func (self *repositoryImpl) UpdateSelectiveContext(ctx context.Context, m Model, updateData map[string]interface{}) error {
+	t, _, err := modelTable(m)
+	if err != nil {
+		return err
+	}
+	for k := range updateData {
+		if _, err = t.column(k); err != nil {
+			return err
+		}
+	}
+	_, err = self.update(ctx, m, t, updateData)
+	return err
+}
+
+func (self *repositoryImpl) update(ctx context.Context, m Model, t *table, set map[string]interface{}) (int, error) {
+	q, d, err := self.querier()
+	if err != nil {
+		return 0, err
+	}
+	if len(set) == 0 {
+		return 0, fmt.Errorf("nothing to update")
+	}
+	w, err := uniqueWhere(d, t, m)
+	if err != nil {
+		return 0, err
+	}
+
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	st := newStatement(d, "")
+	sets := []string{}
+	for _, k := range keys {
+		sets = append(sets, fmt.Sprintf("%s = %s", d.Quote(k), st.arg(set[k])))
+	}
+	st.write("UPDATE %s SET %s", d.Quote(m.Table()), strings.Join(sets, ", ")).where(w)
+
+	res, err := q.ExecContext(ctx, st.String(), st.args...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, ErrNotFound
+	}
+	return int(n), nil
+}
+
+func (self *repositoryImpl) Upsert(m Model) (upserted int, err error) {
+	return self.UpsertContext(context.Background(), m)
+}
+
+// UpsertContext 在事务中按唯一键查找, 存在时更新, 否则插入, 插入时 upserted 为 1.
+// 并发插入同一唯一键时, 后提交的返回数据库的唯一约束错误
+func (self *repositoryImpl) UpsertContext(ctx context.Context, m Model) (upserted int, err error) {
+	err = self.WithTransaction(ctx, func(tx Repository) error {
+		r := tx.(*repositoryImpl)
+		q, d, err := r.querier()
+		if err != nil {
+			return err
+		}
+		t, _, err := modelTable(m)
+		if err != nil {
+			return err
+		}
+		w, err := uniqueWhere(d, t, m)
+		if err != nil {
+			return err
+		}
+		st := newStatement(d, "SELECT COUNT(*) FROM %s", d.Quote(m.Table())).where(w)
+		var n int64
+		if err = q.QueryRowContext(ctx, st.String(), st.args...).Scan(&n); err != nil {
+			return err
+		}
+		if n > 0 {
+			_, err = r.UpdateContext(ctx, m)
+			return err
+		}
+		if err = r.InsertContext(ctx, m); err != nil {
+			return err
+		}
+		upserted = 1
+		return nil
+	})
+	return
+}
+
+func (self *repositoryImpl) Delete(m Model) error {
+	return self.DeleteContext(context.Background(), m)
+}
+
+// DeleteContext 没有匹配的行时返回 ErrNotFound
+func (self *repositoryImpl) DeleteContext(ctx context.Context, m Model) error {
+	q, d, err := self.querier()
+	if err != nil {
+		return err
+	}
+	t, _, err := modelTable(m)
+	if err != nil {
+		return err
+	}
+	w, err := uniqueWhere(d, t, m)
+	if err != nil {
+		return err
+	}
+	st := newStatement(d, "DELETE FROM %s", d.Quote(m.Table())).where(w)
+	res, err := q.ExecContext(ctx, st.String(), st.args...)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (self *repositoryImpl) Page(pageQuery *data.PageQuery, m Model, list interface{}) (total int64, pageNo int64, pageSize int32, err error) {
+	return self.PageContext(context.Background(), pageQuery, m, list)
+}
+
+func (self *repositoryImpl) PageContext(ctx context.Context, pageQuery *data.PageQuery, m Model, list interface{}) (total int64, pageNo int64, pageSize int32, err error) {
+	q, d, err := self.querier()
+	if err != nil {
+		return
+	}
+	where, pageNo, pageSize, orderBy, err := ParsePageQuery(d, m, pageQuery)
+	if err != nil {
+		return
+	}
+	t, _, err := modelTable(m)
+	if err != nil {
+		return
+	}
+	names, err := t.names(pageQuery.Fields, pageQuery.Exclude)
+	if err != nil {
+		return
+	}
+
+	st := newStatement(d, "SELECT COUNT(*) FROM %s", d.Quote(m.Table())).where(where)
+	if err = q.QueryRowContext(ctx, st.String(), st.args...).Scan(&total); err != nil {
+		return
+	}
+
+	st = newStatement(d, "SELECT %s FROM %s", quoteNames(d, names), d.Quote(m.Table())).where(where)
+	if orderBy != "" {
+		st.write(" ORDER BY %s", orderBy)
+	}
+	st.write(" LIMIT %d OFFSET %d", pageSize, (pageNo-1)*int64(pageSize))
+	rows, err := q.QueryContext(ctx, st.String(), st.args...)
+	if err != nil {
+		return
+	}
+	err = scanAll(rows, list)
+	return
+}
+
+func (self *repositoryImpl) WithTransaction(ctx context.Context, fn func(tx Repository) error) (err error) {
+	// 已在事务中时直接执行
+	if self.tx != nil {
+		return fn(self)
+	}
+	ds, err := self.GetDataSource()
+	if err != nil {
+		return err
+	}
+	if ds.DB() == nil {
+		return fmt.Errorf("DataSource is not connected")
+	}
+	tx, err := ds.DB().BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+
+	if err = fn(&repositoryImpl{ds: ds, tx: tx}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,160 @@
+package sql
+
+import (
+	"context"
+	dbsql "database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/mofancloud/xmicro/data"
+)
+
+type Account struct {
+	Id    int64   `db:"id,auto"`
+	Name  string  `db:"name"`
+	Email string  `db:"email"`
+	Age   int     `db:"age"`
+	Note  *string `db:"note"`
+}
+
+func (self *Account) Table() string {
+	return "accounts"
+}
+
+func (self *Account) Unique() map[string]interface{} {
+	return map[string]interface{}{"id": self.Id}
+}
+
+func (self *Account) Migrations() []string {
+	return []string{
+		`CREATE TABLE accounts (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT NOT NULL, email TEXT NOT NULL, age INTEGER NOT NULL DEFAULT 0)`,
+		`CREATE UNIQUE INDEX accounts_email ON accounts (email)`,
+		`ALTER TABLE accounts ADD COLUMN note TEXT`,
+	}
+}
+
+func newTestRepository(t *testing.T) Repository {
+	db, err := dbsql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	dialect, _ := GetDialect(DialectSQLite)
+	repo := NewRepositoryWithDataSource(NewDataSourceWithDB(db, dialect))
+	if err = repo.Migrate(&Account{}); err != nil {
+		t.Fatal(err)
+	}
+	// 再次执行不会重复
+	if err = repo.Migrate(&Account{}); err != nil {
+		t.Fatal(err)
+	}
+	return repo
+}
+
+func TestRepository(t *testing.T) {
+	repo := newTestRepository(t)
+
+	names := []string{"alice", "bob", "carol", "dave", "Eve"}
+	for i, name := range names {
+		a := &Account{Name: name, Email: name + "@example.com", Age: 20 + i*10}
+		if err := repo.Insert(a); err != nil {
+			t.Fatal(err)
+		}
+		if a.Id != int64(i+1) {
+			t.Fatalf("auto id %d", a.Id)
+		}
+	}
+
+	count, err := repo.Count(&Account{})
+	if err != nil || count != 5 {
+		t.Fatalf("count %d %v", count, err)
+	}
+
+	a := &Account{Id: 2}
+	if err = repo.FindOne(a); err != nil || a.Name != "bob" {
+		t.Fatalf("%+v %v", a, err)
+	}
+	if err = repo.FindOne(&Account{Id: 99}); err != ErrNotFound {
+		t.Fatalf("expect not found, got %v", err)
+	}
+
+	note := "vip"
+	a.Note, a.Age = &note, 31
+	if n, err := repo.Update(a); err != nil || n != 1 {
+		t.Fatalf("update %d %v", n, err)
+	}
+	if err = repo.UpdateSelective(&Account{Id: 3}, map[string]interface{}{"age": 41}); err != nil {
+		t.Fatal(err)
+	}
+	if err = repo.UpdateSelective(&Account{Id: 3}, map[string]interface{}{"age = 0, name": "x"}); err == nil {
+		t.Fatal("expect unknown column")
+	}
+	if _, err = repo.Update(&Account{Id: 99, Name: "x", Email: "x"}); err != ErrNotFound {
+		t.Fatalf("expect not found, got %v", err)
+	}
+
+	upserted, err := repo.Upsert(&Account{Id: 2, Name: "bob", Email: "bob@example.com", Age: 32, Note: &note})
+	if err != nil || upserted != 0 {
+		t.Fatalf("upsert %d %v", upserted, err)
+	}
+	f := &Account{Name: "frank", Email: "frank@example.com", Age: 70}
+	upserted, err = repo.Upsert(f)
+	if err != nil || upserted != 1 || f.Id != 6 {
+		t.Fatalf("upsert %d %d %v", upserted, f.Id, err)
+	}
+
+	// 唯一索引冲突时事务回滚
+	err = repo.WithTransaction(context.Background(), func(tx Repository) error {
+		if err := tx.Insert(&Account{Name: "g", Email: "g@example.com"}); err != nil {
+			return err
+		}
+		return tx.Insert(&Account{Name: "h", Email: "alice@example.com"})
+	})
+	if err == nil {
+		t.Fatal("expect unique constraint error")
+	}
+	if count, _ = repo.Count(&Account{}); count != 6 {
+		t.Fatalf("count after rollback %d", count)
+	}
+
+	list := []*Account{}
+	total, pageNo, pageSize, err := repo.Page(&data.PageQuery{
+		Filters: map[string]interface{}{
+			"age": map[string]interface{}{"GTE": 30},
+			"OR": []interface{}{
+				map[string]interface{}{"name": map[string]interface{}{"ILIKE": "^e"}},
+				map[string]interface{}{"note": map[string]interface{}{"EXISTS": true}},
+				map[string]interface{}{"email": map[string]interface{}{"LIKE": "frank@"}},
+			},
+		},
+		PageNo:   1,
+		PageSize: 2,
+		Sort:     []*data.SortSpec{{Property: "age", Type: data.SortType_DSC}},
+		Fields:   []string{"id", "name", "age"},
+	}, &Account{}, &list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 3 || pageNo != 1 || pageSize != 2 || len(list) != 2 || list[0].Name != "frank" || list[1].Name != "Eve" || list[0].Email != "" {
+		t.Fatalf("total %d, %+v %+v", total, list[0], list[1])
+	}
+
+	if err = repo.Delete(&Account{Id: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err = repo.Delete(&Account{Id: 1}); err != ErrNotFound {
+		t.Fatalf("expect not found, got %v", err)
+	}
+
+	all := []Account{}
+	if err = repo.All(&Account{}, &all); err != nil || len(all) != 5 || all[0].Note == nil || *all[0].Note != "vip" {
+		t.Fatalf("all %v %v", all, err)
+	}
+
+	if _, _, _, err = repo.Page(&data.PageQuery{Sort: []*data.SortSpec{{Property: "secret"}}}, &Account{}, &list); !errors.Is(err, data.ErrInvalidFilter) {
+		t.Fatalf("expect invalid sort, got %v", err)
+	}
+}
@@ -0,0 +1,25 @@
+package sql
+
+import (
+	dbsql "database/sql"
+	"errors"
+)
+
+// Model 对应一张表, 字段用 db 标签映射到列, 如 `db:"id,auto"`, auto 表示自增主键
+type Model interface {
+	Table() string
+	Unique() map[string]interface{} // 唯一键的列和值, FindOne/Update/Upsert/Delete 按它定位
+}
+
+// Migrated 表结构由 Migrations 维护, 对应 mongodb 的 Indexed
+type Migrated interface {
+	Model
+	// 建表, 建索引等 DDL, 按顺序执行, 已执行的不再执行, 只能在末尾追加
+	Migrations() []string
+}
+
+// ErrNotFound FindOne/Update/Delete 没有匹配的行, 同 database/sql 的 sql.ErrNoRows
+var ErrNotFound = dbsql.ErrNoRows
+
+// ErrNoUnique Unique() 为空, 不能定位到行
+var ErrNoUnique = errors.New("model has no unique key")
@@ -3,20 +3,26 @@ package data
 type FilterType string
 
 const (
-	FilterType_EQ       FilterType = "EQ"       //相等
-	FilterType_NE       FilterType = "NE"       //不相等
-	FilterType_GT       FilterType = "GT"       //大于
-	FilterType_GTE      FilterType = "GTE"      //大于等于
-	FilterType_LT       FilterType = "LT"       //小于
-	FilterType_LTE      FilterType = "LTE"      //小于等于
-	FilterType_IN       FilterType = "IN"       //在什么范围内
-	FilterType_NOT_IN   FilterType = "NOT_IN"   //不在什么范围内
-	FilterType_LIKE     FilterType = "LIKE"     //like
-	FilterType_NOT_LIKE FilterType = "NOT_LIKE" //not like
-	FilterType_MATCH    FilterType = "MATCH"    //匹配
-	FilterType_AND      FilterType = "AND"      //AND
-	FilterType_OR       FilterType = "OR"       //OR
-	FilterType_NOR      FilterType = "NOR"      //NOR
+	FilterType_EQ         FilterType = "EQ"         //相等
+	FilterType_NE         FilterType = "NE"         //不相等
+	FilterType_GT         FilterType = "GT"         //大于
+	FilterType_GTE        FilterType = "GTE"        //大于等于
+	FilterType_LT         FilterType = "LT"         //小于
+	FilterType_LTE        FilterType = "LTE"        //小于等于
+	FilterType_IN         FilterType = "IN"         //在什么范围内
+	FilterType_NOT_IN     FilterType = "NOT_IN"     //不在什么范围内
+	FilterType_LIKE       FilterType = "LIKE"       //like, 正则
+	FilterType_ILIKE      FilterType = "ILIKE"      //like, 忽略大小写
+	FilterType_NOT_LIKE   FilterType = "NOT_LIKE"   //not like
+	FilterType_MATCH      FilterType = "MATCH"      //匹配正则, "pattern" 或 {"pattern": "^a", "options": "im"}
+	FilterType_EXISTS     FilterType = "EXISTS"     //字段是否存在, bool
+	FilterType_SIZE       FilterType = "SIZE"       //数组长度
+	FilterType_ELEM_MATCH FilterType = "ELEM_MATCH" //数组中有元素满足子条件
+	FilterType_GEO_WITHIN FilterType = "GEO_WITHIN" //在区域内, GeoJSON 或 {"box"/"polygon"/"centerSphere": ...}
+	FilterType_TEXT       FilterType = "TEXT"       //全文检索, 与 AND 同级, "words" 或 {"search": "words", "language": "en"}
+	FilterType_AND        FilterType = "AND"        //AND
+	FilterType_OR         FilterType = "OR"         //OR
+	FilterType_NOR        FilterType = "NOR"        //NOR
 )
 
 type TimeType int // 数据库的时间类型
@@ -47,4 +53,36 @@ type PageQuery struct {
 	PageNo   int64                  `json:"pageNo"`
 	PageSize int32                  `json:"pageSize"`
 	Sort     []*SortSpec            `json:"sort"`
+	Fields   []string               `json:"fields"`  // 只返回这些字段
+	Exclude  []string               `json:"exclude"` // 不返回这些字段, 不能与 Fields 同时使用
+}
+
+type TotalMode string
+
+const (
+	TotalMode_NONE      TotalMode = ""          // 不统计总数
+	TotalMode_EXACT     TotalMode = "EXACT"     // 按条件精确统计
+	TotalMode_ESTIMATED TotalMode = "ESTIMATED" // 集合的估算总数, 忽略条件
+)
+
+/**
+ * 游标(keyset)分页, 按 Sort 的字段定位, 不受翻页深度影响
+ */
+type CursorQuery struct {
+	Filters  map[string]interface{} `json:"filters"`
+	Cursor   string                 `json:"cursor"` // 上次返回的 next 或 prev, 空为第一页
+	PageSize int32                  `json:"pageSize"`
+	Sort     []*SortSpec            `json:"sort"`
+	Total    TotalMode              `json:"total"`
+	Fields   []string               `json:"fields"`
+	Exclude  []string               `json:"exclude"`
+}
+
+type CursorInfo struct {
+	Next     string `json:"next,omitempty"` // 下一页的 cursor
+	Prev     string `json:"prev,omitempty"` // 上一页的 cursor
+	HasNext  bool   `json:"hasNext"`
+	HasPrev  bool   `json:"hasPrev"`
+	PageSize int32  `json:"pageSize"`
+	Total    *int64 `json:"total,omitempty"`
 }
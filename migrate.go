@@ -0,0 +1,57 @@
+package xmicro
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Migrator 数据迁移, 如 mongodb.Migrator
+type Migrator interface {
+	Up(ctx context.Context) error
+	Down(ctx context.Context, steps int) error
+}
+
+type namedMigrator struct {
+	name     string
+	migrator Migrator
+}
+
+var (
+	migratorsMux sync.Mutex
+	migrators    []namedMigrator
+)
+
+// RegisterMigrator 在 Run 的 fn 中注册, 由 migrate 子命令或 --migrate 启动参数执行
+func RegisterMigrator(name string, m Migrator) {
+	migratorsMux.Lock()
+	defer migratorsMux.Unlock()
+	migrators = append(migrators, namedMigrator{name: name, migrator: m})
+}
+
+func registeredMigrators() []namedMigrator {
+	migratorsMux.Lock()
+	defer migratorsMux.Unlock()
+	return append([]namedMigrator{}, migrators...)
+}
+
+// Migrate 按注册顺序执行所有 Migrator 的 Up
+func Migrate(ctx context.Context) error {
+	for _, m := range registeredMigrators() {
+		if err := m.migrator.Up(ctx); err != nil {
+			return fmt.Errorf("migrate %s: %w", m.name, err)
+		}
+	}
+	return nil
+}
+
+// Rollback 按注册的逆序, 回滚每个 Migrator 最近的 steps 个迁移
+func Rollback(ctx context.Context, steps int) error {
+	list := registeredMigrators()
+	for i := len(list) - 1; i >= 0; i-- {
+		if err := list[i].migrator.Down(ctx, steps); err != nil {
+			return fmt.Errorf("rollback %s: %w", list[i].name, err)
+		}
+	}
+	return nil
+}
@@ -4,10 +4,18 @@ import (
 	"fmt"
 	"reflect"
 	"strings"
+	"sync"
 )
 
+// Deprecated: 缓存改为内部的并发安全结构, 这个 map 不再写入, 始终为空
 var StructInfoMap = make(map[reflect.Type]*StructInfo)
 
+// 结构体信息的缓存, 只保存与类型相关的信息, 可并发使用
+var structInfoCache = struct {
+	mux   sync.RWMutex
+	infos map[reflect.Type]*StructInfo
+}{infos: make(map[reflect.Type]*StructInfo)}
+
 //结构体信息
 type StructInfo struct {
 	FieldsMap map[string]*StructField //字段字典集合
@@ -18,8 +26,10 @@ type StructInfo struct {
 type StructField struct {
 	Name           string //字段名
 	FieldType      reflect.Type
-	Value          reflect.Value //字段值
-	TableFieldName string        //表属性名
+	TableFieldName string //表属性名
+
+	// Deprecated: 结构体信息按类型共享, 不再保存字段值, 始终为零值
+	Value reflect.Value
 }
 
 //获得结构体的信息
@@ -36,57 +46,71 @@ func GetStructInfo(target interface{}) (*StructInfo, error) {
 	return GetReflectInfo(t, v.Elem())
 }
 
-// 获得结构体的反射的信息
+// 获得结构体的反射的信息, 结果按类型缓存且被所有调用方共享, 不能修改.
+// v 不再使用, 保留参数以兼容
 func GetReflectInfo(t reflect.Type, v reflect.Value) (*StructInfo, error) {
-	var structInfo *StructInfo
+	structInfoCache.mux.RLock()
+	structInfo, ok := structInfoCache.infos[t]
+	structInfoCache.mux.RUnlock()
+	if ok {
+		return structInfo, nil
+	}
 
 	fieldsMap := make(map[string]*StructField)
-	// 从map里取结构体信息, 如果map没有则新建一个然后存map
-	if value, ok := StructInfoMap[t]; ok {
-		structInfo = value
-		//更新缓存的结构体字段的值,这一部分肯定不能使用缓存,
-		// 因为每一个变量的value是不同的
-		for key, _ := range structInfo.FieldsMap {
-			structField := structInfo.FieldsMap[key]
-			if structField.Value.CanSet() && structField.Value.IsValid() {
-				//更新字段的value属性
-				structField.Value.Set(v.FieldByName(structField.Name))
-			} else {
-				return nil, fmt.Errorf("StructField [%s] is can not set or is not valid", structInfo.FieldsMap[key].Name)
-			}
-		}
-	} else {
-		fmt.Printf("will reflect\n")
+	addFields(t, fieldsMap)
 
-		// 遍历所有属性
-		for index := 0; index < t.NumField(); index++ {
-			structField := t.Field(index)
-			structFieldValue := v.Field(index)
-			// 获取field标签的值 作为数据库字段名
-			tableField := strings.TrimSpace(structField.Tag.Get("bson"))
-			structFieldType := structField.Type
+	structInfo = &StructInfo{
+		Name:      t.Name(),
+		FieldsMap: fieldsMap,
+	}
+	//将新的StructInfo放入Map当缓存用, 并发时以先放入的为准
+	structInfoCache.mux.Lock()
+	defer structInfoCache.mux.Unlock()
+	if cached, ok := structInfoCache.infos[t]; ok {
+		return cached, nil
+	}
+	structInfoCache.infos[t] = structInfo
+	return structInfo, nil
+}
 
-			// 如果字段
-			if len(tableField) != 0 {
-				// 构造一个新的StructField
-				sf := &StructField{
-					Name:           structField.Name,
-					TableFieldName: tableField,
-					FieldType:      structFieldType,
-					Value:          structFieldValue,
-				}
-				// 将新的StructField放入Map
-				fieldsMap[tableField] = sf
+// addFields 按 mgo 的规则取 bson 字段名: 没有标签时为小写的字段名, 未导出和 "-" 的字段跳过,
+// inline 的结构体字段展开到外层
+func addFields(t reflect.Type, fieldsMap map[string]*StructField) {
+	for index := 0; index < t.NumField(); index++ {
+		structField := t.Field(index)
+		if structField.PkgPath != "" && !structField.Anonymous {
+			continue
+		}
+		tag := structField.Tag.Get("bson")
+		if tag == "-" {
+			continue
+		}
+		// 去掉 omitempty, inline 等选项
+		parts := strings.Split(tag, ",")
+		inline := false
+		for _, opt := range parts[1:] {
+			if opt == "inline" {
+				inline = true
+			}
+		}
+		if inline {
+			if structField.Type.Kind() == reflect.Struct {
+				addFields(structField.Type, fieldsMap)
 			}
+			continue
+		}
+		if structField.PkgPath != "" {
+			continue
 		}
 
-		//构造一个新的StructInfo
-		structInfo = &StructInfo{
-			Name:      t.Name(),
-			FieldsMap: fieldsMap,
+		tableField := strings.TrimSpace(parts[0])
+		if tableField == "" {
+			tableField = strings.ToLower(structField.Name)
+		}
+		fieldsMap[tableField] = &StructField{
+			Name:           structField.Name,
+			TableFieldName: tableField,
+			FieldType:      structField.Type,
 		}
-		//将新的StructInfo放入Map当缓存用
-		StructInfoMap[t] = structInfo
 	}
-	return structInfo, nil
 }
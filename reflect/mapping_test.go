@@ -0,0 +1,57 @@
+package reflect
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+type mappingAudit struct {
+	Creator string `bson:"creator"`
+}
+
+type mappingUser struct {
+	Nick   string    `bson:"nick,omitempty"`
+	Ctime  time.Time `bson:"ctime"`
+	Skip   string    `bson:"-"`
+	Plain  string
+	Audit  mappingAudit `bson:",inline"`
+	hidden string
+}
+
+func TestGetStructInfo(t *testing.T) {
+	first := &mappingUser{Nick: "first"}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			info, err := GetStructInfo(&mappingUser{Nick: "other"})
+			if err != nil || len(info.FieldsMap) != 4 {
+				t.Errorf("%+v %v", info, err)
+			}
+		}()
+	}
+	info, err := GetStructInfo(first)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := info.FieldsMap["ctime"]; f == nil || f.Name != "Ctime" || f.FieldType != TimeType {
+		t.Fatalf("%+v", f)
+	}
+	// 没有标签时按 mgo 的规则为小写的字段名, inline 的字段展开
+	if f := info.FieldsMap["plain"]; f == nil || f.Name != "Plain" {
+		t.Fatalf("%+v", f)
+	}
+	if f := info.FieldsMap["creator"]; f == nil || f.Name != "Creator" {
+		t.Fatalf("%+v", f)
+	}
+	// 缓存不能修改调用方的结构体
+	if first.Nick != "first" {
+		t.Fatalf("model changed to %s", first.Nick)
+	}
+	if _, err = GetStructInfo(mappingUser{}); err == nil {
+		t.Fatal("expect not ptr error")
+	}
+}
@@ -34,3 +34,22 @@ func ParsePageQueryFromReader(reader io.Reader) (*data.PageQuery, error) {
 	}
 	return &pageQuery, nil
 }
+
+func ParseCursorQueryFromRequest(req *http.Request) (*data.CursorQuery, error) {
+	defer req.Body.Close()
+	return ParseCursorQueryFromReader(req.Body)
+}
+
+func ParseCursorQueryFromReader(reader io.Reader) (*data.CursorQuery, error) {
+	in, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	var cursorQuery data.CursorQuery
+	err = json.Unmarshal(in, &cursorQuery)
+	if err != nil {
+		return nil, err
+	}
+	return &cursorQuery, nil
+}
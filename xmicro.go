@@ -1,9 +1,11 @@
 package xmicro
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"time"
 
 	"github.com/micro/cli"
@@ -35,29 +37,75 @@ func Run(serviceName string, fn func(c *cli.Context, service micro.Service)) {
 				Name:  "config",
 				Usage: "config file",
 			},
+			cli.BoolFlag{
+				Name:  "migrate",
+				Usage: "run data migrations before starting",
+			},
 		),
 	)
 
-	service.Init(
-		micro.Action(func(c *cli.Context) {
-			configFilePath := c.String("config")
-			if len(configFilePath) == 0 {
-				fmt.Printf("Usage: %s --config=path\n", AppPath)
-				os.Exit(-1)
+	// 读取配置并执行 fn, fn 中注册数据源和 Migrator
+	setup := func(c *cli.Context, configFilePath string) {
+		if len(configFilePath) == 0 {
+			fmt.Printf("Usage: %s --config=path\n", AppPath)
+			os.Exit(-1)
+		}
+
+		// 1. 判断文件是否存在
+		_, err := os.Stat(configFilePath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				panic(err)
 			}
+		}
 
-			// 1. 判断文件是否存在
-			_, err := os.Stat(configFilePath)
-			if err != nil {
-				if os.IsNotExist(err) {
-					panic(err)
+		// 2. 读取配置文件, 理论可支持不同策略
+		LoadAppConfig("json", configFilePath)
+
+		fn(c, service)
+	}
+
+	// migrate 子命令: --config=path migrate [up | down [steps]], 执行后退出
+	app := service.Options().Cmd.App()
+	app.Commands = append(app.Commands, cli.Command{
+		Name:      "migrate",
+		Usage:     "run data migrations registered by RegisterMigrator and exit",
+		ArgsUsage: "[up | down [steps]]",
+		Action: func(c *cli.Context) {
+			setup(c, c.GlobalString("config"))
+
+			var err error
+			ctx := context.Background()
+			switch c.Args().First() {
+			case "", "up":
+				err = Migrate(ctx)
+			case "down":
+				steps := 1
+				if n, e := strconv.Atoi(c.Args().Get(1)); e == nil && n > 0 {
+					steps = n
 				}
+				err = Rollback(ctx, steps)
+			default:
+				err = fmt.Errorf("unknown migrate command `%s`", c.Args().First())
+			}
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
 			}
+			os.Exit(0)
+		},
+	})
 
-			// 2. 读取配置文件, 理论可支持不同策略
-			LoadAppConfig("json", configFilePath)
+	service.Init(
+		micro.Action(func(c *cli.Context) {
+			setup(c, c.String("config"))
 
-			fn(c, service)
+			// 3. 启动前执行迁移
+			if c.Bool("migrate") {
+				if err := Migrate(context.Background()); err != nil {
+					panic(err)
+				}
+			}
 		}),
 	)
 